@@ -11,6 +11,7 @@ import (
 	"fmt"
 	"net"
 	"strings"
+	"sync"
 )
 
 // New creates a BIRDClient.
@@ -20,18 +21,21 @@ func New(socket string) (*BIRDClient, error) {
 		return nil, fmt.Errorf("failed to connect to BIRD: %w", err)
 	}
 	b := &BIRDClient{socket: socket, conn: conn, bs: bufio.NewScanner(conn)}
-	// Read and discard the first line as that is the welcome message.
-	if _, err := b.readLine(); err != nil {
+	// Read and discard the first reply as that is the welcome message.
+	if _, err := b.readReply(); err != nil {
 		return nil, err
 	}
 	return b, nil
 }
 
 // BIRDClient handles communication with the BIRD Internet Routing Daemon.
+// It's safe for concurrent use.
 type BIRDClient struct {
 	socket string
-	conn   net.Conn
-	bs     *bufio.Scanner
+
+	mu   sync.Mutex // serializes commands
+	conn net.Conn
+	bs   *bufio.Scanner
 }
 
 // Close closes the underlying connection to BIRD.
@@ -65,19 +69,58 @@ func (b *BIRDClient) EnableProtocol(protocol string) error {
 	return fmt.Errorf("failed to enable %s: %v", protocol, out)
 }
 
+// Configure has BIRD reload its configuration files, such as after
+// a RouteFeed rewrites its file.
+func (b *BIRDClient) Configure() error {
+	out, err := b.exec("configure\n")
+	if err != nil {
+		return err
+	}
+	// 0003 is "Reconfigured", and 0004 and 0005 are for when the
+	// reconfiguration is in progress or queued behind another.
+	for _, code := range []string{"0003 ", "0004 ", "0005 "} {
+		if strings.Contains(out, code) {
+			return nil
+		}
+	}
+	return fmt.Errorf("failed to configure: %v", out)
+}
+
 func (b *BIRDClient) exec(cmd string, args ...interface{}) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
 	if _, err := fmt.Fprintf(b.conn, cmd, args...); err != nil {
 		return "", err
 	}
-	return b.readLine()
+	return b.readReply()
+}
+
+// readReply reads a reply, which may span several lines, and returns
+// its lines joined with newlines.
+//
+// Each line of a reply starts with a four digit code followed by a
+// '-' if more lines follow, or a space if it's the last line. Lines
+// starting with a space continue the previous line's code.
+func (b *BIRDClient) readReply() (string, error) {
+	var lines []string
+	for {
+		line, err := b.readLine()
+		if err != nil {
+			return "", err
+		}
+		lines = append(lines, line)
+		if len(line) > 4 && line[4] == ' ' && line[0] != ' ' {
+			return strings.Join(lines, "\n"), nil
+		}
+	}
 }
 
 func (b *BIRDClient) readLine() (string, error) {
 	if !b.bs.Scan() {
+		if err := b.bs.Err(); err != nil {
+			return "", err
+		}
 		return "", fmt.Errorf("reading response from bird failed")
 	}
-	if err := b.bs.Err(); err != nil {
-		return "", err
-	}
 	return b.bs.Text(), nil
 }
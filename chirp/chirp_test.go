@@ -0,0 +1,183 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package chirp
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+// fakeBIRD is a fake BIRD control socket, replying to commands with
+// canned replies.
+type fakeBIRD struct {
+	sock string
+	ln   net.Listener
+
+	mu       sync.Mutex
+	replies  map[string]string // command => reply
+	commands []string          // commands received
+}
+
+func newFakeBIRD(t *testing.T, replies map[string]string) *fakeBIRD {
+	sock := filepath.Join(t.TempDir(), "bird.ctl")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fb := &fakeBIRD{sock: sock, ln: ln, replies: replies}
+	go fb.serve()
+	t.Cleanup(func() { ln.Close() })
+	return fb
+}
+
+func (fb *fakeBIRD) serve() {
+	for {
+		c, err := fb.ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			fmt.Fprintf(c, "0001 BIRD 2.0.8 ready.\n")
+			bs := bufio.NewScanner(c)
+			for bs.Scan() {
+				cmd := bs.Text()
+				fb.mu.Lock()
+				fb.commands = append(fb.commands, cmd)
+				reply, ok := fb.replies[cmd]
+				fb.mu.Unlock()
+				if !ok {
+					reply = "9001 syntax error"
+				}
+				fmt.Fprintf(c, "%s\n", reply)
+			}
+		}()
+	}
+}
+
+func (fb *fakeBIRD) Commands() []string {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	return append([]string(nil), fb.commands...)
+}
+
+func TestBIRDClient(t *testing.T) {
+	fb := newFakeBIRD(t, map[string]string{
+		"enable tailscale":  "0011 tailscale: enabled",
+		"disable tailscale": "0008 tailscale: already disabled",
+		"configure":         "0002-Reading configuration from /etc/bird.conf\n0003 Reconfigured",
+	})
+	b, err := New(fb.sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	if err := b.EnableProtocol("tailscale"); err != nil {
+		t.Errorf("EnableProtocol: %v", err)
+	}
+	if err := b.DisableProtocol("tailscale"); err != nil {
+		t.Errorf("DisableProtocol: %v", err)
+	}
+	if err := b.Configure(); err != nil {
+		t.Errorf("Configure: %v", err)
+	}
+	// The whole multi-line reply was read, so replies stay in sync.
+	if err := b.EnableProtocol("tailscale"); err != nil {
+		t.Errorf("EnableProtocol after Configure: %v", err)
+	}
+	if err := b.EnableProtocol("other"); err == nil || !strings.Contains(err.Error(), "syntax error") {
+		t.Errorf("EnableProtocol of unknown protocol = %v; want syntax error", err)
+	}
+}
+
+func TestConfigureError(t *testing.T) {
+	fb := newFakeBIRD(t, map[string]string{
+		"configure": "0002-Reading configuration from /etc/bird.conf\n8002 /etc/bird.conf:3:1 syntax error",
+	})
+	b, err := New(fb.sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if err := b.Configure(); err == nil || !strings.Contains(err.Error(), "8002") {
+		t.Errorf("Configure = %v; want 8002 error", err)
+	}
+}
+
+func TestRouteFeed(t *testing.T) {
+	fb := newFakeBIRD(t, map[string]string{
+		"configure": "0002-Reading configuration from /etc/bird.conf\n0003 Reconfigured",
+	})
+	b, err := New(fb.sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	path := filepath.Join(t.TempDir(), "tailscale.conf")
+	f := NewRouteFeed(b, path)
+	pfx := func(strs ...string) (ret []netaddr.IPPrefix) {
+		for _, s := range strs {
+			ret = append(ret, netaddr.MustParseIPPrefix(s))
+		}
+		return ret
+	}
+	if err := f.SetRoutes(pfx("10.0.0.0/24", "fd00:1::/64"), pfx("100.64.0.2/32", "fd7a:115c:a1e0::2/128")); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `# Generated by tailscaled. Do not edit.
+
+protocol static tailscale_subnets4 {
+	ipv4;
+	route 10.0.0.0/24 blackhole;
+}
+
+protocol static tailscale_subnets6 {
+	ipv6;
+	route fd00:1::/64 blackhole;
+}
+
+protocol static tailscale_peers4 {
+	ipv4;
+	route 100.64.0.2/32 blackhole;
+}
+
+protocol static tailscale_peers6 {
+	ipv6;
+	route fd7a:115c:a1e0::2/128 blackhole;
+}
+`
+	if string(got) != want {
+		t.Errorf("got file:\n%s\nwant:\n%s", got, want)
+	}
+	if got, want := strings.Join(fb.Commands(), ","), "configure"; got != want {
+		t.Errorf("commands = %q; want %q", got, want)
+	}
+
+	// Withdrawing the routes leaves the protocols defined.
+	if err := f.SetRoutes(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	got, err = ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(got), "route") || !strings.Contains(string(got), "protocol static tailscale_peers6 {") {
+		t.Errorf("after withdrawing, got file:\n%s", got)
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package chirp
+
+import (
+	"bytes"
+	"fmt"
+
+	"inet.af/netaddr"
+	"tailscale.com/atomicfile"
+)
+
+// RouteFeed feeds routes to BIRD through a file of static protocols,
+// which must be included from BIRD's configuration, reloading BIRD's
+// configuration whenever the routes change.
+//
+// The file defines four BIRD 2 static protocols, which always exist,
+// even when empty:
+//
+//	tailscale_subnets4, tailscale_subnets6: the subnet routes this
+//	    node is the primary subnet router for
+//	tailscale_peers4, tailscale_peers6: the Tailscale addresses of
+//	    this node's peers, while it's a primary subnet router, if
+//	    they're being exported
+//
+// The routes are blackholes, to be announced by other protocols, such
+// as BGP or OSPF, and not to be exported to the kernel. Routing
+// daemon filters choose which of the protocols to announce.
+type RouteFeed struct {
+	b    *BIRDClient
+	path string
+}
+
+// NewRouteFeed returns a RouteFeed that writes its static protocols
+// to path and reloads the configuration of the BIRD at b.
+func NewRouteFeed(b *BIRDClient, path string) *RouteFeed {
+	return &RouteFeed{b: b, path: path}
+}
+
+// SetRoutes replaces the routes in the file and has BIRD reload it.
+func (f *RouteFeed) SetRoutes(subnets, peers []netaddr.IPPrefix) error {
+	if err := atomicfile.WriteFile(f.path, staticProtocols(subnets, peers), 0644); err != nil {
+		return err
+	}
+	return f.b.Configure()
+}
+
+// staticProtocols returns the BIRD configuration for a RouteFeed.
+func staticProtocols(subnets, peers []netaddr.IPPrefix) []byte {
+	var b bytes.Buffer
+	b.WriteString("# Generated by tailscaled. Do not edit.\n")
+	writeProtocol := func(name string, routes []netaddr.IPPrefix, is6 bool) {
+		family := "ipv4"
+		if is6 {
+			family = "ipv6"
+		}
+		fmt.Fprintf(&b, "\nprotocol static %s {\n\t%s;\n", name, family)
+		for _, r := range routes {
+			if r.IP().Is6() == is6 {
+				fmt.Fprintf(&b, "\troute %s blackhole;\n", r)
+			}
+		}
+		b.WriteString("}\n")
+	}
+	writeProtocol("tailscale_subnets4", subnets, false)
+	writeProtocol("tailscale_subnets6", subnets, true)
+	writeProtocol("tailscale_peers4", peers, false)
+	writeProtocol("tailscale_peers6", peers, true)
+	return b.Bytes()
+}
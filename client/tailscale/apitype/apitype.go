@@ -5,7 +5,12 @@
 // Package apitype contains types for the Tailscale local API.
 package apitype
 
-import "tailscale.com/tailcfg"
+import (
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/tailcfg"
+)
 
 // WhoIsResponse is the JSON type returned by tailscaled debug server's /whois?ip=$IP handler.
 type WhoIsResponse struct {
@@ -26,4 +31,102 @@ type FileTarget struct {
 type WaitingFile struct {
 	Name string
 	Size int64
+
+	// Dir is whether it's a directory tree, which is fetched as a
+	// tar archive. Size is then the total size of its files.
+	Dir bool `json:",omitempty"`
+}
+
+// FileReceived is the JSON body POSTed to a Taildrop hook URL (see
+// tailscaled's --taildrop-hook flag) once a file has been received.
+type FileReceived struct {
+	Name string // base name, such as "foo.jpg"
+	Path string // where the file is now
+	Size int64  // in bytes; for a directory, the total of its files
+	Dir  bool   `json:",omitempty"` // whether it's a directory tree
+
+	// Accepted is whether the file was moved into the auto-accept
+	// directory, rather than left for "tailscale file get".
+	Accepted bool
+
+	From     string   // name of the node that sent it
+	FromUser string   // login name of that node's user
+	FromTags []string `json:",omitempty"` // tags of that node
+}
+
+// FileSHA256Header is the header of a peer API file PUT with the hex
+// SHA-256 of the whole file, which the peer checks before keeping the
+// file. If the sender doesn't know it up front, it may instead send it
+// as a trailer.
+const FileSHA256Header = "Tailscale-File-Sha256"
+
+// PartialFile is the JSON type returned by a GET of a peer API file
+// PUT URL. It describes what the peer kept of an earlier, interrupted
+// transfer of the file, so the sender can resume it by PUTting the
+// rest with the query parameter "offset" set to Size.
+type PartialFile struct {
+	Name   string
+	Size   int64  // bytes received so far
+	SHA256 string // hex SHA-256 of those Size bytes
+}
+
+// FilterRule is a packet filter rule and the number of packets it has
+// accepted.
+type FilterRule struct {
+	Rule string
+	Hits uint64
+}
+
+// FilterDropCount is the number of packets the packet filter has
+// dropped for a reason.
+type FilterDropCount struct {
+	Reason string
+	In     uint64 // packets from peers
+	Out    uint64 // packets to peers
+}
+
+// FilterStatus is the JSON type returned by the local API's
+// debug-filter handler.
+type FilterStatus struct {
+	ShieldsUp bool
+	Rules     []FilterRule
+	Drops     []FilterDropCount
+
+	// Flows are the flows tracked by the packet filter's
+	// connection tracker, and PeerFlows the number of them with
+	// each peer IP.
+	Flows     []FilterFlow
+	PeerFlows map[netaddr.IP]int
+}
+
+// FilterFlow is a flow tracked by the packet filter.
+type FilterFlow struct {
+	Proto string
+
+	// Src and Dst are oriented in the direction of the flow's
+	// first packet.
+	Src, Dst netaddr.IPPort
+
+	// Outbound is whether this node (or a subnet behind it)
+	// opened the flow.
+	Outbound bool
+
+	TCPState string `json:",omitempty"`
+	Expires  time.Time
+
+	PacketsIn, PacketsOut uint64
+	BytesIn, BytesOut     uint64
+}
+
+// FilterCheckResponse is the JSON type returned by the local API's
+// debug-filter-check handler.
+type FilterCheckResponse struct {
+	Verdict string // "Accept" or "Drop"
+	Reason  string // as the filter would log it
+
+	// Rule is the index in FilterStatus.Rules of the rule that
+	// accepted the packet, or -1 if no rule was involved.
+	Rule int
+	// RuleText is the text of the rule at Rule, if any.
+	RuleText string `json:",omitempty"`
 }
@@ -16,6 +16,7 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"os/exec"
 	"runtime"
@@ -31,6 +32,7 @@ import (
 	"tailscale.com/paths"
 	"tailscale.com/safesocket"
 	"tailscale.com/tailcfg"
+	"tailscale.com/util/dirtar"
 	"tailscale.com/version"
 )
 
@@ -59,13 +61,34 @@ func defaultDialer(ctx context.Context, network, addr string) (net.Conn, error)
 	return safesocket.Connect(TailscaledSocket, safesocket.WindowsLocalPort)
 }
 
-var (
+// LocalClient is a client to Tailscale's "local API", communicating with the
+// Tailscale daemon on the local machine. Its zero value is valid to use.
+//
+// Any exported fields should be set before using methods on the type
+// and not changed thereafter.
+type LocalClient struct {
+	// Dial optionally specifies an alternate func that connects to the
+	// local machine's tailscaled or equivalent. If nil, TailscaledDialer
+	// is used.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
 	// tsClient does HTTP requests to the local Tailscale daemon.
-	// We lazily initialize the client in case the caller wants to
+	// It's lazily initialized in case the caller wants to
 	// override TailscaledDialer.
 	tsClient     *http.Client
 	tsClientOnce sync.Once
-)
+}
+
+// defaultLocalClient is the LocalClient used by the package-level
+// functions.
+var defaultLocalClient LocalClient
+
+func (lc *LocalClient) dialer() func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if lc.Dial != nil {
+		return lc.Dial
+	}
+	return TailscaledDialer
+}
 
 // DoLocalRequest makes an HTTP request to the local machine's Tailscale daemon.
 //
@@ -76,18 +99,20 @@ var (
 // authenticating to the local Tailscale daemon vary by platform.
 //
 // DoLocalRequest may mutate the request to add Authorization headers.
-func DoLocalRequest(req *http.Request) (*http.Response, error) {
-	tsClientOnce.Do(func() {
-		tsClient = &http.Client{
+func (lc *LocalClient) DoLocalRequest(req *http.Request) (*http.Response, error) {
+	lc.tsClientOnce.Do(func() {
+		lc.tsClient = &http.Client{
 			Transport: &http.Transport{
-				DialContext: TailscaledDialer,
+				DialContext: lc.dialer(),
 			},
 		}
 	})
-	if _, token, err := safesocket.LocalTCPPortAndToken(); err == nil {
-		req.SetBasicAuth("", token)
+	if lc.Dial == nil {
+		if _, token, err := safesocket.LocalTCPPortAndToken(); err == nil {
+			req.SetBasicAuth("", token)
+		}
 	}
-	return tsClient.Do(req)
+	return lc.tsClient.Do(req)
 }
 
 type errorJSON struct {
@@ -135,12 +160,12 @@ func SetVersionMismatchHandler(f func(clientVer, serverVer string)) {
 	onVersionMismatch = f
 }
 
-func send(ctx context.Context, method, path string, wantStatus int, body io.Reader) ([]byte, error) {
+func (lc *LocalClient) send(ctx context.Context, method, path string, wantStatus int, body io.Reader) ([]byte, error) {
 	req, err := http.NewRequestWithContext(ctx, method, "http://local-tailscaled.sock"+path, body)
 	if err != nil {
 		return nil, err
 	}
-	res, err := DoLocalRequest(req)
+	res, err := lc.DoLocalRequest(req)
 	if err != nil {
 		if ue, ok := err.(*url.Error); ok {
 			if oe, ok := ue.Err.(*net.OpError); ok && oe.Op == "dial" {
@@ -171,13 +196,13 @@ func send(ctx context.Context, method, path string, wantStatus int, body io.Read
 	return slurp, nil
 }
 
-func get200(ctx context.Context, path string) ([]byte, error) {
-	return send(ctx, "GET", path, 200, nil)
+func (lc *LocalClient) get200(ctx context.Context, path string) ([]byte, error) {
+	return lc.send(ctx, "GET", path, 200, nil)
 }
 
 // WhoIs returns the owner of the remoteAddr, which must be an IP or IP:port.
-func WhoIs(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
-	body, err := get200(ctx, "/localapi/v0/whois?addr="+url.QueryEscape(remoteAddr))
+func (lc *LocalClient) WhoIs(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+	body, err := lc.get200(ctx, "/localapi/v0/whois?addr="+url.QueryEscape(remoteAddr))
 	if err != nil {
 		return nil, err
 	}
@@ -192,18 +217,53 @@ func WhoIs(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, erro
 }
 
 // Goroutines returns a dump of the Tailscale daemon's current goroutines.
-func Goroutines(ctx context.Context) ([]byte, error) {
-	return get200(ctx, "/localapi/v0/goroutines")
+func (lc *LocalClient) Goroutines(ctx context.Context) ([]byte, error) {
+	return lc.get200(ctx, "/localapi/v0/goroutines")
 }
 
 // DaemonMetrics returns the Tailscale daemon's metrics in
 // the Prometheus text exposition format.
-func DaemonMetrics(ctx context.Context) ([]byte, error) {
-	return get200(ctx, "/localapi/v0/metrics")
+func (lc *LocalClient) DaemonMetrics(ctx context.Context) ([]byte, error) {
+	return lc.get200(ctx, "/localapi/v0/metrics")
+}
+
+// DebugFilter returns the Tailscale daemon's packet filter rules
+// and counters.
+func (lc *LocalClient) DebugFilter(ctx context.Context) (*apitype.FilterStatus, error) {
+	body, err := lc.get200(ctx, "/localapi/v0/debug-filter")
+	if err != nil {
+		return nil, err
+	}
+	r := new(apitype.FilterStatus)
+	if err := json.Unmarshal(body, r); err != nil {
+		return nil, fmt.Errorf("failed to parse JSON FilterStatus: %w", err)
+	}
+	return r, nil
+}
+
+// DebugFilterCheck reports whether the Tailscale daemon's packet
+// filter would allow a new flow of proto ("tcp", "udp", "sctp",
+// "icmp" or a protocol number) from the peer address src to the local
+// address dst, both of which are ip:port.
+func (lc *LocalClient) DebugFilterCheck(ctx context.Context, src, dst, proto string) (*apitype.FilterCheckResponse, error) {
+	v := url.Values{
+		"src":   {src},
+		"dst":   {dst},
+		"proto": {proto},
+	}
+	body, err := lc.get200(ctx, "/localapi/v0/debug-filter-check?"+v.Encode())
+	if err != nil {
+		return nil, err
+	}
+	r := new(apitype.FilterCheckResponse)
+	if err := json.Unmarshal(body, r); err != nil {
+		return nil, fmt.Errorf("failed to parse JSON FilterCheckResponse: %w", err)
+	}
+	return r, nil
 }
 
 // Profile returns a pprof profile of the Tailscale daemon.
-func Profile(ctx context.Context, pprofType string, sec int) ([]byte, error) {
+func (lc *LocalClient) Profile(ctx context.Context, pprofType string, sec int) ([]byte, error) {
 	var secArg string
 	if sec < 0 || sec > 300 {
 		return nil, errors.New("duration out of range")
@@ -211,12 +271,12 @@ func Profile(ctx context.Context, pprofType string, sec int) ([]byte, error) {
 	if sec != 0 || pprofType == "profile" {
 		secArg = fmt.Sprint(sec)
 	}
-	return get200(ctx, fmt.Sprintf("/localapi/v0/profile?name=%s&seconds=%v", url.QueryEscape(pprofType), secArg))
+	return lc.get200(ctx, fmt.Sprintf("/localapi/v0/profile?name=%s&seconds=%v", url.QueryEscape(pprofType), secArg))
 }
 
 // BugReport logs and returns a log marker that can be shared by the user with support.
-func BugReport(ctx context.Context, note string) (string, error) {
-	body, err := send(ctx, "POST", "/localapi/v0/bugreport?note="+url.QueryEscape(note), 200, nil)
+func (lc *LocalClient) BugReport(ctx context.Context, note string) (string, error) {
+	body, err := lc.send(ctx, "POST", "/localapi/v0/bugreport?note="+url.QueryEscape(note), 200, nil)
 	if err != nil {
 		return "", err
 	}
@@ -224,17 +284,17 @@ func BugReport(ctx context.Context, note string) (string, error) {
 }
 
 // Status returns the Tailscale daemon's status.
-func Status(ctx context.Context) (*ipnstate.Status, error) {
-	return status(ctx, "")
+func (lc *LocalClient) Status(ctx context.Context) (*ipnstate.Status, error) {
+	return lc.status(ctx, "")
 }
 
 // StatusWithPeers returns the Tailscale daemon's status, without the peer info.
-func StatusWithoutPeers(ctx context.Context) (*ipnstate.Status, error) {
-	return status(ctx, "?peers=false")
+func (lc *LocalClient) StatusWithoutPeers(ctx context.Context) (*ipnstate.Status, error) {
+	return lc.status(ctx, "?peers=false")
 }
 
-func status(ctx context.Context, queryString string) (*ipnstate.Status, error) {
-	body, err := get200(ctx, "/localapi/v0/status"+queryString)
+func (lc *LocalClient) status(ctx context.Context, queryString string) (*ipnstate.Status, error) {
+	body, err := lc.get200(ctx, "/localapi/v0/status"+queryString)
 	if err != nil {
 		return nil, err
 	}
@@ -245,8 +305,8 @@ func status(ctx context.Context, queryString string) (*ipnstate.Status, error) {
 	return st, nil
 }
 
-func WaitingFiles(ctx context.Context) ([]apitype.WaitingFile, error) {
-	body, err := get200(ctx, "/localapi/v0/files/")
+func (lc *LocalClient) WaitingFiles(ctx context.Context) ([]apitype.WaitingFile, error) {
+	body, err := lc.get200(ctx, "/localapi/v0/files/")
 	if err != nil {
 		return nil, err
 	}
@@ -257,21 +317,24 @@ func WaitingFiles(ctx context.Context) ([]apitype.WaitingFile, error) {
 	return wfs, nil
 }
 
-func DeleteWaitingFile(ctx context.Context, baseName string) error {
-	_, err := send(ctx, "DELETE", "/localapi/v0/files/"+url.PathEscape(baseName), http.StatusNoContent, nil)
+func (lc *LocalClient) DeleteWaitingFile(ctx context.Context, baseName string) error {
+	_, err := lc.send(ctx, "DELETE", "/localapi/v0/files/"+url.PathEscape(baseName), http.StatusNoContent, nil)
 	return err
 }
 
-func GetWaitingFile(ctx context.Context, baseName string) (rc io.ReadCloser, size int64, err error) {
+// GetWaitingFile opens the waiting file baseName. If it's a
+// directory, rc reads it as a tar archive (see package dirtar) and
+// size is -1.
+func (lc *LocalClient) GetWaitingFile(ctx context.Context, baseName string) (rc io.ReadCloser, size int64, err error) {
 	req, err := http.NewRequestWithContext(ctx, "GET", "http://local-tailscaled.sock/localapi/v0/files/"+url.PathEscape(baseName), nil)
 	if err != nil {
 		return nil, 0, err
 	}
-	res, err := DoLocalRequest(req)
+	res, err := lc.DoLocalRequest(req)
 	if err != nil {
 		return nil, 0, err
 	}
-	if res.ContentLength == -1 {
+	if res.ContentLength == -1 && res.Header.Get("Content-Type") != dirtar.ContentType {
 		res.Body.Close()
 		return nil, 0, fmt.Errorf("unexpected chunking")
 	}
@@ -283,8 +346,8 @@ func GetWaitingFile(ctx context.Context, baseName string) (rc io.ReadCloser, siz
 	return res.Body, res.ContentLength, nil
 }
 
-func FileTargets(ctx context.Context) ([]apitype.FileTarget, error) {
-	body, err := get200(ctx, "/localapi/v0/file-targets")
+func (lc *LocalClient) FileTargets(ctx context.Context) ([]apitype.FileTarget, error) {
+	body, err := lc.get200(ctx, "/localapi/v0/file-targets")
 	if err != nil {
 		return nil, err
 	}
@@ -295,8 +358,8 @@ func FileTargets(ctx context.Context) ([]apitype.FileTarget, error) {
 	return fts, nil
 }
 
-func CheckIPForwarding(ctx context.Context) error {
-	body, err := get200(ctx, "/localapi/v0/check-ip-forwarding")
+func (lc *LocalClient) CheckIPForwarding(ctx context.Context) error {
+	body, err := lc.get200(ctx, "/localapi/v0/check-ip-forwarding")
 	if err != nil {
 		return err
 	}
@@ -312,8 +375,8 @@ func CheckIPForwarding(ctx context.Context) error {
 	return nil
 }
 
-func GetPrefs(ctx context.Context) (*ipn.Prefs, error) {
-	body, err := get200(ctx, "/localapi/v0/prefs")
+func (lc *LocalClient) GetPrefs(ctx context.Context) (*ipn.Prefs, error) {
+	body, err := lc.get200(ctx, "/localapi/v0/prefs")
 	if err != nil {
 		return nil, err
 	}
@@ -324,12 +387,12 @@ func GetPrefs(ctx context.Context) (*ipn.Prefs, error) {
 	return &p, nil
 }
 
-func EditPrefs(ctx context.Context, mp *ipn.MaskedPrefs) (*ipn.Prefs, error) {
+func (lc *LocalClient) EditPrefs(ctx context.Context, mp *ipn.MaskedPrefs) (*ipn.Prefs, error) {
 	mpj, err := json.Marshal(mp)
 	if err != nil {
 		return nil, err
 	}
-	body, err := send(ctx, "PATCH", "/localapi/v0/prefs", http.StatusOK, bytes.NewReader(mpj))
+	body, err := lc.send(ctx, "PATCH", "/localapi/v0/prefs", http.StatusOK, bytes.NewReader(mpj))
 	if err != nil {
 		return nil, err
 	}
@@ -340,11 +403,103 @@ func EditPrefs(ctx context.Context, mp *ipn.MaskedPrefs) (*ipn.Prefs, error) {
 	return &p, nil
 }
 
-func Logout(ctx context.Context) error {
-	_, err := send(ctx, "POST", "/localapi/v0/logout", http.StatusNoContent, nil)
+func (lc *LocalClient) Logout(ctx context.Context) error {
+	_, err := lc.send(ctx, "POST", "/localapi/v0/logout", http.StatusNoContent, nil)
+	return err
+}
+
+// Profiles returns tailscaled's login profiles.
+func (lc *LocalClient) Profiles(ctx context.Context) (*ipn.Profiles, error) {
+	body, err := lc.get200(ctx, "/localapi/v0/profiles")
+	if err != nil {
+		return nil, err
+	}
+	var p ipn.Profiles
+	if err := json.Unmarshal(body, &p); err != nil {
+		return nil, fmt.Errorf("invalid profiles JSON: %w", err)
+	}
+	return &p, nil
+}
+
+// SwitchProfile makes tailscaled switch to the named login profile,
+// creating it if it doesn't exist.
+func (lc *LocalClient) SwitchProfile(ctx context.Context, name string) error {
+	_, err := lc.send(ctx, "POST", "/localapi/v0/switch-profile?name="+url.QueryEscape(name), http.StatusNoContent, nil)
 	return err
 }
 
+// DialTCP connects to host:port through tailscaled, which dials it
+// itself: host may be a MagicDNS name, and peers are reachable even if
+// tailscaled has no TUN device. The connection's bytes are carried
+// over the LocalAPI connection.
+func (lc *LocalClient) DialTCP(ctx context.Context, host string, port uint16) (net.Conn, error) {
+	connCh := make(chan net.Conn, 1)
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			select {
+			case connCh <- info.Conn:
+			default:
+			}
+		},
+	}
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), "POST", "http://local-tailscaled.sock/localapi/v0/dial", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = http.Header{
+		"Upgrade":    {"ts-dial"},
+		"Connection": {"upgrade"},
+		"Dial-Host":  {host},
+		"Dial-Port":  {strconv.Itoa(int(port))},
+	}
+	res, err := lc.DoLocalRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode == http.StatusForbidden {
+			return nil, &AccessDeniedError{errors.New(errorMessageFromBody(body))}
+		}
+		return nil, fmt.Errorf("dialing %s: %s", net.JoinHostPort(host, strconv.Itoa(int(port))), errorMessageFromBody(body))
+	}
+	rwc, ok := res.Body.(io.ReadWriteCloser)
+	if !ok {
+		res.Body.Close()
+		return nil, errors.New("dial: HTTP transport didn't return a writable body")
+	}
+	var conn net.Conn
+	select {
+	case conn = <-connCh:
+	default:
+		rwc.Close()
+		return nil, errors.New("dial: no LocalAPI connection")
+	}
+	return &switchedConn{Conn: conn, rwc: rwc}, nil
+}
+
+// switchedConn is a LocalAPI connection that has switched protocols
+// from HTTP. Reads and writes go through rwc, the response body, which
+// may hold bytes already buffered from Conn.
+type switchedConn struct {
+	net.Conn
+	rwc io.ReadWriteCloser
+}
+
+func (c *switchedConn) Read(p []byte) (int, error)  { return c.rwc.Read(p) }
+func (c *switchedConn) Write(p []byte) (int, error) { return c.rwc.Write(p) }
+func (c *switchedConn) Close() error                { return c.rwc.Close() }
+
+// CloseWrite shuts down the writing side of the connection, if the
+// underlying LocalAPI connection supports that.
+func (c *switchedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("CloseWrite not supported")
+}
+
 // SetDNS adds a DNS TXT record for the given domain name, containing
 // the provided TXT value. The intended use case is answering
 // LetsEncrypt/ACME dns-01 challenges.
@@ -359,19 +514,19 @@ func Logout(ctx context.Context) error {
 // This is a low-level interface; it's expected that most Tailscale
 // users use a higher level interface to getting/using TLS
 // certificates.
-func SetDNS(ctx context.Context, name, value string) error {
+func (lc *LocalClient) SetDNS(ctx context.Context, name, value string) error {
 	v := url.Values{}
 	v.Set("name", name)
 	v.Set("value", value)
-	_, err := send(ctx, "POST", "/localapi/v0/set-dns?"+v.Encode(), 200, nil)
+	_, err := lc.send(ctx, "POST", "/localapi/v0/set-dns?"+v.Encode(), 200, nil)
 	return err
 }
 
 // CurrentDERPMap returns the current DERPMap that is being used by the local tailscaled.
 // It is intended to be used with netcheck to see availability of DERPs.
-func CurrentDERPMap(ctx context.Context) (*tailcfg.DERPMap, error) {
+func (lc *LocalClient) CurrentDERPMap(ctx context.Context) (*tailcfg.DERPMap, error) {
 	var derpMap tailcfg.DERPMap
-	res, err := send(ctx, "GET", "/localapi/v0/derpmap", 200, nil)
+	res, err := lc.send(ctx, "GET", "/localapi/v0/derpmap", 200, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -384,8 +539,8 @@ func CurrentDERPMap(ctx context.Context) (*tailcfg.DERPMap, error) {
 // CertPair returns a cert and private key for the provided DNS domain.
 //
 // It returns a cached certificate from disk if it's still valid.
-func CertPair(ctx context.Context, domain string) (certPEM, keyPEM []byte, err error) {
-	res, err := send(ctx, "GET", "/localapi/v0/cert/"+domain+"?type=pair", 200, nil)
+func (lc *LocalClient) CertPair(ctx context.Context, domain string) (certPEM, keyPEM []byte, err error) {
+	res, err := lc.send(ctx, "GET", "/localapi/v0/cert/"+domain+"?type=pair", 200, nil)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -409,7 +564,7 @@ func CertPair(ctx context.Context, domain string) (certPEM, keyPEM []byte, err e
 //
 // It's the right signature to use as the value of
 // tls.Config.GetCertificate.
-func GetCertificate(hi *tls.ClientHelloInfo) (*tls.Certificate, error) {
+func (lc *LocalClient) GetCertificate(hi *tls.ClientHelloInfo) (*tls.Certificate, error) {
 	if hi == nil || hi.ServerName == "" {
 		return nil, errors.New("no SNI ServerName")
 	}
@@ -418,11 +573,11 @@ func GetCertificate(hi *tls.ClientHelloInfo) (*tls.Certificate, error) {
 
 	name := hi.ServerName
 	if !strings.Contains(name, ".") {
-		if v, ok := ExpandSNIName(ctx, name); ok {
+		if v, ok := lc.ExpandSNIName(ctx, name); ok {
 			name = v
 		}
 	}
-	certPEM, keyPEM, err := CertPair(ctx, name)
+	certPEM, keyPEM, err := lc.CertPair(ctx, name)
 	if err != nil {
 		return nil, err
 	}
@@ -434,8 +589,8 @@ func GetCertificate(hi *tls.ClientHelloInfo) (*tls.Certificate, error) {
 }
 
 // ExpandSNIName expands bare label name into the the most likely actual TLS cert name.
-func ExpandSNIName(ctx context.Context, name string) (fqdn string, ok bool) {
-	st, err := StatusWithoutPeers(ctx)
+func (lc *LocalClient) ExpandSNIName(ctx context.Context, name string) (fqdn string, ok bool) {
+	st, err := lc.StatusWithoutPeers(ctx)
 	if err != nil {
 		return "", false
 	}
@@ -476,3 +631,136 @@ func tailscaledConnectHint() string {
 	}
 	return "not running?"
 }
+
+// The following package-level functions use the default LocalClient,
+// which connects to the local machine's tailscaled via TailscaledDialer.
+
+// DoLocalRequest calls LocalClient.DoLocalRequest on the default LocalClient.
+func DoLocalRequest(req *http.Request) (*http.Response, error) {
+	return defaultLocalClient.DoLocalRequest(req)
+}
+
+// WhoIs calls LocalClient.WhoIs on the default LocalClient.
+func WhoIs(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+	return defaultLocalClient.WhoIs(ctx, remoteAddr)
+}
+
+// Goroutines calls LocalClient.Goroutines on the default LocalClient.
+func Goroutines(ctx context.Context) ([]byte, error) {
+	return defaultLocalClient.Goroutines(ctx)
+}
+
+// DaemonMetrics calls LocalClient.DaemonMetrics on the default LocalClient.
+func DaemonMetrics(ctx context.Context) ([]byte, error) {
+	return defaultLocalClient.DaemonMetrics(ctx)
+}
+
+// DebugFilter calls LocalClient.DebugFilter on the default LocalClient.
+func DebugFilter(ctx context.Context) (*apitype.FilterStatus, error) {
+	return defaultLocalClient.DebugFilter(ctx)
+}
+
+// DebugFilterCheck calls LocalClient.DebugFilterCheck on the default LocalClient.
+func DebugFilterCheck(ctx context.Context, src, dst, proto string) (*apitype.FilterCheckResponse, error) {
+	return defaultLocalClient.DebugFilterCheck(ctx, src, dst, proto)
+}
+
+// Profile calls LocalClient.Profile on the default LocalClient.
+func Profile(ctx context.Context, pprofType string, sec int) ([]byte, error) {
+	return defaultLocalClient.Profile(ctx, pprofType, sec)
+}
+
+// BugReport calls LocalClient.BugReport on the default LocalClient.
+func BugReport(ctx context.Context, note string) (string, error) {
+	return defaultLocalClient.BugReport(ctx, note)
+}
+
+// Status calls LocalClient.Status on the default LocalClient.
+func Status(ctx context.Context) (*ipnstate.Status, error) {
+	return defaultLocalClient.Status(ctx)
+}
+
+// StatusWithoutPeers calls LocalClient.StatusWithoutPeers on the default LocalClient.
+func StatusWithoutPeers(ctx context.Context) (*ipnstate.Status, error) {
+	return defaultLocalClient.StatusWithoutPeers(ctx)
+}
+
+// WaitingFiles calls LocalClient.WaitingFiles on the default LocalClient.
+func WaitingFiles(ctx context.Context) ([]apitype.WaitingFile, error) {
+	return defaultLocalClient.WaitingFiles(ctx)
+}
+
+// DeleteWaitingFile calls LocalClient.DeleteWaitingFile on the default LocalClient.
+func DeleteWaitingFile(ctx context.Context, baseName string) error {
+	return defaultLocalClient.DeleteWaitingFile(ctx, baseName)
+}
+
+// GetWaitingFile calls LocalClient.GetWaitingFile on the default LocalClient.
+func GetWaitingFile(ctx context.Context, baseName string) (rc io.ReadCloser, size int64, err error) {
+	return defaultLocalClient.GetWaitingFile(ctx, baseName)
+}
+
+// FileTargets calls LocalClient.FileTargets on the default LocalClient.
+func FileTargets(ctx context.Context) ([]apitype.FileTarget, error) {
+	return defaultLocalClient.FileTargets(ctx)
+}
+
+// CheckIPForwarding calls LocalClient.CheckIPForwarding on the default LocalClient.
+func CheckIPForwarding(ctx context.Context) error {
+	return defaultLocalClient.CheckIPForwarding(ctx)
+}
+
+// GetPrefs calls LocalClient.GetPrefs on the default LocalClient.
+func GetPrefs(ctx context.Context) (*ipn.Prefs, error) {
+	return defaultLocalClient.GetPrefs(ctx)
+}
+
+// EditPrefs calls LocalClient.EditPrefs on the default LocalClient.
+func EditPrefs(ctx context.Context, mp *ipn.MaskedPrefs) (*ipn.Prefs, error) {
+	return defaultLocalClient.EditPrefs(ctx, mp)
+}
+
+// Logout calls LocalClient.Logout on the default LocalClient.
+func Logout(ctx context.Context) error {
+	return defaultLocalClient.Logout(ctx)
+}
+
+// Profiles calls LocalClient.Profiles on the default LocalClient.
+func Profiles(ctx context.Context) (*ipn.Profiles, error) {
+	return defaultLocalClient.Profiles(ctx)
+}
+
+// SwitchProfile calls LocalClient.SwitchProfile on the default LocalClient.
+func SwitchProfile(ctx context.Context, name string) error {
+	return defaultLocalClient.SwitchProfile(ctx, name)
+}
+
+// DialTCP calls LocalClient.DialTCP on the default LocalClient.
+func DialTCP(ctx context.Context, host string, port uint16) (net.Conn, error) {
+	return defaultLocalClient.DialTCP(ctx, host, port)
+}
+
+// SetDNS calls LocalClient.SetDNS on the default LocalClient.
+func SetDNS(ctx context.Context, name, value string) error {
+	return defaultLocalClient.SetDNS(ctx, name, value)
+}
+
+// CurrentDERPMap calls LocalClient.CurrentDERPMap on the default LocalClient.
+func CurrentDERPMap(ctx context.Context) (*tailcfg.DERPMap, error) {
+	return defaultLocalClient.CurrentDERPMap(ctx)
+}
+
+// CertPair calls LocalClient.CertPair on the default LocalClient.
+func CertPair(ctx context.Context, domain string) (certPEM, keyPEM []byte, err error) {
+	return defaultLocalClient.CertPair(ctx, domain)
+}
+
+// GetCertificate calls LocalClient.GetCertificate on the default LocalClient.
+func GetCertificate(hi *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return defaultLocalClient.GetCertificate(hi)
+}
+
+// ExpandSNIName calls LocalClient.ExpandSNIName on the default LocalClient.
+func ExpandSNIName(ctx context.Context, name string) (fqdn string, ok bool) {
+	return defaultLocalClient.ExpandSNIName(ctx, name)
+}
@@ -0,0 +1,260 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/types/key"
+	"tailscale.com/types/logger"
+)
+
+// newAdmitFunc returns the client admission check configured by the
+// --allow-keys-file and --admit-webhook flags, for
+// derp.Server.SetAdmitClient, or nil if neither is set.
+//
+// A client is admitted if its key is in the allow-list file, or
+// otherwise if the webhook approves it.
+func newAdmitFunc(logf logger.Logf) (func(context.Context, key.NodePublic) error, error) {
+	var al *allowList
+	var wh *admitWebhook
+	if *allowKeysFile != "" {
+		var err error
+		al, err = newAllowList(*allowKeysFile, logf)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if *admitWebhookURL != "" {
+		wh = newAdmitWebhook(*admitWebhookURL, *admitWebhookCache)
+	}
+	if al == nil && wh == nil {
+		return nil, nil
+	}
+	return func(ctx context.Context, k key.NodePublic) error {
+		if al != nil && al.contains(k) {
+			return nil
+		}
+		if wh != nil {
+			allow, err := wh.allow(ctx, k)
+			if err != nil {
+				// Don't tell the client about our webhook.
+				logf("admission webhook for %v: %v", k.ShortString(), err)
+				return errors.New("admission check failed")
+			}
+			if allow {
+				return nil
+			}
+		}
+		return errors.New("node key not allowed")
+	}, nil
+}
+
+// allowListCheckInterval is how often an allowList checks whether its
+// file changed.
+const allowListCheckInterval = time.Second
+
+// allowList is a set of node public keys read from a file, which is
+// reloaded when it changes.
+type allowList struct {
+	path string
+	logf logger.Logf
+	now  func() time.Time // time.Now, except in tests
+
+	mu        sync.Mutex
+	keys      map[key.NodePublic]bool
+	modTime   time.Time // of the file when keys was read
+	size      int64     // of the file when keys was read
+	lastCheck time.Time
+}
+
+// newAllowList returns an allowList of the keys in the file at path.
+// Unlike reloads, which keep the previous keys on error, the first
+// load must succeed.
+func newAllowList(path string, logf logger.Logf) (*allowList, error) {
+	a := &allowList{
+		path: path,
+		logf: logf,
+		now:  time.Now,
+	}
+	if err := a.reloadLocked(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// contains reports whether k is in the allow-list, first reloading
+// the file if it's changed.
+func (a *allowList) contains(k key.NodePublic) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if now := a.now(); now.Sub(a.lastCheck) >= allowListCheckInterval {
+		a.lastCheck = now
+		if err := a.reloadLocked(); err != nil {
+			a.logf("keeping previous allow-list: %v", err)
+		}
+	}
+	return a.keys[k]
+}
+
+// reloadLocked reads the allow-list file, if it's changed since it
+// was last read.
+//
+// a.mu must be held.
+func (a *allowList) reloadLocked() error {
+	fi, err := os.Stat(a.path)
+	if err != nil {
+		return err
+	}
+	if a.keys != nil && fi.ModTime().Equal(a.modTime) && fi.Size() == a.size {
+		return nil
+	}
+	b, err := ioutil.ReadFile(a.path)
+	if err != nil {
+		return err
+	}
+	keys, err := parseAllowList(b)
+	if err != nil {
+		return fmt.Errorf("%s: %w", a.path, err)
+	}
+	if a.keys != nil {
+		a.logf("reloaded allow-list %s: %d keys", a.path, len(keys))
+	}
+	a.keys, a.modTime, a.size = keys, fi.ModTime(), fi.Size()
+	return nil
+}
+
+// parseAllowList parses the contents of an allow-list file: one node
+// public key per line, in the "nodekey:<hex>" form. Blank lines and
+// lines starting with # are ignored.
+func parseAllowList(b []byte) (map[key.NodePublic]bool, error) {
+	keys := map[key.NodePublic]bool{}
+	for i, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var k key.NodePublic
+		if err := k.UnmarshalText([]byte(line)); err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		keys[k] = true
+	}
+	return keys, nil
+}
+
+// maxAdmitWebhookCache is the maximum number of answers an
+// admitWebhook caches.
+const maxAdmitWebhookCache = 10000
+
+// admitWebhook asks an HTTP endpoint whether to admit clients, and
+// caches its answers.
+//
+// The endpoint is POSTed an admitRequest as JSON, and must reply 200
+// OK with an admitResponse as JSON. Other replies and errors reject
+// the client, and aren't cached.
+type admitWebhook struct {
+	url    string
+	ttl    time.Duration
+	client *http.Client
+	now    func() time.Time // time.Now, except in tests
+
+	mu    sync.Mutex
+	cache map[key.NodePublic]admitAnswer
+}
+
+// admitRequest is the body of a request to an admission webhook.
+type admitRequest struct {
+	NodePublic key.NodePublic
+}
+
+// admitResponse is the body of an admission webhook's response.
+type admitResponse struct {
+	Allow bool
+}
+
+type admitAnswer struct {
+	allow   bool
+	expires time.Time
+}
+
+func newAdmitWebhook(url string, ttl time.Duration) *admitWebhook {
+	return &admitWebhook{
+		url:    url,
+		ttl:    ttl,
+		client: &http.Client{Timeout: 5 * time.Second},
+		now:    time.Now,
+		cache:  map[key.NodePublic]admitAnswer{},
+	}
+}
+
+// allow reports whether the webhook admits k, asking it if there's no
+// unexpired cached answer.
+func (w *admitWebhook) allow(ctx context.Context, k key.NodePublic) (bool, error) {
+	now := w.now()
+	w.mu.Lock()
+	ans, ok := w.cache[k]
+	w.mu.Unlock()
+	if ok && now.Before(ans.expires) {
+		return ans.allow, nil
+	}
+
+	allow, err := w.ask(ctx, k)
+	if err != nil {
+		return false, err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.cache) >= maxAdmitWebhookCache {
+		for ck, ca := range w.cache {
+			if !now.Before(ca.expires) {
+				delete(w.cache, ck)
+			}
+		}
+		if len(w.cache) >= maxAdmitWebhookCache {
+			w.cache = map[key.NodePublic]admitAnswer{}
+		}
+	}
+	w.cache[k] = admitAnswer{allow: allow, expires: now.Add(w.ttl)}
+	return allow, nil
+}
+
+// ask asks the webhook whether to admit k.
+func (w *admitWebhook) ask(ctx context.Context, k key.NodePublic) (bool, error) {
+	body, err := json.Marshal(admitRequest{NodePublic: k})
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", w.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := w.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("unexpected status %v", res.Status)
+	}
+	var ar admitResponse
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&ar); err != nil {
+		return false, fmt.Errorf("decoding response: %w", err)
+	}
+	return ar.Allow, nil
+}
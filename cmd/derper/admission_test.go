@@ -0,0 +1,117 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"tailscale.com/types/key"
+)
+
+func TestAllowList(t *testing.T) {
+	k1, k2 := key.NewNode().Public(), key.NewNode().Public()
+	path := filepath.Join(t.TempDir(), "allow")
+	write := func(contents string, mtime time.Time) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mtime := time.Unix(1000, 0)
+	write("# team\n"+k1.String()+"\n\n", mtime)
+
+	a, err := newAllowList(path, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(2000, 0)
+	a.now = func() time.Time { return now }
+	if !a.contains(k1) || a.contains(k2) {
+		t.Fatal("wrong initial allow-list")
+	}
+
+	// Changes are noticed once allowListCheckInterval passes.
+	write(k2.String()+"\n", mtime.Add(time.Second))
+	if !a.contains(k1) {
+		t.Error("reloaded before allowListCheckInterval")
+	}
+	now = now.Add(allowListCheckInterval)
+	if a.contains(k1) || !a.contains(k2) {
+		t.Error("allow-list not reloaded after change")
+	}
+
+	// A bad file keeps the previous keys.
+	write("nodekey:bogus\n", mtime.Add(2*time.Second))
+	now = now.Add(allowListCheckInterval)
+	if !a.contains(k2) {
+		t.Error("bad file replaced previous allow-list")
+	}
+
+	if _, err := parseAllowList([]byte(k1.String() + "\nnot-a-key\n")); err == nil {
+		t.Error("parseAllowList accepted a bad line")
+	}
+}
+
+func TestAdmitWebhook(t *testing.T) {
+	allowed, denied := key.NewNode().Public(), key.NewNode().Public()
+	var calls int32
+	var fail int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if atomic.LoadInt32(&fail) != 0 {
+			http.Error(w, "oops", 500)
+			return
+		}
+		var req admitRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decoding request: %v", err)
+		}
+		json.NewEncoder(w).Encode(admitResponse{Allow: req.NodePublic == allowed})
+	}))
+	defer ts.Close()
+
+	w := newAdmitWebhook(ts.URL, time.Minute)
+	now := time.Unix(1000, 0)
+	w.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	check := func(k key.NodePublic, wantAllow bool, wantCalls int32) {
+		t.Helper()
+		allow, err := w.allow(ctx, k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allow != wantAllow {
+			t.Errorf("allow = %v; want %v", allow, wantAllow)
+		}
+		if got := atomic.LoadInt32(&calls); got != wantCalls {
+			t.Errorf("webhook calls = %d; want %d", got, wantCalls)
+		}
+	}
+	check(allowed, true, 1)
+	check(denied, false, 2)
+	check(allowed, true, 2) // cached
+	check(denied, false, 2) // cached
+
+	// Once answers expire, errors reject, and aren't cached.
+	now = now.Add(time.Minute)
+	atomic.StoreInt32(&fail, 1)
+	if _, err := w.allow(ctx, allowed); err == nil {
+		t.Error("webhook failure didn't return an error")
+	}
+	atomic.StoreInt32(&fail, 0)
+	check(allowed, true, 4)
+}
@@ -12,6 +12,7 @@ import (
 	"errors"
 	"expvar"
 	"flag"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
@@ -46,6 +47,19 @@ var (
 	meshWith      = flag.String("mesh-with", "", "optional comma-separated list of hostnames to mesh with; the server's own hostname can be in the list")
 	bootstrapDNS  = flag.String("bootstrap-dns-names", "", "optional comma-separated list of hostnames to make available at /bootstrap-dns")
 	verifyClients = flag.Bool("verify-clients", false, "verify clients to this DERP server through a local tailscaled instance.")
+
+	// Admission control; see admission.go.
+	allowKeysFile     = flag.String("allow-keys-file", "", "if non-empty, path to a file of node public keys (nodekey:<hex>, one per line) allowed to connect. It's reloaded when it changes.")
+	admitWebhookURL   = flag.String("admit-webhook", "", `if non-empty, URL to POST {"NodePublic":"nodekey:<hex>"} to for each client not in --allow-keys-file. It must reply with {"Allow":true} to admit the client.`)
+	admitWebhookCache = flag.Duration("admit-webhook-cache", 5*time.Minute, "how long to cache --admit-webhook answers")
+
+	// Rate limits; non-zero values override the config file's RateLimits.
+	clientPacketsPerSec = flag.Int("client-packets-per-sec", 0, "if non-zero, the packets per second each client key may send")
+	clientPacketsBurst  = flag.Int("client-packets-burst", 0, "burst of --client-packets-per-sec; 0 means one second's worth")
+	clientBytesPerSec   = flag.Int("client-bytes-per-sec", 0, "if non-zero, the bytes per second each client key may send")
+	clientBytesBurst    = flag.Int("client-bytes-burst", 0, "burst of --client-bytes-per-sec; 0 means one second's worth")
+	globalBytesPerSec   = flag.Int("global-bytes-per-sec", 0, "if non-zero, the bytes per second all clients together may send")
+	globalBytesBurst    = flag.Int("global-bytes-burst", 0, "burst of --global-bytes-per-sec; 0 means one second's worth")
 )
 
 var (
@@ -70,6 +84,34 @@ func init() {
 
 type config struct {
 	PrivateKey key.NodePrivate
+
+	// RateLimits optionally limits the traffic clients may send.
+	// The rate limit flags override it.
+	RateLimits *derp.RateLimits `json:",omitempty"`
+}
+
+// rateLimits returns the rate limits configured by cfg and the flags.
+func rateLimits(cfg config) derp.RateLimits {
+	var l derp.RateLimits
+	if cfg.RateLimits != nil {
+		l = *cfg.RateLimits
+	}
+	for _, f := range []struct {
+		dst  *int
+		flag int
+	}{
+		{&l.PerClientPacketsPerSecond, *clientPacketsPerSec},
+		{&l.PerClientPacketsBurst, *clientPacketsBurst},
+		{&l.PerClientBytesPerSecond, *clientBytesPerSec},
+		{&l.PerClientBytesBurst, *clientBytesBurst},
+		{&l.GlobalBytesPerSecond, *globalBytesPerSec},
+		{&l.GlobalBytesBurst, *globalBytesBurst},
+	} {
+		if f.flag != 0 {
+			*f.dst = f.flag
+		}
+	}
+	return l
 }
 
 func loadConfig() config {
@@ -145,6 +187,15 @@ func main() {
 
 	s := derp.NewServer(cfg.PrivateKey, log.Printf)
 	s.SetVerifyClient(*verifyClients)
+	limits := rateLimits(cfg)
+	s.SetRateLimits(limits)
+	admit, err := newAdmitFunc(log.Printf)
+	if err != nil {
+		log.Fatalf("derper: %v", err)
+	}
+	if admit != nil {
+		s.SetAdmitClient(admit)
+	}
 
 	if *meshPSKFile != "" {
 		b, err := ioutil.ReadFile(*meshPSKFile)
@@ -189,6 +240,7 @@ func main() {
 	debug := tsweb.Debugger(mux)
 	debug.KV("TLS hostname", *hostname)
 	debug.KV("Mesh key", s.HasMeshKey())
+	debug.KV("Rate limits", fmt.Sprintf("%+v", limits))
 	debug.Handle("check", "Consistency check", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		err := s.ConsistencyCheck()
 		if err != nil {
@@ -6,9 +6,11 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"net"
 	"testing"
 
+	"tailscale.com/derp"
 	"tailscale.com/net/stun"
 )
 
@@ -36,6 +38,27 @@ func TestProdAutocertHostPolicy(t *testing.T) {
 	}
 }
 
+func TestRateLimits(t *testing.T) {
+	defer func(v int) { *clientBytesPerSec = v }(*clientBytesPerSec)
+	*clientBytesPerSec = 5000
+
+	var cfg config
+	if err := json.Unmarshal([]byte(`{"RateLimits": {"PerClientBytesPerSecond": 1000, "GlobalBytesPerSecond": 1000000}}`), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	got := rateLimits(cfg)
+	want := derp.RateLimits{
+		PerClientBytesPerSecond: 5000, // flag overrides config
+		GlobalBytesPerSecond:    1000000,
+	}
+	if got != want {
+		t.Errorf("rateLimits = %+v; want %+v", got, want)
+	}
+	if got := rateLimits(config{}); got != (derp.RateLimits{PerClientBytesPerSecond: 5000}) {
+		t.Errorf("rateLimits without config = %+v", got)
+	}
+}
+
 func BenchmarkServerSTUN(b *testing.B) {
 	b.ReportAllocs()
 	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
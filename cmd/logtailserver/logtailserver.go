@@ -0,0 +1,81 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// The logtailserver binary is a self-hosted log collection server
+// implementing the storage and retrieval APIs of logtail/api.md, so
+// that Tailscale nodes' logs can be sent to it (with TS_LOG_TARGET)
+// rather than to log.tailscale.io.
+//
+// Logs are stored in the --dir directory, in a subdirectory per
+// collection of segment files of JSON lines, deleting the oldest
+// segments to keep each collection under --max-size bytes.
+//
+// Uploads are authorized by the collection being one of
+// --collections; the uploading instance's private ID is its
+// credential, and only its public ID is stored. Retrieval requires
+// the API key from --api-key-file as the HTTP basic auth username:
+//
+//	curl -u <api-key>: 'http://localhost:8080/c/tailnode.log.tailscale.io?stream=true'
+package main // import "tailscale.com/cmd/logtailserver"
+
+import (
+	"flag"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	addr        = flag.String("a", ":8080", "server address")
+	dir         = flag.String("dir", "", "directory to store logs in")
+	collections = flag.String("collections", "tailnode.log.tailscale.io", "comma-separated names of the collections to accept logs for")
+	apiKeyFile  = flag.String("api-key-file", "", "if non-empty, path to a file containing the API key for retrieving logs; whitespace is trimmed. If empty, logs can't be retrieved.")
+	maxSize     = flag.Int64("max-size", 1<<30, "maximum bytes of logs to keep per collection; the oldest are deleted")
+	certFile    = flag.String("tls-cert", "", "if non-empty, path to a TLS certificate to serve HTTPS with; requires --tls-key")
+	keyFile     = flag.String("tls-key", "", "path to the TLS private key for --tls-cert")
+)
+
+// segmentSize is the size at which a collection's logs start a new
+// segment file. It's the granularity of deleting old logs.
+const segmentSize = 16 << 20
+
+func main() {
+	flag.Parse()
+	if *dir == "" {
+		log.Fatalf("--dir is required")
+	}
+	if (*certFile == "") != (*keyFile == "") {
+		log.Fatalf("--tls-cert and --tls-key must be used together")
+	}
+	var apiKey string
+	if *apiKeyFile != "" {
+		b, err := ioutil.ReadFile(*apiKeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		apiKey = strings.TrimSpace(string(b))
+		if apiKey == "" {
+			log.Fatalf("--api-key-file %s is empty", *apiKeyFile)
+		}
+	}
+
+	s, err := newServer(*dir, strings.Split(*collections, ","), apiKey, segmentSize, *maxSize)
+	if err != nil {
+		log.Fatal(err)
+	}
+	httpsrv := &http.Server{
+		Addr:              *addr,
+		Handler:           s,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	log.Printf("logtailserver listening on %s, storing logs in %s", *addr, *dir)
+	if *certFile != "" {
+		err = httpsrv.ListenAndServeTLS(*certFile, *keyFile)
+	} else {
+		err = httpsrv.ListenAndServe()
+	}
+	log.Fatal(err)
+}
@@ -0,0 +1,386 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"tailscale.com/logtail"
+	"tailscale.com/smallzstd"
+)
+
+// maxBodySize is the maximum size of an upload, before and after
+// decompression. logtail.Logger uploads at most a few hundred KB at
+// once.
+const maxBodySize = 4 << 20
+
+// validCollectionName matches the collection names api.md allows.
+var validCollectionName = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+// server implements the storage and retrieval APIs of logtail/api.md.
+type server struct {
+	apiKey  string            // for retrieval; if empty, retrieval is disabled
+	stores  map[string]*store // by collection name
+	zstd    *zstd.Decoder
+	timeNow func() time.Time
+}
+
+// newServer returns a server storing the logs of each of collections
+// in a subdirectory of dir.
+func newServer(dir string, collections []string, apiKey string, segmentSize, maxSize int64) (*server, error) {
+	zd, err := smallzstd.NewDecoder(nil, zstd.WithDecoderMaxMemory(maxBodySize))
+	if err != nil {
+		return nil, err
+	}
+	s := &server{
+		apiKey:  apiKey,
+		stores:  make(map[string]*store),
+		zstd:    zd,
+		timeNow: time.Now,
+	}
+	for _, c := range collections {
+		if !validCollectionName.MatchString(c) || strings.Trim(c, ".") == "" {
+			return nil, fmt.Errorf("invalid collection name %q", c)
+		}
+		st, err := openStore(filepath.Join(dir, c), segmentSize, maxSize)
+		if err != nil {
+			return nil, fmt.Errorf("collection %q: %w", c, err)
+		}
+		s.stores[c] = st
+	}
+	return s, nil
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/collections":
+		s.serveCollections(w, r)
+	case strings.HasPrefix(r.URL.Path, "/c/"):
+		collection := strings.TrimPrefix(r.URL.Path, "/c/")
+		if i := strings.Index(collection, "/"); i >= 0 {
+			s.serveUpload(w, r, collection[:i], collection[i+1:])
+		} else {
+			s.serveQuery(w, r, collection)
+		}
+	default:
+		httpError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// serveUpload handles POST /c/<collection>/<private-ID>.
+func (s *server) serveUpload(w http.ResponseWriter, r *http.Request, collection, privateID string) {
+	if r.Method != "POST" {
+		httpError(w, http.StatusMethodNotAllowed, "POST required")
+		return
+	}
+	st := s.stores[collection]
+	if st == nil {
+		httpError(w, http.StatusForbidden, "invalid collection name")
+		return
+	}
+	id, err := logtail.ParsePrivateID(privateID)
+	if err != nil {
+		httpError(w, http.StatusForbidden, "invalid private ID")
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxBodySize+1))
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	instance, now := id.Public(), s.timeNow()
+	var lines []byte
+	var entryErr error
+	if body, err := s.decodeBody(r.Header.Get("Content-Encoding"), body); err != nil {
+		entryErr = err
+		lines = storedLine(nil, nil, err, instance, now)
+	} else {
+		lines, entryErr = storedLines(body, instance, now)
+	}
+	if err := st.Append(lines); err != nil {
+		log.Printf("storing logs for %s/%s: %v", collection, instance, err)
+		httpError(w, http.StatusInternalServerError, "failed to store logs")
+		return
+	}
+	if entryErr != nil {
+		httpError(w, http.StatusBadRequest, entryErr.Error())
+		return
+	}
+}
+
+// decodeBody returns the body of an upload with the given
+// Content-Encoding, decompressed.
+func (s *server) decodeBody(contentEncoding string, body []byte) ([]byte, error) {
+	if len(body) > maxBodySize {
+		return nil, fmt.Errorf("body larger than %d bytes", maxBodySize)
+	}
+	switch contentEncoding {
+	case "":
+		return body, nil
+	case "zstd":
+		body, err := s.zstd.DecodeAll(body, nil)
+		if err != nil {
+			return nil, fmt.Errorf("decompressing body: %w", err)
+		}
+		return body, nil
+	default:
+		return nil, fmt.Errorf("unsupported Content-Encoding %q", contentEncoding)
+	}
+}
+
+// storedLines returns the log messages in body, a single JSON object
+// or a JSON array of them, as stored entries received from instance
+// at now. It returns an error if any message was invalid. Invalid
+// messages are still stored, with the error in their logtail object.
+func storedLines(body []byte, instance logtail.PublicID, now time.Time) (lines []byte, err error) {
+	var msgs []json.RawMessage
+	if body = bytes.TrimSpace(body); len(body) > 0 && body[0] == '[' {
+		if json.Unmarshal(body, &msgs) != nil {
+			msgs = []json.RawMessage{body}
+		}
+	} else {
+		msgs = []json.RawMessage{body}
+	}
+	for _, msg := range msgs {
+		var obj, lt map[string]json.RawMessage
+		var msgErr error
+		if json.Unmarshal(msg, &obj) != nil || obj == nil {
+			msgErr = errors.New("log entry is not a JSON object")
+			text, _ := json.Marshal(string(msg))
+			obj = map[string]json.RawMessage{"text": text}
+		} else if raw, ok := obj["logtail"]; ok && json.Unmarshal(raw, &lt) != nil {
+			msgErr = fmt.Errorf("invalid logtail property %s", raw)
+		} else {
+			// Clients may only set client_time; move any other
+			// properties to the error.
+			invalid := make(map[string]json.RawMessage)
+			for k, v := range lt {
+				if k != "client_time" {
+					invalid[k] = v
+					delete(lt, k)
+				}
+			}
+			if len(invalid) > 0 {
+				b, _ := json.Marshal(invalid)
+				msgErr = fmt.Errorf("invalid logtail properties %s", b)
+			}
+		}
+		if msgErr != nil && err == nil {
+			err = msgErr
+		}
+		lines = append(lines, storedLine(obj, lt, msgErr, instance, now)...)
+	}
+	return lines, err
+}
+
+// storedLine returns the stored entry line for the log message obj,
+// with the logtail object lt, if any, received from instance at now.
+// If msgErr is non-nil, it's recorded in the logtail object.
+func storedLine(obj, lt map[string]json.RawMessage, msgErr error, instance logtail.PublicID, now time.Time) []byte {
+	if obj == nil {
+		obj = make(map[string]json.RawMessage)
+	}
+	if lt == nil {
+		lt = make(map[string]json.RawMessage)
+	}
+	lt["server_time"], _ = json.Marshal(now.UTC().Format(time.RFC3339Nano))
+	lt["instance"], _ = json.Marshal(instance)
+	if msgErr != nil {
+		lt["error"], _ = json.Marshal(msgErr.Error())
+	}
+	obj["logtail"], _ = json.Marshal(lt)
+	b, err := json.Marshal(obj)
+	if err != nil {
+		// The values were all either parsed or made from JSON.
+		panic("logtailserver: re-encoding JSON failed: " + err.Error())
+	}
+	return append(b, '\n')
+}
+
+// authorized reports whether r has the API key as its basic auth
+// username, writing an error to w if not.
+func (s *server) authorized(w http.ResponseWriter, r *http.Request) bool {
+	if s.apiKey == "" {
+		httpError(w, http.StatusForbidden, "log retrieval is disabled; see --api-key-file")
+		return false
+	}
+	key, _, ok := r.BasicAuth()
+	if !ok || subtle.ConstantTimeCompare([]byte(key), []byte(s.apiKey)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="logtailserver"`)
+		httpError(w, http.StatusUnauthorized, "invalid API key")
+		return false
+	}
+	return true
+}
+
+type collectionsResponse struct {
+	Collections map[string]collectionInfo `json:"collections"`
+}
+
+type collectionInfo struct {
+	Instances map[logtail.PublicID]*instanceStats `json:"instances"`
+}
+
+// serveCollections handles GET /collections.
+func (s *server) serveCollections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		httpError(w, http.StatusMethodNotAllowed, "GET required")
+		return
+	}
+	if !s.authorized(w, r) {
+		return
+	}
+	name := r.FormValue("collection-name")
+	if name != "" && s.stores[name] == nil {
+		httpError(w, http.StatusNotFound, "unknown collection")
+		return
+	}
+	res := collectionsResponse{Collections: make(map[string]collectionInfo)}
+	for c, st := range s.stores {
+		if name == "" || c == name {
+			res.Collections[c] = collectionInfo{Instances: st.Instances()}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// streamHeader is the first line of a streaming query's response.
+type streamHeader struct {
+	Collection string    `json:"collection"`
+	ServerTime time.Time `json:"server_time"`
+}
+
+// serveQuery handles GET /c/<collection>.
+func (s *server) serveQuery(w http.ResponseWriter, r *http.Request, collection string) {
+	if r.Method != "GET" {
+		httpError(w, http.StatusMethodNotAllowed, "GET required")
+		return
+	}
+	if !s.authorized(w, r) {
+		return
+	}
+	st := s.stores[collection]
+	if st == nil {
+		httpError(w, http.StatusNotFound, "unknown collection")
+		return
+	}
+	q, err := parseQuery(r.URL.Query())
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	if q.stream {
+		flusher, _ := w.(http.Flusher)
+		flush := func() {
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		json.NewEncoder(w).Encode(streamHeader{Collection: collection, ServerTime: s.timeNow().UTC()})
+		flush()
+		err := st.Query(r.Context(), q, func(line []byte) error {
+			_, err := w.Write(line)
+			flush()
+			return err
+		})
+		if err != nil {
+			log.Printf("streaming %s to %s: %v", collection, r.RemoteAddr, err)
+		}
+		return
+	}
+
+	hdr, _ := json.Marshal(collection)
+	fmt.Fprintf(w, `{"collection":%s,"logs":[`, hdr)
+	n := 0
+	err = st.Query(r.Context(), q, func(line []byte) error {
+		if n > 0 {
+			io.WriteString(w, ",")
+		}
+		n++
+		_, err := w.Write(bytes.TrimSuffix(line, []byte("\n")))
+		return err
+	})
+	if err != nil {
+		// Too late for an error status; leave the JSON unterminated.
+		log.Printf("querying %s for %s: %v", collection, r.RemoteAddr, err)
+		return
+	}
+	io.WriteString(w, "]}\n")
+}
+
+// parseQuery parses the query parameters of GET /c/<collection>.
+func parseQuery(v url.Values) (q query, err error) {
+	for _, s := range v["instances"] {
+		for _, s := range strings.Split(s, ",") {
+			id, err := logtail.ParsePublicID(s)
+			if err != nil {
+				return q, fmt.Errorf("invalid instance %q", s)
+			}
+			if q.instances == nil {
+				q.instances = make(map[logtail.PublicID]bool)
+			}
+			q.instances[id] = true
+		}
+	}
+	parseTime := func(name string) (time.Time, error) {
+		s := v.Get(name)
+		if s == "" {
+			return time.Time{}, nil
+		}
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid %s %q; want RFC 3339 time", name, s)
+		}
+		return t, nil
+	}
+	if q.start, err = parseTime("time-start"); err != nil {
+		return q, err
+	}
+	if q.end, err = parseTime("time-end"); err != nil {
+		return q, err
+	}
+	if s := v.Get("max-count"); s != "" {
+		if q.maxCount, err = strconv.Atoi(s); err != nil || q.maxCount <= 0 {
+			return q, fmt.Errorf("invalid max-count %q", s)
+		}
+	}
+	if s := v.Get("stream"); s != "" {
+		if q.stream, err = strconv.ParseBool(s); err != nil {
+			return q, fmt.Errorf("invalid stream %q", s)
+		}
+	}
+	if q.stream && !q.end.IsZero() {
+		return q, errors.New("time-end is incompatible with stream")
+	}
+	return q, nil
+}
+
+// httpError writes a JSON error response, as api.md describes.
+func httpError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+	}{msg})
+}
@@ -0,0 +1,271 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"tailscale.com/logtail"
+	"tailscale.com/smallzstd"
+)
+
+const (
+	testCollection = "test.example.com"
+	testAPIKey     = "secret"
+)
+
+// testEntry is a stored log entry, as returned by queries.
+type testEntry struct {
+	Text    string `json:"text"`
+	Foo     string `json:"foo"`
+	Logtail struct {
+		ClientTime string           `json:"client_time"`
+		ServerTime time.Time        `json:"server_time"`
+		Instance   logtail.PublicID `json:"instance"`
+		Error      string           `json:"error"`
+	} `json:"logtail"`
+}
+
+func newTestServer(t *testing.T) *server {
+	s, err := newServer(t.TempDir(), []string{testCollection}, testAPIKey, 1<<20, 1<<30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func get(t *testing.T, url string, v interface{}) {
+	t.Helper()
+	req, _ := http.NewRequest("GET", url, nil)
+	req.SetBasicAuth(testAPIKey, "")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		b, _ := ioutil.ReadAll(res.Body)
+		t.Fatalf("GET %s: %s: %s", url, res.Status, b)
+	}
+	if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+}
+
+func TestLogtailUpload(t *testing.T) {
+	s := newTestServer(t)
+	var mu sync.Mutex
+	var encodings []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		encodings = append(encodings, r.Header.Get("Content-Encoding"))
+		mu.Unlock()
+		s.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	priv, err := logtail.NewPrivateID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lg := logtail.NewLogger(logtail.Config{
+		Collection: testCollection,
+		PrivateID:  priv,
+		BaseURL:    ts.URL,
+		Stderr:     ioutil.Discard,
+		NewZstdEncoder: func() logtail.Encoder {
+			w, err := smallzstd.NewEncoder(nil)
+			if err != nil {
+				panic(err)
+			}
+			return w
+		},
+	}, t.Logf)
+	long := strings.Repeat("compressible ", 100)
+	lg.Write([]byte("hello\n"))
+	lg.Write([]byte(`{"text":"structured","foo":"bar"}`))
+	lg.Write([]byte(long))
+	if err := lg.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	pub := priv.Public()
+	var res struct {
+		Collection string      `json:"collection"`
+		Logs       []testEntry `json:"logs"`
+	}
+	get(t, ts.URL+"/c/"+testCollection+"?instances="+pub.String(), &res)
+	var texts []string
+	for _, e := range res.Logs {
+		texts = append(texts, e.Text)
+		if e.Logtail.Instance != pub || e.Logtail.ServerTime.IsZero() || e.Logtail.ClientTime == "" || e.Logtail.Error != "" {
+			t.Errorf("bad logtail object in %+v", e)
+		}
+	}
+	want := []string{"logtail started", "hello\n", "structured", long, "logger closing down\n"}
+	if strings.Join(texts, "|") != strings.Join(want, "|") {
+		t.Errorf("got texts %q; want %q", texts, want)
+	}
+	if res.Collection != testCollection || res.Logs[2].Foo != "bar" {
+		t.Errorf("got %+v", res)
+	}
+	mu.Lock()
+	if !strings.Contains(strings.Join(encodings, ","), "zstd") {
+		t.Errorf("no zstd uploads; got Content-Encodings %q", encodings)
+	}
+	mu.Unlock()
+
+	var cols collectionsResponse
+	get(t, ts.URL+"/collections?collection-name="+testCollection, &cols)
+	if st := cols.Collections[testCollection].Instances[pub]; st == nil || st.Size == 0 || st.FirstSeen.IsZero() {
+		t.Errorf("got collections %+v", cols)
+	}
+
+	// Paging.
+	get(t, ts.URL+"/c/"+testCollection+"?max-count=2", &res)
+	if len(res.Logs) != 2 || res.Logs[1].Text != "hello\n" {
+		t.Errorf("max-count=2 got %+v", res.Logs)
+	}
+	get(t, ts.URL+"/c/"+testCollection+"?time-start="+time.Now().Add(time.Hour).Format(time.RFC3339), &res)
+	if len(res.Logs) != 0 {
+		t.Errorf("future time-start got %+v", res.Logs)
+	}
+}
+
+func TestUploadErrors(t *testing.T) {
+	s := newTestServer(t)
+	s.timeNow = func() time.Time { return time.Date(2021, 7, 1, 12, 0, 0, 0, time.UTC) }
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	priv, err := logtail.NewPrivateID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		path     string
+		body     string
+		wantCode int
+	}{
+		{"ok", "/c/" + testCollection + "/" + priv.String(), `{"text":"ok"}`, 200},
+		{"bad_collection", "/c/other.example.com/" + priv.String(), `{"text":"x"}`, 403},
+		{"bad_id", "/c/" + testCollection + "/1234", `{"text":"x"}`, 403},
+		{"not_object", "/c/" + testCollection + "/" + priv.String(), `[{"text":"ok2"},42]`, 400},
+		{"not_json", "/c/" + testCollection + "/" + priv.String(), `hi`, 400},
+		{"bad_logtail", "/c/" + testCollection + "/" + priv.String(), `{"text":"x","logtail":{"client_time":"2021-07-01T11:00:00Z","server_time":"1999-01-01T00:00:00Z"}}`, 400},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := http.Post(ts.URL+tt.path, "application/json", strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if res.StatusCode != tt.wantCode {
+				t.Errorf("status = %d; want %d", res.StatusCode, tt.wantCode)
+			}
+		})
+	}
+
+	var res struct {
+		Logs []testEntry `json:"logs"`
+	}
+	get(t, ts.URL+"/c/"+testCollection, &res)
+	var got []string
+	for _, e := range res.Logs {
+		got = append(got, e.Text+":"+e.Logtail.Error)
+		if !e.Logtail.ServerTime.Equal(s.timeNow()) {
+			t.Errorf("server_time = %v", e.Logtail.ServerTime)
+		}
+	}
+	want := []string{
+		"ok:",
+		"ok2:",
+		"42:log entry is not a JSON object",
+		"hi:log entry is not a JSON object",
+		`x:invalid logtail properties {"server_time":"1999-01-01T00:00:00Z"}`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("stored entries:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestRetrievalAuth(t *testing.T) {
+	ts := httptest.NewServer(newTestServer(t))
+	defer ts.Close()
+	for _, key := range []string{"", "wrong"} {
+		req, _ := http.NewRequest("GET", ts.URL+"/c/"+testCollection, nil)
+		if key != "" {
+			req.SetBasicAuth(key, "")
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusUnauthorized {
+			t.Errorf("key %q: status = %d; want 401", key, res.StatusCode)
+		}
+	}
+}
+
+func TestStream(t *testing.T) {
+	ts := httptest.NewServer(newTestServer(t))
+	defer ts.Close()
+	priv, err := logtail.NewPrivateID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	post := func(body string) {
+		t.Helper()
+		res, err := http.Post(ts.URL+"/c/"+testCollection+"/"+priv.String(), "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+	post(`{"text":"before"}`)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", ts.URL+"/c/"+testCollection+"?stream=true", nil)
+	req.SetBasicAuth(testAPIKey, "")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	bs := bufio.NewScanner(res.Body)
+	next := func() testEntry {
+		t.Helper()
+		if !bs.Scan() {
+			t.Fatalf("stream ended: %v", bs.Err())
+		}
+		var e testEntry
+		if err := json.Unmarshal(bs.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		return e
+	}
+	next() // header
+	if e := next(); e.Text != "before" {
+		t.Errorf("got %q; want before", e.Text)
+	}
+	post(`[{"text":"after1"},{"text":"after2"}]`)
+	for _, want := range []string{"after1", "after2"} {
+		if e := next(); e.Text != want {
+			t.Errorf("got %q; want %q", e.Text, want)
+		}
+	}
+}
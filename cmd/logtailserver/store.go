@@ -0,0 +1,333 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/logtail"
+)
+
+const segmentSuffix = ".log"
+
+// A store is the logs of one collection, stored in a directory as a
+// sequence of segment files of JSON log entries, one per line. Each
+// segment is named by its sequence number (e.g. "00000001.log") and
+// is started once the previous one reaches segmentSize bytes. The
+// oldest segments are deleted to keep the total under maxSize bytes.
+//
+// Each stored entry has a "logtail" object with the "server_time" it
+// was received and the "instance" (logtail.PublicID) that sent it.
+type store struct {
+	dir         string
+	segmentSize int64
+	maxSize     int64
+
+	mu   sync.Mutex
+	segs []*segment // oldest first; the last is being appended to
+	f    *os.File   // last segment's file, or nil if not yet opened
+	subs map[chan []byte]bool
+}
+
+// segment is a segment file's metadata.
+type segment struct {
+	seq       int
+	size      int64
+	instances map[logtail.PublicID]*instanceStats
+}
+
+// instanceStats are an instance's logs' stats in a segment, or in
+// the whole store.
+type instanceStats struct {
+	FirstSeen time.Time `json:"first-seen"`
+	Size      int64     `json:"size"`
+}
+
+// storedEntry is the part of a stored log entry the store uses.
+type storedEntry struct {
+	Logtail struct {
+		ServerTime time.Time        `json:"server_time"`
+		Instance   logtail.PublicID `json:"instance"`
+	} `json:"logtail"`
+}
+
+// openStore opens the store in dir, creating dir if needed, and
+// reading the metadata of any existing segments.
+func openStore(dir string, segmentSize, maxSize int64) (*store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	s := &store{
+		dir:         dir,
+		segmentSize: segmentSize,
+		maxSize:     maxSize,
+		subs:        make(map[chan []byte]bool),
+	}
+	for _, fi := range fis {
+		seq, err := strconv.Atoi(strings.TrimSuffix(fi.Name(), segmentSuffix))
+		if err != nil || !strings.HasSuffix(fi.Name(), segmentSuffix) {
+			continue
+		}
+		seg := &segment{seq: seq, size: fi.Size()}
+		if err := s.readSegment(seg, func(line []byte, e *storedEntry) error {
+			seg.add(e, len(line))
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+		s.segs = append(s.segs, seg)
+	}
+	sort.Slice(s.segs, func(i, j int) bool { return s.segs[i].seq < s.segs[j].seq })
+	if len(s.segs) == 0 {
+		s.segs = []*segment{{seq: 1}}
+	}
+	return s, nil
+}
+
+func (seg *segment) add(e *storedEntry, size int) {
+	if seg.instances == nil {
+		seg.instances = make(map[logtail.PublicID]*instanceStats)
+	}
+	st := seg.instances[e.Logtail.Instance]
+	if st == nil {
+		st = &instanceStats{FirstSeen: e.Logtail.ServerTime}
+		seg.instances[e.Logtail.Instance] = st
+	}
+	st.Size += int64(size)
+}
+
+func (s *store) segmentPath(seq int) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%08d%s", seq, segmentSuffix))
+}
+
+// Append appends the JSON lines in b, which must be stored entries,
+// to the store. b is passed to streaming queries, and must not be
+// modified afterwards.
+func (s *store) Append(b []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seg := s.segs[len(s.segs)-1]
+	if seg.size > 0 && seg.size+int64(len(b)) > s.segmentSize {
+		if err := s.startSegmentLocked(); err != nil {
+			return err
+		}
+		seg = s.segs[len(s.segs)-1]
+	}
+	if s.f == nil {
+		f, err := os.OpenFile(s.segmentPath(seg.seq), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		s.f = f
+	}
+	n, err := s.f.Write(b)
+	seg.size += int64(n)
+	if err != nil {
+		return err
+	}
+	for _, line := range bytes.SplitAfter(b, []byte("\n")) {
+		var e storedEntry
+		if json.Unmarshal(line, &e) == nil {
+			seg.add(&e, len(line))
+		}
+	}
+	for c := range s.subs {
+		select {
+		case c <- b:
+		default:
+			// The subscriber isn't keeping up; drop it.
+			delete(s.subs, c)
+			close(c)
+		}
+	}
+	return nil
+}
+
+// startSegmentLocked closes the last segment, starts a new one, and
+// deletes the oldest segments while over maxSize.
+func (s *store) startSegmentLocked() error {
+	if s.f != nil {
+		if err := s.f.Close(); err != nil {
+			return err
+		}
+		s.f = nil
+	}
+	s.segs = append(s.segs, &segment{seq: s.segs[len(s.segs)-1].seq + 1})
+
+	var total int64
+	for _, seg := range s.segs {
+		total += seg.size
+	}
+	for len(s.segs) > 1 && total > s.maxSize {
+		old := s.segs[0]
+		if err := os.Remove(s.segmentPath(old.seq)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		total -= old.size
+		s.segs = s.segs[1:]
+	}
+	return nil
+}
+
+// Instances returns the stats of the logs of each instance in the
+// store.
+func (s *store) Instances() map[logtail.PublicID]*instanceStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := make(map[logtail.PublicID]*instanceStats)
+	for _, seg := range s.segs {
+		for id, st := range seg.instances {
+			if all, ok := ret[id]; ok {
+				all.Size += st.Size
+			} else {
+				ret[id] = &instanceStats{FirstSeen: st.FirstSeen, Size: st.Size}
+			}
+		}
+	}
+	return ret
+}
+
+// query are the parameters of a store query.
+type query struct {
+	instances map[logtail.PublicID]bool // if non-empty, only these instances
+	start     time.Time                 // if non-zero, only entries received at or after
+	end       time.Time                 // if non-zero, only entries received at or before
+	maxCount  int                       // if non-zero, the maximum number of entries
+	stream    bool                      // whether to keep returning entries as they're appended
+}
+
+func (q *query) matches(e *storedEntry) bool {
+	t := e.Logtail.ServerTime
+	if !q.start.IsZero() && t.Before(q.start) {
+		return false
+	}
+	if !q.end.IsZero() && t.After(q.end) {
+		return false
+	}
+	return len(q.instances) == 0 || q.instances[e.Logtail.Instance]
+}
+
+// errLagging is returned by Query when a streaming query can't keep
+// up with the logs being appended.
+var errLagging = errors.New("stream fell behind")
+
+// Query calls fn with each log entry line (ending in a newline)
+// matching q, oldest first. Streaming queries return only once ctx
+// is done, fn fails, or fn is too slow to keep up.
+func (s *store) Query(ctx context.Context, q query, fn func(line []byte) error) error {
+	s.mu.Lock()
+	// Copy the segments, as the last one keeps growing.
+	segs := make([]segment, len(s.segs))
+	for i, seg := range s.segs {
+		segs[i] = segment{seq: seg.seq, size: seg.size}
+	}
+	var sub chan []byte
+	if q.stream {
+		sub = make(chan []byte, 256)
+		s.subs[sub] = true
+		defer func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			delete(s.subs, sub)
+		}()
+	}
+	s.mu.Unlock()
+
+	count := 0
+	errDone := errors.New("done")
+	visit := func(line []byte, e *storedEntry) error {
+		if !q.matches(e) {
+			return nil
+		}
+		if err := fn(line); err != nil {
+			return err
+		}
+		count++
+		if q.maxCount > 0 && count >= q.maxCount {
+			return errDone
+		}
+		return nil
+	}
+	for i := range segs {
+		if err := s.readSegment(&segs[i], visit); err == errDone {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	if !q.stream {
+		return nil
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case b, ok := <-sub:
+			if !ok {
+				return errLagging
+			}
+			for _, line := range bytes.SplitAfter(b, []byte("\n")) {
+				var e storedEntry
+				if json.Unmarshal(line, &e) != nil {
+					continue
+				}
+				if err := visit(line, &e); err == errDone {
+					return nil
+				} else if err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// readSegment calls fn with each line of the first seg.size bytes of
+// the segment, and the line parsed as a stored entry, skipping lines
+// that can't be parsed. A missing segment, deleted as too old, has
+// no lines.
+func (s *store) readSegment(seg *segment, fn func(line []byte, e *storedEntry) error) error {
+	f, err := os.Open(s.segmentPath(seg.seq))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	br := bufio.NewReader(io.LimitReader(f, seg.size))
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			// Ignore any partially written last line.
+			return nil
+		} else if err != nil {
+			return err
+		}
+		var e storedEntry
+		if json.Unmarshal(line, &e) != nil {
+			continue
+		}
+		if err := fn(line, &e); err != nil {
+			return err
+		}
+	}
+}
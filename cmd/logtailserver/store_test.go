@@ -0,0 +1,105 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"tailscale.com/logtail"
+)
+
+func TestStoreSegments(t *testing.T) {
+	dir := t.TempDir()
+	const segSize, maxSize = 1000, 2500
+	s, err := openStore(dir, segSize, maxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var a, b logtail.PublicID
+	a[0], b[0] = 'a', 'b'
+	start := time.Date(2021, 7, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 40; i++ {
+		id := a
+		if i%2 == 1 {
+			id = b
+		}
+		msg := fmt.Sprintf(`{"text":"%03d"}`, i)
+		line, err := storedLines([]byte(msg), id, start.Add(time.Duration(i)*time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Append(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	texts := func(s *store, q query) string {
+		t.Helper()
+		var ret []string
+		err := s.Query(context.Background(), q, func(line []byte) error {
+			var e testEntry
+			if err := json.Unmarshal(line, &e); err != nil {
+				return err
+			}
+			ret = append(ret, e.Text)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Join(ret, ",")
+	}
+
+	// Each entry is 142 bytes, so segments hold 7 entries, and only
+	// the newest 2 full segments plus the current one fit in maxSize.
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, fi := range fis {
+		names = append(names, fi.Name())
+	}
+	if got, want := strings.Join(names, ","), "00000004.log,00000005.log,00000006.log"; got != want {
+		t.Errorf("segments = %s; want %s", got, want)
+	}
+	all := texts(s, query{})
+	if got, want := all, "021,022,023,024,025,026,027,028,029,030,031,032,033,034,035,036,037,038,039"; got != want {
+		t.Errorf("all = %s; want %s", got, want)
+	}
+	if got, want := texts(s, query{
+		instances: map[logtail.PublicID]bool{b: true},
+		start:     start.Add(30 * time.Second),
+		end:       start.Add(36 * time.Second),
+	}), "031,033,035"; got != want {
+		t.Errorf("filtered = %s; want %s", got, want)
+	}
+	if got, want := texts(s, query{maxCount: 2}), "021,022"; got != want {
+		t.Errorf("maxCount = %s; want %s", got, want)
+	}
+
+	insts := s.Instances()
+	if len(insts) != 2 || !insts[a].FirstSeen.Equal(start.Add(22*time.Second)) || !insts[b].FirstSeen.Equal(start.Add(21*time.Second)) {
+		t.Errorf("instances = %v", insts)
+	}
+
+	// Reopening the store finds the same logs.
+	s2, err := openStore(dir, segSize, maxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := texts(s2, query{}); got != all {
+		t.Errorf("after reopening, all = %s; want %s", got, all)
+	}
+	if got := s2.Instances(); fmt.Sprint(got[a], got[b]) != fmt.Sprint(insts[a], insts[b]) {
+		t.Errorf("after reopening, instances = %v; want %v", got, insts)
+	}
+}
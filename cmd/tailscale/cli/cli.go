@@ -133,15 +133,20 @@ change in the future.
 			upCmd,
 			downCmd,
 			logoutCmd,
+			switchCmd,
 			netcheckCmd,
 			ipCmd,
 			statusCmd,
+			whoisCmd,
+			exitNodeCmd,
 			pingCmd,
+			ncCmd,
 			versionCmd,
 			webCmd,
 			fileCmd,
 			bugReportCmd,
 			certCmd,
+			serveCmd,
 		},
 		FlagSet:   rootfs,
 		Exec:      func(context.Context, []string) error { return flag.ErrHelp },
@@ -173,6 +173,24 @@ func TestCheckForAccidentalSettingReverts(t *testing.T) {
 			},
 			want: "",
 		},
+		{
+			name:  "error_advertised_routes_nosnat_removed",
+			flags: []string{"--advertise-routes=10.0.42.0/24,10.0.43.0/24"},
+			curPrefs: &ipn.Prefs{
+				ControlURL:       ipn.DefaultControlURL,
+				AllowSingleHosts: true,
+				CorpDNS:          true,
+				NetfilterMode:    preftype.NetfilterOn,
+				AdvertiseRoutes: []netaddr.IPPrefix{
+					netaddr.MustParseIPPrefix("10.0.42.0/24"),
+					netaddr.MustParseIPPrefix("10.0.43.0/24"),
+				},
+				NoSNATRoutes: []netaddr.IPPrefix{
+					netaddr.MustParseIPPrefix("10.0.43.0/24"),
+				},
+			},
+			want: accidentalUpPrefix + " --advertise-routes=10.0.42.0/24,10.0.43.0/24:nosnat",
+		},
 		{
 			name:  "advertised_routes_includes_the_0_routes", // but no --advertise-exit-node
 			flags: []string{"--advertise-routes=11.1.43.0/24,0.0.0.0/0,::/0"},
@@ -405,6 +423,21 @@ func TestCheckForAccidentalSettingReverts(t *testing.T) {
 			},
 			want: accidentalUpPrefix + " --hostname=foo --exit-node=100.64.5.7",
 		},
+		{
+			name:          "error_exit_node_omit_with_auto_pref",
+			flags:         []string{"--hostname=foo"},
+			curExitNodeIP: netaddr.MustParseIP("100.64.5.7"),
+			curPrefs: &ipn.Prefs{
+				ControlURL:       ipn.DefaultControlURL,
+				AllowSingleHosts: true,
+				CorpDNS:          true,
+				NetfilterMode:    preftype.NetfilterOn,
+
+				ExitNodeID:   "some_stable_id",
+				AutoExitNode: true,
+			},
+			want: accidentalUpPrefix + " --hostname=foo --exit-node=auto",
+		},
 		{
 			name:  "ignore_login_server_synonym",
 			flags: []string{"--login-server=https://controlplane.tailscale.com"},
@@ -513,6 +546,33 @@ func TestPrefsFromUpArgs(t *testing.T) {
 				NetfilterMode: preftype.NetfilterOn,
 			},
 		},
+		{
+			name: "advertise_routes_nosnat",
+			args: upArgsFromOSArgs("linux", "--advertise-routes=fd00:1::/64:nosnat,10.0.0.0/8,10.1.0.0/16:nosnat"),
+			want: &ipn.Prefs{
+				ControlURL:       ipn.DefaultControlURL,
+				WantRunning:      true,
+				AllowSingleHosts: true,
+				CorpDNS:          true,
+				AdvertiseRoutes: []netaddr.IPPrefix{
+					netaddr.MustParseIPPrefix("10.0.0.0/8"),
+					netaddr.MustParseIPPrefix("10.1.0.0/16"),
+					netaddr.MustParseIPPrefix("fd00:1::/64"),
+				},
+				NoSNATRoutes: []netaddr.IPPrefix{
+					netaddr.MustParseIPPrefix("10.1.0.0/16"),
+					netaddr.MustParseIPPrefix("fd00:1::/64"),
+				},
+				NetfilterMode: preftype.NetfilterOn,
+			},
+		},
+		{
+			name: "error_advertise_route_exit_node_nosnat",
+			args: upArgsT{
+				advertiseRoutes: "0.0.0.0/0:nosnat,::/0",
+			},
+			wantErr: `"0.0.0.0/0:nosnat": exit node routes are always source NATed`,
+		},
 		{
 			name: "error_advertise_route_invalid_ip",
 			args: upArgsT{
@@ -527,6 +587,19 @@ func TestPrefsFromUpArgs(t *testing.T) {
 			},
 			wantErr: `1.2.3.4/16 has non-address bits set; expected 1.2.0.0/16`,
 		},
+		{
+			name: "exit_node_auto",
+			args: upArgsFromOSArgs("linux", "--exit-node=auto", "--exit-node-allow-lan-access"),
+			want: &ipn.Prefs{
+				ControlURL:             ipn.DefaultControlURL,
+				WantRunning:            true,
+				AllowSingleHosts:       true,
+				CorpDNS:                true,
+				AutoExitNode:           true,
+				ExitNodeAllowLANAccess: true,
+				NetfilterMode:          preftype.NetfilterOn,
+			},
+		},
 		{
 			name: "error_exit_node_bad_ip",
 			args: upArgsT{
@@ -673,6 +746,9 @@ func TestPrefFlagMapping(t *testing.T) {
 		case "NotepadURLs":
 			// TODO(bradfitz): https://github.com/tailscale/tailscale/issues/1830
 			continue
+		case "Serve":
+			// Managed by "tailscale serve"; carried over by updatePrefs.
+			continue
 		}
 		t.Errorf("unexpected new ipn.Pref field %q is not handled by up.go (see addPrefFlagMapping and checkForAccidentalSettingReverts)", prefName)
 	}
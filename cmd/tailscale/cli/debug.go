@@ -15,6 +15,7 @@ import (
 	"os"
 	"runtime"
 	"strings"
+	"time"
 
 	"github.com/peterbourgon/ff/v3/ffcli"
 	"tailscale.com/client/tailscale"
@@ -51,6 +52,25 @@ var debugCmd = &ffcli.Command{
 			Exec:      runDaemonMetrics,
 			ShortHelp: "print tailscaled's metrics",
 		},
+		{
+			Name:       "filter",
+			Exec:       runDebugFilter,
+			ShortHelp:  "print packet filter rules and counters, or check a flow",
+			ShortUsage: "filter [<src-ip:port> <dst-ip:port>[/<proto>]]",
+			LongHelp: strings.TrimSpace(`
+With no arguments, "tailscale debug filter" prints the packet filter's
+rules, how many packets each rule has accepted, how many packets have
+been dropped for each reason, and the flows tracked by its connection
+tracker. Flow packet and byte counts are shown as in/out.
+
+With a source and destination, it reports whether the packet filter
+would allow a new flow from the peer address src to the local address
+dst, and by which rule. The protocol is one of tcp (the default), udp,
+sctp or icmp, or an IP protocol number:
+
+  tailscale debug filter 100.101.102.103:40000 100.64.0.1:22/tcp
+`),
+		},
 		{
 			Name:      "env",
 			Exec:      runEnv,
@@ -259,3 +279,52 @@ func runDaemonMetrics(ctx context.Context, args []string) error {
 	Stdout.Write(out)
 	return nil
 }
+
+func runDebugFilter(ctx context.Context, args []string) error {
+	switch len(args) {
+	case 0:
+		st, err := tailscale.DebugFilter(ctx)
+		if err != nil {
+			return err
+		}
+		if st.ShieldsUp {
+			outln("shields up: all incoming connections are blocked")
+		}
+		printf("Rules:\n")
+		for i, r := range st.Rules {
+			printf("  %3d  %10d  %s\n", i, r.Hits, r.Rule)
+		}
+		printf("Drops:\n")
+		for _, d := range st.Drops {
+			printf("  %-28s in=%d out=%d\n", d.Reason, d.In, d.Out)
+		}
+		printf("Flows:\n")
+		for _, fl := range st.Flows {
+			dir := "in "
+			if fl.Outbound {
+				dir = "out"
+			}
+			printf("  %s %-6s %21s -> %-21s %-11s pkts=%d/%d bytes=%d/%d expires=%v\n",
+				dir, fl.Proto, fl.Src, fl.Dst, fl.TCPState,
+				fl.PacketsIn, fl.PacketsOut, fl.BytesIn, fl.BytesOut,
+				time.Until(fl.Expires).Round(time.Second))
+		}
+		return nil
+	case 2:
+		dst, proto := args[1], "tcp"
+		if i := strings.LastIndex(dst, "/"); i != -1 {
+			dst, proto = dst[:i], dst[i+1:]
+		}
+		res, err := tailscale.DebugFilterCheck(ctx, args[0], dst, proto)
+		if err != nil {
+			return err
+		}
+		printf("%s (%s)\n", res.Verdict, res.Reason)
+		if res.Rule >= 0 {
+			printf("rule %d: %s\n", res.Rule, res.RuleText)
+		}
+		return nil
+	default:
+		return errors.New("usage: filter [<src-ip:port> <dst-ip:port>[/<proto>]]")
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/util/dnsname"
+)
+
+var exitNodeCmd = &ffcli.Command{
+	Name:       "exit-node",
+	ShortUsage: "exit-node list [--json]",
+	ShortHelp:  "Show exit nodes",
+	LongHelp: strings.TrimSpace(`
+"tailscale exit-node list" lists the peers offering to be an exit node,
+best first, as ranked for "tailscale up --exit-node=auto": online nodes
+by latency, measured by ping where possible and otherwise estimated
+from the latency to the node's home DERP region.
+`),
+	Subcommands: []*ffcli.Command{
+		exitNodeListCmd,
+	},
+	Exec: func(context.Context, []string) error {
+		return errors.New("exit-node subcommand required; run 'tailscale exit-node -h' for details")
+	},
+}
+
+var exitNodeListCmd = &ffcli.Command{
+	Name:       "list",
+	ShortUsage: "exit-node list [--json]",
+	ShortHelp:  "List exit nodes, best first",
+	Exec:       runExitNodeList,
+	FlagSet: (func() *flag.FlagSet {
+		fs := newFlagSet("list")
+		fs.BoolVar(&exitNodeArgs.json, "json", false, "output in JSON format")
+		return fs
+	})(),
+}
+
+var exitNodeArgs struct {
+	json bool
+}
+
+func runExitNodeList(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("too many arguments")
+	}
+	st, err := tailscale.Status(ctx)
+	if err != nil {
+		return fixTailscaledConnectError(err)
+	}
+	if exitNodeArgs.json {
+		cands := st.ExitNodeCandidates
+		if cands == nil {
+			cands = []*ipnstate.ExitNodeCandidate{}
+		}
+		j, err := json.MarshalIndent(cands, "", "  ")
+		if err != nil {
+			return err
+		}
+		printf("%s\n", j)
+		return nil
+	}
+	if len(st.ExitNodeCandidates) == 0 {
+		outln("No exit nodes found.")
+		return nil
+	}
+	if st.AutoExitNode {
+		outln("# Exit node is picked automatically.")
+	}
+	tw := tabwriter.NewWriter(Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "IP\tHOSTNAME\tLATENCY\tSTATUS")
+	for _, c := range st.ExitNodeCandidates {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n",
+			firstIPString(c.TailscaleIPs),
+			dnsname.TrimSuffix(c.DNSName, st.MagicDNSSuffix),
+			exitNodeLatency(c),
+			exitNodeStatus(c),
+		)
+	}
+	return tw.Flush()
+}
+
+// exitNodeStatus returns "selected", "offline" or "-" for c.
+func exitNodeStatus(c *ipnstate.ExitNodeCandidate) string {
+	switch {
+	case c.Selected:
+		return "selected"
+	case !c.Online:
+		return "offline"
+	}
+	return "-"
+}
+
+// exitNodeLatency returns the latency of c for display, such as
+// "12ms (ping)", or "-" if it's unknown.
+func exitNodeLatency(c *ipnstate.ExitNodeCandidate) string {
+	if c.LatencySeconds == 0 {
+		return "-"
+	}
+	d := time.Duration(c.LatencySeconds * float64(time.Second)).Round(100 * time.Microsecond)
+	return fmt.Sprintf("%v (%s)", d, c.LatencySource)
+}
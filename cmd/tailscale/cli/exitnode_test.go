@@ -0,0 +1,31 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"testing"
+
+	"tailscale.com/ipn/ipnstate"
+)
+
+func TestExitNodeLatencyAndStatus(t *testing.T) {
+	tests := []struct {
+		c           ipnstate.ExitNodeCandidate
+		wantLatency string
+		wantStatus  string
+	}{
+		{ipnstate.ExitNodeCandidate{Online: true}, "-", "-"},
+		{ipnstate.ExitNodeCandidate{Online: true, Selected: true, LatencySeconds: 0.01234, LatencySource: "ping"}, "12.3ms (ping)", "selected"},
+		{ipnstate.ExitNodeCandidate{LatencySeconds: 0.08, LatencySource: "derp"}, "80ms (derp)", "offline"},
+	}
+	for _, tt := range tests {
+		if got := exitNodeLatency(&tt.c); got != tt.wantLatency {
+			t.Errorf("exitNodeLatency(%+v) = %q; want %q", tt.c, got, tt.wantLatency)
+		}
+		if got := exitNodeStatus(&tt.c); got != tt.wantStatus {
+			t.Errorf("exitNodeStatus(%+v) = %q; want %q", tt.c, got, tt.wantStatus)
+		}
+	}
+}
@@ -7,9 +7,13 @@ package cli
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"log"
@@ -24,12 +28,14 @@ import (
 	"unicode/utf8"
 
 	"github.com/peterbourgon/ff/v3/ffcli"
+	"golang.org/x/term"
 	"golang.org/x/time/rate"
 	"inet.af/netaddr"
 	"tailscale.com/client/tailscale"
 	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/ipn"
 	"tailscale.com/net/tsaddr"
+	"tailscale.com/util/dirtar"
 	"tailscale.com/version"
 )
 
@@ -53,10 +59,18 @@ var fileCpCmd = &ffcli.Command{
 	Name:       "cp",
 	ShortUsage: "file cp <files...> <target>:",
 	ShortHelp:  "Copy file(s) to a host",
-	Exec:       runCp,
+	LongHelp: strings.TrimSpace(`
+"tailscale file cp" sends files to another of your devices, which checks
+each file's SHA-256 before accepting it. If a send is interrupted, running
+the same command again resumes it where it stopped.
+
+A directory is sent as a whole, as is a list of files given a --name,
+which the other device receives as a directory of that name.
+`),
+	Exec: runCp,
 	FlagSet: (func() *flag.FlagSet {
 		fs := newFlagSet("cp")
-		fs.StringVar(&cpArgs.name, "name", "", "alternate filename to use, especially useful when <file> is \"-\" (stdin)")
+		fs.StringVar(&cpArgs.name, "name", "", "alternate filename to use, especially useful when <file> is \"-\" (stdin); with multiple files, the name of a directory to send them in")
 		fs.BoolVar(&cpArgs.verbose, "verbose", false, "verbose output")
 		fs.BoolVar(&cpArgs.targets, "targets", false, "list possible file cp targets")
 		return fs
@@ -105,78 +119,319 @@ func runCp(ctx context.Context, args []string) error {
 	}
 
 	if len(files) > 1 {
-		if cpArgs.name != "" {
-			return errors.New("can't use --name= with multiple files")
-		}
 		for _, fileArg := range files {
 			if fileArg == "-" {
 				return errors.New("can't use '-' as STDIN file when providing filename arguments")
 			}
 		}
+		if cpArgs.name != "" {
+			// Send them together, as one directory.
+			return sendTree(ctx, peerAPIBase, cpArgs.name, func(w io.Writer) error {
+				return dirtar.WriteFiles(w, files)
+			})
+		}
 	}
 
 	for _, fileArg := range files {
-		var fileContents io.Reader
-		var name = cpArgs.name
-		var contentLength int64 = -1
-		if fileArg == "-" {
-			fileContents = os.Stdin
-			if name == "" {
-				name, fileContents, err = pickStdinFilename()
-				if err != nil {
-					return err
-				}
-			}
-		} else {
-			f, err := os.Open(fileArg)
-			if err != nil {
-				if version.IsSandboxedMacOS() {
-					return errors.New("the GUI version of Tailscale on macOS runs in a macOS sandbox that can't read files")
-				}
-				return err
-			}
-			defer f.Close()
-			fi, err := f.Stat()
+		if err := sendFile(ctx, peerAPIBase, fileArg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendFile sends fileArg, a file or directory name or "-" for stdin,
+// to the peer API at peerAPIBase. If the peer has part of the file
+// from an earlier send, only the rest is sent.
+func sendFile(ctx context.Context, peerAPIBase, fileArg string) error {
+	u := upload{
+		name:          cpArgs.name,
+		contentLength: -1,
+	}
+	if fileArg == "-" {
+		u.body = os.Stdin
+		if u.name == "" {
+			var err error
+			u.name, u.body, err = pickStdinFilename()
 			if err != nil {
 				return err
 			}
-			if fi.IsDir() {
-				return errors.New("directories not supported")
-			}
-			contentLength = fi.Size()
-			fileContents = io.LimitReader(f, contentLength)
-			if name == "" {
-				name = filepath.Base(fileArg)
-			}
-
-			if slow, _ := strconv.ParseBool(os.Getenv("TS_DEBUG_SLOW_PUSH")); slow {
-				fileContents = &slowReader{r: fileContents}
-			}
 		}
+		return u.put(ctx, peerAPIBase)
+	}
+	f, err := os.Open(fileArg)
+	if err != nil {
+		if version.IsSandboxedMacOS() {
+			return errors.New("the GUI version of Tailscale on macOS runs in a macOS sandbox that can't read files")
+		}
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if u.name == "" {
+		u.name = filepath.Base(fileArg)
+	}
+	if fi.IsDir() {
+		return sendTree(ctx, peerAPIBase, u.name, func(w io.Writer) error {
+			return dirtar.WriteDir(w, fileArg)
+		})
+	}
+	u.offset, u.sum, err = resumeOffset(ctx, peerAPIBase, u.name, f)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(u.offset, io.SeekStart); err != nil {
+		return err
+	}
+	u.contentLength = fi.Size() - u.offset
+	u.body = io.LimitReader(f, u.contentLength)
 
-		dstURL := peerAPIBase + "/v0/put/" + url.PathEscape(name)
-		req, err := http.NewRequestWithContext(ctx, "PUT", dstURL, fileContents)
-		if err != nil {
-			return err
+	if slow, _ := strconv.ParseBool(os.Getenv("TS_DEBUG_SLOW_PUSH")); slow {
+		u.body = &slowReader{r: u.body}
+	}
+	return u.put(ctx, peerAPIBase)
+}
+
+// sendTree sends the tar archive written by write to the peer API at
+// peerAPIBase, to be received as the directory name.
+func sendTree(ctx context.Context, peerAPIBase, name string, write func(io.Writer) error) error {
+	if _, ok, err := getPartial(ctx, peerAPIBase, name); err != nil {
+		return err
+	} else if !ok {
+		return errors.New("target's Tailscale version is too old to receive directories")
+	}
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	go func() {
+		pw.CloseWithError(write(pw))
+	}()
+	u := upload{
+		name:          name,
+		body:          pr,
+		contentLength: -1,
+		contentType:   dirtar.ContentType,
+	}
+	return u.put(ctx, peerAPIBase)
+}
+
+// upload is a file or directory to PUT to a peer.
+type upload struct {
+	name          string
+	body          io.Reader
+	contentLength int64  // of body, or -1 if unknown
+	offset        int64  // where body starts in the file, to resume a send
+	sum           string // hex SHA-256 of the whole file, if known up front
+	contentType   string // or empty for a file
+}
+
+func (u *upload) put(ctx context.Context, peerAPIBase string) error {
+	dstURL := peerAPIBase + "/v0/put/" + url.PathEscape(u.name)
+	if u.offset > 0 {
+		dstURL += "?offset=" + strconv.FormatInt(u.offset, 10)
+	}
+	body := u.body
+	var trailer http.Header
+	if u.sum == "" {
+		// Send the checksum after the contents instead.
+		trailer = http.Header{apitype.FileSHA256Header: nil}
+		body = &trailerHashReader{r: body, h: sha256.New(), trailer: trailer}
+	}
+	var pr *progressReader
+	if stderrIsTerminal() {
+		pr = &progressReader{
+			r: body,
+			pf: ipn.PartialFile{
+				Name:         u.name,
+				Started:      time.Now(),
+				DeclaredSize: -1,
+				Received:     u.offset,
+			},
+			offset: u.offset,
 		}
-		req.ContentLength = contentLength
-		if cpArgs.verbose {
+		if u.contentLength >= 0 {
+			pr.pf.DeclaredSize = u.offset + u.contentLength
+		}
+		body = pr
+	}
+	req, err := http.NewRequestWithContext(ctx, "PUT", dstURL, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = u.contentLength
+	if u.sum != "" {
+		req.Header.Set(apitype.FileSHA256Header, u.sum)
+	}
+	if u.contentType != "" {
+		req.Header.Set("Content-Type", u.contentType)
+	}
+	req.Trailer = trailer
+	if cpArgs.verbose {
+		if u.offset > 0 {
+			log.Printf("resuming send to %v at byte %d ...", dstURL, u.offset)
+		} else {
 			log.Printf("sending to %v ...", dstURL)
 		}
-		res, err := http.DefaultClient.Do(req)
-		if err != nil {
-			return err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if pr != nil {
+		pr.done()
+	}
+	if err != nil {
+		return err
+	}
+	if res.StatusCode == 200 {
+		io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+		return nil
+	}
+	io.Copy(Stdout, res.Body)
+	res.Body.Close()
+	return errors.New(res.Status)
+}
+
+// getPartial returns what the peer API at peerAPIBase has of the file
+// name from an earlier, interrupted send. It reports false if the peer
+// is too old to resume sends or receive directories.
+func getPartial(ctx context.Context, peerAPIBase, name string) (pf apitype.PartialFile, ok bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", peerAPIBase+"/v0/put/"+url.PathEscape(name), nil)
+	if err != nil {
+		return pf, false, err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return pf, false, err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+		if err := json.NewDecoder(res.Body).Decode(&pf); err != nil {
+			return pf, false, fmt.Errorf("invalid JSON from peer: %w", err)
 		}
-		if res.StatusCode == 200 {
-			io.Copy(ioutil.Discard, res.Body)
-			res.Body.Close()
-			continue
+		return pf, true, nil
+	case http.StatusMethodNotAllowed:
+		return pf, false, nil
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1<<10))
+	return pf, false, fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(body)))
+}
+
+// resumeOffset asks the peer API at peerAPIBase how much of the file
+// name it has from an earlier send of f, which must be at its start.
+// It returns the offset to send f from and f's hex SHA-256. The offset
+// is 0 if the peer has none of f, has some other file's bytes, or is
+// too old to resume sends.
+func resumeOffset(ctx context.Context, peerAPIBase, name string, f *os.File) (offset int64, sum string, err error) {
+	pf, _, err := getPartial(ctx, peerAPIBase, name)
+	if err != nil {
+		return 0, "", err
+	}
+	h := sha256.New()
+	if pf.Size > 0 {
+		_, err := io.CopyN(h, f, pf.Size)
+		if err == nil && strings.EqualFold(hex.EncodeToString(h.Sum(nil)), pf.SHA256) {
+			offset = pf.Size
+		} else if err != nil && err != io.EOF {
+			return 0, "", err
 		}
-		io.Copy(Stdout, res.Body)
-		res.Body.Close()
-		return errors.New(res.Status)
 	}
-	return nil
+	if _, err := io.Copy(h, f); err != nil {
+		return 0, "", err
+	}
+	return offset, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// trailerHashReader hashes what's read from r and, at EOF, sets the
+// hex hash in trailer for the peer to check.
+type trailerHashReader struct {
+	r       io.Reader
+	h       hash.Hash
+	trailer http.Header
+}
+
+func (r *trailerHashReader) Read(p []byte) (n int, err error) {
+	n, err = r.r.Read(p)
+	r.h.Write(p[:n])
+	if err == io.EOF {
+		r.trailer.Set(apitype.FileSHA256Header, hex.EncodeToString(r.h.Sum(nil)))
+	}
+	return
+}
+
+func stderrIsTerminal() bool {
+	f, ok := Stderr.(*os.File)
+	return ok && term.IsTerminal(int(f.Fd()))
+}
+
+// progressReader shows the progress of a file send on Stderr, which
+// must be a terminal.
+type progressReader struct {
+	r      io.Reader
+	pf     ipn.PartialFile
+	offset int64 // bytes the peer had before this send
+
+	last    time.Time // of last update
+	lastLen int       // of last progress line
+}
+
+func (r *progressReader) Read(p []byte) (n int, err error) {
+	n, err = r.r.Read(p)
+	r.pf.Received += int64(n)
+	if now := time.Now(); now.Sub(r.last) >= time.Second/4 {
+		r.last = now
+		r.show(now)
+	}
+	return
+}
+
+func (r *progressReader) show(now time.Time) {
+	line := progressLine(r.pf, r.offset, now)
+	pad := r.lastLen - len(line)
+	if pad < 0 {
+		pad = 0
+	}
+	r.lastLen = len(line)
+	fmt.Fprintf(Stderr, "\r%s%s", line, strings.Repeat(" ", pad))
+}
+
+// done shows the final progress and ends the progress line.
+func (r *progressReader) done() {
+	r.show(time.Now())
+	fmt.Fprintln(Stderr)
+}
+
+// progressLine returns a line of progress of sending pf, such as
+// "foo.jpg  45%  1.2 GB/2.6 GB  12.3 MB/s". offset is how much of pf
+// the peer had before this send, which doesn't count to the rate.
+func progressLine(pf ipn.PartialFile, offset int64, now time.Time) string {
+	var sb strings.Builder
+	sb.WriteString(pf.Name)
+	if pf.DeclaredSize > 0 {
+		fmt.Fprintf(&sb, "  %3d%%  %s/%s", pf.Received*100/pf.DeclaredSize, formatSize(pf.Received), formatSize(pf.DeclaredSize))
+	} else {
+		fmt.Fprintf(&sb, "  %s", formatSize(pf.Received))
+	}
+	if d := now.Sub(pf.Started).Seconds(); d > 0 {
+		fmt.Fprintf(&sb, "  %s/s", formatSize(int64(float64(pf.Received-offset)/d)))
+	}
+	return sb.String()
+}
+
+// formatSize formats n bytes with a decimal SI unit, such as "1.2 MB".
+func formatSize(n int64) string {
+	const units = "kMGTPE"
+	if n < 1000 {
+		return fmt.Sprintf("%d B", n)
+	}
+	f := float64(n)
+	i := -1
+	for f >= 1000 && i < len(units)-1 {
+		f /= 1000
+		i++
+	}
+	return fmt.Sprintf("%.1f %cB", f, units[i])
 }
 
 func discoverPeerAPIBase(ctx context.Context, ipStr string) (base string, isOffline bool, err error) {
@@ -356,23 +611,21 @@ func runFileGet(ctx context.Context, args []string) error {
 			return fmt.Errorf("opening inbox file %q: %v", wf.Name, err)
 		}
 		targetFile := filepath.Join(dir, wf.Name)
-		of, err := os.OpenFile(targetFile, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
-		if err != nil {
-			if _, err := os.Stat(targetFile); err == nil {
-				return fmt.Errorf("refusing to overwrite %v", targetFile)
-			}
-			return err
+		if wf.Dir {
+			err = getWaitingDir(targetFile, rc)
+		} else {
+			err = getWaitingFile(targetFile, rc)
 		}
-		_, err = io.Copy(of, rc)
 		rc.Close()
 		if err != nil {
-			return fmt.Errorf("failed to write %v: %v", targetFile, err)
-		}
-		if err := of.Close(); err != nil {
 			return err
 		}
 		if getArgs.verbose {
-			log.Printf("wrote %v (%d bytes)", wf.Name, size)
+			if wf.Dir {
+				log.Printf("wrote directory %v (%d bytes)", wf.Name, wf.Size)
+			} else {
+				log.Printf("wrote %v (%d bytes)", wf.Name, size)
+			}
 		}
 		if err := tailscale.DeleteWaitingFile(ctx, wf.Name); err != nil {
 			return fmt.Errorf("deleting %q from inbox: %v", wf.Name, err)
@@ -385,6 +638,33 @@ func runFileGet(ctx context.Context, args []string) error {
 	return nil
 }
 
+func getWaitingFile(targetFile string, r io.Reader) error {
+	of, err := os.OpenFile(targetFile, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		if _, err := os.Stat(targetFile); err == nil {
+			return fmt.Errorf("refusing to overwrite %v", targetFile)
+		}
+		return err
+	}
+	if _, err := io.Copy(of, r); err != nil {
+		of.Close()
+		return fmt.Errorf("failed to write %v: %v", targetFile, err)
+	}
+	return of.Close()
+}
+
+// getWaitingDir extracts r, a waiting directory as a tar archive, to
+// targetDir.
+func getWaitingDir(targetDir string, r io.Reader) error {
+	if _, err := os.Stat(targetDir); err == nil {
+		return fmt.Errorf("refusing to overwrite %v", targetDir)
+	}
+	if err := dirtar.Extract(r, targetDir, nil); err != nil {
+		return fmt.Errorf("failed to write %v: %v", targetDir, err)
+	}
+	return nil
+}
+
 func wipeInbox(ctx context.Context) error {
 	if getArgs.wait {
 		return errors.New("can't use --wait with /dev/null target")
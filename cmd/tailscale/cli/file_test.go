@@ -0,0 +1,68 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"testing"
+	"time"
+
+	"tailscale.com/ipn"
+)
+
+func TestFormatSize(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{0, "0 B"},
+		{999, "999 B"},
+		{1000, "1.0 kB"},
+		{1234567, "1.2 MB"},
+		{2600000000, "2.6 GB"},
+	}
+	for _, tt := range tests {
+		if got := formatSize(tt.n); got != tt.want {
+			t.Errorf("formatSize(%d) = %q; want %q", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestProgressLine(t *testing.T) {
+	start := time.Unix(1000, 0)
+	tests := []struct {
+		name   string
+		pf     ipn.PartialFile
+		offset int64
+		now    time.Time
+		want   string
+	}{
+		{
+			name: "known_size",
+			pf:   ipn.PartialFile{Name: "foo.jpg", Started: start, DeclaredSize: 2000000, Received: 500000},
+			now:  start.Add(2 * time.Second),
+			want: "foo.jpg   25%  500.0 kB/2.0 MB  250.0 kB/s",
+		},
+		{
+			name:   "resumed",
+			pf:     ipn.PartialFile{Name: "foo.jpg", Started: start, DeclaredSize: 2000000, Received: 1500000},
+			offset: 1000000,
+			now:    start.Add(2 * time.Second),
+			want:   "foo.jpg   75%  1.5 MB/2.0 MB  250.0 kB/s",
+		},
+		{
+			name: "unknown_size",
+			pf:   ipn.PartialFile{Name: "stdin.txt", Started: start, DeclaredSize: -1, Received: 42},
+			now:  start,
+			want: "stdin.txt  42 B",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := progressLine(tt.pf, tt.offset, tt.now); got != tt.want {
+				t.Errorf("got %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"tailscale.com/client/tailscale"
+)
+
+var ncCmd = &ffcli.Command{
+	Name:       "nc",
+	ShortUsage: "nc <hostname-or-IP> <port>",
+	ShortHelp:  "Connect to a port on a host, connected to stdin/stdout",
+	LongHelp: strings.TrimSpace(`
+"tailscale nc" makes tailscaled connect to a TCP port on a tailnet host,
+by MagicDNS name or IP, and copies stdin to it and its output to stdout.
+As tailscaled makes the connection, it works without a TUN device, such
+as with "tailscaled --tun=userspace-networking". For example, in
+~/.ssh/config:
+
+  Host *.ts.net
+    ProxyCommand tailscale nc %h %p
+`),
+	Exec: runNC,
+}
+
+func runNC(ctx context.Context, args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: tailscale nc <hostname-or-IP> <port>")
+	}
+	host, portStr := args[0], args[1]
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || port == 0 {
+		return fmt.Errorf("invalid port number %q", portStr)
+	}
+	c, err := tailscale.DialTCP(ctx, host, uint16(port))
+	if err != nil {
+		return fmt.Errorf("dial: %w", err)
+	}
+	defer c.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(os.Stdout, c)
+		errc <- err
+	}()
+	go func() {
+		_, err := io.Copy(c, os.Stdin)
+		if err != nil {
+			errc <- err
+			return
+		}
+		// Tell the other end we're done sending but keep reading
+		// its reply.
+		if cw, ok := c.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		}
+	}()
+	return <-errc
+}
@@ -0,0 +1,345 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/ipn"
+)
+
+var serveCmd = &ffcli.Command{
+	Name:       "serve",
+	ShortUsage: "serve <https|tcp|remove|status|reset> ...",
+	ShortHelp:  "Serve local services to your tailnet",
+	LongHelp: strings.TrimSpace(`
+"tailscale serve" makes tailscaled serve local web apps, files and TCP
+services to the tailnet on this node's Tailscale IPs. HTTPS is served
+with a TLS cert for the node's MagicDNS name, as from "tailscale cert".
+
+The configuration is saved in tailscaled's prefs and shown in
+"tailscale status".
+`),
+	Subcommands: []*ffcli.Command{
+		serveHTTPSCmd,
+		serveTCPCmd,
+		serveRemoveCmd,
+		serveStatusCmd,
+		serveResetCmd,
+	},
+	Exec: func(context.Context, []string) error {
+		return errors.New("serve subcommand required; run 'tailscale serve -h' for details")
+	},
+}
+
+var serveHTTPSCmd = &ffcli.Command{
+	Name:       "https",
+	ShortUsage: "serve https [--port=443] <mount-point> <target>",
+	ShortHelp:  "Serve a local web server, file or directory over HTTPS",
+	LongHelp: strings.TrimSpace(`
+Serves <target> at path <mount-point> (such as "/" or "/docs/") of
+https://<node's MagicDNS name>. The mount point is stripped from request
+paths. <target> is one of:
+
+  - a local HTTP server to reverse proxy to: "http://127.0.0.1:3000",
+    "localhost:3000" or just "3000"
+  - the path of a file or directory to serve
+
+Proxied requests carry the Tailscale-User-Login, Tailscale-User-Name,
+Tailscale-Node-Name and Tailscale-Node-Tags headers, identifying the
+tailnet user and node they came from. Any such headers sent by the
+client are replaced.
+`),
+	Exec: runServeHTTPS,
+	FlagSet: (func() *flag.FlagSet {
+		fs := newFlagSet("https")
+		fs.UintVar(&serveArgs.port, "port", 443, "port on the node's Tailscale IPs to serve HTTPS on")
+		return fs
+	})(),
+}
+
+var serveTCPCmd = &ffcli.Command{
+	Name:       "tcp",
+	ShortUsage: "serve tcp <port> <target>",
+	ShortHelp:  "Forward a port to a local TCP service",
+	LongHelp: strings.TrimSpace(`
+Forwards TCP connections to <port> on the node's Tailscale IPs to
+<target>, a local "host:port" or just a port on 127.0.0.1.
+`),
+	Exec: runServeTCP,
+}
+
+var serveRemoveCmd = &ffcli.Command{
+	Name:       "remove",
+	ShortUsage: "serve remove <port> [<mount-point>]",
+	ShortHelp:  "Stop serving a port, or one mount point of an HTTPS port",
+	Exec:       runServeRemove,
+}
+
+var serveStatusCmd = &ffcli.Command{
+	Name:       "status",
+	ShortUsage: "serve status [--json]",
+	ShortHelp:  "Show what's being served",
+	Exec:       runServeStatus,
+	FlagSet: (func() *flag.FlagSet {
+		fs := newFlagSet("status")
+		fs.BoolVar(&serveArgs.json, "json", false, "output the serve config in JSON format")
+		return fs
+	})(),
+}
+
+var serveResetCmd = &ffcli.Command{
+	Name:       "reset",
+	ShortUsage: "serve reset",
+	ShortHelp:  "Stop serving everything",
+	Exec:       runServeReset,
+}
+
+var serveArgs struct {
+	port uint
+	json bool
+}
+
+// editServeConfig applies edit to a copy of tailscaled's serve config
+// and saves the result.
+func editServeConfig(ctx context.Context, edit func(sc *ipn.ServeConfig) error) error {
+	prefs, err := tailscale.GetPrefs(ctx)
+	if err != nil {
+		return err
+	}
+	sc := prefs.Serve.Clone()
+	if sc == nil {
+		sc = new(ipn.ServeConfig)
+	}
+	if err := edit(sc); err != nil {
+		return err
+	}
+	if err := sc.Check(); err != nil {
+		return err
+	}
+	_, err = tailscale.EditPrefs(ctx, &ipn.MaskedPrefs{
+		Prefs:    ipn.Prefs{Serve: sc},
+		ServeSet: true,
+	})
+	return err
+}
+
+func runServeHTTPS(ctx context.Context, args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: tailscale serve https [--port=443] <mount-point> <target>")
+	}
+	if serveArgs.port == 0 || serveArgs.port > 65535 {
+		return fmt.Errorf("invalid --port %d", serveArgs.port)
+	}
+	h, err := serveHTTPHandler(args[1])
+	if err != nil {
+		return err
+	}
+	return editServeConfig(ctx, func(sc *ipn.ServeConfig) error {
+		return addServeHTTPS(sc, uint16(serveArgs.port), args[0], h)
+	})
+}
+
+func runServeTCP(ctx context.Context, args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: tailscale serve tcp <port> <target>")
+	}
+	port, err := parseServePort(args[0])
+	if err != nil {
+		return err
+	}
+	target, err := expandServeHostPort(args[1])
+	if err != nil {
+		return err
+	}
+	return editServeConfig(ctx, func(sc *ipn.ServeConfig) error {
+		if sc.TCP == nil {
+			sc.TCP = make(map[uint16]*ipn.TCPPortHandler)
+		}
+		sc.TCP[port] = &ipn.TCPPortHandler{TCPForward: target}
+		return nil
+	})
+}
+
+func runServeRemove(ctx context.Context, args []string) error {
+	if len(args) != 1 && len(args) != 2 {
+		return errors.New("usage: tailscale serve remove <port> [<mount-point>]")
+	}
+	port, err := parseServePort(args[0])
+	if err != nil {
+		return err
+	}
+	var mount string
+	if len(args) == 2 {
+		mount = args[1]
+	}
+	return editServeConfig(ctx, func(sc *ipn.ServeConfig) error {
+		return removeServe(sc, port, mount)
+	})
+}
+
+func runServeStatus(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("too many arguments")
+	}
+	prefs, err := tailscale.GetPrefs(ctx)
+	if err != nil {
+		return err
+	}
+	if serveArgs.json {
+		sc := prefs.Serve
+		if sc == nil {
+			sc = new(ipn.ServeConfig)
+		}
+		j, err := json.MarshalIndent(sc, "", "  ")
+		if err != nil {
+			return err
+		}
+		printf("%s\n", j)
+		return nil
+	}
+	if prefs.Serve.IsEmpty() {
+		outln("Not serving anything.")
+		return nil
+	}
+	for _, line := range serveConfigLines(prefs.Serve) {
+		outln(line)
+	}
+	return nil
+}
+
+func runServeReset(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("too many arguments")
+	}
+	return editServeConfig(ctx, func(sc *ipn.ServeConfig) error {
+		sc.TCP = nil
+		return nil
+	})
+}
+
+func parseServePort(s string) (uint16, error) {
+	port, err := strconv.ParseUint(s, 10, 16)
+	if err != nil || port == 0 {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return uint16(port), nil
+}
+
+// expandServeHostPort returns target as a host:port, with a bare port
+// meaning one on 127.0.0.1.
+func expandServeHostPort(target string) (string, error) {
+	if _, err := parseServePort(target); err == nil {
+		return net.JoinHostPort("127.0.0.1", target), nil
+	}
+	host, port, err := net.SplitHostPort(target)
+	if err != nil || host == "" {
+		return "", fmt.Errorf("invalid target %q; want host:port or a port", target)
+	}
+	if _, err := parseServePort(port); err != nil {
+		return "", err
+	}
+	return target, nil
+}
+
+// serveHTTPHandler returns the handler for the "tailscale serve https"
+// target.
+func serveHTTPHandler(target string) (*ipn.HTTPHandler, error) {
+	switch {
+	case strings.HasPrefix(target, "http://"), strings.HasPrefix(target, "https://"):
+		return &ipn.HTTPHandler{Proxy: target}, nil
+	case strings.HasPrefix(target, "/"), strings.HasPrefix(target, "."):
+		path, err := filepath.Abs(target)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(path); err != nil {
+			return nil, err
+		}
+		return &ipn.HTTPHandler{Path: path}, nil
+	}
+	hostPort, err := expandServeHostPort(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target %q; want a URL, port, host:port or path", target)
+	}
+	return &ipn.HTTPHandler{Proxy: "http://" + hostPort}, nil
+}
+
+// addServeHTTPS adds h at mount to the HTTPS server on port, replacing
+// any TCP forwarding there.
+func addServeHTTPS(sc *ipn.ServeConfig, port uint16, mount string, h *ipn.HTTPHandler) error {
+	if !strings.HasPrefix(mount, "/") {
+		return fmt.Errorf("invalid mount point %q; must start with /", mount)
+	}
+	if !strings.HasSuffix(mount, "/") {
+		mount += "/"
+	}
+	if sc.TCP == nil {
+		sc.TCP = make(map[uint16]*ipn.TCPPortHandler)
+	}
+	ph := sc.TCP[port]
+	if ph == nil || ph.TCPForward != "" {
+		ph = new(ipn.TCPPortHandler)
+		sc.TCP[port] = ph
+	}
+	if ph.Web == nil {
+		ph.Web = make(map[string]*ipn.HTTPHandler)
+	}
+	ph.Web[mount] = h
+	return nil
+}
+
+// removeServe stops serving port or, if mount is non-empty, just that
+// mount point of port's HTTPS server.
+func removeServe(sc *ipn.ServeConfig, port uint16, mount string) error {
+	ph, ok := sc.TCP[port]
+	if !ok {
+		return fmt.Errorf("not serving port %d", port)
+	}
+	if mount == "" {
+		delete(sc.TCP, port)
+		return nil
+	}
+	if !strings.HasSuffix(mount, "/") {
+		mount += "/"
+	}
+	if _, ok := ph.Web[mount]; !ok {
+		return fmt.Errorf("not serving %q on port %d", mount, port)
+	}
+	delete(ph.Web, mount)
+	if len(ph.Web) == 0 {
+		delete(sc.TCP, port)
+	}
+	return nil
+}
+
+// serveConfigLines returns a human-readable description of sc, one
+// line per thing served, sorted.
+func serveConfigLines(sc *ipn.ServeConfig) []string {
+	var lines []string
+	for port, ph := range sc.TCP {
+		if ph.TCPForward != "" {
+			lines = append(lines, fmt.Sprintf("tcp port %d -> %s", port, ph.TCPForward))
+			continue
+		}
+		for mount, h := range ph.Web {
+			lines = append(lines, fmt.Sprintf("https port %d %s -> %s", port, mount, h))
+		}
+	}
+	sort.Strings(lines)
+	return lines
+}
@@ -0,0 +1,91 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"reflect"
+	"testing"
+
+	"tailscale.com/ipn"
+)
+
+func TestServeHTTPHandler(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		target string
+		want   *ipn.HTTPHandler
+	}{
+		{"3000", &ipn.HTTPHandler{Proxy: "http://127.0.0.1:3000"}},
+		{"localhost:3000", &ipn.HTTPHandler{Proxy: "http://localhost:3000"}},
+		{"http://127.0.0.1:3000/app", &ipn.HTTPHandler{Proxy: "http://127.0.0.1:3000/app"}},
+		{dir, &ipn.HTTPHandler{Path: dir}},
+		{"/does/not/exist", nil},
+		{"nonsense", nil},
+		{"99999", nil},
+	}
+	for _, tt := range tests {
+		got, err := serveHTTPHandler(tt.target)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("serveHTTPHandler(%q) = %+v; want error", tt.target, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("serveHTTPHandler(%q): %v", tt.target, err)
+			continue
+		}
+		if *got != *tt.want {
+			t.Errorf("serveHTTPHandler(%q) = %+v; want %+v", tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestEditServeConfig(t *testing.T) {
+	sc := new(ipn.ServeConfig)
+	if err := addServeHTTPS(sc, 443, "/", &ipn.HTTPHandler{Proxy: "http://127.0.0.1:3000"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := addServeHTTPS(sc, 443, "/docs", &ipn.HTTPHandler{Path: "/var/www"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := addServeHTTPS(sc, 443, "docs", &ipn.HTTPHandler{Path: "/var/www"}); err == nil {
+		t.Error("mount point without leading slash accepted")
+	}
+	sc.TCP[5432] = &ipn.TCPPortHandler{TCPForward: "127.0.0.1:5432"}
+	if err := sc.Check(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"https port 443 / -> http://127.0.0.1:3000",
+		"https port 443 /docs/ -> /var/www",
+		"tcp port 5432 -> 127.0.0.1:5432",
+	}
+	if got := serveConfigLines(sc); !reflect.DeepEqual(got, want) {
+		t.Errorf("lines = %q; want %q", got, want)
+	}
+
+	if err := removeServe(sc, 443, "/docs"); err != nil {
+		t.Fatal(err)
+	}
+	if err := removeServe(sc, 443, "/docs/"); err == nil {
+		t.Error("removing missing mount point succeeded")
+	}
+	if err := removeServe(sc, 443, "/"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := sc.TCP[443]; ok {
+		t.Error("port 443 still served with no mount points")
+	}
+	if err := removeServe(sc, 5432, ""); err != nil {
+		t.Fatal(err)
+	}
+	if !sc.IsEmpty() {
+		t.Errorf("config not empty: %+v", sc)
+	}
+	if err := removeServe(sc, 80, ""); err == nil {
+		t.Error("removing unserved port succeeded")
+	}
+}
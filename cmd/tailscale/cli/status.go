@@ -13,6 +13,7 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"sort"
 	"strings"
 
 	"github.com/peterbourgon/ff/v3/ffcli"
@@ -191,6 +192,33 @@ func runStatus(ctx context.Context, args []string) error {
 		}
 	}
 	Stdout.Write(buf.Bytes())
+
+	if st.AutoExitNode {
+		outln()
+		printf("# Exit node (auto):\n")
+		if len(st.ExitNodeCandidates) == 0 {
+			printf("#     no exit nodes found\n")
+		}
+		for _, c := range st.ExitNodeCandidates {
+			printf("#     %-20s %-16s %s\n",
+				dnsname.TrimSuffix(c.DNSName, st.MagicDNSSuffix),
+				exitNodeLatency(c),
+				exitNodeStatus(c),
+			)
+		}
+	}
+	if len(st.Serve) > 0 {
+		urls := make([]string, 0, len(st.Serve))
+		for u := range st.Serve {
+			urls = append(urls, u)
+		}
+		sort.Strings(urls)
+		outln()
+		printf("# Serving:\n")
+		for _, u := range urls {
+			printf("#     %s -> %s\n", u, st.Serve[u])
+		}
+	}
 	return nil
 }
 
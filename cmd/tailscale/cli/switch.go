@@ -0,0 +1,67 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"tailscale.com/client/tailscale"
+)
+
+var switchCmd = &ffcli.Command{
+	Name:       "switch",
+	ShortUsage: "switch [--list] [profile]",
+	ShortHelp:  "Switch to a different login profile",
+	LongHelp: strings.TrimSpace(`
+"tailscale switch <profile>" switches tailscaled to another login
+profile, each of which has its own prefs and node key. Switching to a
+profile that has logged in before doesn't require logging in again.
+A profile that doesn't exist yet is created, logged out.
+
+"tailscale switch --list" lists the profiles, marking the current one.
+`),
+	Exec: runSwitch,
+	FlagSet: (func() *flag.FlagSet {
+		fs := newFlagSet("switch")
+		fs.BoolVar(&switchArgs.list, "list", false, "list login profiles")
+		return fs
+	})(),
+}
+
+var switchArgs struct {
+	list bool
+}
+
+func runSwitch(ctx context.Context, args []string) error {
+	if switchArgs.list {
+		if len(args) > 0 {
+			return errors.New("--list takes no profile argument")
+		}
+		profiles, err := tailscale.Profiles(ctx)
+		if err != nil {
+			return err
+		}
+		for _, name := range profiles.Names {
+			mark := " "
+			if name == profiles.Current {
+				mark = "*"
+			}
+			printf("%s %s\n", mark, name)
+		}
+		return nil
+	}
+	if len(args) != 1 {
+		return errors.New("usage: tailscale switch <profile>")
+	}
+	if err := tailscale.SwitchProfile(ctx, args[0]); err != nil {
+		return fmt.Errorf("switching to profile %q: %w", args[0], err)
+	}
+	return nil
+}
@@ -73,13 +73,13 @@ func newUpFlagSet(goos string, upArgs *upArgsT) *flag.FlagSet {
 	upf.BoolVar(&upArgs.acceptRoutes, "accept-routes", false, "accept routes advertised by other Tailscale nodes")
 	upf.BoolVar(&upArgs.acceptDNS, "accept-dns", true, "accept DNS configuration from the admin panel")
 	upf.BoolVar(&upArgs.singleRoutes, "host-routes", true, "install host routes to other Tailscale nodes")
-	upf.StringVar(&upArgs.exitNodeIP, "exit-node", "", "Tailscale IP of the exit node for internet traffic, or empty string to not use an exit node")
+	upf.StringVar(&upArgs.exitNodeIP, "exit-node", "", "Tailscale IP of the exit node for internet traffic, \"auto\" to pick the best one automatically, or empty string to not use an exit node")
 	upf.BoolVar(&upArgs.exitNodeAllowLANAccess, "exit-node-allow-lan-access", false, "Allow direct access to the local network when routing traffic via an exit node")
 	upf.BoolVar(&upArgs.shieldsUp, "shields-up", false, "don't allow incoming connections")
 	upf.StringVar(&upArgs.advertiseTags, "advertise-tags", "", "comma-separated ACL tags to request; each must start with \"tag:\" (e.g. \"tag:eng,tag:montreal,tag:ssh\")")
 	upf.StringVar(&upArgs.authKeyOrFile, "authkey", "", `node authorization key; if it begins with "file:", then it's a path to a file containing the authkey`)
 	upf.StringVar(&upArgs.hostname, "hostname", "", "hostname to use instead of the one provided by the OS")
-	upf.StringVar(&upArgs.advertiseRoutes, "advertise-routes", "", "routes to advertise to other nodes (comma-separated, e.g. \"10.0.0.0/8,192.168.0.0/24\") or empty string to not advertise routes")
+	upf.StringVar(&upArgs.advertiseRoutes, "advertise-routes", "", "routes to advertise to other nodes (comma-separated, e.g. \"10.0.0.0/8,192.168.0.0/24\") or empty string to not advertise routes; on Linux, a route suffixed with \":nosnat\" isn't source NATed even with --snat-subnet-routes")
 	upf.BoolVar(&upArgs.advertiseDefaultRoute, "advertise-exit-node", false, "offer to be an exit node for internet traffic for the tailnet")
 	if safesocket.GOOSUsesPeerCreds(goos) {
 		upf.StringVar(&upArgs.opUser, "operator", "", "Unix username to allow to operate on tailscaled without sudo")
@@ -87,7 +87,7 @@ func newUpFlagSet(goos string, upArgs *upArgsT) *flag.FlagSet {
 	switch goos {
 	case "linux":
 		upf.BoolVar(&upArgs.snat, "snat-subnet-routes", true, "source NAT traffic to local routes advertised with --advertise-routes")
-		upf.StringVar(&upArgs.netfilterMode, "netfilter-mode", defaultNetfilterMode(), "netfilter mode (one of on, nodivert, off)")
+		upf.StringVar(&upArgs.netfilterMode, "netfilter-mode", defaultNetfilterMode(), "netfilter mode (one of on, nodivert, off, nftables)")
 	case "windows":
 		upf.BoolVar(&upArgs.forceDaemon, "unattended", false, "run in \"Unattended Mode\" where Tailscale keeps running even after the current GUI user logs out (Windows-only)")
 	}
@@ -147,47 +147,86 @@ var (
 	ipv6default = netaddr.MustParseIPPrefix("::/0")
 )
 
-func calcAdvertiseRoutes(advertiseRoutes string, advertiseDefaultRoute bool) ([]netaddr.IPPrefix, error) {
-	routeMap := map[netaddr.IPPrefix]bool{}
+// noSNATSuffix is the suffix of an --advertise-routes route that
+// isn't source NATed.
+const noSNATSuffix = ":nosnat"
+
+// calcAdvertiseRoutes returns the routes to advertise, and which of
+// them not to source NAT, from the --advertise-routes and
+// --advertise-exit-node flags.
+func calcAdvertiseRoutes(advertiseRoutes string, advertiseDefaultRoute bool) (routes, noSNAT []netaddr.IPPrefix, err error) {
+	routeMap := map[netaddr.IPPrefix]bool{} // route => whether to SNAT
 	if advertiseRoutes != "" {
 		var default4, default6 bool
 		advroutes := strings.Split(advertiseRoutes, ",")
 		for _, s := range advroutes {
-			ipp, err := netaddr.ParseIPPrefix(s)
+			snat := !strings.HasSuffix(s, noSNATSuffix)
+			ipp, err := netaddr.ParseIPPrefix(strings.TrimSuffix(s, noSNATSuffix))
 			if err != nil {
-				return nil, fmt.Errorf("%q is not a valid IP address or CIDR prefix", s)
+				return nil, nil, fmt.Errorf("%q is not a valid IP address or CIDR prefix", s)
 			}
 			if ipp != ipp.Masked() {
-				return nil, fmt.Errorf("%s has non-address bits set; expected %s", ipp, ipp.Masked())
+				return nil, nil, fmt.Errorf("%s has non-address bits set; expected %s", ipp, ipp.Masked())
 			}
 			if ipp == ipv4default {
 				default4 = true
 			} else if ipp == ipv6default {
 				default6 = true
 			}
-			routeMap[ipp] = true
+			if !snat && ipp.Bits() == 0 {
+				return nil, nil, fmt.Errorf("%q: exit node routes are always source NATed", s)
+			}
+			routeMap[ipp] = snat
 		}
 		if default4 && !default6 {
-			return nil, fmt.Errorf("%s advertised without its IPv6 counterpart, please also advertise %s", ipv4default, ipv6default)
+			return nil, nil, fmt.Errorf("%s advertised without its IPv6 counterpart, please also advertise %s", ipv4default, ipv6default)
 		} else if default6 && !default4 {
-			return nil, fmt.Errorf("%s advertised without its IPv6 counterpart, please also advertise %s", ipv6default, ipv4default)
+			return nil, nil, fmt.Errorf("%s advertised without its IPv6 counterpart, please also advertise %s", ipv6default, ipv4default)
 		}
 	}
 	if advertiseDefaultRoute {
 		routeMap[netaddr.MustParseIPPrefix("0.0.0.0/0")] = true
 		routeMap[netaddr.MustParseIPPrefix("::/0")] = true
 	}
-	routes := make([]netaddr.IPPrefix, 0, len(routeMap))
-	for r := range routeMap {
+	routes = make([]netaddr.IPPrefix, 0, len(routeMap))
+	for r, snat := range routeMap {
 		routes = append(routes, r)
+		if !snat {
+			noSNAT = append(noSNAT, r)
+		}
 	}
+	sortRoutes(routes)
+	sortRoutes(noSNAT)
+	return routes, noSNAT, nil
+}
+
+func sortRoutes(routes []netaddr.IPPrefix) {
 	sort.Slice(routes, func(i, j int) bool {
 		if routes[i].Bits() != routes[j].Bits() {
 			return routes[i].Bits() < routes[j].Bits()
 		}
 		return routes[i].IP().Less(routes[j].IP())
 	})
-	return routes, nil
+}
+
+// formatAdvertiseRoutes returns the --advertise-routes value for
+// routes, other than exit node routes, suffixing those in noSNAT
+// with ":nosnat".
+func formatAdvertiseRoutes(routes, noSNAT []netaddr.IPPrefix) string {
+	var sb strings.Builder
+	for i, r := range withoutExitNodes(routes) {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(r.String())
+		for _, n := range noSNAT {
+			if n == r {
+				sb.WriteString(noSNATSuffix)
+				break
+			}
+		}
+	}
+	return sb.String()
 }
 
 // prefsFromUpArgs returns the ipn.Prefs for the provided args.
@@ -197,13 +236,15 @@ func calcAdvertiseRoutes(advertiseRoutes string, advertiseDefaultRoute bool) ([]
 // function exists for testing and should have no side effects or
 // outside interactions (e.g. no making Tailscale local API calls).
 func prefsFromUpArgs(upArgs upArgsT, warnf logger.Logf, st *ipnstate.Status, goos string) (*ipn.Prefs, error) {
-	routes, err := calcAdvertiseRoutes(upArgs.advertiseRoutes, upArgs.advertiseDefaultRoute)
+	routes, noSNATRoutes, err := calcAdvertiseRoutes(upArgs.advertiseRoutes, upArgs.advertiseDefaultRoute)
 	if err != nil {
 		return nil, err
 	}
 
 	var exitNodeIP netaddr.IP
-	if upArgs.exitNodeIP != "" {
+	if upArgs.exitNodeIP == "auto" {
+		// Picked by tailscaled; see ipn.Prefs.AutoExitNode.
+	} else if upArgs.exitNodeIP != "" {
 		var err error
 		exitNodeIP, err = netaddr.ParseIP(upArgs.exitNodeIP)
 		if err != nil {
@@ -241,6 +282,7 @@ func prefsFromUpArgs(upArgs upArgsT, warnf logger.Logf, st *ipnstate.Status, goo
 	prefs.WantRunning = true
 	prefs.RouteAll = upArgs.acceptRoutes
 	prefs.ExitNodeIP = exitNodeIP
+	prefs.AutoExitNode = upArgs.exitNodeIP == "auto"
 	prefs.ExitNodeAllowLANAccess = upArgs.exitNodeAllowLANAccess
 	prefs.CorpDNS = upArgs.acceptDNS
 	prefs.AllowSingleHosts = upArgs.singleRoutes
@@ -253,10 +295,13 @@ func prefsFromUpArgs(upArgs upArgsT, warnf logger.Logf, st *ipnstate.Status, goo
 
 	if goos == "linux" {
 		prefs.NoSNAT = !upArgs.snat
+		prefs.NoSNATRoutes = noSNATRoutes
 
 		switch upArgs.netfilterMode {
 		case "on":
 			prefs.NetfilterMode = preftype.NetfilterOn
+		case "nftables":
+			prefs.NetfilterMode = preftype.NetfilterNFTables
 		case "nodivert":
 			prefs.NetfilterMode = preftype.NetfilterNoDivert
 			warnf("netfilter=nodivert; add iptables calls to ts-* chains manually.")
@@ -283,6 +328,9 @@ func prefsFromUpArgs(upArgs upArgsT, warnf logger.Logf, st *ipnstate.Status, goo
 // transition to running from a previously-logged-in but down state,
 // without changing any settings.
 func updatePrefs(prefs, curPrefs *ipn.Prefs, env upCheckEnv) (simpleUp bool, justEditMP *ipn.MaskedPrefs, err error) {
+	// The serve config is managed by "tailscale serve", not by flags.
+	prefs.Serve = curPrefs.Serve
+
 	if !env.upArgs.reset {
 		applyImplicitPrefs(prefs, curPrefs, env.user)
 
@@ -547,16 +595,16 @@ func runUp(ctx context.Context, args []string) error {
 }
 
 var (
-	prefsOfFlag = map[string][]string{} // "exit-node" => ExitNodeIP, ExitNodeID
+	prefsOfFlag = map[string][]string{} // "exit-node" => ExitNodeIP, ExitNodeID, AutoExitNode
 )
 
 func init() {
 	// Both these have the same ipn.Pref:
 	addPrefFlagMapping("advertise-exit-node", "AdvertiseRoutes")
-	addPrefFlagMapping("advertise-routes", "AdvertiseRoutes")
+	addPrefFlagMapping("advertise-routes", "AdvertiseRoutes", "NoSNATRoutes")
 
-	// And this flag has two ipn.Prefs:
-	addPrefFlagMapping("exit-node", "ExitNodeIP", "ExitNodeID")
+	// And this flag has three ipn.Prefs:
+	addPrefFlagMapping("exit-node", "ExitNodeIP", "ExitNodeID", "AutoExitNode")
 
 	// The rest are 1:1:
 	addPrefFlagMapping("accept-dns", "CorpDNS")
@@ -732,6 +780,9 @@ func prefsToFlags(env upCheckEnv, prefs *ipn.Prefs) (flagVal map[string]interfac
 	ret := make(map[string]interface{})
 
 	exitNodeIPStr := func() string {
+		if prefs.AutoExitNode {
+			return "auto"
+		}
 		if !prefs.ExitNodeIP.IsZero() {
 			return prefs.ExitNodeIP.String()
 		}
@@ -777,14 +828,7 @@ func prefsToFlags(env upCheckEnv, prefs *ipn.Prefs) (flagVal map[string]interfac
 		case "operator":
 			set(prefs.OperatorUser)
 		case "advertise-routes":
-			var sb strings.Builder
-			for i, r := range withoutExitNodes(prefs.AdvertiseRoutes) {
-				if i > 0 {
-					sb.WriteByte(',')
-				}
-				sb.WriteString(r.String())
-			}
-			set(sb.String())
+			set(formatAdvertiseRoutes(prefs.AdvertiseRoutes, prefs.NoSNATRoutes))
 		case "advertise-exit-node":
 			set(hasExitNodeRoutes(prefs.AdvertiseRoutes))
 		case "snat-subnet-routes":
@@ -325,13 +325,14 @@ func webHandler(w http.ResponseWriter, r *http.Request) {
 			json.NewEncoder(w).Encode(mi{"error": err.Error()})
 			return
 		} else {
-			routes, err := calcAdvertiseRoutes(postData.AdvertiseRoutes, postData.AdvertiseExitNode)
+			routes, noSNATRoutes, err := calcAdvertiseRoutes(postData.AdvertiseRoutes, postData.AdvertiseExitNode)
 			if err != nil {
 				w.WriteHeader(http.StatusInternalServerError)
 				json.NewEncoder(w).Encode(mi{"error": err.Error()})
 				return
 			}
 			prefs.AdvertiseRoutes = routes
+			prefs.NoSNATRoutes = noSNATRoutes
 		}
 
 		w.Header().Set("Content-Type", "application/json")
@@ -378,6 +379,11 @@ func webHandler(w http.ResponseWriter, r *http.Request) {
 				data.AdvertiseRoutes = ","
 			}
 			data.AdvertiseRoutes += r.String()
+			for _, n := range prefs.NoSNATRoutes {
+				if n == r {
+					data.AdvertiseRoutes += noSNATSuffix
+				}
+			}
 		}
 	}
 	if len(st.TailscaleIPs) != 0 {
@@ -0,0 +1,115 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"inet.af/netaddr"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/client/tailscale/apitype"
+)
+
+var whoisCmd = &ffcli.Command{
+	Name:       "whois",
+	ShortUsage: "whois [--json] <ip[:port]>",
+	ShortHelp:  "Show the machine and user of a Tailscale IP",
+	LongHelp: strings.TrimSpace(`
+"tailscale whois" shows the machine that has the Tailscale IP (or, with
+a port, the IP:port of a connection through a subnet router) and the
+user who owns it, along with its tags and capabilities.
+`),
+	Exec: runWhoIs,
+	FlagSet: (func() *flag.FlagSet {
+		fs := newFlagSet("whois")
+		fs.BoolVar(&whoisArgs.json, "json", false, "output in JSON format")
+		return fs
+	})(),
+}
+
+var whoisArgs struct {
+	json bool
+}
+
+func runWhoIs(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: tailscale whois <ip[:port]>")
+	}
+	addr, err := whoisAddr(args[0])
+	if err != nil {
+		return err
+	}
+	who, err := tailscale.WhoIs(ctx, addr)
+	if err != nil {
+		return err
+	}
+	if whoisArgs.json {
+		j, err := json.MarshalIndent(who, "", "  ")
+		if err != nil {
+			return err
+		}
+		printf("%s\n", j)
+		return nil
+	}
+	tw := tabwriter.NewWriter(Stdout, 0, 0, 2, ' ', 0)
+	writeWhoIs(tw, who)
+	return tw.Flush()
+}
+
+// whoisAddr returns arg, an IP or IP:port, as the IP:port the LocalAPI
+// wants; port 0 matches any connection from a Tailscale IP.
+func whoisAddr(arg string) (string, error) {
+	if ip, err := netaddr.ParseIP(arg); err == nil {
+		return netaddr.IPPortFrom(ip, 0).String(), nil
+	}
+	if _, err := netaddr.ParseIPPort(arg); err != nil {
+		return "", fmt.Errorf("invalid address %q; want an IP or IP:port", arg)
+	}
+	return arg, nil
+}
+
+// writeWhoIs writes who to w, which should be a tabwriter.
+func writeWhoIs(w io.Writer, who *apitype.WhoIsResponse) {
+	n := who.Node
+	fmt.Fprintf(w, "Machine:\n")
+	fmt.Fprintf(w, "  Name:\t%s\n", strings.TrimSuffix(n.Name, "."))
+	fmt.Fprintf(w, "  ID:\t%s\n", n.StableID)
+	var addrs []string
+	for _, a := range n.Addresses {
+		addrs = append(addrs, a.IP().String())
+	}
+	fmt.Fprintf(w, "  Addresses:\t%s\n", strings.Join(addrs, ", "))
+	if n.Hostinfo.OS != "" {
+		fmt.Fprintf(w, "  OS:\t%s\n", n.Hostinfo.OS)
+	}
+	if len(n.Tags) > 0 {
+		fmt.Fprintf(w, "  Tags:\t%s\n", strings.Join(n.Tags, ", "))
+	}
+	for i, c := range n.Capabilities {
+		label := ""
+		if i == 0 {
+			label = "Capabilities:"
+		}
+		fmt.Fprintf(w, "  %s\t%s\n", label, c)
+	}
+	// A tagged node is owned by its tags, not the user who
+	// created it.
+	if u := who.UserProfile; u != nil && len(n.Tags) == 0 {
+		fmt.Fprintf(w, "User:\n")
+		fmt.Fprintf(w, "  Name:\t%s\n", u.LoginName)
+		if u.DisplayName != "" {
+			fmt.Fprintf(w, "  Display name:\t%s\n", u.DisplayName)
+		}
+		fmt.Fprintf(w, "  ID:\t%d\n", u.ID)
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"text/tabwriter"
+
+	"inet.af/netaddr"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+func TestWhoisAddr(t *testing.T) {
+	tests := []struct {
+		in, want string
+		wantErr  bool
+	}{
+		{in: "100.101.102.103", want: "100.101.102.103:0"},
+		{in: "100.101.102.103:22", want: "100.101.102.103:22"},
+		{in: "fd7a:115c:a1e0::1", want: "[fd7a:115c:a1e0::1]:0"},
+		{in: "[fd7a:115c:a1e0::1]:22", want: "[fd7a:115c:a1e0::1]:22"},
+		{in: "foo", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := whoisAddr(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("whoisAddr(%q) error = %v; want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("whoisAddr(%q) = %q; want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestWriteWhoIs(t *testing.T) {
+	who := &apitype.WhoIsResponse{
+		Node: &tailcfg.Node{
+			Name:      "foo.example.ts.net.",
+			StableID:  "n123",
+			Addresses: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("100.101.102.103/32")},
+			Hostinfo:  tailcfg.Hostinfo{OS: "linux"},
+		},
+		UserProfile: &tailcfg.UserProfile{
+			ID:          1,
+			LoginName:   "alice@example.com",
+			DisplayName: "Alice",
+		},
+	}
+	var buf bytes.Buffer
+	tw := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	writeWhoIs(tw, who)
+	tw.Flush()
+	got := buf.String()
+	for _, want := range []string{"foo.example.ts.net\n", "100.101.102.103\n", "alice@example.com\n", "Alice\n"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %q in output:\n%s", want, got)
+		}
+	}
+
+	// Tagged nodes don't show the user.
+	buf.Reset()
+	who.Node.Tags = []string{"tag:server"}
+	writeWhoIs(tw, who)
+	tw.Flush()
+	got = buf.String()
+	if !strings.Contains(got, "tag:server") {
+		t.Errorf("missing tags in output:\n%s", got)
+	}
+	if strings.Contains(got, "alice@example.com") {
+		t.Errorf("tagged node output has user:\n%s", got)
+	}
+}
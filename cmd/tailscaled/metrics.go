@@ -0,0 +1,129 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/ipn/ipnlocal"
+	"tailscale.com/types/logger"
+)
+
+// runMetricsServer serves h, the node's Prometheus metrics, on the
+// --metrics-listen address addr. It doesn't return.
+//
+// If addr's host is "tailscale", the server listens only on this
+// node's Tailscale IP addresses, as returned by tsIPs, using listen
+// (which is netstack's with userspace networking). It waits until
+// the node has addresses and moves if they change.
+func runMetricsServer(logf logger.Logf, addr string, h http.Handler, tsIPs func() []netaddr.IP, listen func(netaddr.IPPort) (net.Listener, error)) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		logf("metrics: bad --metrics-listen %q: %v", addr, err)
+		return
+	}
+	if host != "tailscale" {
+		logf("metrics: listening on %v", addr)
+		logf("metrics: server exited: %v", http.ListenAndServe(addr, h))
+		return
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		logf("metrics: bad --metrics-listen port %q", portStr)
+		return
+	}
+	warned := false
+	for {
+		ips := tsIPs()
+		if len(ips) == 0 {
+			if !warned {
+				logf("metrics: no Tailscale IP addresses yet; polling until there are some")
+				warned = true
+			}
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		warned = false
+		var lns []net.Listener
+		for _, ip := range ips {
+			ln, err := listen(netaddr.IPPortFrom(ip, uint16(port)))
+			if err != nil {
+				logf("metrics: %v", err)
+				break
+			}
+			lns = append(lns, ln)
+		}
+		if len(lns) < len(ips) {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			time.Sleep(5 * time.Second)
+			continue
+		}
+
+		srv := &http.Server{Handler: h}
+		done := make(chan struct{})
+		go func() {
+			// Move if the addresses change.
+			for {
+				select {
+				case <-done:
+					return
+				case <-time.After(5 * time.Second):
+				}
+				if !sameIPs(tsIPs(), ips) {
+					srv.Close()
+					return
+				}
+			}
+		}()
+		errc := make(chan error, len(lns))
+		for _, ln := range lns {
+			logf("metrics: listening on %v", ln.Addr())
+			go func(ln net.Listener) { errc <- srv.Serve(ln) }(ln)
+		}
+		// If any listener fails, start over on all of them.
+		logf("metrics: server on %v exited: %v", ips, <-errc)
+		srv.Close()
+		for range lns[1:] {
+			<-errc
+		}
+		close(done)
+	}
+}
+
+// netmapIPs returns a func that returns the Tailscale IP addresses in
+// b's current network map.
+func netmapIPs(b *ipnlocal.LocalBackend) func() []netaddr.IP {
+	return func() []netaddr.IP {
+		nm := b.NetMap()
+		if nm == nil {
+			return nil
+		}
+		var ips []netaddr.IP
+		for _, a := range nm.Addresses {
+			if a.IsSingleIP() {
+				ips = append(ips, a.IP())
+			}
+		}
+		return ips
+	}
+}
+
+func sameIPs(a, b []netaddr.IP) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -28,7 +28,9 @@ import (
 	"syscall"
 	"time"
 
+	"inet.af/netaddr"
 	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnlocal"
 	"tailscale.com/ipn/ipnserver"
 	"tailscale.com/logpolicy"
 	"tailscale.com/net/dns"
@@ -84,15 +86,26 @@ var args struct {
 	statedir       string
 	socketpath     string
 	birdSocketPath string
+	birdRoutesFile string // file of BIRD static protocols to feed routes to
+	birdPeerRoutes bool   // whether to also feed peers' addresses to birdRoutesFile
 	verbose        int
+	logFormat      string // "text" or "json"
+	logOutput      string // logpolicy.Options.Output
+	noLogUpload    bool   // don't upload logs to log.tailscale.io
 	socksAddr      string // listen address for SOCKS5 server
+	socksAuth      string // "user:password" or "file:<path>" for SOCKS5 server
 	httpProxyAddr  string // listen address for HTTP proxy server
+	metricsAddr    string // listen address for Prometheus metrics server
+	fileAcceptDir  string // directory to move received Taildrop files into
+	fileAcceptFrom string // comma-separated users and tags to accept files from
+	fileHook       string // program or URL to run or POST to per received file
 }
 
 var (
-	installSystemDaemon   func([]string) error                      // non-nil on some platforms
-	uninstallSystemDaemon func([]string) error                      // non-nil on some platforms
-	createBIRDClient      func(string) (wgengine.BIRDClient, error) // non-nil on some platforms
+	installSystemDaemon   func([]string) error                                          // non-nil on some platforms
+	uninstallSystemDaemon func([]string) error                                          // non-nil on some platforms
+	createBIRDClient      func(string) (wgengine.BIRDClient, error)                     // non-nil on some platforms
+	createBIRDRouteFeed   func(wgengine.BIRDClient, string) (wgengine.RouteFeed, error) // non-nil where createBIRDClient is
 )
 
 var subCommands = map[string]*func([]string) error{
@@ -112,16 +125,26 @@ func main() {
 
 	printVersion := false
 	flag.IntVar(&args.verbose, "verbose", 0, "log verbosity level; 0 is default, 1 or higher are increasingly verbose")
+	flag.StringVar(&args.logFormat, "log-format", "text", `format of local logs: "text" or "json" (one JSON object per line)`)
+	flag.StringVar(&args.logOutput, "log-output", "stderr", `where to write local logs: "stderr", "file:" and the path of a file to write and rotate, "syslog", or "journald" (Linux)`)
+	flag.BoolVar(&args.noLogUpload, "no-logs-no-support", false, "disable uploading logs to log.tailscale.io; Tailscale support won't be able to debug this node")
 	flag.BoolVar(&args.cleanup, "cleanup", false, "clean up system state and exit")
 	flag.StringVar(&args.debug, "debug", "", "listen address ([ip]:port) of optional debug server")
 	flag.StringVar(&args.socksAddr, "socks5-server", "", `optional [ip]:port to run a SOCK5 server (e.g. "localhost:1080")`)
+	flag.StringVar(&args.socksAuth, "socks5-auth", "", `optional credentials SOCKS5 clients must authenticate with: "user:password", or "file:" and the path of a file containing that`)
 	flag.StringVar(&args.httpProxyAddr, "outbound-http-proxy-listen", "", `optional [ip]:port to run an outbound HTTP proxy (e.g. "localhost:8080")`)
+	flag.StringVar(&args.metricsAddr, "metrics-listen", "", `optional [ip]:port to serve Prometheus metrics on at /metrics; use "tailscale:port" to listen only on this node's Tailscale IP addresses`)
 	flag.StringVar(&args.tunname, "tun", defaultTunName(), `tunnel interface name; use "userspace-networking" (beta) to not use TUN`)
 	flag.Var(flagtype.PortValue(&args.port, 0), "port", "UDP port to listen on for WireGuard and peer-to-peer traffic; 0 means automatically select")
 	flag.StringVar(&args.statepath, "state", paths.DefaultTailscaledStateFile(), "absolute path of state file; use 'kube:<secret-name>' to use Kubernetes secrets or 'arn:aws:ssm:...' to store in AWS SSM. If empty and --statedir is provided, the default is <statedir>/tailscaled.state")
 	flag.StringVar(&args.statedir, "statedir", "", "path to directory for storage of config state, TLS certs, temporary incoming Taildrop files, etc. If empty, it's derived from --state when possible.")
 	flag.StringVar(&args.socketpath, "socket", paths.DefaultTailscaledSocket(), "path of the service unix socket")
 	flag.StringVar(&args.birdSocketPath, "bird-socket", "", "path of the bird unix socket")
+	flag.StringVar(&args.birdRoutesFile, "bird-routes-file", "", "optional path of a file of BIRD static protocols to write the routes this node is primary subnet router for to; BIRD's configuration must include it. Requires --bird-socket")
+	flag.BoolVar(&args.birdPeerRoutes, "bird-peer-routes", false, "whether --bird-routes-file also gets the Tailscale addresses of this node's peers, as /32 and /128 routes, while it's a primary subnet router")
+	flag.StringVar(&args.fileAcceptDir, "taildrop-accept-dir", "", `optional absolute path of a directory to move received Taildrop files into, rather than leaving them for "tailscale file get"`)
+	flag.StringVar(&args.fileAcceptFrom, "taildrop-accept-from", "", `optional comma-separated login names and tags (e.g. "tag:ci") of senders whose files --taildrop-accept-dir accepts; if empty, all are`)
+	flag.StringVar(&args.fileHook, "taildrop-hook", "", "optional program to run, or http(s) URL to POST JSON to, once each Taildrop file is received")
 	flag.BoolVar(&printVersion, "version", false, "print version information and exit")
 
 	if len(os.Args) > 1 {
@@ -163,10 +186,36 @@ func main() {
 		log.Fatalf("--socket is required")
 	}
 
+	if args.fileAcceptDir != "" && !filepath.IsAbs(args.fileAcceptDir) {
+		log.SetFlags(0)
+		log.Fatalf("--taildrop-accept-dir must be an absolute path")
+	}
+	if args.fileAcceptFrom != "" && args.fileAcceptDir == "" {
+		log.SetFlags(0)
+		log.Fatalf("--taildrop-accept-from requires --taildrop-accept-dir")
+	}
+
+	if args.logFormat != "text" && args.logFormat != "json" {
+		log.SetFlags(0)
+		log.Fatalf(`--log-format must be "text" or "json"`)
+	}
+	if err := logpolicy.CheckOutput(args.logOutput); err != nil {
+		log.SetFlags(0)
+		log.Fatalf("--log-output: %v", err)
+	}
+
 	if args.birdSocketPath != "" && createBIRDClient == nil {
 		log.SetFlags(0)
 		log.Fatalf("--bird-socket is not supported on %s", runtime.GOOS)
 	}
+	if args.birdRoutesFile != "" && args.birdSocketPath == "" {
+		log.SetFlags(0)
+		log.Fatalf("--bird-routes-file requires --bird-socket")
+	}
+	if args.birdPeerRoutes && args.birdRoutesFile == "" {
+		log.SetFlags(0)
+		log.Fatalf("--bird-peer-routes requires --bird-routes-file")
+	}
 
 	err := run()
 
@@ -217,6 +266,21 @@ func statePathOrDefault() string {
 	return ""
 }
 
+// fileAcceptConfig returns the Taildrop auto-accept and hook
+// configuration from the command-line flags.
+func fileAcceptConfig() ipnlocal.FileAcceptConfig {
+	c := ipnlocal.FileAcceptConfig{
+		Dir:  args.fileAcceptDir,
+		Hook: args.fileHook,
+	}
+	for _, from := range strings.Split(args.fileAcceptFrom, ",") {
+		if from = strings.TrimSpace(from); from != "" {
+			c.From = append(c.From, from)
+		}
+	}
+	return c
+}
+
 func ipnServerOpts() (o ipnserver.Options) {
 	// Allow changing the OS-specific IPN behavior for tests
 	// so we can e.g. test Windows-specific behaviors on Linux.
@@ -248,7 +312,11 @@ func ipnServerOpts() (o ipnserver.Options) {
 func run() error {
 	var err error
 
-	pol := logpolicy.New("tailnode.log.tailscale.io")
+	pol := logpolicy.NewWithOptions("tailnode.log.tailscale.io", logpolicy.Options{
+		JSON:     args.logFormat == "json",
+		Output:   args.logOutput,
+		NoUpload: args.noLogUpload,
+	})
 	pol.SetVerbosityLevel(args.verbose)
 	defer func() {
 		// Finish uploading logs after closing everything else.
@@ -322,6 +390,12 @@ func run() error {
 
 	if socksListener != nil || httpProxyListener != nil {
 		srv := tssocks.NewServer(logger.WithPrefix(logf, "socks5: "), e, ns)
+		if args.socksAuth != "" {
+			srv.Username, srv.Password, err = parseSOCKSAuth(args.socksAuth)
+			if err != nil {
+				return fmt.Errorf("--socks5-auth: %w", err)
+			}
+		}
 		if httpProxyListener != nil {
 			hs := &http.Server{Handler: httpProxyHandler(srv.Dialer)}
 			go func() {
@@ -367,10 +441,42 @@ func run() error {
 		logf("ipnserver.New: %v", err)
 		return err
 	}
+	// Let "tailscale nc" reach MagicDNS names, and peers even
+	// without a TUN device.
+	srv.LocalBackend().SetUserDialFunc(tssocks.NewDialer(e, ns))
+	srv.LocalBackend().SetFileAcceptConfig(fileAcceptConfig())
+	if useNetstack {
+		// The Tailscale IPs aren't on an OS interface, so
+		// "tailscale serve" has to listen on them in netstack.
+		srv.LocalBackend().SetListenTCPFunc(func(ipp netaddr.IPPort) (net.Listener, error) {
+			ln, err := ns.ListenTCP(ipp)
+			if err != nil {
+				return nil, err
+			}
+			return ln, nil
+		})
+	}
 
 	if debugMux != nil {
 		debugMux.HandleFunc("/debug/ipn", srv.ServeHTMLStatus)
 	}
+	if args.metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", srv.ServeMetrics)
+		listen := func(ipp netaddr.IPPort) (net.Listener, error) {
+			return net.Listen("tcp", ipp.String())
+		}
+		if useNetstack {
+			listen = func(ipp netaddr.IPPort) (net.Listener, error) {
+				ln, err := ns.ListenTCP(ipp)
+				if err != nil {
+					return nil, err
+				}
+				return ln, nil
+			}
+		}
+		go runMetricsServer(logf, args.metricsAddr, mux, netmapIPs(srv.LocalBackend()), listen)
+	}
 
 	ln, _, err := safesocket.Listen(args.socketpath, safesocket.WindowsLocalPort)
 	if err != nil {
@@ -441,6 +547,13 @@ func tryEngine(logf logger.Logf, linkMon *monitor.Mon, name string) (e wgengine.
 		if err != nil {
 			return nil, false, err
 		}
+		if args.birdRoutesFile != "" {
+			conf.RouteFeed, err = createBIRDRouteFeed(conf.BIRDClient, args.birdRoutesFile)
+			if err != nil {
+				return nil, false, err
+			}
+			conf.RouteFeedPeers = args.birdPeerRoutes
+		}
 	}
 	if !useNetstack {
 		dev, devName, err := tstun.New(logf, name)
@@ -511,6 +624,23 @@ func newNetstack(logf logger.Logf, e wgengine.Engine) (*netstack.Impl, error) {
 	return netstack.Create(logf, tunDev, e, magicConn)
 }
 
+// parseSOCKSAuth parses the value of the --socks5-auth flag:
+// "user:password", or "file:" and the path of a file containing that.
+func parseSOCKSAuth(v string) (user, pass string, err error) {
+	if path := strings.TrimPrefix(v, "file:"); path != v {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return "", "", err
+		}
+		v = strings.TrimSpace(string(b))
+	}
+	i := strings.Index(v, ":")
+	if i <= 0 {
+		return "", "", errors.New(`want "user:password"`)
+	}
+	return v[:i], v[i+1:], nil
+}
+
 func mustStartTCPListener(name, addr string) net.Listener {
 	if addr == "" {
 		return nil
@@ -8,6 +8,8 @@
 package main
 
 import (
+	"fmt"
+
 	"tailscale.com/chirp"
 	"tailscale.com/wgengine"
 )
@@ -16,4 +18,11 @@ func init() {
 	createBIRDClient = func(ctlSocket string) (wgengine.BIRDClient, error) {
 		return chirp.New(ctlSocket)
 	}
+	createBIRDRouteFeed = func(c wgengine.BIRDClient, path string) (wgengine.RouteFeed, error) {
+		bc, ok := c.(*chirp.BIRDClient)
+		if !ok {
+			return nil, fmt.Errorf("BIRD route feed: unsupported BIRD client %T", c)
+		}
+		return chirp.NewRouteFeed(bc, path), nil
+	}
 }
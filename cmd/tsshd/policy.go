@@ -0,0 +1,157 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"tailscale.com/client/tailscale/apitype"
+)
+
+// Policy is the tsshd authorization policy. It is loaded from a JSON
+// file named by the --policy flag.
+//
+// Rules are evaluated in order; the first rule whose principals match
+// the connecting tailnet identity and whose LocalUsers permit the
+// requested SSH user decides the outcome. If no rule matches, the
+// connection is rejected.
+type Policy struct {
+	Rules []*PolicyRule
+}
+
+// PolicyRule is a single rule in a Policy.
+type PolicyRule struct {
+	// Users are the tailnet login names (e.g. "alice@example.com")
+	// this rule applies to. The special value "*" matches any user.
+	Users []string `json:",omitempty"`
+
+	// Tags are ACL tags (e.g. "tag:ci"). A node matches if it has
+	// any of the listed tags. Tagged nodes are not matched by Users
+	// (other than "*"), as tags replace user ownership.
+	Tags []string `json:",omitempty"`
+
+	// LocalUsers are the local Unix users the principals may log in
+	// as. The special value "=" means the local user with the same
+	// name as the local part of the tailnet login name
+	// ("alice@example.com" may log in as "alice"). The special
+	// value "*" means any local user.
+	LocalUsers []string
+
+	// Reject, if true, rejects matching connections instead of
+	// accepting them.
+	Reject bool `json:",omitempty"`
+}
+
+// loadPolicy reads and parses the policy file at path.
+func loadPolicy(path string) (*Policy, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parsePolicy(b)
+}
+
+func parsePolicy(b []byte) (*Policy, error) {
+	p := new(Policy)
+	if err := json.Unmarshal(b, p); err != nil {
+		return nil, fmt.Errorf("parsing policy: %w", err)
+	}
+	for i, r := range p.Rules {
+		if r == nil {
+			return nil, fmt.Errorf("policy rule %d is null", i)
+		}
+		if len(r.Users) == 0 && len(r.Tags) == 0 {
+			return nil, fmt.Errorf("policy rule %d has no Users or Tags", i)
+		}
+		if len(r.LocalUsers) == 0 {
+			return nil, fmt.Errorf("policy rule %d has no LocalUsers", i)
+		}
+		for _, t := range r.Tags {
+			if !strings.HasPrefix(t, "tag:") {
+				return nil, fmt.Errorf("policy rule %d: invalid tag %q", i, t)
+			}
+		}
+	}
+	return p, nil
+}
+
+var errNoPolicyMatch = errors.New("no policy rule matched")
+
+// localUserFor reports the local Unix user that the tailnet identity
+// who may log in as, given that they asked for sshUser.
+//
+// It returns an error if the policy does not permit the login.
+func (p *Policy) localUserFor(who *apitype.WhoIsResponse, sshUser string) (localUser string, err error) {
+	if who == nil || who.Node == nil || who.UserProfile == nil {
+		return "", errors.New("unknown tailnet identity")
+	}
+	for _, r := range p.Rules {
+		if !r.matchesPrincipal(who) {
+			continue
+		}
+		lu, ok := r.matchLocalUser(who, sshUser)
+		if !ok {
+			continue
+		}
+		if r.Reject {
+			return "", errors.New("rejected by policy")
+		}
+		return lu, nil
+	}
+	return "", errNoPolicyMatch
+}
+
+func (r *PolicyRule) matchesPrincipal(who *apitype.WhoIsResponse) bool {
+	tagged := len(who.Node.Tags) > 0
+	for _, u := range r.Users {
+		if u == "*" {
+			return true
+		}
+		if !tagged && strings.EqualFold(u, who.UserProfile.LoginName) {
+			return true
+		}
+	}
+	for _, want := range r.Tags {
+		for _, t := range who.Node.Tags {
+			if t == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r *PolicyRule) matchLocalUser(who *apitype.WhoIsResponse, sshUser string) (string, bool) {
+	for _, lu := range r.LocalUsers {
+		switch lu {
+		case "*":
+			return sshUser, true
+		case "=":
+			if len(who.Node.Tags) > 0 {
+				// Tagged nodes have no meaningful login name.
+				continue
+			}
+			local := who.UserProfile.LoginName
+			if i := strings.Index(local, "@"); i != -1 {
+				local = local[:i]
+			}
+			if local != "" && local == sshUser {
+				return sshUser, true
+			}
+		default:
+			if lu == sshUser {
+				return sshUser, true
+			}
+		}
+	}
+	return "", false
+}
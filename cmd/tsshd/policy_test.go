@@ -0,0 +1,88 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"testing"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+func TestPolicy(t *testing.T) {
+	p, err := parsePolicy([]byte(`{"Rules": [
+		{"Users": ["mallory@example.com"], "LocalUsers": ["*"], "Reject": true},
+		{"Users": ["alice@example.com"], "LocalUsers": ["=", "deploy"]},
+		{"Tags": ["tag:ci"], "LocalUsers": ["ci"]},
+		{"Users": ["*"], "LocalUsers": ["guest"]}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := func(login string) *apitype.WhoIsResponse {
+		return &apitype.WhoIsResponse{
+			Node:        &tailcfg.Node{Name: "n1.example.ts.net."},
+			UserProfile: &tailcfg.UserProfile{LoginName: login},
+		}
+	}
+	tagged := func(login string, tags ...string) *apitype.WhoIsResponse {
+		w := user(login)
+		w.Node.Tags = tags
+		return w
+	}
+	tests := []struct {
+		name    string
+		who     *apitype.WhoIsResponse
+		sshUser string
+		want    string // empty means rejected
+	}{
+		{"alice-self", user("alice@example.com"), "alice", "alice"},
+		{"alice-case", user("Alice@Example.com"), "alice", ""},
+		{"alice-deploy", user("alice@example.com"), "deploy", "deploy"},
+		{"alice-root", user("alice@example.com"), "root", ""},
+		{"alice-guest", user("alice@example.com"), "guest", "guest"},
+		{"bob-self", user("bob@example.com"), "bob", ""},
+		{"bob-guest", user("bob@example.com"), "guest", "guest"},
+		{"mallory-guest", user("mallory@example.com"), "guest", ""},
+		{"ci", tagged("alice@example.com", "tag:ci"), "ci", "ci"},
+		{"tagged-not-user", tagged("alice@example.com", "tag:ci"), "alice", ""},
+		{"tagged-other", tagged("alice@example.com", "tag:web"), "ci", ""},
+		{"nil", nil, "guest", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := p.localUserFor(tt.who, tt.sshUser)
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("got %q; want rejection", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePolicyErrors(t *testing.T) {
+	for _, in := range []string{
+		`{"Rules": [null]}`,
+		`{"Rules": [{"LocalUsers": ["x"]}]}`,
+		`{"Rules": [{"Users": ["*"]}]}`,
+		`{"Rules": [{"Tags": ["ci"], "LocalUsers": ["x"]}]}`,
+		`not json`,
+	} {
+		if _, err := parsePolicy([]byte(in)); err == nil {
+			t.Errorf("parsePolicy(%s) succeeded; want error", in)
+		}
+	}
+}
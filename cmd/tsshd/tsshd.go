@@ -6,18 +6,25 @@
 // +build !windows
 
 // The tsshd binary is an SSH server that accepts connections
-// from anybody on the same Tailscale network.
+// from peers on the same Tailscale network.
 //
-// It does not use passwords or SSH public key.
+// It does not use passwords or SSH public key. Instead, the
+// connecting peer's Tailscale IP is mapped to a tailnet user and node
+// using the local tailscaled's WhoIs LocalAPI, and that identity is
+// checked against the policy file named by --policy to decide which
+// local Unix users it may log in as.
 //
-// Any user name is accepted; users are logged in as whoever is
-// running this daemon.
+// Sessions run as the target local user, so tsshd generally needs to
+// run as root.
 //
 // Warning: use at your own risk. This code has had very few eyeballs
 // on it.
 package main
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -26,6 +33,10 @@ import (
 	"net"
 	"os"
 	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 	"unsafe"
@@ -34,20 +45,35 @@ import (
 	"github.com/gliderlabs/ssh"
 	gossh "golang.org/x/crypto/ssh"
 	"inet.af/netaddr"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/net/interfaces"
 	"tailscale.com/net/tsaddr"
 )
 
 var (
-	port    = flag.Int("port", 2200, "port to listen on")
-	hostKey = flag.String("hostkey", "", "SSH host key")
+	port       = flag.Int("port", 2200, "port to listen on")
+	hostKey    = flag.String("hostkey", "", "SSH host key")
+	policyFile = flag.String("policy", "", "path to JSON file with the SSH authorization policy")
 )
 
+// policy is the loaded authorization policy.
+// It is set once at startup and not modified afterwards.
+var policy *Policy
+
 func main() {
 	flag.Parse()
 	if *hostKey == "" {
 		log.Fatalf("missing required --hostkey")
 	}
+	if *policyFile == "" {
+		log.Fatalf("missing required --policy")
+	}
+	var err error
+	policy, err = loadPolicy(*policyFile)
+	if err != nil {
+		log.Fatalf("loading policy: %v", err)
+	}
 	hostKey, err := ioutil.ReadFile(*hostKey)
 	if err != nil {
 		log.Fatal(err)
@@ -98,7 +124,7 @@ func main() {
 }
 
 func handleSSH(s ssh.Session) {
-	user := s.User()
+	sshUser := s.User()
 	addr := s.RemoteAddr()
 	ta, ok := addr.(*net.TCPAddr)
 	if !ok {
@@ -118,57 +144,228 @@ func handleSSH(s ssh.Session) {
 		return
 	}
 
-	log.Printf("new session for %q from %v", user, ta)
-	defer log.Printf("closing session for %q from %v", user, ta)
-	ptyReq, winCh, isPty := s.Pty()
-	if !isPty {
-		fmt.Fprintf(s, "TODO scp etc")
+	ctx, cancel := context.WithTimeout(s.Context(), 10*time.Second)
+	who, err := tailscale.WhoIs(ctx, ta.String())
+	cancel()
+	if err != nil {
+		log.Printf("tsshd: rejecting %v: whois: %v", ta, err)
+		fmt.Fprintf(s, "tsshd: unknown tailnet peer\n")
+		s.Exit(1)
+		return
+	}
+	localUser, err := policy.localUserFor(who, sshUser)
+	if err != nil {
+		log.Printf("tsshd: rejecting %q from %v (%s): %v", sshUser, ta, describeWho(who), err)
+		fmt.Fprintf(s, "tsshd: access denied for %q\n", sshUser)
+		s.Exit(1)
+		return
+	}
+	lu, err := lookupLocalUser(localUser)
+	if err != nil {
+		log.Printf("tsshd: looking up local user %q: %v", localUser, err)
+		fmt.Fprintf(s, "tsshd: unknown local user %q\n", localUser)
 		s.Exit(1)
 		return
 	}
 
-	userWantsShell := len(s.Command()) == 0
+	log.Printf("new session for %q (%s) from %v", localUser, describeWho(who), ta)
+	defer log.Printf("closing session for %q from %v", localUser, ta)
 
-	if userWantsShell {
-		shell, err := shellOfUser(s.User())
+	cmd, err := lu.command(s.RawCommand())
+	if err != nil {
+		log.Printf("tsshd: preparing session for %q: %v", localUser, err)
+		fmt.Fprintf(s, "tsshd: %v\n", err)
+		s.Exit(1)
+		return
+	}
+	cmd.Env = append(cmd.Env, fmt.Sprintf("SSH_CLIENT=%s %d %d", ta.IP, ta.Port, *port))
+
+	ptyReq, winCh, isPty := s.Pty()
+	if !isPty {
+		// Use a pipe for stdin rather than setting cmd.Stdin to
+		// the session, so that Wait doesn't block on the client
+		// closing its stdin after the command has exited.
+		stdin, err := cmd.StdinPipe()
 		if err != nil {
-			fmt.Fprintf(s, "failed to find shell: %v\n", err)
+			log.Printf("running command: %v", err)
 			s.Exit(1)
 			return
 		}
-		cmd := exec.Command(shell)
-		cmd.Env = append(cmd.Env, fmt.Sprintf("TERM=%s", ptyReq.Term))
-		f, err := pty.Start(cmd)
-		if err != nil {
-			log.Printf("running shell: %v", err)
+		cmd.Stdout = s
+		cmd.Stderr = s.Stderr()
+		if err := cmd.Start(); err != nil {
+			log.Printf("running command: %v", err)
 			s.Exit(1)
 			return
 		}
-		defer f.Close()
 		go func() {
-			for win := range winCh {
-				setWinsize(f, win.Width, win.Height)
-			}
+			io.Copy(stdin, s)
+			stdin.Close()
 		}()
-		go func() {
-			io.Copy(f, s) // stdin
-		}()
-		io.Copy(s, f) // stdout
-		cmd.Process.Kill()
-		if err := cmd.Wait(); err != nil {
-			s.Exit(1)
-		}
-		s.Exit(0)
+		err = cmd.Wait()
+		stdin.Close()
+		s.Exit(exitStatus(err))
 		return
 	}
 
-	fmt.Fprintf(s, "TODO: args\n")
-	s.Exit(1)
+	cmd.Env = append(cmd.Env, fmt.Sprintf("TERM=%s", ptyReq.Term))
+	f, err := pty.Start(cmd)
+	if err != nil {
+		log.Printf("running shell: %v", err)
+		s.Exit(1)
+		return
+	}
+	defer f.Close()
+	go func() {
+		for win := range winCh {
+			setWinsize(f, win.Width, win.Height)
+		}
+	}()
+	go func() {
+		io.Copy(f, s) // stdin
+	}()
+	io.Copy(s, f) // stdout
+	cmd.Process.Kill()
+	s.Exit(exitStatus(cmd.Wait()))
+}
+
+// exitStatus returns the SSH exit status for err, the result of
+// waiting for a session's command.
+func exitStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+	var ee *exec.ExitError
+	if !errors.As(err, &ee) {
+		log.Printf("running command: %v", err)
+		return 1
+	}
+	if ws, ok := ee.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		// Like shells, report death by signal N as 128+N.
+		return 128 + int(ws.Signal())
+	}
+	return ee.ExitCode()
+}
+
+// describeWho returns a description of who for logging. who may be
+// missing fields.
+func describeWho(who *apitype.WhoIsResponse) string {
+	login, node := "unknown user", "unknown node"
+	if who != nil && who.UserProfile != nil {
+		login = who.UserProfile.LoginName
+	}
+	if who != nil && who.Node != nil {
+		node = who.Node.Name
+	}
+	return login + " on " + node
+}
+
+// localUser is a local Unix user that an SSH session runs as.
+type localUser struct {
+	*user.User
+	uid, gid uint32
+	groups   []uint32
+	shell    string
 }
 
-func shellOfUser(user string) (string, error) {
-	// TODO
-	return "/bin/bash", nil
+// lookupLocalUser returns the local Unix user with the given name.
+func lookupLocalUser(name string) (*localUser, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	lu := &localUser{
+		User:  u,
+		uid:   uint32(uid),
+		gid:   uint32(gid),
+		shell: shellOfUser(name),
+	}
+	gids, err := u.GroupIds()
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range gids {
+		v, err := strconv.ParseUint(g, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		lu.groups = append(lu.groups, uint32(v))
+	}
+	return lu, nil
+}
+
+// command returns the command to run for the session. If rawCmd is
+// empty, it's an interactive login shell. Otherwise rawCmd, exactly as
+// the client sent it, is run by the user's shell with -c.
+//
+// The returned command runs as lu, with a login environment.
+func (lu *localUser) command(rawCmd string) (*exec.Cmd, error) {
+	euid := uint32(os.Geteuid())
+	if euid != 0 && euid != lu.uid {
+		return nil, fmt.Errorf("cannot run as %q: tsshd is not running as root", lu.Username)
+	}
+	var cmd *exec.Cmd
+	if rawCmd == "" {
+		cmd = exec.Command(lu.shell)
+		cmd.Args[0] = "-" + filepath.Base(lu.shell) // login shell
+	} else {
+		cmd = exec.Command(lu.shell, "-c", rawCmd)
+	}
+	cmd.Dir = lu.HomeDir
+	if fi, err := os.Stat(cmd.Dir); err != nil || !fi.IsDir() {
+		cmd.Dir = "/"
+	}
+	cmd.Env = []string{
+		"HOME=" + lu.HomeDir,
+		"USER=" + lu.Username,
+		"LOGNAME=" + lu.Username,
+		"SHELL=" + lu.shell,
+		"PATH=" + defaultPath(lu.uid),
+	}
+	if euid != lu.uid {
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Credential: &syscall.Credential{
+				Uid:    lu.uid,
+				Gid:    lu.gid,
+				Groups: lu.groups,
+			},
+		}
+	}
+	return cmd, nil
+}
+
+func defaultPath(uid uint32) string {
+	if uid == 0 {
+		return "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+	}
+	return "/usr/local/bin:/usr/bin:/bin"
+}
+
+// shellOfUser returns the login shell of the named user from
+// /etc/passwd, or /bin/sh if it can't be determined.
+func shellOfUser(name string) string {
+	f, err := os.Open("/etc/passwd")
+	if err != nil {
+		return "/bin/sh"
+	}
+	defer f.Close()
+	bs := bufio.NewScanner(f)
+	for bs.Scan() {
+		// name:passwd:uid:gid:gecos:home:shell
+		fields := strings.Split(bs.Text(), ":")
+		if len(fields) == 7 && fields[0] == name && fields[6] != "" {
+			return fields[6]
+		}
+	}
+	return "/bin/sh"
 }
 
 func setWinsize(f *os.File, w, h int) {
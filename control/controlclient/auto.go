@@ -693,6 +693,7 @@ func (c *Auto) Shutdown() {
 		<-c.authDone
 		c.cancelMapUnsafely()
 		<-c.mapDone
+		c.direct.Close()
 		c.logf("Client.Shutdown done.")
 	}
 }
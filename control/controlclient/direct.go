@@ -15,6 +15,7 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -52,8 +53,10 @@ import (
 
 // Direct is the client that connects to a tailcontrol server for a node.
 type Direct struct {
-	httpc                  *http.Client // HTTP client used to talk to tailcontrol
-	serverURL              string       // URL of the tailcontrol server
+	httpc                  *http.Client             // HTTP client used to talk to tailcontrol
+	dialContext            dnscache.DialContextFunc // for the Noise transport, or nil if unsupported
+	noise                  bool                     // whether to use the Noise transport, if the server supports it
+	serverURL              string                   // URL of the tailcontrol server
 	timeNow                func() time.Time
 	lastPrintMap           time.Time
 	newDecompressor        func() (Decompressor, error)
@@ -69,6 +72,9 @@ type Direct struct {
 
 	mu           sync.Mutex // mutex guards the following fields
 	serverKey    key.MachinePublic
+	noiseKey     key.MachinePublic // server's Noise key, or zero if unsupported
+	noiseClient  *noiseClient      // or nil if not yet needed
+	closed       bool              // whether Close was called
 	persist      persist.Persist
 	authKey      string
 	tryingNewKey key.NodePrivate
@@ -95,6 +101,7 @@ type Options struct {
 	HTTPTestClient       *http.Client // optional HTTP client to use (for tests only)
 	DebugFlags           []string     // debug settings to send to control
 	LinkMonitor          *monitor.Mon // optional link monitor
+	Noise                bool         // use the Noise control transport, if the server supports it
 
 	// KeepSharerAndUserSplit controls whether the client
 	// understands Node.Sharer. If false, the Sharer is mapped to the User.
@@ -146,6 +153,10 @@ func NewDirect(opts Options) (*Direct, error) {
 	}
 
 	httpc := opts.HTTPTestClient
+	var dialContext dnscache.DialContextFunc
+	if httpc != nil {
+		dialContext = new(net.Dialer).DialContext
+	}
 	if httpc == nil && runtime.GOOS == "js" {
 		// In js/wasm, net/http.Transport (as of Go 1.18) will
 		// only use the browser's Fetch API if you're using
@@ -164,7 +175,8 @@ func NewDirect(opts Options) (*Direct, error) {
 		tr.Proxy = tshttpproxy.ProxyFromEnvironment
 		tshttpproxy.SetTransportGetProxyConnectHeader(tr)
 		tr.TLSClientConfig = tlsdial.Config(serverURL.Hostname(), tr.TLSClientConfig)
-		tr.DialContext = dnscache.Dialer(dialer.DialContext, dnsCache)
+		dialContext = dnscache.Dialer(dialer.DialContext, dnsCache)
+		tr.DialContext = dialContext
 		tr.DialTLSContext = dnscache.TLSDialer(dialer.DialContext, dnsCache, tr.TLSClientConfig)
 		tr.ForceAttemptHTTP2 = true
 		httpc = &http.Client{Transport: tr}
@@ -172,6 +184,8 @@ func NewDirect(opts Options) (*Direct, error) {
 
 	c := &Direct{
 		httpc:                  httpc,
+		dialContext:            dialContext,
+		noise:                  opts.Noise,
 		getMachinePrivKey:      opts.GetMachinePrivateKey,
 		serverURL:              opts.ServerURL,
 		timeNow:                opts.TimeNow,
@@ -321,15 +335,20 @@ func (c *Direct) doLogin(ctx context.Context, opt loginOpt) (mustRegen bool, new
 
 	c.logf("doLogin(regen=%v, hasUrl=%v)", regen, opt.URL != "")
 	if serverKey.IsZero() {
+		var noiseKey key.MachinePublic
 		var err error
-		serverKey, err = loadServerKey(ctx, c.httpc, c.serverURL)
+		serverKey, noiseKey, err = loadServerKeys(ctx, c.httpc, c.serverURL)
 		if err != nil {
 			return regen, opt.URL, err
 		}
 		c.logf("control server key %s from %s", serverKey.ShortString(), c.serverURL)
+		if !noiseKey.IsZero() {
+			c.logf("control server Noise key %s", noiseKey.ShortString())
+		}
 
 		c.mu.Lock()
 		c.serverKey = serverKey
+		c.noiseKey = noiseKey
 		c.mu.Unlock()
 	}
 
@@ -400,20 +419,7 @@ func (c *Direct) doLogin(ctx context.Context, opt loginOpt) (mustRegen bool, new
 		c.logf("RegisterRequest: %s", j)
 	}
 
-	bodyData, err := encode(request, serverKey, machinePrivKey)
-	if err != nil {
-		return regen, opt.URL, err
-	}
-	body := bytes.NewReader(bodyData)
-
-	u := fmt.Sprintf("%s/machine/%s", c.serverURL, machinePrivKey.Public().UntypedHexString())
-	req, err := http.NewRequest("POST", u, body)
-	if err != nil {
-		return regen, opt.URL, err
-	}
-	req = req.WithContext(ctx)
-
-	res, err := c.httpc.Do(req)
+	res, overNoise, err := c.doMachineRequest(ctx, "register", request, serverKey, machinePrivKey)
 	if err != nil {
 		return regen, opt.URL, fmt.Errorf("register request: %v", err)
 	}
@@ -424,7 +430,7 @@ func (c *Direct) doLogin(ctx context.Context, opt loginOpt) (mustRegen bool, new
 			res.StatusCode, strings.TrimSpace(string(msg)))
 	}
 	resp := tailcfg.RegisterResponse{}
-	if err := decode(res, &resp, serverKey, machinePrivKey); err != nil {
+	if err := decode(res, &resp, serverKey, machinePrivKey, overNoise); err != nil {
 		c.logf("error decoding RegisterResponse with server key %s and machine key %s: %v", serverKey, machinePrivKey.Public(), err)
 		return regen, opt.URL, fmt.Errorf("register request: %v", err)
 	}
@@ -560,7 +566,6 @@ const pollTimeout = 120 * time.Second
 func (c *Direct) sendMapRequest(ctx context.Context, maxPolls int, cb func(*netmap.NetworkMap)) error {
 	c.mu.Lock()
 	persist := c.persist
-	serverURL := c.serverURL
 	serverKey := c.serverKey
 	hi := c.hostinfo.Clone()
 	backendLogID := hi.BackendLogID
@@ -644,25 +649,13 @@ func (c *Direct) sendMapRequest(ctx context.Context, maxPolls int, cb func(*netm
 		request.ReadOnly = true
 	}
 
-	bodyData, err := encode(request, serverKey, machinePrivKey)
-	if err != nil {
-		vlogf("netmap: encode: %v", err)
-		return err
-	}
-
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
 	machinePubKey := machinePrivKey.Public()
 	t0 := time.Now()
-	u := fmt.Sprintf("%s/machine/%s/map", serverURL, machinePubKey.UntypedHexString())
 
-	req, err := http.NewRequestWithContext(ctx, "POST", u, bytes.NewReader(bodyData))
-	if err != nil {
-		return err
-	}
-
-	res, err := c.httpc.Do(req)
+	res, overNoise, err := c.doMachineRequest(ctx, "map", request, serverKey, machinePrivKey)
 	if err != nil {
 		vlogf("netmap: Do: %v", err)
 		return err
@@ -742,7 +735,7 @@ func (c *Direct) sendMapRequest(ctx context.Context, maxPolls int, cb func(*netm
 		vlogf("netmap: read body after %v", time.Since(t0).Round(time.Millisecond))
 
 		var resp tailcfg.MapResponse
-		if err := c.decodeMsg(msg, &resp, machinePrivKey); err != nil {
+		if err := c.decodeMsg(msg, &resp, machinePrivKey, overNoise); err != nil {
 			vlogf("netmap: decode error: %v")
 			return err
 		}
@@ -842,7 +835,9 @@ func (c *Direct) sendMapRequest(ctx context.Context, maxPolls int, cb func(*netm
 	return nil
 }
 
-func decode(res *http.Response, v interface{}, serverKey key.MachinePublic, mkey key.MachinePrivate) error {
+// decode decodes the response res into v. Unless it came over the
+// Noise transport, it's boxed from serverKey to mkey.
+func decode(res *http.Response, v interface{}, serverKey key.MachinePublic, mkey key.MachinePrivate, overNoise bool) error {
 	defer res.Body.Close()
 	msg, err := ioutil.ReadAll(io.LimitReader(res.Body, 1<<20))
 	if err != nil {
@@ -851,7 +846,7 @@ func decode(res *http.Response, v interface{}, serverKey key.MachinePublic, mkey
 	if res.StatusCode != 200 {
 		return fmt.Errorf("%d: %v", res.StatusCode, string(msg))
 	}
-	return decodeMsg(msg, v, serverKey, mkey)
+	return decodeMsg(msg, v, serverKey, mkey, overNoise)
 }
 
 var (
@@ -861,14 +856,18 @@ var (
 
 var jsonEscapedZero = []byte(`\u0000`)
 
-func (c *Direct) decodeMsg(msg []byte, v interface{}, machinePrivKey key.MachinePrivate) error {
+func (c *Direct) decodeMsg(msg []byte, v interface{}, machinePrivKey key.MachinePrivate, overNoise bool) error {
 	c.mu.Lock()
 	serverKey := c.serverKey
 	c.mu.Unlock()
 
-	decrypted, ok := machinePrivKey.OpenFrom(serverKey, msg)
-	if !ok {
-		return errors.New("cannot decrypt response")
+	decrypted := msg
+	if !overNoise {
+		var ok bool
+		decrypted, ok = machinePrivKey.OpenFrom(serverKey, msg)
+		if !ok {
+			return errors.New("cannot decrypt response")
+		}
 	}
 	var b []byte
 	if c.newDecompressor == nil {
@@ -900,10 +899,14 @@ func (c *Direct) decodeMsg(msg []byte, v interface{}, machinePrivKey key.Machine
 
 }
 
-func decodeMsg(msg []byte, v interface{}, serverKey key.MachinePublic, machinePrivKey key.MachinePrivate) error {
-	decrypted, ok := machinePrivKey.OpenFrom(serverKey, msg)
-	if !ok {
-		return errors.New("cannot decrypt response")
+func decodeMsg(msg []byte, v interface{}, serverKey key.MachinePublic, machinePrivKey key.MachinePrivate, overNoise bool) error {
+	decrypted := msg
+	if !overNoise {
+		var ok bool
+		decrypted, ok = machinePrivKey.OpenFrom(serverKey, msg)
+		if !ok {
+			return errors.New("cannot decrypt response")
+		}
 	}
 	if bytes.Contains(decrypted, jsonEscapedZero) {
 		log.Printf("[unexpected] zero byte in controlclient decodeMsg into %T: %q", v, decrypted)
@@ -914,6 +917,9 @@ func decodeMsg(msg []byte, v interface{}, serverKey key.MachinePublic, machinePr
 	return nil
 }
 
+// encode encodes v as JSON, boxed from mkey to serverKey. If
+// serverKey is zero, as it is for requests over the Noise transport,
+// it's not boxed.
 func encode(v interface{}, serverKey key.MachinePublic, mkey key.MachinePrivate) ([]byte, error) {
 	b, err := json.Marshal(v)
 	if err != nil {
@@ -924,32 +930,116 @@ func encode(v interface{}, serverKey key.MachinePublic, mkey key.MachinePrivate)
 			log.Printf("MapRequest: %s", b)
 		}
 	}
+	if serverKey.IsZero() {
+		return b, nil
+	}
 	return mkey.SealTo(serverKey, b), nil
 }
 
-func loadServerKey(ctx context.Context, httpc *http.Client, serverURL string) (key.MachinePublic, error) {
-	req, err := http.NewRequest("GET", serverURL+"/key", nil)
+// doMachineRequest POSTs v to the control server's machine endpoint
+// named ep ("register", "map" or "set-dns"). It reports whether the
+// request went over the Noise transport, whose responses aren't boxed.
+func (c *Direct) doMachineRequest(ctx context.Context, ep string, v interface{}, serverKey key.MachinePublic, machinePrivKey key.MachinePrivate) (res *http.Response, overNoise bool, err error) {
+	var u string
+	httpc := c.httpc
+	if nc := c.getNoiseClient(machinePrivKey); nc != nil {
+		overNoise = true
+		serverKey = key.MachinePublic{} // don't box
+		u = fmt.Sprintf("%s/machine/%s", c.serverURL, ep)
+		httpc = nc.httpc
+	} else {
+		u = fmt.Sprintf("%s/machine/%s", c.serverURL, machinePrivKey.Public().UntypedHexString())
+		if ep != "register" {
+			u += "/" + ep
+		}
+	}
+	bodyData, err := encode(v, serverKey, machinePrivKey)
+	if err != nil {
+		return nil, false, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", u, bytes.NewReader(bodyData))
+	if err != nil {
+		return nil, false, err
+	}
+	res, err = httpc.Do(req)
 	if err != nil {
-		return key.MachinePublic{}, fmt.Errorf("create control key request: %v", err)
+		return nil, false, err
+	}
+	return res, overNoise, nil
+}
+
+// getNoiseClient returns the client for the Noise transport to the
+// control server as machinePrivKey, or nil if it's not in use.
+//
+// The Noise transport is used if Options.Noise was set and the
+// control server supports it.
+func (c *Direct) getNoiseClient(machinePrivKey key.MachinePrivate) *noiseClient {
+	if !c.noise || c.dialContext == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.noiseKey.IsZero() || c.closed {
+		return nil
+	}
+	if nc := c.noiseClient; nc != nil && nc.machineKey.Equal(machinePrivKey) && nc.serverKey == c.noiseKey {
+		return nc
+	}
+	if c.noiseClient != nil {
+		c.noiseClient.close()
+	}
+	c.noiseClient = newNoiseClient(c.serverURL, machinePrivKey, c.noiseKey, c.dialContext)
+	return c.noiseClient
+}
+
+// loadServerKeys fetches the control server's public keys: its legacy
+// key, and its key for the Noise transport, which is zero if the
+// server doesn't support it.
+func loadServerKeys(ctx context.Context, httpc *http.Client, serverURL string) (legacyKey, noiseKey key.MachinePublic, err error) {
+	u := fmt.Sprintf("%s/key?v=%d", serverURL, tailcfg.CurrentMapRequestVersion)
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return legacyKey, noiseKey, fmt.Errorf("create control key request: %v", err)
 	}
-	req = req.WithContext(ctx)
 	res, err := httpc.Do(req)
 	if err != nil {
-		return key.MachinePublic{}, fmt.Errorf("fetch control key: %v", err)
+		return legacyKey, noiseKey, fmt.Errorf("fetch control key: %v", err)
 	}
 	defer res.Body.Close()
 	b, err := ioutil.ReadAll(io.LimitReader(res.Body, 1<<16))
 	if err != nil {
-		return key.MachinePublic{}, fmt.Errorf("fetch control key response: %v", err)
+		return legacyKey, noiseKey, fmt.Errorf("fetch control key response: %v", err)
 	}
 	if res.StatusCode != 200 {
-		return key.MachinePublic{}, fmt.Errorf("fetch control key: %d: %s", res.StatusCode, string(b))
+		return legacyKey, noiseKey, fmt.Errorf("fetch control key: %d: %s", res.StatusCode, string(b))
 	}
-	k, err := key.ParseMachinePublicUntyped(mem.B(b))
+	if bytes.HasPrefix(b, []byte("{")) {
+		var keys tailcfg.ServerKeyResponse
+		if err := json.Unmarshal(b, &keys); err != nil {
+			return legacyKey, noiseKey, fmt.Errorf("fetch control key: %v", err)
+		}
+		return keys.LegacyPublicKey, keys.PublicKey, nil
+	}
+	// Servers without the Noise transport reply with just their
+	// legacy key, in hex.
+	legacyKey, err = key.ParseMachinePublicUntyped(mem.B(b))
 	if err != nil {
-		return key.MachinePublic{}, fmt.Errorf("fetch control key: %v", err)
+		return legacyKey, noiseKey, fmt.Errorf("fetch control key: %v", err)
+	}
+	return legacyKey, noiseKey, nil
+}
+
+// Close closes the connections of c's Noise transport, if any.
+// Requests made after Close don't use the Noise transport.
+func (c *Direct) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	if c.noiseClient != nil {
+		c.noiseClient.close()
+		c.noiseClient = nil
 	}
-	return k, nil
+	return nil
 }
 
 // Debug contains temporary internal-only debug knobs.
@@ -1197,18 +1287,7 @@ func (c *Direct) SetDNS(ctx context.Context, req *tailcfg.SetDNSRequest) error {
 		return errors.New("getMachinePrivKey returned zero key")
 	}
 
-	bodyData, err := encode(req, serverKey, machinePrivKey)
-	if err != nil {
-		return err
-	}
-	body := bytes.NewReader(bodyData)
-
-	u := fmt.Sprintf("%s/machine/%s/set-dns", c.serverURL, machinePrivKey.Public().UntypedHexString())
-	hreq, err := http.NewRequestWithContext(ctx, "POST", u, body)
-	if err != nil {
-		return err
-	}
-	res, err := c.httpc.Do(hreq)
+	res, overNoise, err := c.doMachineRequest(ctx, "set-dns", req, serverKey, machinePrivKey)
 	if err != nil {
 		return err
 	}
@@ -1218,7 +1297,7 @@ func (c *Direct) SetDNS(ctx context.Context, req *tailcfg.SetDNSRequest) error {
 		return fmt.Errorf("set-dns response: %v, %.200s", res.Status, strings.TrimSpace(string(msg)))
 	}
 	var setDNSRes struct{} // no fields yet
-	if err := decode(res, &setDNSRes, serverKey, machinePrivKey); err != nil {
+	if err := decode(res, &setDNSRes, serverKey, machinePrivKey, overNoise); err != nil {
 		c.logf("error decoding SetDNSResponse with server key %s and machine key %s: %v", serverKey, machinePrivKey.Public(), err)
 		return fmt.Errorf("set-dns-response: %v", err)
 	}
@@ -0,0 +1,234 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package controlclient
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+	"tailscale.com/control/noise"
+	"tailscale.com/net/dnscache"
+	"tailscale.com/net/tlsdial"
+	"tailscale.com/net/tshttpproxy"
+	"tailscale.com/types/key"
+)
+
+// noiseDialTimeout bounds how long dialing and handshaking a Noise
+// connection to the control server may take.
+const noiseDialTimeout = 30 * time.Second
+
+// noiseClient sends requests to the control server as HTTP/2 over a
+// Noise connection, which it dials (and redials, once broken) as
+// needed. Requests sent over it identify the machine by the Noise
+// handshake, so they're neither boxed nor include the machine key in
+// their paths.
+type noiseClient struct {
+	httpc *http.Client // for requests to the control server
+
+	serverURL   string
+	machineKey  key.MachinePrivate
+	serverKey   key.MachinePublic // the server's Noise static key
+	dialContext dnscache.DialContextFunc
+	h2t         *http2.Transport
+}
+
+func newNoiseClient(serverURL string, machineKey key.MachinePrivate, serverKey key.MachinePublic, dialContext dnscache.DialContextFunc) *noiseClient {
+	nc := &noiseClient{
+		serverURL:   serverURL,
+		machineKey:  machineKey,
+		serverKey:   serverKey,
+		dialContext: dialContext,
+	}
+	nc.h2t = &http2.Transport{
+		// The control server's URL may be http, but the
+		// connection is secured by Noise regardless.
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), noiseDialTimeout)
+			defer cancel()
+			return nc.dial(ctx)
+		},
+	}
+	nc.httpc = &http.Client{Transport: nc.h2t}
+	return nc
+}
+
+// close closes the client's idle connections. In-flight requests
+// continue until done.
+func (nc *noiseClient) close() {
+	nc.h2t.CloseIdleConnections()
+}
+
+// dial dials the control server, via the HTTP proxy Direct's other
+// requests use if there is one, upgrades the connection to the Noise
+// transport and does the handshake.
+func (nc *noiseClient) dial(ctx context.Context) (*noise.Conn, error) {
+	u, err := url.Parse(nc.serverURL)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Hostname()
+	useTLS := u.Scheme == "https"
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if useTLS {
+			port = "443"
+		}
+	}
+	addr := net.JoinHostPort(host, port)
+	proxyURL, err := tshttpproxy.ProxyFromEnvironment(&http.Request{URL: u})
+	if err != nil {
+		return nil, fmt.Errorf("noise dial: %w", err)
+	}
+	var conn net.Conn
+	if proxyURL != nil {
+		conn, err = nc.dialProxy(ctx, proxyURL, addr)
+	} else {
+		conn, err = nc.dialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("noise dial: %w", err)
+	}
+	if useTLS {
+		tlsConn := tls.Client(conn, tlsdial.Config(host, nil))
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("noise dial: %w", err)
+		}
+		conn = tlsConn
+	}
+	if err := nc.upgrade(ctx, conn, u); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("noise upgrade: %w", err)
+	}
+	ncc, err := noise.Client(ctx, conn, nc.machineKey, nc.serverKey)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("noise handshake: %w", err)
+	}
+	return ncc, nil
+}
+
+// dialProxy dials the HTTP proxy at proxyURL and asks it to CONNECT to
+// addr, returning the tunneled connection.
+func (nc *noiseClient) dialProxy(ctx context.Context, proxyURL *url.URL, addr string) (net.Conn, error) {
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		if proxyURL.Scheme == "https" {
+			proxyAddr = net.JoinHostPort(proxyURL.Hostname(), "443")
+		} else {
+			proxyAddr = net.JoinHostPort(proxyURL.Hostname(), "80")
+		}
+	}
+	conn, err := nc.dialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("proxy %s: %w", proxyAddr, err)
+	}
+	if proxyURL.Scheme == "https" {
+		tlsConn := tls.Client(conn, tlsdial.Config(proxyURL.Hostname(), nil))
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("proxy %s: %w", proxyAddr, err)
+		}
+		conn = tlsConn
+	}
+	if err := proxyConnect(ctx, conn, proxyURL, addr); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %w", proxyAddr, err)
+	}
+	return conn, nil
+}
+
+// proxyConnect sends a CONNECT request for addr to the HTTP proxy at
+// proxyURL over conn, and waits for it to succeed.
+func proxyConnect(ctx context.Context, conn net.Conn, proxyURL *url.URL, addr string) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	auth, err := tshttpproxy.GetAuthHeader(proxyURL)
+	if err != nil {
+		return err
+	}
+	if auth != "" {
+		req.Header.Set("Proxy-Authorization", auth)
+	}
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+
+	// The proxy sends nothing more until the tunnel is used, so br
+	// can't have read past its response.
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return fmt.Errorf("CONNECT %s: %s", addr, res.Status)
+	}
+	if br.Buffered() > 0 {
+		return errors.New("unexpected data after CONNECT response")
+	}
+	return nil
+}
+
+// upgrade asks the control server to switch conn to the Noise
+// transport, and waits for it to agree.
+func (nc *noiseClient) upgrade(ctx context.Context, conn net.Conn, serverURL *url.URL) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	u := *serverURL
+	u.Path = noise.UpgradePath
+	req, err := http.NewRequest("POST", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Upgrade", noise.UpgradeProtocol)
+	req.Header.Set("Connection", "upgrade")
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+
+	// The server sends nothing after its response until the client
+	// starts the handshake, so br can't have read past it.
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		msg, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		return fmt.Errorf("http %d: %.200s", res.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	if !strings.EqualFold(res.Header.Get("Upgrade"), noise.UpgradeProtocol) {
+		return fmt.Errorf("unexpected Upgrade %q", res.Header.Get("Upgrade"))
+	}
+	if br.Buffered() > 0 {
+		return errors.New("unexpected data after upgrade response")
+	}
+	return nil
+}
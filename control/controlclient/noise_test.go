@@ -0,0 +1,138 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package controlclient
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"tailscale.com/hostinfo"
+	"tailscale.com/tstest/integration/testcontrol"
+	"tailscale.com/types/key"
+	"tailscale.com/types/netmap"
+)
+
+func TestNoiseTransport(t *testing.T) {
+	for _, useNoise := range []bool{false, true} {
+		t.Run(fmt.Sprintf("noise=%v", useNoise), func(t *testing.T) {
+			control := &testcontrol.Server{RequireNoise: useNoise}
+			control.HTTPTestServer = httptest.NewServer(control)
+			defer control.HTTPTestServer.Close()
+
+			hi := hostinfo.New()
+			hi.BackendLogID = "test-backend-log-id"
+			mk := key.NewMachine()
+			c, err := NewDirect(Options{
+				ServerURL: control.BaseURL(),
+				Hostinfo:  hi,
+				GetMachinePrivateKey: func() (key.MachinePrivate, error) {
+					return mk, nil
+				},
+				HTTPTestClient: control.HTTPTestServer.Client(),
+				Logf:           t.Logf,
+				Noise:          useNoise,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			authURL, err := c.TryLogin(ctx, nil, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if authURL != "" {
+				t.Fatalf("got auth URL %q; want none", authURL)
+			}
+
+			var nm *netmap.NetworkMap
+			if err := c.PollNetMap(ctx, 1, func(got *netmap.NetworkMap) { nm = got }); err != nil {
+				t.Fatal(err)
+			}
+			if nm == nil {
+				t.Fatal("no netmap")
+			}
+			if got := nm.SelfNode.Machine; got != mk.Public() {
+				t.Errorf("self machine key = %v; want %v", got, mk.Public())
+			}
+
+			c.mu.Lock()
+			gotNoise := c.noiseClient != nil
+			c.mu.Unlock()
+			if gotNoise != useNoise {
+				t.Errorf("used Noise = %v; want %v", gotNoise, useNoise)
+			}
+
+			c.Close()
+			c.mu.Lock()
+			gotNoise = c.noiseClient != nil
+			c.mu.Unlock()
+			if gotNoise {
+				t.Error("Noise client not closed by Close")
+			}
+		})
+	}
+}
+
+func TestNoiseDialProxy(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	gotReq := make(chan *http.Request, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		br := bufio.NewReader(c)
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		gotReq <- req
+		io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n")
+		io.Copy(c, br) // echo
+	}()
+
+	nc := &noiseClient{dialContext: new(net.Dialer).DialContext}
+	proxyURL := &url.URL{Scheme: "http", Host: ln.Addr().String(), User: url.UserPassword("foo", "bar")}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := nc.dialProxy(ctx, proxyURL, "control.example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	req := <-gotReq
+	if req.Method != "CONNECT" || req.Host != "control.example.com:443" {
+		t.Errorf("proxy got %s %s; want CONNECT control.example.com:443", req.Method, req.Host)
+	}
+	if got, want := req.Header.Get("Proxy-Authorization"), "Basic Zm9vOmJhcg=="; got != want {
+		t.Errorf("Proxy-Authorization = %q; want %q", got, want)
+	}
+	if _, err := io.WriteString(conn, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Errorf("tunnel echoed %q; want hello", buf)
+	}
+}
@@ -44,6 +44,17 @@ const (
 	invalidNonce          = ^uint64(0)
 )
 
+const (
+	// UpgradePath is the path of the control server's HTTP endpoint
+	// that switches a connection to this transport. Once the server
+	// replies 101 Switching Protocols, the client starts the
+	// handshake on the same connection.
+	UpgradePath = "/ts2021"
+	// UpgradeProtocol is the value of the Upgrade header in requests
+	// to UpgradePath and in their responses.
+	UpgradeProtocol = "tailscale-control-protocol"
+)
+
 func protocolVersionPrologue(version uint16) []byte {
 	ret := make([]byte, 0, len(protocolVersionPrefix)+5) // 5 bytes is enough to encode all possible version numbers.
 	ret = append(ret, protocolVersionPrefix...)
@@ -131,6 +131,7 @@ type Server struct {
 	dupClientConns               expvar.Int // current number of connections sharing a public key
 	dupClientConnTotal           expvar.Int // total number of accepted connections when a dup key existed
 	unknownFrames                expvar.Int
+	clientsRejected              expvar.Int // clients refused by verifyClient
 	homeMovesIn                  expvar.Int // established clients announce home server moves in
 	homeMovesOut                 expvar.Int // established clients announce home server moves out
 	multiForwarderCreated        expvar.Int
@@ -142,6 +143,13 @@ type Server struct {
 	// known peer in the network, as specified by a running tailscaled's client's local api.
 	verifyClients bool
 
+	// admitClient, if non-nil, is the admission check set by
+	// SetAdmitClient.
+	admitClient func(context.Context, key.NodePublic) error
+
+	rateLimits    RateLimits
+	globalLimiter *rate.Limiter // or nil if there's no global limit
+
 	mu       sync.Mutex
 	closed   bool
 	netConns map[Conn]chan struct{} // chan is closed when conn closes
@@ -161,6 +169,11 @@ type Server struct {
 
 	// maps from netaddr.IPPort to a client's public key
 	keyOfAddr map[netaddr.IPPort]key.NodePublic
+
+	// keyLimiters are the rate limiters of each connected client
+	// key, shared by all of its connections. It's empty if there
+	// are no per-client limits.
+	keyLimiters map[key.NodePublic]*keyLimiter
 }
 
 // clientSet represents 1 or more *sclients.
@@ -313,6 +326,7 @@ func NewServer(privateKey key.NodePrivate, logf logger.Logf) *Server {
 		sentTo:               map[key.NodePublic]map[key.NodePublic]int64{},
 		avgQueueDuration:     new(uint64),
 		keyOfAddr:            map[netaddr.IPPort]key.NodePublic{},
+		keyLimiters:          map[key.NodePublic]*keyLimiter{},
 	}
 	s.initMetacert()
 	s.packetsRecvDisco = s.packetsRecvByKind.Get("disco")
@@ -324,6 +338,10 @@ func NewServer(privateKey key.NodePrivate, logf logger.Logf) *Server {
 		s.packetsDroppedReason.Get("queue_head"),
 		s.packetsDroppedReason.Get("queue_tail"),
 		s.packetsDroppedReason.Get("write_error"),
+		s.packetsDroppedReason.Get("dup_client"),
+		s.packetsDroppedReason.Get("client_packets_limit"),
+		s.packetsDroppedReason.Get("client_bytes_limit"),
+		s.packetsDroppedReason.Get("global_bytes_limit"),
 	}
 	s.packetsDroppedTypeDisco = s.packetsDroppedType.Get("disco")
 	s.packetsDroppedTypeOther = s.packetsDroppedType.Get("other")
@@ -345,6 +363,111 @@ func (s *Server) SetVerifyClient(v bool) {
 	s.verifyClients = v
 }
 
+// RateLimits are limits on the packets a Server accepts from clients
+// for delivery. Zero values mean no limit. Packets over a limit are
+// dropped, and counted by reason in the server's
+// counter_packets_dropped_reason expvar.
+//
+// Sizes are counted as DERP frames, including framing bytes, as
+// clients count them when they respect the limits the server
+// advertises.
+type RateLimits struct {
+	// PerClientPacketsPerSecond and PerClientPacketsBurst limit the
+	// packets sent by each client public key, over all of its
+	// connections. Mesh peers are exempt.
+	PerClientPacketsPerSecond int `json:",omitempty"`
+	PerClientPacketsBurst     int `json:",omitempty"`
+
+	// PerClientBytesPerSecond and PerClientBytesBurst limit the
+	// bytes sent by each client public key, over all of its
+	// connections. Mesh peers are exempt. The bytes limits are
+	// advertised to clients, which then limit themselves.
+	PerClientBytesPerSecond int `json:",omitempty"`
+	PerClientBytesBurst     int `json:",omitempty"`
+
+	// GlobalBytesPerSecond and GlobalBytesBurst limit the bytes
+	// sent by all clients together, including packets forwarded by
+	// mesh peers.
+	GlobalBytesPerSecond int `json:",omitempty"`
+	GlobalBytesBurst     int `json:",omitempty"`
+}
+
+// maxFrameBytes is the size of the largest frame a client can send a
+// packet in. It's the minimum burst of a bytes limit, as a smaller one
+// would drop the largest packets regardless of rate.
+const maxFrameBytes = frameHeaderLen + keyLen + MaxPacketSize
+
+// limitBurst returns the burst of a limit of perSecond events with the
+// configured burst. A zero burst means one second's worth. The burst
+// is raised to minBurst if smaller.
+func limitBurst(perSecond, burst, minBurst int) int {
+	if burst <= 0 {
+		burst = perSecond
+	}
+	if burst < minBurst {
+		burst = minBurst
+	}
+	return burst
+}
+
+// newLimiter returns a token bucket limiter of perSecond events, with
+// a burst as returned by limitBurst, or nil if perSecond is zero.
+func newLimiter(perSecond, burst, minBurst int) *rate.Limiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(perSecond), limitBurst(perSecond, burst, minBurst))
+}
+
+// SetRateLimits sets the limits on the packets the server accepts
+// from clients.
+//
+// It must be called before serving begins.
+func (s *Server) SetRateLimits(l RateLimits) {
+	s.rateLimits = l
+	s.globalLimiter = newLimiter(l.GlobalBytesPerSecond, l.GlobalBytesBurst, maxFrameBytes)
+}
+
+// keyLimiter is the rate limiters shared by the connections of a
+// client key.
+type keyLimiter struct {
+	packets *rate.Limiter // or nil
+	bytes   *rate.Limiter // or nil
+}
+
+// keyLimiterLocked returns the rate limiters of client key k, or nil
+// if there are no per-client limits.
+//
+// s.mu must be held.
+func (s *Server) keyLimiterLocked(k key.NodePublic) *keyLimiter {
+	l := s.rateLimits
+	if l.PerClientPacketsPerSecond <= 0 && l.PerClientBytesPerSecond <= 0 {
+		return nil
+	}
+	if kl, ok := s.keyLimiters[k]; ok {
+		return kl
+	}
+	kl := &keyLimiter{
+		packets: newLimiter(l.PerClientPacketsPerSecond, l.PerClientPacketsBurst, 1),
+		bytes:   newLimiter(l.PerClientBytesPerSecond, l.PerClientBytesBurst, maxFrameBytes),
+	}
+	s.keyLimiters[k] = kl
+	return kl
+}
+
+// SetAdmitClient sets a func that decides whether a client with the
+// given public key may connect, in addition to the SetVerifyClient
+// check. A non-nil error rejects the client: its text is sent to the
+// client in a health frame before the server disconnects it. Mesh
+// peers aren't checked.
+//
+// The context is done when the client's login times out.
+//
+// It must be called before serving begins.
+func (s *Server) SetAdmitClient(f func(ctx context.Context, clientKey key.NodePublic) error) {
+	s.admitClient = f
+}
+
 // HasMeshKey reports whether the server is configured with a mesh key.
 func (s *Server) HasMeshKey() bool { return s.meshKey != "" }
 
@@ -504,6 +627,9 @@ func (s *Server) registerClient(c *sclient) {
 	if _, ok := s.clientsMesh[c.key]; !ok {
 		s.clientsMesh[c.key] = nil // just for varz of total users in cluster
 	}
+	if !c.canMesh {
+		c.limiter = s.keyLimiterLocked(c.key)
+	}
 	s.keyOfAddr[c.remoteIPPort] = c.key
 	s.curClients.Add(1)
 	s.broadcastPeerStateChangeLocked(c.key, true)
@@ -533,6 +659,7 @@ func (s *Server) unregisterClient(c *sclient) {
 	case singleClient:
 		c.logf("removing connection")
 		delete(s.clients, c.key)
+		delete(s.keyLimiters, c.key)
 		if v, ok := s.clientsMesh[c.key]; ok && v == nil {
 			delete(s.clientsMesh, c.key)
 			s.notePeerGoneFromRegionLocked(c.key)
@@ -637,6 +764,8 @@ func (s *Server) accept(nc Conn, brw *bufio.ReadWriter, remoteAddr string, connN
 		return fmt.Errorf("receive client key: %v", err)
 	}
 	if err := s.verifyClient(clientKey, clientInfo); err != nil {
+		s.clientsRejected.Add(1)
+		s.sendRejection(bw, err)
 		return fmt.Errorf("client %x rejected: %v", clientKey, err)
 	}
 
@@ -676,7 +805,7 @@ func (s *Server) accept(nc Conn, brw *bufio.ReadWriter, remoteAddr string, connN
 	s.registerClient(c)
 	defer s.unregisterClient(c)
 
-	err = s.sendServerInfo(c.bw, clientKey)
+	err = s.sendServerInfo(c.bw, clientKey, c.canMesh)
 	if err != nil {
 		return fmt.Errorf("send server info: %v", err)
 	}
@@ -812,6 +941,11 @@ func (c *sclient) handleFrameForwardPacket(ft frameType, fl uint32) error {
 	}
 	s.packetsForwardedIn.Add(1)
 
+	if reason, ok := c.allowSend(fl); !ok {
+		s.recordDrop(contents, srcKey, dstKey, reason)
+		return nil
+	}
+
 	var dstLen int
 	var dst *sclient
 
@@ -862,6 +996,11 @@ func (c *sclient) handleFrameSendPacket(ft frameType, fl uint32) error {
 		return fmt.Errorf("client %x: recvPacket: %v", c.key, err)
 	}
 
+	if reason, ok := c.allowSend(fl); !ok {
+		s.recordDrop(contents, c.key, dstKey, reason)
+		return nil
+	}
+
 	var fwd PacketForwarder
 	var dstLen int
 	var dst *sclient
@@ -903,19 +1042,44 @@ func (c *sclient) handleFrameSendPacket(ft frameType, fl uint32) error {
 	return c.sendPkt(dst, p)
 }
 
+// allowSend reports whether the server's rate limits allow c to send
+// a frame of fl bytes, not counting the frame header, and if not, why.
+//
+// A frame over a later limit still spends the tokens of earlier
+// ones, erring on the side of limiting.
+func (c *sclient) allowSend(fl uint32) (_ dropReason, ok bool) {
+	now := time.Now()
+	n := frameHeaderLen + int(fl)
+	if l := c.limiter; l != nil {
+		if l.packets != nil && !l.packets.AllowN(now, 1) {
+			return dropReasonClientPacketsLimit, false
+		}
+		if l.bytes != nil && !l.bytes.AllowN(now, n) {
+			return dropReasonClientBytesLimit, false
+		}
+	}
+	if g := c.s.globalLimiter; g != nil && !g.AllowN(now, n) {
+		return dropReasonGlobalBytesLimit, false
+	}
+	return 0, true
+}
+
 // dropReason is why we dropped a DERP frame.
 type dropReason int
 
 //go:generate go run tailscale.com/cmd/addlicense -year 2021 -file dropreason_string.go go run golang.org/x/tools/cmd/stringer -type=dropReason -trimprefix=dropReason
 
 const (
-	dropReasonUnknownDest      dropReason = iota // unknown destination pubkey
-	dropReasonUnknownDestOnFwd                   // unknown destination pubkey on a derp-forwarded packet
-	dropReasonGone                               // destination tailscaled disconnected before we could send
-	dropReasonQueueHead                          // destination queue is full, dropped packet at queue head
-	dropReasonQueueTail                          // destination queue is full, dropped packet at queue tail
-	dropReasonWriteError                         // OS write() failed
-	dropReasonDupClient                          // the public key is connected 2+ times (active/active, fighting)
+	dropReasonUnknownDest        dropReason = iota // unknown destination pubkey
+	dropReasonUnknownDestOnFwd                     // unknown destination pubkey on a derp-forwarded packet
+	dropReasonGone                                 // destination tailscaled disconnected before we could send
+	dropReasonQueueHead                            // destination queue is full, dropped packet at queue head
+	dropReasonQueueTail                            // destination queue is full, dropped packet at queue tail
+	dropReasonWriteError                           // OS write() failed
+	dropReasonDupClient                            // the public key is connected 2+ times (active/active, fighting)
+	dropReasonClientPacketsLimit                   // the source client key is over its packets per second limit
+	dropReasonClientBytesLimit                     // the source client key is over its bytes per second limit
+	dropReasonGlobalBytesLimit                     // all clients together are over the server's bytes per second limit
 )
 
 func (s *Server) recordDrop(packetBytes []byte, srcKey, dstKey key.NodePublic, reason dropReason) {
@@ -999,23 +1163,37 @@ func (c *sclient) requestMeshUpdate() {
 }
 
 func (s *Server) verifyClient(clientKey key.NodePublic, info *clientInfo) error {
-	if !s.verifyClients {
-		return nil
-	}
-	status, err := tailscale.Status(context.TODO())
-	if err != nil {
-		return fmt.Errorf("failed to query local tailscaled status: %w", err)
-	}
-	if clientKey == status.Self.PublicKey {
-		return nil
+	if s.verifyClients {
+		status, err := tailscale.Status(context.TODO())
+		if err != nil {
+			return fmt.Errorf("failed to query local tailscaled status: %w", err)
+		}
+		if clientKey != status.Self.PublicKey {
+			if _, exists := status.Peer[clientKey]; !exists {
+				return fmt.Errorf("client %v not in set of peers", clientKey)
+			}
+		}
 	}
-	if _, exists := status.Peer[clientKey]; !exists {
-		return fmt.Errorf("client %v not in set of peers", clientKey)
+	if s.admitClient != nil && !(info != nil && info.MeshKey != "" && info.MeshKey == s.meshKey) {
+		// Bound the check like the rest of the client's login,
+		// whose deadline accept sets.
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := s.admitClient(ctx, clientKey); err != nil {
+			return err
+		}
 	}
-	// TODO(bradfitz): add policy for configurable bandwidth rate per client?
 	return nil
 }
 
+// sendRejection tells a client that verifyClient rejected it, for
+// reason err, before the server disconnects it.
+func (s *Server) sendRejection(bw *lazyBufioWriter, err error) {
+	msg := fmt.Sprintf("this DERP server rejected your node key: %v", err)
+	writeFrame(bw.bw(), frameHealth, []byte(msg))
+	bw.Flush()
+}
+
 func (s *Server) sendServerKey(lw *lazyBufioWriter) error {
 	buf := make([]byte, 0, len(magic)+key.NodePublicRawLen)
 	buf = append(buf, magic...)
@@ -1083,8 +1261,15 @@ type serverInfo struct {
 	TokenBucketBytesBurst     int `json:",omitempty"`
 }
 
-func (s *Server) sendServerInfo(bw *lazyBufioWriter, clientKey key.NodePublic) error {
-	msg, err := json.Marshal(serverInfo{Version: ProtocolVersion})
+func (s *Server) sendServerInfo(bw *lazyBufioWriter, clientKey key.NodePublic, canMesh bool) error {
+	info := serverInfo{Version: ProtocolVersion}
+	if l := s.rateLimits; l.PerClientBytesPerSecond > 0 && !canMesh {
+		// Advertise the per-client limit so well-behaved clients
+		// drop over-limit packets before sending them.
+		info.TokenBucketBytesPerSecond = l.PerClientBytesPerSecond
+		info.TokenBucketBytesBurst = limitBurst(l.PerClientBytesPerSecond, l.PerClientBytesBurst, maxFrameBytes)
+	}
+	msg, err := json.Marshal(info)
 	if err != nil {
 		return err
 	}
@@ -1213,6 +1398,11 @@ type sclient struct {
 	// taking over ownership of a key.
 	replaceLimiter *rate.Limiter
 
+	// limiter is the rate limiters of the client's key, or nil if
+	// there are no per-client limits or the client is a mesh peer.
+	// It's set by registerClient.
+	limiter *keyLimiter
+
 	// Owned by run, not thread-safe.
 	br          *bufio.Reader
 	connectedAt time.Time
@@ -1623,6 +1813,7 @@ func (s *Server) ExpVar() expvar.Var {
 	m.Set("packets_sent", &s.packetsSent)
 	m.Set("packets_received", &s.packetsRecv)
 	m.Set("unknown_frames", &s.unknownFrames)
+	m.Set("counter_clients_rejected", &s.clientsRejected)
 	m.Set("home_moves_in", &s.homeMovesIn)
 	m.Set("home_moves_out", &s.homeMovesOut)
 	m.Set("peer_gone_frames", &s.peerGoneFrames)
@@ -18,6 +18,7 @@ import (
 	"log"
 	"net"
 	"reflect"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -1129,6 +1130,140 @@ func TestLimiter(t *testing.T) {
 	}
 }
 
+func TestServerRateLimits(t *testing.T) {
+	s := NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+	s.SetRateLimits(RateLimits{
+		PerClientPacketsPerSecond: 1,
+		PerClientPacketsBurst:     3,
+		PerClientBytesPerSecond:   1, // burst raised to maxFrameBytes
+		GlobalBytesPerSecond:      1, // burst raised to maxFrameBytes
+		GlobalBytesBurst:          3 * maxFrameBytes,
+	})
+	if got := len(s.packetsDroppedReasonCounters); got != int(dropReasonGlobalBytesLimit)+1 {
+		t.Fatalf("%d drop reason counters; want one per dropReason", got)
+	}
+
+	newClient := func(k key.NodePublic, canMesh bool) *sclient {
+		c := &sclient{s: s, key: k, canMesh: canMesh, logf: t.Logf}
+		s.registerClient(c)
+		return c
+	}
+	k := key.NewNode().Public()
+	c1 := newClient(k, false)
+	c2 := newClient(k, false) // dup connection, sharing c1's limits
+	if c1.limiter == nil || c1.limiter != c2.limiter {
+		t.Fatalf("connections of a key don't share limiters: %p, %p", c1.limiter, c2.limiter)
+	}
+
+	// The packets limit allows a burst of 3, over both connections.
+	var reasons []dropReason
+	for _, c := range []*sclient{c1, c2, c1, c2} {
+		if reason, ok := c.allowSend(keyLen + 100); !ok {
+			reasons = append(reasons, reason)
+		}
+	}
+	if len(reasons) != 1 || reasons[0] != dropReasonClientPacketsLimit {
+		t.Errorf("drops = %v; want [ClientPacketsLimit]", reasons)
+	}
+
+	// A fresh key gets its own limits. The bytes limit allows one
+	// maximum-sized packet.
+	c3 := newClient(key.NewNode().Public(), false)
+	if _, ok := c3.allowSend(keyLen + MaxPacketSize); !ok {
+		t.Fatal("first max-size packet dropped")
+	}
+	if reason, ok := c3.allowSend(keyLen + 100); ok || reason != dropReasonClientBytesLimit {
+		t.Errorf("allowSend = %v, %v; want ClientBytesLimit", reason, ok)
+	}
+
+	// Mesh peers are exempt from the per-client limits, but not the
+	// global one, of whose burst c1, c2 and c3 have left just over one
+	// maximum-sized packet.
+	mesh := newClient(key.NewNode().Public(), true)
+	if mesh.limiter != nil {
+		t.Error("mesh peer has per-client limits")
+	}
+	if _, ok := mesh.allowSend(keyLen + MaxPacketSize); !ok {
+		t.Error("mesh peer's packet dropped under global limit")
+	}
+	if reason, ok := mesh.allowSend(keyLen + MaxPacketSize); ok || reason != dropReasonGlobalBytesLimit {
+		t.Errorf("allowSend = %v, %v; want GlobalBytesLimit", reason, ok)
+	}
+
+	s.recordDrop(nil, k, k, dropReasonGlobalBytesLimit)
+	if got := s.packetsDroppedReason.Get("global_bytes_limit").Value(); got != 1 {
+		t.Errorf("global_bytes_limit drops = %d; want 1", got)
+	}
+
+	// The key's limiters are forgotten once all its connections are gone.
+	for _, c := range []*sclient{c1, c2, c3, mesh} {
+		s.unregisterClient(c)
+	}
+	if n := len(s.keyLimiters); n != 0 {
+		t.Errorf("%d key limiters remain after disconnect", n)
+	}
+}
+
+func TestServerAdmitClient(t *testing.T) {
+	s := NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+	s.SetMeshKey("mesh-key")
+	allowed := key.NewNode()
+	s.SetAdmitClient(func(ctx context.Context, k key.NodePublic) error {
+		if k == allowed.Public() {
+			return nil
+		}
+		return errors.New("not on the list")
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	connect := func(priv key.NodePrivate, opts ...ClientOpt) *Client {
+		t.Helper()
+		cout, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { cout.Close() })
+		cin, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		brwServer := bufio.NewReadWriter(bufio.NewReader(cin), bufio.NewWriter(cin))
+		go s.Accept(cin, brwServer, "test-client")
+		brw := bufio.NewReadWriter(bufio.NewReader(cout), bufio.NewWriter(cout))
+		c, err := NewClient(priv, cout, brw, t.Logf, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	waitConnect(t, connect(allowed))
+	waitConnect(t, connect(key.NewNode(), MeshKey("mesh-key"))) // mesh peers aren't checked
+
+	c := connect(key.NewNode())
+	m, err := c.Recv()
+	if err != nil {
+		t.Fatalf("rejected client's first Recv: %v", err)
+	}
+	hm, ok := m.(HealthMessage)
+	if !ok || !strings.Contains(hm.Problem, "not on the list") {
+		t.Fatalf("rejected client got %#v; want HealthMessage with the reason", m)
+	}
+	if _, err := c.Recv(); err == nil {
+		t.Error("rejected client still connected")
+	}
+	if got := s.clientsRejected.Value(); got != 1 {
+		t.Errorf("clientsRejected = %d; want 1", got)
+	}
+}
+
 func BenchmarkSendRecv(b *testing.B) {
 	for _, size := range []int{10, 100, 1000, 10000} {
 		b.Run(fmt.Sprintf("msgsize=%d", size), func(b *testing.B) { benchmarkSendRecvSize(b, size) })
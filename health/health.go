@@ -62,6 +62,10 @@ const (
 	// the Windows network adapter's "category" (public, private, domain).
 	// If it's unhealthy, the Windows firewall rules won't match.
 	SysNetworkCategory = Subsystem("network-category")
+
+	// SysRouteFeed is the name of the subsystem that exports routes
+	// to a routing daemon, such as BIRD.
+	SysRouteFeed = Subsystem("route-feed")
 )
 
 type watchHandle byte
@@ -107,6 +111,14 @@ func SetNetworkCategoryHealth(err error) { set(SysNetworkCategory, err) }
 
 func NetworkCategoryHealth() error { return get(SysNetworkCategory) }
 
+// SetRouteFeedHealth sets the state of exporting routes to a routing
+// daemon, such as BIRD.
+func SetRouteFeedHealth(err error) { set(SysRouteFeed, err) }
+
+// RouteFeedHealth returns the error state of exporting routes to a
+// routing daemon.
+func RouteFeedHealth() error { return get(SysRouteFeed) }
+
 func get(key Subsystem) error {
 	mu.Lock()
 	defer mu.Unlock()
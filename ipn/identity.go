@@ -0,0 +1,98 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+
+	"tailscale.com/tailcfg"
+)
+
+// Identity headers are added to HTTP requests proxied by tailscaled
+// (see HTTPHandler.Proxy) and by tsnet's Server.IdentityHandler so
+// that the backend knows which tailnet user and node the request came
+// from, without doing its own auth.
+//
+// Values that aren't printable ASCII are encoded as RFC 2047 "Q"
+// encoded-words; use mime.WordDecoder to decode them.
+const (
+	// HeaderUserLogin is the login name of the node's owner, such as
+	// "alice@example.com". It's not set for tagged nodes.
+	HeaderUserLogin = "Tailscale-User-Login"
+
+	// HeaderUserName is the display name of the node's owner. It's
+	// not set for tagged nodes.
+	HeaderUserName = "Tailscale-User-Name"
+
+	// HeaderNodeName is the node's MagicDNS name, without the
+	// trailing dot.
+	HeaderNodeName = "Tailscale-Node-Name"
+
+	// HeaderNodeTags is the comma-separated list of the node's ACL
+	// tags, if any.
+	HeaderNodeTags = "Tailscale-Node-Tags"
+)
+
+var identityHeaders = []string{
+	HeaderUserLogin,
+	HeaderUserName,
+	HeaderNodeName,
+	HeaderNodeTags,
+}
+
+// StripIdentityHeaders removes all identity headers from h, so that
+// clients can't spoof them. That includes headers whose names only
+// differ from an identity header's in case or in using "_" for "-",
+// such as "Tailscale_User_Login", which some servers (e.g. CGI and
+// WSGI ones) treat as the same header.
+func StripIdentityHeaders(h http.Header) {
+	for k := range h {
+		if isIdentityHeader(k) {
+			delete(h, k)
+		}
+	}
+}
+
+func isIdentityHeader(k string) bool {
+	k = strings.ReplaceAll(k, "_", "-")
+	for _, ih := range identityHeaders {
+		if strings.EqualFold(k, ih) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetIdentityHeaders replaces any identity headers in h with those of
+// node n, owned by u. The user headers are only set if the node isn't
+// tagged and u is non-nil.
+func SetIdentityHeaders(h http.Header, n *tailcfg.Node, u *tailcfg.UserProfile) {
+	StripIdentityHeaders(h)
+	if n == nil {
+		return
+	}
+	if len(n.Tags) > 0 {
+		h.Set(HeaderNodeTags, strings.Join(n.Tags, ","))
+	} else if u != nil {
+		setIdentityHeader(h, HeaderUserLogin, u.LoginName)
+		setIdentityHeader(h, HeaderUserName, u.DisplayName)
+	}
+	setIdentityHeader(h, HeaderNodeName, strings.TrimSuffix(n.Name, "."))
+}
+
+func setIdentityHeader(h http.Header, k, v string) {
+	if v == "" {
+		return
+	}
+	for _, r := range v {
+		if r < ' ' || r > '~' {
+			v = mime.QEncoding.Encode("utf-8", v)
+			break
+		}
+	}
+	h.Set(k, v)
+}
@@ -0,0 +1,101 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"mime"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"tailscale.com/tailcfg"
+)
+
+func TestSetIdentityHeaders(t *testing.T) {
+	spoofed := func() http.Header {
+		return http.Header{
+			HeaderUserLogin: {"mallory@example.com"},
+			HeaderNodeTags:  {"tag:admin"},
+			"Other":         {"kept"},
+		}
+	}
+	user := &tailcfg.UserProfile{LoginName: "alice@example.com", DisplayName: "Alice Smith"}
+	tests := []struct {
+		name string
+		n    *tailcfg.Node
+		u    *tailcfg.UserProfile
+		want http.Header
+	}{
+		{
+			name: "unknown",
+			want: http.Header{"Other": {"kept"}},
+		},
+		{
+			name: "user",
+			n:    &tailcfg.Node{Name: "laptop.alice.ts.net."},
+			u:    user,
+			want: http.Header{
+				"Other":         {"kept"},
+				HeaderUserLogin: {"alice@example.com"},
+				HeaderUserName:  {"Alice Smith"},
+				HeaderNodeName:  {"laptop.alice.ts.net"},
+			},
+		},
+		{
+			name: "tagged",
+			n:    &tailcfg.Node{Name: "ci.alice.ts.net.", Tags: []string{"tag:ci", "tag:prod"}},
+			u:    &tailcfg.UserProfile{LoginName: "tagged-devices"},
+			want: http.Header{
+				"Other":        {"kept"},
+				HeaderNodeName: {"ci.alice.ts.net"},
+				HeaderNodeTags: {"tag:ci,tag:prod"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := spoofed()
+			SetIdentityHeaders(h, tt.n, tt.u)
+			if !reflect.DeepEqual(h, tt.want) {
+				t.Errorf("got %v; want %v", h, tt.want)
+			}
+		})
+	}
+}
+
+func TestStripIdentityHeaders(t *testing.T) {
+	h := http.Header{
+		"Tailscale_User_Login": {"mallory@example.com"},
+		"Tailscale-User_Name":  {"Mallory"},
+		"tailscale-node-name":  {"evil.ts.net"},
+		HeaderNodeTags:         {"tag:admin"},
+		"Tailscale-User":       {"kept"},
+		"Other_Header":         {"kept"},
+	}
+	StripIdentityHeaders(h)
+	want := http.Header{
+		"Tailscale-User": {"kept"},
+		"Other_Header":   {"kept"},
+	}
+	if !reflect.DeepEqual(h, want) {
+		t.Errorf("got %v; want %v", h, want)
+	}
+}
+
+func TestSetIdentityHeadersNonASCII(t *testing.T) {
+	h := make(http.Header)
+	SetIdentityHeaders(h, &tailcfg.Node{Name: "n."}, &tailcfg.UserProfile{DisplayName: "Zoë"})
+	v := h.Get(HeaderUserName)
+	if v == "Zoë" {
+		t.Fatalf("name not encoded: %q", v)
+	}
+	got, err := new(mime.WordDecoder).DecodeHeader(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "Zoë" {
+		t.Errorf("decoded %q; want Zoë", got)
+	}
+}
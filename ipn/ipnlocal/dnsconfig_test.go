@@ -9,9 +9,11 @@ import (
 	"reflect"
 	"testing"
 
+	"golang.org/x/net/dns/dnsmessage"
 	"inet.af/netaddr"
 	"tailscale.com/ipn"
 	"tailscale.com/net/dns"
+	"tailscale.com/net/dns/resolver"
 	"tailscale.com/tailcfg"
 	"tailscale.com/tstest"
 	"tailscale.com/types/dnstype"
@@ -143,6 +145,34 @@ func TestDNSConfigForNetmap(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "extra_records_srv_txt_cname",
+			nm: &netmap.NetworkMap{
+				Name:      "myname.net",
+				Addresses: ipps("100.101.101.101"),
+				DNS: tailcfg.DNSConfig{
+					ExtraRecords: []tailcfg.DNSRecord{
+						{Name: "_http._tcp.foo.com", Type: "SRV", Value: "10 5 8080 foo.com"},
+						{Name: "foo.com", Type: "TXT", Value: "v=1"},
+						{Name: "www.foo.com", Type: "CNAME", Value: "foo.com"},
+						{Name: "bad.foo.com", Type: "SRV", Value: "not an srv"},
+					},
+				},
+			},
+			prefs: &ipn.Prefs{},
+			want: &dns.Config{
+				Routes: map[dnsname.FQDN][]dnstype.Resolver{},
+				Hosts: map[dnsname.FQDN][]netaddr.IP{
+					"myname.net.": ips("100.101.101.101"),
+				},
+				Records: map[dnsname.FQDN][]resolver.Record{
+					"_http._tcp.foo.com.": {{Type: dnsmessage.TypeSRV, Priority: 10, Weight: 5, Port: 8080, Target: "foo.com."}},
+					"foo.com.":            {{Type: dnsmessage.TypeTXT, TXT: []string{"v=1"}}},
+					"www.foo.com.":        {{Type: dnsmessage.TypeCNAME, Target: "foo.com."}},
+				},
+			},
+			wantLog: "[unexpected] bad SRV record for \"bad.foo.com\": SRV value \"not an srv\" is not of the form \"priority weight port target\"\n",
+		},
 		{
 			name: "corp_dns_misc",
 			nm: &netmap.NetworkMap{
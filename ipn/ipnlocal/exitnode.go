@@ -0,0 +1,242 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/netmap"
+)
+
+// exitNodePingInterval is how often the exit node candidates are
+// pinged to measure their latency, while the exit node is picked
+// automatically.
+const exitNodePingInterval = 5 * time.Minute
+
+// isExitNodeOption reports whether n offers to be an exit node, by
+// having both IPv4 and IPv6 default routes in its AllowedIPs.
+func isExitNodeOption(n *tailcfg.Node) bool {
+	var v4, v6 bool
+	for _, r := range n.AllowedIPs {
+		if r.Bits() != 0 {
+			continue
+		}
+		if r.IP().Is4() {
+			v4 = true
+		} else {
+			v6 = true
+		}
+	}
+	return v4 && v6
+}
+
+// homeDERPRegion returns the region ID of n's home DERP server, or 0
+// if it doesn't have one.
+func homeDERPRegion(n *tailcfg.Node) int {
+	const derpPrefix = "127.3.3.40:"
+	if !strings.HasPrefix(n.DERP, derpPrefix) {
+		return 0
+	}
+	region, _ := strconv.Atoi(n.DERP[len(derpPrefix):])
+	return region
+}
+
+// derpRegionLatency returns the lower of the IPv4 and IPv6 latencies
+// to the DERP region from ni, or 0 if neither is known.
+func derpRegionLatency(ni *tailcfg.NetInfo, region int) time.Duration {
+	if ni == nil || region == 0 {
+		return 0
+	}
+	var best float64
+	for _, fam := range []string{"v4", "v6"} {
+		if sec, ok := ni.DERPLatency[fmt.Sprintf("%d-%s", region, fam)]; ok && sec > 0 && (best == 0 || sec < best) {
+			best = sec
+		}
+	}
+	return time.Duration(best * float64(time.Second))
+}
+
+// rankExitNodes returns the exit node candidates of nm, best first:
+// online nodes before offline ones, then by latency, with unknown
+// latencies last. The latency of a node is pings[node] if present,
+// else that of its home DERP region from ni. Ties are broken by ID so
+// that the order is stable. The candidate with ID selected is marked
+// as such.
+func rankExitNodes(nm *netmap.NetworkMap, ni *tailcfg.NetInfo, pings map[tailcfg.StableNodeID]time.Duration, selected tailcfg.StableNodeID) []*ipnstate.ExitNodeCandidate {
+	if nm == nil {
+		return nil
+	}
+	var cands []*ipnstate.ExitNodeCandidate
+	for _, p := range nm.Peers {
+		if p.StableID == "" || !isExitNodeOption(p) {
+			continue
+		}
+		c := &ipnstate.ExitNodeCandidate{
+			ID:       p.StableID,
+			DNSName:  p.Name,
+			Online:   p.Online == nil || *p.Online, // unknown counts as online
+			Selected: p.StableID == selected,
+		}
+		for _, a := range p.Addresses {
+			if a.IsSingleIP() && tsaddr.IsTailscaleIP(a.IP()) {
+				c.TailscaleIPs = append(c.TailscaleIPs, a.IP())
+			}
+		}
+		if d, ok := pings[p.StableID]; ok {
+			c.LatencySeconds, c.LatencySource = d.Seconds(), "ping"
+		} else if d := derpRegionLatency(ni, homeDERPRegion(p)); d > 0 {
+			c.LatencySeconds, c.LatencySource = d.Seconds(), "derp"
+		}
+		cands = append(cands, c)
+	}
+	sort.Slice(cands, func(i, j int) bool {
+		a, b := cands[i], cands[j]
+		if a.Online != b.Online {
+			return a.Online
+		}
+		if (a.LatencySeconds == 0) != (b.LatencySeconds == 0) {
+			return a.LatencySeconds != 0
+		}
+		if a.LatencySeconds != b.LatencySeconds {
+			return a.LatencySeconds < b.LatencySeconds
+		}
+		return a.ID < b.ID
+	})
+	return cands
+}
+
+// pickAutoExitNodeLocked points b.prefs.ExitNodeID at the best exit
+// node candidate of nm, if the exit node is picked automatically. The
+// current exit node is kept as long as it's online, so that traffic
+// (and its connections) doesn't move between exit nodes just because
+// another one got a bit faster. If no candidate is online, the current
+// exit node is kept too, to keep traffic blackholed rather than leak
+// it. It reports whether b.prefs was changed.
+//
+// b.mu must be held.
+func (b *LocalBackend) pickAutoExitNodeLocked(nm *netmap.NetworkMap) (prefsChanged bool) {
+	if b.prefs == nil || !b.prefs.AutoExitNode || nm == nil {
+		return false
+	}
+	if !b.prefs.ExitNodeIP.IsZero() {
+		b.prefs.ExitNodeIP = netaddr.IP{}
+		prefsChanged = true
+	}
+	cur := b.prefs.ExitNodeID
+	cands := rankExitNodes(nm, b.netInfoLocked(), b.exitNodeLatency, cur)
+	b.pingExitNodesLocked(cands)
+
+	var best *ipnstate.ExitNodeCandidate
+	for _, c := range cands {
+		if c.Selected && c.Online {
+			return prefsChanged
+		}
+		if best == nil && c.Online {
+			best = c
+		}
+	}
+	if best == nil {
+		if cur != "" {
+			b.logf("auto exit node: no exit node online; keeping %v", cur)
+		}
+		return prefsChanged
+	}
+	if cur == "" {
+		b.logf("auto exit node: picked %v (%s)", best.ID, best.DNSName)
+	} else {
+		b.logf("auto exit node: %v offline; failing over to %v (%s)", cur, best.ID, best.DNSName)
+	}
+	b.prefs.ExitNodeID = best.ID
+	return true
+}
+
+// pingExitNodesLocked starts disco pings of the exit node candidates
+// to measure their latency, if it's been exitNodePingInterval since
+// the last time.
+//
+// b.mu must be held.
+func (b *LocalBackend) pingExitNodesLocked(cands []*ipnstate.ExitNodeCandidate) {
+	now := time.Now()
+	if len(cands) == 0 || now.Sub(b.lastExitNodePing) < exitNodePingInterval {
+		return
+	}
+	b.lastExitNodePing = now
+	pings := make(map[tailcfg.StableNodeID]netaddr.IP)
+	for _, c := range cands {
+		if c.Online && len(c.TailscaleIPs) > 0 {
+			pings[c.ID] = c.TailscaleIPs[0]
+		}
+	}
+	// The engine may call back synchronously, so ping without b.mu.
+	go func() {
+		for id, ip := range pings {
+			id := id
+			b.e.Ping(ip, false, func(pr *ipnstate.PingResult) {
+				if pr.Err != "" || pr.LatencySeconds <= 0 {
+					return
+				}
+				b.mu.Lock()
+				defer b.mu.Unlock()
+				if !hasExitNodeOption(b.netMap, id) {
+					// Removed from the netmap while pinging.
+					return
+				}
+				if b.exitNodeLatency == nil {
+					b.exitNodeLatency = make(map[tailcfg.StableNodeID]time.Duration)
+				}
+				b.exitNodeLatency[id] = time.Duration(pr.LatencySeconds * float64(time.Second))
+			})
+		}
+	}()
+}
+
+// pruneExitNodeLatencyLocked forgets the pinged latencies of nodes
+// that aren't exit node options in nm, so that exitNodeLatency doesn't
+// grow as exit nodes come and go.
+//
+// b.mu must be held.
+func (b *LocalBackend) pruneExitNodeLatencyLocked(nm *netmap.NetworkMap) {
+	if nm == nil {
+		b.exitNodeLatency = nil
+		return
+	}
+	for id := range b.exitNodeLatency {
+		if !hasExitNodeOption(nm, id) {
+			delete(b.exitNodeLatency, id)
+		}
+	}
+}
+
+// hasExitNodeOption reports whether nm has a peer with the given ID
+// that's an exit node option.
+func hasExitNodeOption(nm *netmap.NetworkMap, id tailcfg.StableNodeID) bool {
+	if nm == nil {
+		return false
+	}
+	for _, p := range nm.Peers {
+		if p.StableID == id {
+			return isExitNodeOption(p)
+		}
+	}
+	return false
+}
+
+// netInfoLocked returns the last NetInfo from magicsock, or nil.
+//
+// b.mu must be held.
+func (b *LocalBackend) netInfoLocked() *tailcfg.NetInfo {
+	if b.hostinfo == nil {
+		return nil
+	}
+	return b.hostinfo.NetInfo
+}
@@ -0,0 +1,141 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/ipn"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/netmap"
+)
+
+func exitNodeForTest(id tailcfg.StableNodeID, derpRegion string, online bool) *tailcfg.Node {
+	return &tailcfg.Node{
+		StableID: id,
+		Name:     string(id) + ".example.ts.net.",
+		DERP:     "127.3.3.40:" + derpRegion,
+		Online:   &online,
+		AllowedIPs: []netaddr.IPPrefix{
+			netaddr.MustParseIPPrefix("0.0.0.0/0"),
+			netaddr.MustParseIPPrefix("::/0"),
+		},
+	}
+}
+
+func TestRankExitNodes(t *testing.T) {
+	nm := &netmap.NetworkMap{
+		Peers: []*tailcfg.Node{
+			exitNodeForTest("far", "2", true),
+			exitNodeForTest("near", "1", true),
+			exitNodeForTest("pinged", "2", true),
+			exitNodeForTest("offline", "1", false),
+			exitNodeForTest("unknown", "9", true),
+			{StableID: "notexit", Online: new(bool)},
+		},
+	}
+	ni := &tailcfg.NetInfo{
+		DERPLatency: map[string]float64{
+			"1-v4": 0.020,
+			"1-v6": 0.010,
+			"2-v4": 0.100,
+		},
+	}
+	pings := map[tailcfg.StableNodeID]time.Duration{
+		"pinged": 5 * time.Millisecond,
+	}
+	cands := rankExitNodes(nm, ni, pings, "far")
+
+	var got []tailcfg.StableNodeID
+	for _, c := range cands {
+		got = append(got, c.ID)
+	}
+	want := []tailcfg.StableNodeID{"pinged", "near", "far", "unknown", "offline"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("ranking = %v; want %v", got, want)
+	}
+	if c := cands[0]; c.LatencySource != "ping" || c.LatencySeconds != 0.005 {
+		t.Errorf("pinged latency = %v (%q)", c.LatencySeconds, c.LatencySource)
+	}
+	if c := cands[1]; c.LatencySource != "derp" || c.LatencySeconds != 0.010 {
+		t.Errorf("near latency = %v (%q)", c.LatencySeconds, c.LatencySource)
+	}
+	if !cands[2].Selected || cands[0].Selected {
+		t.Errorf("wrong candidate selected")
+	}
+}
+
+func TestPickAutoExitNode(t *testing.T) {
+	a := exitNodeForTest("a", "1", true)
+	bNode := exitNodeForTest("b", "2", true)
+	nm := &netmap.NetworkMap{Peers: []*tailcfg.Node{a, bNode}}
+	ni := &tailcfg.NetInfo{
+		DERPLatency: map[string]float64{"1-v4": 0.050, "2-v4": 0.010},
+	}
+	b := &LocalBackend{
+		logf:     t.Logf,
+		prefs:    &ipn.Prefs{AutoExitNode: true},
+		hostinfo: &tailcfg.Hostinfo{NetInfo: ni},
+		// Don't ping; there's no engine.
+		lastExitNodePing: time.Now(),
+	}
+
+	if !b.pickAutoExitNodeLocked(nm) || b.prefs.ExitNodeID != "b" {
+		t.Fatalf("picked %q; want b", b.prefs.ExitNodeID)
+	}
+
+	// A faster node doesn't make it switch.
+	ni.DERPLatency["1-v4"] = 0.001
+	if b.pickAutoExitNodeLocked(nm) || b.prefs.ExitNodeID != "b" {
+		t.Fatalf("switched to %q; want to keep b", b.prefs.ExitNodeID)
+	}
+
+	// Its going offline does.
+	offline := false
+	bNode.Online = &offline
+	if !b.pickAutoExitNodeLocked(nm) || b.prefs.ExitNodeID != "a" {
+		t.Fatalf("failed over to %q; want a", b.prefs.ExitNodeID)
+	}
+
+	// With none online, the last one is kept.
+	a.Online = &offline
+	if b.pickAutoExitNodeLocked(nm) || b.prefs.ExitNodeID != "a" {
+		t.Fatalf("with none online, got %q; want a", b.prefs.ExitNodeID)
+	}
+
+	// Without AutoExitNode, nothing changes.
+	b.prefs = &ipn.Prefs{ExitNodeID: "b"}
+	if b.pickAutoExitNodeLocked(nm) || b.prefs.ExitNodeID != "b" {
+		t.Fatalf("without AutoExitNode, got %q; want b", b.prefs.ExitNodeID)
+	}
+}
+
+func TestPruneExitNodeLatency(t *testing.T) {
+	b := &LocalBackend{
+		exitNodeLatency: map[tailcfg.StableNodeID]time.Duration{
+			"kept":    time.Millisecond,
+			"removed": time.Millisecond,
+			"notexit": time.Millisecond,
+		},
+	}
+	b.pruneExitNodeLatencyLocked(&netmap.NetworkMap{
+		Peers: []*tailcfg.Node{
+			exitNodeForTest("kept", "1", true),
+			{StableID: "notexit"},
+		},
+	})
+	want := map[tailcfg.StableNodeID]time.Duration{"kept": time.Millisecond}
+	if !reflect.DeepEqual(b.exitNodeLatency, want) {
+		t.Errorf("after prune, got %v; want %v", b.exitNodeLatency, want)
+	}
+
+	b.pruneExitNodeLatencyLocked(nil)
+	if b.exitNodeLatency != nil {
+		t.Errorf("with no netmap, got %v; want nil", b.exitNodeLatency)
+	}
+}
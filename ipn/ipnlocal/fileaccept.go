@@ -0,0 +1,352 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/util/dirtar"
+)
+
+// FileAcceptConfig configures what's done with files received with
+// Taildrop, beyond leaving them for "tailscale file get".
+type FileAcceptConfig struct {
+	// Dir, if non-empty, is the absolute path of a directory to
+	// move received files and directories into, so they're not
+	// left waiting.
+	Dir string
+
+	// From, if non-empty, limits moving files into Dir to those
+	// sent by the listed users, by login name, or by nodes with
+	// the listed tags, such as "tag:ci".
+	From []string
+
+	// Hook, if non-empty, is run once each file is received, and
+	// moved into Dir if accepted. If it's an http or https URL, an
+	// apitype.FileReceived is POSTed to it as JSON. Otherwise it's
+	// the path of a program, which is run with the file's path as
+	// its argument and the rest of the apitype.FileReceived in
+	// TS_FILE_* environment variables.
+	Hook string
+}
+
+// IsZero reports whether c does nothing.
+func (c FileAcceptConfig) IsZero() bool {
+	return c.Dir == "" && c.Hook == ""
+}
+
+// SetFileAcceptConfig sets what's done with files received with
+// Taildrop. It doesn't apply in direct file mode (see
+// SetDirectFileRoot), where the frontend handles received files.
+//
+// If c starts moving files into a Dir, files already waiting are
+// moved there too, as by acceptWaitingFiles.
+func (b *LocalBackend) SetFileAcceptConfig(c FileAcceptConfig) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	dirChanged := c.Dir != b.fileAccept.Dir
+	b.fileAccept = c
+	if ps := b.peerAPIServer; ps != nil && dirChanged {
+		go ps.acceptWaitingFiles()
+	}
+}
+
+// fileAcceptHookTimeout is how long a Taildrop hook may run.
+const fileAcceptHookTimeout = time.Minute
+
+// acceptsFrom reports whether c accepts files sent by fr's sender.
+func (c FileAcceptConfig) acceptsFrom(fr *apitype.FileReceived) bool {
+	if c.Dir == "" {
+		return false
+	}
+	if len(c.From) == 0 {
+		return true
+	}
+	for _, from := range c.From {
+		if strings.HasPrefix(from, "tag:") {
+			for _, tag := range fr.FromTags {
+				if tag == from {
+					return true
+				}
+			}
+		} else if strings.EqualFold(from, fr.FromUser) {
+			return true
+		}
+	}
+	return false
+}
+
+// fileReceived starts applying the FileAcceptConfig, if any, to the
+// file or directory name, received from h's peer and waiting at path.
+func (h *peerAPIHandler) fileReceived(name, path string, isDir bool) {
+	b := h.ps.b
+	b.mu.Lock()
+	zero := b.fileAccept.IsZero()
+	b.mu.Unlock()
+	if zero || h.ps.directFileMode {
+		return
+	}
+	fr := apitype.FileReceived{
+		Name:     name,
+		Path:     path,
+		Dir:      isDir,
+		From:     h.peerNode.ComputedName,
+		FromUser: h.peerUser.LoginName,
+		FromTags: h.peerNode.Tags,
+	}
+	go func() {
+		if isDir {
+			fr.Size = treeSize(path)
+		} else if fi, err := os.Stat(path); err == nil {
+			fr.Size = fi.Size()
+		}
+		h.ps.fileReceived(fr)
+	}()
+}
+
+// fileReceived applies the FileAcceptConfig to fr, a file that's
+// been fully received and is waiting for pick-up. It may take a
+// while, so callers should run it in its own goroutine.
+func (s *peerAPIServer) fileReceived(fr apitype.FileReceived) {
+	b := s.b
+	b.mu.Lock()
+	conf := b.fileAccept
+	b.mu.Unlock()
+
+	if conf.acceptsFrom(&fr) {
+		path, err := moveInto(fr.Path, conf.Dir, fr.Dir)
+		if err != nil {
+			b.logf("peerapi: auto-accepting file: %v", redactErr(err))
+		} else {
+			fr.Path = path
+			fr.Accepted = true
+			b.sendFileNotify()
+		}
+	}
+	if conf.Hook == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), fileAcceptHookTimeout)
+	defer cancel()
+	if err := runFileHook(ctx, conf.Hook, &fr); err != nil {
+		b.logf("peerapi: taildrop hook: %v", err)
+	}
+}
+
+// acceptWaitingFiles moves the files already waiting for pick-up,
+// such as those received before tailscaled started or before
+// auto-accepting was configured, into the FileAcceptConfig's Dir.
+// Who sent them isn't known, so they're only moved if the config
+// accepts files from anyone, and no hook is run for them, as it may
+// have been already.
+func (s *peerAPIServer) acceptWaitingFiles() {
+	b := s.b
+	b.mu.Lock()
+	conf := b.fileAccept
+	b.mu.Unlock()
+	if conf.Dir == "" || len(conf.From) > 0 || s.directFileMode {
+		return
+	}
+	wfs, err := s.WaitingFiles()
+	if err != nil {
+		b.logf("peerapi: auto-accepting waiting files: %v", err)
+		return
+	}
+	moved := false
+	for _, wf := range wfs {
+		path, ok := s.diskPath(wf.Name)
+		if !ok || s.isIncoming(wf.Name) {
+			continue
+		}
+		if _, err := moveInto(path, conf.Dir, wf.Dir); err != nil {
+			b.logf("peerapi: auto-accepting waiting file: %v", redactErr(err))
+			continue
+		}
+		moved = true
+	}
+	if moved {
+		b.sendFileNotify()
+	}
+}
+
+// maxSameName is how many files of the same name moveInto tries to
+// number before giving up.
+const maxSameName = 1000
+
+// moveInto moves the file or directory at path into dir, without
+// replacing anything there, and returns its new path. If its name is
+// taken, it's moved to "name (1)", "name (2)", etc, keeping any
+// extension.
+//
+// Each destination is claimed atomically, by hard linking or
+// exclusively creating it, so files created in dir concurrently are
+// never replaced.
+func moveInto(path, dir string, isDir bool) (string, error) {
+	name := filepath.Base(path)
+	for i := 0; i < maxSameName; i++ {
+		dst := filepath.Join(dir, numberedName(name, i))
+		var err error
+		if isDir {
+			err = moveDir(path, dst)
+		} else {
+			err = moveFile(path, dst)
+		}
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return dst, nil
+	}
+	return "", fmt.Errorf("too many files of the same name in %s", dir)
+}
+
+// numberedName returns name if i is 0, and otherwise name with " (i)"
+// inserted before its extension.
+func numberedName(name string, i int) string {
+	if i == 0 {
+		return name
+	}
+	ext := filepath.Ext(name)
+	return fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), i, ext)
+}
+
+// moveFile moves the regular file src to dst, failing with an error
+// satisfying os.IsExist if dst exists.
+func moveFile(src, dst string) error {
+	err := os.Link(src, dst)
+	if err == nil {
+		return os.Remove(src)
+	}
+	if os.IsExist(err) {
+		return err
+	}
+	// Probably a different filesystem, or one without hard
+	// links; copy instead.
+	if err := copyFile(src, dst); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// moveDir moves the directory src to dst, failing with an error
+// satisfying os.IsExist if dst exists.
+func moveDir(src, dst string) error {
+	// Claim dst with an empty directory, which renaming src
+	// replaces. Other processes' files are never empty
+	// directories of ours.
+	if err := os.Mkdir(dst, 0700); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	// Probably a different filesystem, or an OS whose rename
+	// doesn't replace directories. Give up the claim, which
+	// fails if something was put in it, and copy instead.
+	if err := os.Remove(dst); err != nil {
+		return &os.PathError{Op: "move", Path: dst, Err: os.ErrExist}
+	}
+	if err := copyTree(src, dst); err != nil {
+		return err
+	}
+	return os.RemoveAll(src)
+}
+
+// copyFile copies the regular file src to dst, which it creates,
+// failing with an error satisfying os.IsExist if dst exists.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return nil
+}
+
+// copyTree copies the directory src to dst, which it creates, failing
+// with an error satisfying os.IsExist if dst exists.
+func copyTree(src, dst string) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(dirtar.WriteDir(pw, src))
+	}()
+	err := dirtar.Extract(pr, dst, nil)
+	pr.Close()
+	if err != nil && !os.IsExist(err) {
+		os.RemoveAll(dst)
+	}
+	return err
+}
+
+// runFileHook runs hook, a URL or program (see
+// FileAcceptConfig.Hook), for fr.
+func runFileHook(ctx context.Context, hook string, fr *apitype.FileReceived) error {
+	if strings.HasPrefix(hook, "http://") || strings.HasPrefix(hook, "https://") {
+		j, err := json.Marshal(fr)
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequestWithContext(ctx, "POST", hook, bytes.NewReader(j))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		if res.StatusCode/100 != 2 {
+			return fmt.Errorf("POST returned %v", res.Status)
+		}
+		return nil
+	}
+	// The hook's output isn't logged, as it likely names the file.
+	cmd := exec.CommandContext(ctx, hook, fr.Path)
+	cmd.Env = append(os.Environ(), fileHookEnv(fr)...)
+	return cmd.Run()
+}
+
+// fileHookEnv returns the environment variables describing fr to a
+// hook program.
+func fileHookEnv(fr *apitype.FileReceived) []string {
+	return []string{
+		"TS_FILE_NAME=" + fr.Name,
+		"TS_FILE_PATH=" + fr.Path,
+		"TS_FILE_SIZE=" + strconv.FormatInt(fr.Size, 10),
+		"TS_FILE_DIR=" + strconv.FormatBool(fr.Dir),
+		"TS_FILE_ACCEPTED=" + strconv.FormatBool(fr.Accepted),
+		"TS_FILE_FROM=" + fr.From,
+		"TS_FILE_FROM_USER=" + fr.FromUser,
+		"TS_FILE_FROM_TAGS=" + strings.Join(fr.FromTags, ","),
+	}
+}
@@ -0,0 +1,237 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"tailscale.com/client/tailscale/apitype"
+)
+
+func TestFileAcceptsFrom(t *testing.T) {
+	alice := &apitype.FileReceived{FromUser: "alice@example.com"}
+	ci := &apitype.FileReceived{FromUser: "alice@example.com", FromTags: []string{"tag:ci"}}
+	tests := []struct {
+		name string
+		conf FileAcceptConfig
+		fr   *apitype.FileReceived
+		want bool
+	}{
+		{"no_dir", FileAcceptConfig{Hook: "/bin/true"}, alice, false},
+		{"anyone", FileAcceptConfig{Dir: "/srv/in"}, alice, true},
+		{"user", FileAcceptConfig{Dir: "/srv/in", From: []string{"Alice@example.com"}}, alice, true},
+		{"other_user", FileAcceptConfig{Dir: "/srv/in", From: []string{"bob@example.com"}}, alice, false},
+		{"tag", FileAcceptConfig{Dir: "/srv/in", From: []string{"tag:ci"}}, ci, true},
+		{"untagged", FileAcceptConfig{Dir: "/srv/in", From: []string{"tag:ci"}}, alice, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.conf.acceptsFrom(tt.fr); got != tt.want {
+				t.Errorf("got %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMoveInto(t *testing.T) {
+	waiting, dir := t.TempDir(), t.TempDir()
+	for _, name := range []string{"foo.txt", "foo (1).txt", "bar"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("old"), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "docs"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"foo.txt", "bar", "baz.jpg"} {
+		if err := ioutil.WriteFile(filepath.Join(waiting, name), []byte("new"), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(waiting, "docs", "sub"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(waiting, "docs", "sub", "a.txt"), []byte("new"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name  string
+		isDir bool
+		want  string
+	}{
+		{"foo.txt", false, "foo (2).txt"},
+		{"bar", false, "bar (1)"},
+		{"baz.jpg", false, "baz.jpg"},
+		{"docs", true, "docs (1)"},
+	} {
+		got, err := moveInto(filepath.Join(waiting, tt.name), dir, tt.isDir)
+		if err != nil {
+			t.Fatalf("moveInto(%q): %v", tt.name, err)
+		}
+		if got != filepath.Join(dir, tt.want) {
+			t.Errorf("moveInto(%q) = %q; want %q", tt.name, got, tt.want)
+		}
+		if _, err := os.Stat(filepath.Join(waiting, tt.name)); !os.IsNotExist(err) {
+			t.Errorf("%q still waiting: %v", tt.name, err)
+		}
+	}
+	for name, want := range map[string]string{
+		"foo.txt":            "old",
+		"foo (1).txt":        "old",
+		"foo (2).txt":        "new",
+		"bar":                "old",
+		"bar (1)":            "new",
+		"baz.jpg":            "new",
+		"docs (1)/sub/a.txt": "new",
+	} {
+		if b, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(name))); err != nil || string(b) != want {
+			t.Errorf("%s = %q, %v; want %q", name, b, err, want)
+		}
+	}
+}
+
+func TestMoveFileExists(t *testing.T) {
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	for _, path := range []string{src, dst} {
+		if err := ioutil.WriteFile(path, []byte(filepath.Base(path)), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := moveFile(src, dst); !os.IsExist(err) {
+		t.Errorf("moveFile onto existing file = %v; want exists error", err)
+	}
+	if err := copyFile(src, dst); !os.IsExist(err) {
+		t.Errorf("copyFile onto existing file = %v; want exists error", err)
+	}
+	if err := moveDir(t.TempDir(), dst); !os.IsExist(err) {
+		t.Errorf("moveDir onto existing file = %v; want exists error", err)
+	}
+	if b, err := ioutil.ReadFile(dst); err != nil || string(b) != "dst" {
+		t.Errorf("dst = %q, %v; want unchanged", b, err)
+	}
+}
+
+func TestAcceptWaitingFiles(t *testing.T) {
+	waiting, acceptDir := t.TempDir(), t.TempDir()
+	for _, name := range []string{"foo.txt", "incoming.txt", "bar.txt.partial"} {
+		if err := ioutil.WriteFile(filepath.Join(waiting, name), nil, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ps := &peerAPIServer{
+		b:       &LocalBackend{logf: t.Logf},
+		rootDir: waiting,
+	}
+	ps.startIncoming("incoming.txt")
+
+	// With a From list, the unknown senders aren't accepted.
+	ps.b.fileAccept = FileAcceptConfig{Dir: acceptDir, From: []string{"alice@example.com"}}
+	ps.acceptWaitingFiles()
+	if fis, _ := ioutil.ReadDir(acceptDir); len(fis) != 0 {
+		t.Errorf("with From, accepted %d files; want 0", len(fis))
+	}
+
+	ps.b.fileAccept = FileAcceptConfig{Dir: acceptDir}
+	ps.acceptWaitingFiles()
+	var names []string
+	fis, err := ioutil.ReadDir(acceptDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fi := range fis {
+		names = append(names, fi.Name())
+	}
+	if got, want := strings.Join(names, ","), "foo.txt"; got != want {
+		t.Errorf("accepted %q; want %q", got, want)
+	}
+}
+
+func TestFileReceivedAcceptAndHTTPHook(t *testing.T) {
+	var got apitype.FileReceived
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer hook.Close()
+
+	waiting, acceptDir := t.TempDir(), t.TempDir()
+	path := filepath.Join(waiting, "foo.txt")
+	if err := ioutil.WriteFile(path, []byte("foo"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(acceptDir, "foo.txt"), nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	ps := &peerAPIServer{
+		b: &LocalBackend{
+			logf: t.Logf,
+			fileAccept: FileAcceptConfig{
+				Dir:  acceptDir,
+				Hook: hook.URL,
+			},
+		},
+		rootDir: waiting,
+	}
+	ps.fileReceived(apitype.FileReceived{
+		Name:     "foo.txt",
+		Path:     path,
+		Size:     3,
+		FromUser: "alice@example.com",
+	})
+
+	wantPath := filepath.Join(acceptDir, "foo (1).txt")
+	if b, err := ioutil.ReadFile(wantPath); err != nil || string(b) != "foo" {
+		t.Errorf("accepted file = %q, %v; want foo", b, err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("file still waiting: %v", err)
+	}
+	if !got.Accepted || got.Path != wantPath || got.Name != "foo.txt" || got.FromUser != "alice@example.com" {
+		t.Errorf("hook got %+v", got)
+	}
+}
+
+func TestFileReceivedExecHook(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test uses a shell script")
+	}
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out")
+	hook := filepath.Join(dir, "hook.sh")
+	script := "#!/bin/sh\necho \"$1 $TS_FILE_NAME $TS_FILE_SIZE $TS_FILE_ACCEPTED $TS_FILE_FROM_TAGS\" > " + out + "\n"
+	if err := ioutil.WriteFile(hook, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	ps := &peerAPIServer{
+		b: &LocalBackend{
+			logf:       t.Logf,
+			fileAccept: FileAcceptConfig{Hook: hook},
+		},
+	}
+	ps.fileReceived(apitype.FileReceived{
+		Name:     "foo.txt",
+		Path:     "/var/lib/tailscale/files/foo.txt",
+		Size:     3,
+		FromTags: []string{"tag:a", "tag:b"},
+	})
+	b, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.TrimSpace(string(b)), "/var/lib/tailscale/files/foo.txt foo.txt 3 false tag:a,tag:b"; got != want {
+		t.Errorf("hook wrote %q; want %q", got, want)
+	}
+}
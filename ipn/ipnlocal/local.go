@@ -34,6 +34,7 @@ import (
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/ipn/policy"
 	"tailscale.com/net/dns"
+	"tailscale.com/net/dns/resolver"
 	"tailscale.com/net/interfaces"
 	"tailscale.com/net/tsaddr"
 	"tailscale.com/paths"
@@ -69,6 +70,23 @@ func getControlDebugFlags() []string {
 	return nil
 }
 
+// getConntrackTimeouts returns the packet filter's connection tracking
+// timeouts, as overridden by TS_CONNTRACK_TIMEOUTS (see
+// filter.ParseConntrackTimeouts for its format).
+func getConntrackTimeouts(logf logger.Logf) filter.ConntrackTimeouts {
+	e := os.Getenv("TS_CONNTRACK_TIMEOUTS")
+	if e == "" {
+		return filter.DefaultConntrackTimeouts
+	}
+	to, err := filter.ParseConntrackTimeouts(e)
+	if err != nil {
+		logf("ignoring TS_CONNTRACK_TIMEOUTS: %v", err)
+		return filter.DefaultConntrackTimeouts
+	}
+	logf("conntrack timeouts: %+v", to)
+	return to
+}
+
 // LocalBackend is the glue between the major pieces of the Tailscale
 // network software: the cloud control plane (via controlclient), the
 // network data plane (via wgengine), and the user-facing UIs and CLIs
@@ -96,9 +114,11 @@ type LocalBackend struct {
 	gotPortPollRes        chan struct{}    // closed upon first readPoller result
 	serverURL             string           // tailcontrol URL
 	newDecompressor       func() (controlclient.Decompressor, error)
-	varRoot               string // or empty if SetVarRoot never called
+	varRoot               string                   // or empty if SetVarRoot never called
+	loginFlags            controlclient.LoginFlags // extra flags for every Login; see SetLoginFlags
 
-	filterHash deephash.Sum
+	filterHash        deephash.Sum
+	conntrackTimeouts filter.ConntrackTimeouts // for every new packet filter
 
 	// The mutex protects the following elements.
 	mu             sync.Mutex
@@ -107,6 +127,8 @@ type LocalBackend struct {
 	notify         func(ipn.Notify)
 	cc             controlclient.Client
 	stateKey       ipn.StateKey // computed in part from user-provided value
+	profileBaseKey ipn.StateKey // StateKey given to Start; stateKey is its current profile's
+	profile        string       // name of the current login profile of profileBaseKey
 	userID         string       // current controlling user ID (for Windows, primarily)
 	prefs          *ipn.Prefs
 	inServerMode   bool
@@ -129,6 +151,12 @@ type LocalBackend struct {
 	prevIfState      *interfaces.State
 	peerAPIServer    *peerAPIServer // or nil
 	peerAPIListeners []*peerAPIListener
+	serveListeners   map[netaddr.IPPort]*serveListener
+	listenTCP        func(netaddr.IPPort) (net.Listener, error) // or nil to use the OS; see SetListenTCPFunc
+	// userDial is used by UserDial, or nil to use the OS; see SetUserDialFunc.
+	userDial         func(ctx context.Context, network, addr string) (net.Conn, error)
+	exitNodeLatency  map[tailcfg.StableNodeID]time.Duration // pinged RTTs of exit node candidates
+	lastExitNodePing time.Time                              // when exit node candidates were last pinged
 	incomingFiles    map[*incomingFile]bool
 	// directFileRoot, if non-empty, means to write received files
 	// directly to this directory, without staging them in an
@@ -140,6 +168,7 @@ type LocalBackend struct {
 	// double-copying files by writing them to the right location
 	// immediately.
 	directFileRoot string
+	fileAccept     FileAcceptConfig // see SetFileAcceptConfig
 
 	// statusLock must be held before calling statusChanged.Wait() or
 	// statusChanged.Broadcast().
@@ -160,8 +189,12 @@ func NewLocalBackend(logf logger.Logf, logid string, store ipn.StateStore, e wge
 
 	osshare.SetFileSharingEnabled(false, logf)
 
+	conntrackTimeouts := getConntrackTimeouts(logf)
+
 	// Default filter blocks everything and logs nothing, until Start() is called.
-	e.SetFilter(filter.NewAllowNone(logf, &netaddr.IPSet{}))
+	f := filter.NewAllowNone(logf, &netaddr.IPSet{})
+	f.SetConntrackTimeouts(conntrackTimeouts)
+	e.SetFilter(f)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	portpoll, err := portlist.NewPoller()
@@ -181,6 +214,8 @@ func NewLocalBackend(logf logger.Logf, logid string, store ipn.StateStore, e wge
 		state:          ipn.NoState,
 		portpoll:       portpoll,
 		gotPortPollRes: make(chan struct{}),
+
+		conntrackTimeouts: conntrackTimeouts,
 	}
 	b.statusChanged = sync.NewCond(&b.statusLock)
 	b.e.SetStatusCallback(b.setWgengineStatus)
@@ -219,6 +254,29 @@ func (b *LocalBackend) SetDirectFileRoot(dir string) {
 	b.directFileRoot = dir
 }
 
+// SetUserDialFunc sets the func used by UserDial to dial addresses on
+// the tailnet, including MagicDNS names, such as one that dials via
+// netstack when there's no TUN device. If nil (the default), UserDial
+// uses the OS's network stack.
+func (b *LocalBackend) SetUserDialFunc(fn func(ctx context.Context, network, addr string) (net.Conn, error)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.userDial = fn
+}
+
+// UserDial dials addr on behalf of a LocalAPI client, such as for
+// "tailscale nc".
+func (b *LocalBackend) UserDial(ctx context.Context, network, addr string) (net.Conn, error) {
+	b.mu.Lock()
+	dial := b.userDial
+	b.mu.Unlock()
+	if dial == nil {
+		var d net.Dialer
+		dial = d.DialContext
+	}
+	return dial(ctx, network, addr)
+}
+
 // b.mu must be held.
 func (b *LocalBackend) maybePauseControlClientLocked() {
 	if b.cc == nil {
@@ -348,6 +406,7 @@ func (b *LocalBackend) updateStatus(sb *ipnstate.StatusBuilder, extraLocked func
 			s.MagicDNSSuffix = b.netMap.MagicDNSSuffix()
 			s.CertDomains = append([]string(nil), b.netMap.DNS.CertDomains...)
 		}
+		s.Serve = b.serveStatusLocked()
 	})
 	sb.MutateSelfStatus(func(ss *ipnstate.PeerStatus) {
 		if b.netMap != nil && b.netMap.SelfNode != nil {
@@ -404,8 +463,13 @@ func (b *LocalBackend) populatePeerStatusLocked(sb *ipnstate.StatusBuilder) {
 			LastSeen:           lastSeen,
 			ShareeNode:         p.Hostinfo.ShareeNode,
 			ExitNode:           p.StableID != "" && p.StableID == b.prefs.ExitNodeID,
+			ExitNodeOption:     isExitNodeOption(p),
 		})
 	}
+	sb.MutateStatus(func(s *ipnstate.Status) {
+		s.AutoExitNode = b.prefs.AutoExitNode
+		s.ExitNodeCandidates = rankExitNodes(b.netMap, b.netInfoLocked(), b.exitNodeLatency, b.prefs.ExitNodeID)
+	})
 }
 
 // WhoIs reports the node and user who owns the node with the given IP:port.
@@ -445,6 +509,14 @@ func (b *LocalBackend) SetDecompressor(fn func() (controlclient.Decompressor, er
 	b.newDecompressor = fn
 }
 
+// SetLoginFlags sets extra flags, such as controlclient.LoginEphemeral,
+// to use on every login to the control server.
+//
+// It must be called before Start.
+func (b *LocalBackend) SetLoginFlags(flags controlclient.LoginFlags) {
+	b.loginFlags = flags
+}
+
 // setClientStatus is the callback invoked by the control client whenever it posts a new status.
 // Among other things, this is where we update the netmap, packet filters, DNS and DERP maps.
 func (b *LocalBackend) setClientStatus(st controlclient.Status) {
@@ -525,6 +597,9 @@ func (b *LocalBackend) setClientStatus(st controlclient.Status) {
 		if b.findExitNodeIDLocked(st.NetMap) {
 			prefsChanged = true
 		}
+		if b.pickAutoExitNodeLocked(st.NetMap) {
+			prefsChanged = true
+		}
 		b.setNetMapLocked(st.NetMap)
 	}
 	if st.URL != "" {
@@ -732,7 +807,8 @@ func (b *LocalBackend) startIsNoopLocked(opts ipn.Options) bool {
 	return b.state == ipn.Running &&
 		b.hostinfo != nil &&
 		b.hostinfo.FrontendLogID == opts.FrontendLogID &&
-		b.stateKey == opts.StateKey &&
+		b.profileBaseKey == opts.StateKey &&
+		b.stateKey == ipn.ProfileStateKey(opts.StateKey, b.profile) &&
 		opts.Prefs == nil &&
 		opts.UpdatePrefs == nil &&
 		opts.AuthKey == ""
@@ -815,8 +891,8 @@ func (b *LocalBackend) Start(opts ipn.Options) error {
 		newPrefs.Persist = b.prefs.Persist
 		b.prefs = newPrefs
 
-		if opts.StateKey != "" {
-			if err := b.store.WriteState(opts.StateKey, b.prefs.ToBytes()); err != nil {
+		if b.stateKey != "" {
+			if err := b.store.WriteState(b.stateKey, b.prefs.ToBytes()); err != nil {
 				b.logf("failed to save UpdatePrefs state: %v", err)
 			}
 		}
@@ -900,6 +976,7 @@ func (b *LocalBackend) Start(opts ipn.Options) error {
 		DebugFlags:           debugFlags,
 		LinkMonitor:          b.e.GetLinkMonitor(),
 		Pinger:               b.e,
+		Noise:                controlNoise,
 
 		// Don't warn about broken Linux IP forwarding when
 		// netstack is being used.
@@ -934,7 +1011,7 @@ func (b *LocalBackend) Start(opts ipn.Options) error {
 		// Even if !WantRunning, we should verify our key, if there
 		// is one. If you want tailscaled to be completely idle,
 		// use logout instead.
-		cc.Login(nil, controlclient.LoginDefault)
+		cc.Login(nil, b.loginFlags|controlclient.LoginDefault)
 	}
 	b.stateMachine()
 	return nil
@@ -1001,20 +1078,27 @@ func (b *LocalBackend) updateFilter(netMap *netmap.NetworkMap, prefs *ipn.Prefs)
 
 	if !haveNetmap {
 		b.logf("netmap packet filter: (not ready yet)")
-		b.e.SetFilter(filter.NewAllowNone(b.logf, logNets))
+		b.setFilter(filter.NewAllowNone(b.logf, logNets))
 		return
 	}
 
 	oldFilter := b.e.GetFilter()
 	if shieldsUp {
 		b.logf("netmap packet filter: (shields up)")
-		b.e.SetFilter(filter.NewShieldsUpFilter(localNets, logNets, oldFilter, b.logf))
+		b.setFilter(filter.NewShieldsUpFilter(localNets, logNets, oldFilter, b.logf))
 	} else {
 		b.logf("netmap packet filter: %v filters", len(packetFilter))
-		b.e.SetFilter(filter.New(packetFilter, localNets, logNets, oldFilter, b.logf))
+		b.setFilter(filter.New(packetFilter, localNets, logNets, oldFilter, b.logf))
 	}
 }
 
+// setFilter installs f as the engine's packet filter, with the
+// configured connection tracking timeouts.
+func (b *LocalBackend) setFilter(f *filter.Filter) {
+	f.SetConntrackTimeouts(b.conntrackTimeouts)
+	b.e.SetFilter(f)
+}
+
 var removeFromDefaultRoute = []netaddr.IPPrefix{
 	// RFC1918 LAN ranges
 	netaddr.MustParseIPPrefix("192.168.0.0/16"),
@@ -1299,6 +1383,10 @@ func (b *LocalBackend) popBrowserAuthNow() {
 // For testing lazy machine key generation.
 var panicOnMachineKeyGeneration, _ = strconv.ParseBool(os.Getenv("TS_DEBUG_PANIC_MACHINE_KEY"))
 
+// controlNoise is whether to use the Noise transport to the control
+// server, if it supports it.
+var controlNoise, _ = strconv.ParseBool(os.Getenv("TS_DEBUG_CONTROL_NOISE"))
+
 func (b *LocalBackend) createGetMachinePrivateKeyFunc() func() (key.MachinePrivate, error) {
 	var cache atomic.Value
 	return func() (key.MachinePrivate, error) {
@@ -1397,8 +1485,15 @@ func (b *LocalBackend) writeServerModeStartState(userID string, prefs *ipn.Prefs
 		// redundant with the one in the 'if stateKey != ""'
 		// check block above. That one won't fire in the case
 		// where the Windows client started up in client mode.
-		// This happens when we transition into server mode:
-		if err := b.store.WriteState(stateKey, prefs.ToBytes()); err != nil {
+		// This happens when we transition into server mode.
+		//
+		// The prefs belong to the user's current login profile.
+		profiles, err := ipn.ReadProfiles(b.store, stateKey)
+		if err != nil {
+			b.logf("ReadProfiles error: %v", err)
+			return
+		}
+		if err := b.store.WriteState(ipn.ProfileStateKey(stateKey, profiles.Current), prefs.ToBytes()); err != nil {
 			b.logf("WriteState error: %v", err)
 		}
 	} else {
@@ -1409,8 +1504,9 @@ func (b *LocalBackend) writeServerModeStartState(userID string, prefs *ipn.Prefs
 }
 
 // loadStateLocked sets b.prefs and b.stateKey based on a complex
-// combination of key, prefs, and legacyPath. b.mu must be held when
-// calling.
+// combination of key, prefs, and legacyPath. If the backend owns the
+// state, it's loaded from key's current login profile. b.mu must be
+// held when calling.
 func (b *LocalBackend) loadStateLocked(key ipn.StateKey, prefs *ipn.Prefs) (err error) {
 	if prefs == nil && key == "" {
 		panic("state key and prefs are both unset")
@@ -1420,9 +1516,13 @@ func (b *LocalBackend) loadStateLocked(key ipn.StateKey, prefs *ipn.Prefs) (err
 	// logging), but revert it if we return an error so a later SetPrefs
 	// call can't pick it up if it's bogus.
 	b.stateKey = key
+	b.profileBaseKey = key
+	b.profile = ""
 	defer func() {
 		if err != nil {
 			b.stateKey = ""
+			b.profileBaseKey = ""
+			b.profile = ""
 		}
 	}()
 
@@ -1438,6 +1538,15 @@ func (b *LocalBackend) loadStateLocked(key ipn.StateKey, prefs *ipn.Prefs) (err
 		return nil
 	}
 
+	// The backend's state is that of the current login profile.
+	profiles, err := ipn.ReadProfiles(b.store, key)
+	if err != nil {
+		return fmt.Errorf("reading profiles: %v", err)
+	}
+	b.profile = profiles.Current
+	key = ipn.ProfileStateKey(key, b.profile)
+	b.stateKey = key
+
 	if prefs != nil {
 		// Backend owns the state, but frontend is trying to migrate
 		// state into the backend.
@@ -1507,7 +1616,7 @@ func (b *LocalBackend) Login(token *tailcfg.Oauth2Token) {
 	cc := b.cc
 	b.mu.Unlock()
 
-	cc.Login(token, controlclient.LoginInteractive)
+	cc.Login(token, b.loginFlags|controlclient.LoginInteractive)
 }
 
 // StartLoginInteractive implements Backend. It requests a new
@@ -1526,7 +1635,7 @@ func (b *LocalBackend) StartLoginInteractive() {
 	if url != "" {
 		b.popBrowserAuthNow()
 	} else {
-		flags := controlclient.LoginInteractive
+		flags := b.loginFlags | controlclient.LoginInteractive
 		if runtime.GOOS == "js" {
 			// The js/wasm client has no state storage so for now
 			// treat all interactive logins as ephemeral.
@@ -1623,6 +1732,11 @@ func (b *LocalBackend) SetCurrentUserID(uid string) {
 }
 
 func (b *LocalBackend) EditPrefs(mp *ipn.MaskedPrefs) (*ipn.Prefs, error) {
+	if mp.ServeSet {
+		if err := mp.Serve.Check(); err != nil {
+			return nil, fmt.Errorf("invalid serve config: %w", err)
+		}
+	}
 	b.mu.Lock()
 	p0 := b.prefs.Clone()
 	p1 := b.prefs.Clone()
@@ -1660,6 +1774,7 @@ func (b *LocalBackend) setPrefsLockedOnEntry(caller string, newp *ipn.Prefs) {
 	newp.Persist = oldp.Persist // caller isn't allowed to override this
 	b.prefs = newp
 	b.inServerMode = newp.ForceDaemon
+	b.pickAutoExitNodeLocked(netMap)
 	// We do this to avoid holding the lock while doing everything else.
 	newp = b.prefs.Clone()
 
@@ -1711,7 +1826,7 @@ func (b *LocalBackend) setPrefsLockedOnEntry(caller string, newp *ipn.Prefs) {
 
 	if !oldp.WantRunning && newp.WantRunning {
 		b.logf("transitioning to running; doing Login...")
-		cc.Login(nil, controlclient.LoginDefault)
+		cc.Login(nil, b.loginFlags|controlclient.LoginDefault)
 	}
 
 	if oldp.WantRunning != newp.WantRunning {
@@ -1855,6 +1970,9 @@ func (b *LocalBackend) authReconfig() {
 	dcfg := dnsConfigForNetmap(nm, prefs, b.logf, version.OS())
 
 	err = b.e.Reconfig(cfg, rcfg, dcfg, nm.Debug)
+	// The serve config can change without the engine's, so this
+	// goes before the ErrNoChanges check.
+	b.updateServeListeners()
 	if err == wgengine.ErrNoChanges {
 		return
 	}
@@ -1920,23 +2038,32 @@ func dnsConfigForNetmap(nm *netmap.NetworkMap, prefs *ipn.Prefs, logf logger.Log
 		set(peer.Name, peer.Addresses)
 	}
 	for _, rec := range nm.DNS.ExtraRecords {
+		fqdn, err := dnsname.ToFQDN(rec.Name)
+		if err != nil {
+			continue
+		}
 		switch rec.Type {
 		case "", "A", "AAAA":
 			// Treat these all the same for now: infer from the value
+			ip, err := netaddr.ParseIP(rec.Value)
+			if err != nil {
+				// Ignore.
+				continue
+			}
+			dcfg.Hosts[fqdn] = append(dcfg.Hosts[fqdn], ip)
+		case "SRV", "TXT", "CNAME":
+			r, err := resolver.ParseRecord(rec.Type, rec.Value)
+			if err != nil {
+				logf("[unexpected] bad %s record for %q: %v", rec.Type, rec.Name, err)
+				continue
+			}
+			if dcfg.Records == nil {
+				dcfg.Records = map[dnsname.FQDN][]resolver.Record{}
+			}
+			dcfg.Records[fqdn] = append(dcfg.Records[fqdn], r)
 		default:
 			// TODO: more
-			continue
 		}
-		ip, err := netaddr.ParseIP(rec.Value)
-		if err != nil {
-			// Ignore.
-			continue
-		}
-		fqdn, err := dnsname.ToFQDN(rec.Name)
-		if err != nil {
-			continue
-		}
-		dcfg.Hosts[fqdn] = append(dcfg.Hosts[fqdn], ip)
 	}
 
 	if !prefs.CorpDNS {
@@ -2143,6 +2270,7 @@ func (b *LocalBackend) initPeerAPIListener() {
 		directFileMode: b.directFileRoot != "",
 	}
 	b.peerAPIServer = ps
+	go ps.acceptWaitingFiles()
 
 	isNetstack := wgengine.IsNetstack(b.e)
 	for i, a := range b.netMap.Addresses {
@@ -2249,11 +2377,12 @@ func peerRoutes(peers []wgcfg.Peer, cgnatThreshold int) (routes []netaddr.IPPref
 // routerConfig produces a router.Config from a wireguard config and IPN prefs.
 func (b *LocalBackend) routerConfig(cfg *wgcfg.Config, prefs *ipn.Prefs) *router.Config {
 	rs := &router.Config{
-		LocalAddrs:       unmapIPPrefixes(cfg.Addresses),
-		SubnetRoutes:     unmapIPPrefixes(prefs.AdvertiseRoutes),
-		SNATSubnetRoutes: !prefs.NoSNAT,
-		NetfilterMode:    prefs.NetfilterMode,
-		Routes:           peerRoutes(cfg.Peers, 10_000),
+		LocalAddrs:         unmapIPPrefixes(cfg.Addresses),
+		SubnetRoutes:       unmapIPPrefixes(prefs.AdvertiseRoutes),
+		SNATSubnetRoutes:   !prefs.NoSNAT,
+		NoSNATSubnetRoutes: unmapIPPrefixes(prefs.NoSNATRoutes),
+		NetfilterMode:      prefs.NetfilterMode,
+		Routes:             peerRoutes(cfg.Peers, 10_000),
 	}
 
 	if distro.Get() == distro.Synology {
@@ -2267,7 +2396,7 @@ func (b *LocalBackend) routerConfig(cfg *wgcfg.Config, prefs *ipn.Prefs) *router
 	// likely to break some functionality, but if the user expressed a
 	// preference for routing remotely, we want to avoid leaking
 	// traffic at the expense of functionality.
-	if prefs.ExitNodeID != "" || !prefs.ExitNodeIP.IsZero() {
+	if prefs.ExitNodeID != "" || !prefs.ExitNodeIP.IsZero() || prefs.AutoExitNode {
 		var default4, default6 bool
 		for _, route := range rs.Routes {
 			switch route {
@@ -2353,6 +2482,7 @@ func (b *LocalBackend) enterState(newState ipn.State) {
 	} else if oldState == ipn.Running {
 		// Transitioning away from running.
 		b.closePeerAPIListenersLocked()
+		b.closeServeListenersLocked()
 	}
 	b.maybePauseControlClientLocked()
 	b.mu.Unlock()
@@ -2530,6 +2660,8 @@ func (b *LocalBackend) ResetForClientDisconnect() {
 		b.cc = nil
 	}
 	b.stateKey = ""
+	b.profileBaseKey = ""
+	b.profile = ""
 	b.userID = ""
 	b.setNetMapLocked(nil)
 	b.prefs = new(ipn.Prefs)
@@ -2539,6 +2671,67 @@ func (b *LocalBackend) ResetForClientDisconnect() {
 	b.activeLogin = ""
 }
 
+// Profiles returns the login profiles of the backend's state.
+func (b *LocalBackend) Profiles() (*ipn.Profiles, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.profileBaseKey == "" {
+		return nil, errors.New("login profiles require backend-owned state")
+	}
+	return ipn.ReadProfiles(b.store, b.profileBaseKey)
+}
+
+// SwitchProfile makes name the current login profile, creating it if
+// it doesn't exist, and restarts the backend with that profile's prefs.
+//
+// The control client and engine are torn down and rebuilt, but a
+// profile that was already logged in keeps its node key, so it comes
+// back up without re-authenticating. A new profile starts out logged
+// out, like a fresh install.
+func (b *LocalBackend) SwitchProfile(name string) error {
+	if err := ipn.CheckProfileName(name); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	base := b.profileBaseKey
+	if base == "" {
+		b.mu.Unlock()
+		return errors.New("login profiles require backend-owned state")
+	}
+	profiles, err := ipn.ReadProfiles(b.store, base)
+	if err != nil {
+		b.mu.Unlock()
+		return err
+	}
+	if profiles.Current == name && b.profile == name {
+		b.mu.Unlock()
+		return nil
+	}
+	profiles.Current = name
+	profiles.Add(name)
+	if err := ipn.WriteProfiles(b.store, base, profiles); err != nil {
+		b.mu.Unlock()
+		return fmt.Errorf("saving profiles: %w", err)
+	}
+	b.logf("SwitchProfile: %q -> %q", b.profile, name)
+	b.profile = name // so Start doesn't treat this as a no-op
+	var frontendLogID string
+	if b.hostinfo != nil {
+		frontendLogID = b.hostinfo.FrontendLogID
+	}
+	b.mu.Unlock()
+
+	// Drop the old profile's peers, routes and DNS now rather than
+	// when the new profile's first netmap arrives.
+	if err := b.e.Reconfig(&wgcfg.Config{}, &router.Config{}, &dns.Config{}, nil); err != nil {
+		b.logf("SwitchProfile: Reconfig(down): %v", err)
+	}
+	return b.Start(ipn.Options{
+		FrontendLogID: frontendLogID,
+		StateKey:      base,
+	})
+}
+
 // Logout tells the controlclient that we want to log out, and
 // transitions the local engine to the logged-out state without
 // waiting for controlclient to be in that state.
@@ -2626,6 +2819,7 @@ func (b *LocalBackend) setNetMapLocked(nm *netmap.NetworkMap) {
 		}
 	}
 	b.netMap = nm
+	b.pruneExitNodeLatencyLocked(nm)
 	if login != b.activeLogin {
 		b.logf("active login: %v", login)
 		b.activeLogin = login
@@ -2947,3 +3141,9 @@ func (b *LocalBackend) DERPMap() *tailcfg.DERPMap {
 	}
 	return b.netMap.DERPMap
 }
+
+// PacketFilter returns the packet filter currently in use by the
+// engine, for debugging.
+func (b *LocalBackend) PacketFilter() *filter.Filter {
+	return b.e.GetFilter()
+}
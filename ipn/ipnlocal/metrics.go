@@ -0,0 +1,99 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"time"
+
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/metrics"
+	"tailscale.com/util/clientmetric"
+)
+
+// WritePrometheusMetrics writes the node's metrics to w in the
+// Prometheus text exposition format: the client metrics, the
+// histograms published as expvars (such as DNS forwarding latency),
+// per-peer WireGuard statistics, and the packet filter's drop
+// counters.
+func (b *LocalBackend) WritePrometheusMetrics(w io.Writer) {
+	clientmetric.WritePrometheusExpositionFormat(w)
+	expvar.Do(func(kv expvar.KeyValue) {
+		if h, ok := kv.Value.(*metrics.Histogram); ok {
+			fmt.Fprintf(w, "# TYPE %s histogram\n", kv.Key)
+			h.WritePrometheus(w, kv.Key, "")
+		}
+	})
+	writePeerMetrics(w, b.Status(), time.Now())
+	if f := b.PacketFilter(); f != nil {
+		fmt.Fprintf(w, "# TYPE tailscaled_filter_drops counter\n")
+		for _, dc := range f.DropCounts() {
+			fmt.Fprintf(w, "tailscaled_filter_drops{reason=%q,direction=\"in\"} %d\n", dc.Reason, dc.In)
+			fmt.Fprintf(w, "tailscaled_filter_drops{reason=%q,direction=\"out\"} %d\n", dc.Reason, dc.Out)
+		}
+	}
+}
+
+// writePeerMetrics writes metrics for each peer in st that's in the
+// network map. Samples are labeled with the peer's stable node ID,
+// host name and first Tailscale IP.
+func writePeerMetrics(w io.Writer, st *ipnstate.Status, now time.Time) {
+	type peerMetric struct {
+		name, typ string
+		val       func(ps *ipnstate.PeerStatus) (v float64, ok bool)
+	}
+	peerMetrics := []peerMetric{
+		{"tailscaled_peer_rx_bytes", "counter", func(ps *ipnstate.PeerStatus) (float64, bool) {
+			return float64(ps.RxBytes), true
+		}},
+		{"tailscaled_peer_tx_bytes", "counter", func(ps *ipnstate.PeerStatus) (float64, bool) {
+			return float64(ps.TxBytes), true
+		}},
+		{"tailscaled_peer_rx_packets", "counter", func(ps *ipnstate.PeerStatus) (float64, bool) {
+			return float64(ps.RxPackets), true
+		}},
+		{"tailscaled_peer_tx_packets", "counter", func(ps *ipnstate.PeerStatus) (float64, bool) {
+			return float64(ps.TxPackets), true
+		}},
+		{"tailscaled_peer_handshake_age_seconds", "gauge", func(ps *ipnstate.PeerStatus) (float64, bool) {
+			if ps.LastHandshake.IsZero() {
+				return 0, false
+			}
+			return now.Sub(ps.LastHandshake).Seconds(), true
+		}},
+		{"tailscaled_peer_direct", "gauge", func(ps *ipnstate.PeerStatus) (float64, bool) {
+			// 1 if using a direct UDP path, 0 if via DERP.
+			if ps.CurAddr != "" {
+				return 1, true
+			}
+			return 0, ps.Relay != ""
+		}},
+	}
+	var peers []*ipnstate.PeerStatus
+	for _, k := range st.Peers() {
+		if ps := st.Peer[k]; ps.InNetworkMap {
+			peers = append(peers, ps)
+		}
+	}
+	for _, m := range peerMetrics {
+		fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.typ)
+		for _, ps := range peers {
+			if v, ok := m.val(ps); ok {
+				fmt.Fprintf(w, "%s{%s} %v\n", m.name, peerLabels(ps), v)
+			}
+		}
+	}
+}
+
+// peerLabels returns the Prometheus labels identifying ps.
+func peerLabels(ps *ipnstate.PeerStatus) string {
+	var ip string
+	if len(ps.TailscaleIPs) > 0 {
+		ip = ps.TailscaleIPs[0].String()
+	}
+	return fmt.Sprintf("node=%q,hostname=%q,ip=%q", ps.ID, ps.HostName, ip)
+}
@@ -0,0 +1,69 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/types/key"
+)
+
+func TestWritePeerMetrics(t *testing.T) {
+	now := time.Unix(1000, 0)
+	sb := new(ipnstate.StatusBuilder)
+	sb.AddPeer(key.NewNode().Public(), &ipnstate.PeerStatus{
+		ID:            "nDirect",
+		HostName:      "direct",
+		TailscaleIPs:  []netaddr.IP{netaddr.MustParseIP("100.64.0.1")},
+		CurAddr:       "1.2.3.4:41641",
+		Relay:         "nyc",
+		RxBytes:       10,
+		TxBytes:       20,
+		RxPackets:     3,
+		TxPackets:     4,
+		LastHandshake: now.Add(-30 * time.Second),
+		InNetworkMap:  true,
+	})
+	sb.AddPeer(key.NewNode().Public(), &ipnstate.PeerStatus{
+		ID:           "nDERP",
+		HostName:     "derp",
+		TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.2")},
+		Relay:        "nyc",
+		InNetworkMap: true,
+	})
+	sb.AddPeer(key.NewNode().Public(), &ipnstate.PeerStatus{
+		ID:       "nGone",
+		HostName: "gone",
+	})
+
+	var buf bytes.Buffer
+	writePeerMetrics(&buf, sb.Status(), now)
+	got := buf.String()
+	for _, want := range []string{
+		"# TYPE tailscaled_peer_rx_bytes counter\n",
+		`tailscaled_peer_rx_bytes{node="nDirect",hostname="direct",ip="100.64.0.1"} 10` + "\n",
+		`tailscaled_peer_tx_bytes{node="nDirect",hostname="direct",ip="100.64.0.1"} 20` + "\n",
+		`tailscaled_peer_rx_packets{node="nDirect",hostname="direct",ip="100.64.0.1"} 3` + "\n",
+		`tailscaled_peer_tx_packets{node="nDirect",hostname="direct",ip="100.64.0.1"} 4` + "\n",
+		`tailscaled_peer_handshake_age_seconds{node="nDirect",hostname="direct",ip="100.64.0.1"} 30` + "\n",
+		`tailscaled_peer_direct{node="nDirect",hostname="direct",ip="100.64.0.1"} 1` + "\n",
+		`tailscaled_peer_direct{node="nDERP",hostname="derp",ip="100.64.0.2"} 0` + "\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %q in:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "nGone") {
+		t.Errorf("peer not in netmap was written:\n%s", got)
+	}
+	if strings.Contains(got, `tailscaled_peer_handshake_age_seconds{node="nDERP"`) {
+		t.Errorf("handshake age written for peer without a handshake:\n%s", got)
+	}
+}
@@ -6,13 +6,17 @@ package ipnlocal
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
 	"hash/crc32"
 	"html"
 	"io"
 	"io/fs"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
@@ -36,6 +40,7 @@ import (
 	"tailscale.com/net/interfaces"
 	"tailscale.com/syncs"
 	"tailscale.com/tailcfg"
+	"tailscale.com/util/dirtar"
 	"tailscale.com/wgengine"
 )
 
@@ -55,6 +60,9 @@ type peerAPIServer struct {
 	// In directFileMode, the peerapi doesn't do the final rename
 	// from "foo.jpg.partial" to "foo.jpg".
 	directFileMode bool
+
+	mu       sync.Mutex
+	incoming map[string]bool // base names of files being PUT
 }
 
 const (
@@ -88,29 +96,37 @@ func validFilenameRune(r rune) bool {
 	return unicode.IsPrint(r)
 }
 
-func (s *peerAPIServer) diskPath(baseName string) (fullPath string, ok bool) {
-	if !utf8.ValidString(baseName) {
-		return "", false
+// validFilename reports whether name is valid as the name of a
+// received file, or of a file or directory in a received directory.
+func validFilename(name string) bool {
+	if !utf8.ValidString(name) {
+		return false
 	}
-	if strings.TrimSpace(baseName) != baseName {
-		return "", false
+	if strings.TrimSpace(name) != name {
+		return false
 	}
-	if len(baseName) > 255 {
-		return "", false
+	if len(name) > 255 {
+		return false
 	}
 	// TODO: validate unicode normalization form too? Varies by platform.
-	clean := path.Clean(baseName)
-	if clean != baseName ||
-		clean == "." || clean == ".." ||
-		strings.HasSuffix(clean, deletedSuffix) ||
-		strings.HasSuffix(clean, partialSuffix) {
-		return "", false
+	clean := path.Clean(name)
+	if clean != name || clean == "." || clean == ".." {
+		return false
 	}
-	for _, r := range baseName {
+	for _, r := range name {
 		if !validFilenameRune(r) {
-			return "", false
+			return false
 		}
 	}
+	return true
+}
+
+func (s *peerAPIServer) diskPath(baseName string) (fullPath string, ok bool) {
+	if !validFilename(baseName) ||
+		strings.HasSuffix(baseName, deletedSuffix) ||
+		strings.HasSuffix(baseName, partialSuffix) {
+		return "", false
+	}
 	return filepath.Join(s.rootDir, baseName), true
 }
 
@@ -149,7 +165,7 @@ func (s *peerAPIServer) hasFilesWaiting() bool {
 				defer tryDeleteAgain(filepath.Join(s.rootDir, strings.TrimSuffix(name, deletedSuffix)))
 				continue
 			}
-			if de.Type().IsRegular() {
+			if de.Type().IsRegular() || de.IsDir() {
 				_, err := os.Stat(filepath.Join(s.rootDir, name+deletedSuffix))
 				if os.IsNotExist(err) {
 					return true
@@ -212,6 +228,12 @@ func (s *peerAPIServer) WaitingFiles() (ret []apitype.WaitingFile, err error) {
 					Name: filepath.Base(name),
 					Size: fi.Size(),
 				})
+			} else if de.IsDir() {
+				ret = append(ret, apitype.WaitingFile{
+					Name: filepath.Base(name),
+					Size: treeSize(filepath.Join(s.rootDir, name)),
+					Dir:  true,
+				})
 			}
 		}
 		if err == io.EOF {
@@ -242,6 +264,19 @@ func (s *peerAPIServer) WaitingFiles() (ret []apitype.WaitingFile, err error) {
 	return ret, nil
 }
 
+// treeSize returns the total size of the regular files under dir.
+func treeSize(dir string) (size int64) {
+	filepath.WalkDir(dir, func(path string, de fs.DirEntry, err error) error {
+		if err == nil && de.Type().IsRegular() {
+			if fi, err := de.Info(); err == nil {
+				size += fi.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
+
 // tryDeleteAgain tries to delete path (and path+deletedSuffix) after
 // it failed earlier.  This happens on Windows when various anti-virus
 // tools hook into filesystem operations and have the file open still
@@ -251,7 +286,7 @@ func (s *peerAPIServer) WaitingFiles() (ret []apitype.WaitingFile, err error) {
 //
 // fullPath is the full path to the file without the deleted suffix.
 func tryDeleteAgain(fullPath string) {
-	if err := os.Remove(fullPath); err == nil || os.IsNotExist(err) {
+	if err := os.RemoveAll(fullPath); err == nil {
 		os.Remove(fullPath + deletedSuffix)
 	}
 }
@@ -271,8 +306,8 @@ func (s *peerAPIServer) DeleteFile(baseName string) error {
 	logf := s.b.logf
 	t0 := time.Now()
 	for {
-		err := os.Remove(path)
-		if err != nil && !os.IsNotExist(err) {
+		err := os.RemoveAll(path)
+		if err != nil {
 			err = redactErr(err)
 			// Put a retry loop around deletes on Windows. Windows
 			// file descriptor closes are effectively asynchronous,
@@ -322,6 +357,8 @@ func touchFile(path string) error {
 	return f.Close()
 }
 
+// OpenFile opens the waiting file baseName. If it's a directory, rc
+// reads it as a tar archive (see package dirtar) and size is -1.
 func (s *peerAPIServer) OpenFile(baseName string) (rc io.ReadCloser, size int64, err error) {
 	if s.rootDir == "" {
 		return nil, 0, errors.New("peerapi disabled; no storage configured")
@@ -346,6 +383,14 @@ func (s *peerAPIServer) OpenFile(baseName string) (rc io.ReadCloser, size int64,
 		f.Close()
 		return nil, 0, redactErr(err)
 	}
+	if fi.IsDir() {
+		f.Close()
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(redactErr(dirtar.WriteDir(pw, path)))
+		}()
+		return pr, -1, nil
+	}
 	return f, fi.Size(), nil
 }
 
@@ -581,6 +626,79 @@ func (f *incomingFile) PartialFile() ipn.PartialFile {
 	}
 }
 
+// startIncoming marks the file baseName as being received, reporting
+// false if it already is.
+func (s *peerAPIServer) startIncoming(baseName string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.incoming[baseName] {
+		return false
+	}
+	if s.incoming == nil {
+		s.incoming = make(map[string]bool)
+	}
+	s.incoming[baseName] = true
+	return true
+}
+
+func (s *peerAPIServer) endIncoming(baseName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.incoming, baseName)
+}
+
+func (s *peerAPIServer) isIncoming(baseName string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.incoming[baseName]
+}
+
+// hashPartial returns the size and hex SHA-256 of the partial file
+// path, which need not exist.
+func hashPartial(path string) (size int64, sum string, err error) {
+	h := sha256.New()
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, hex.EncodeToString(h.Sum(nil)), nil
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	if fi, err := f.Stat(); err == nil && fi.IsDir() {
+		// Left by an interrupted directory transfer, which
+		// can't be resumed.
+		return 0, hex.EncodeToString(h.Sum(nil)), nil
+	}
+	size, err = io.Copy(h, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// openPartialAt opens the partial file path to resume a transfer
+// after its first offset bytes, which it writes to h. It drops
+// anything after them.
+func openPartialAt(path string, offset int64, h hash.Hash) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	n, err := io.Copy(h, io.LimitReader(f, offset))
+	if err == nil && n != offset {
+		err = fmt.Errorf("have %d bytes, not %d", n, offset)
+	}
+	if err == nil {
+		err = f.Truncate(offset)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
 func (h *peerAPIHandler) handlePeerPut(w http.ResponseWriter, r *http.Request) {
 	if !h.isSelf {
 		http.Error(w, "not owner", http.StatusForbidden)
@@ -590,7 +708,7 @@ func (h *peerAPIHandler) handlePeerPut(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "file sharing not enabled by Tailscale admin", http.StatusForbidden)
 		return
 	}
-	if r.Method != "PUT" {
+	if r.Method != "PUT" && r.Method != "GET" {
 		http.Error(w, "expected method PUT", http.StatusMethodNotAllowed)
 		return
 	}
@@ -622,30 +740,73 @@ func (h *peerAPIHandler) handlePeerPut(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "bad filename", 400)
 		return
 	}
-	t0 := time.Now()
-	// TODO(bradfitz): prevent same filename being sent by two peers at once
 	partialFile := dstFile + partialSuffix
-	f, err := os.Create(partialFile)
-	if err != nil {
-		h.logf("put Create error: %v", redactErr(err))
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if r.Method == "GET" {
+		h.servePartialFile(w, baseName, partialFile)
 		return
 	}
-	var success bool
+	var offset int64
+	if v := r.URL.Query().Get("offset"); v != "" {
+		offset, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || offset < 0 {
+			http.Error(w, "bad offset", 400)
+			return
+		}
+	}
+	if !h.ps.startIncoming(baseName) {
+		http.Error(w, "file already being received", http.StatusConflict)
+		return
+	}
+	defer h.ps.endIncoming(baseName)
+
+	if r.Header.Get("Content-Type") == dirtar.ContentType {
+		if offset != 0 {
+			http.Error(w, "directory transfers can't be resumed", 400)
+			return
+		}
+		h.handlePeerPutDir(w, r, baseName, dstFile)
+		return
+	}
+
+	t0 := time.Now()
+	sum := sha256.New()
+	var f *os.File
+	if offset == 0 {
+		f, err = os.Create(partialFile)
+		if err != nil {
+			h.logf("put Create error: %v", redactErr(err))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	} else {
+		f, err = openPartialAt(partialFile, offset, sum)
+		if err != nil {
+			err = redactErr(err)
+			h.logf("put resume error: %v", err)
+			http.Error(w, "can't resume: "+err.Error(), http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+	}
+	var success, keepPartial bool
 	defer func() {
-		if !success {
+		if !success && !keepPartial {
 			os.Remove(partialFile)
 		}
 	}()
-	var finalSize int64
+	finalSize := offset
 	var inFile *incomingFile
 	if r.ContentLength != 0 {
+		size := r.ContentLength
+		if size > 0 {
+			size += offset
+		}
 		inFile = &incomingFile{
 			name:    baseName,
 			started: time.Now(),
-			size:    r.ContentLength,
-			w:       f,
+			size:    size,
+			w:       io.MultiWriter(f, sum),
 			ph:      h,
+			copied:  offset,
 		}
 		if h.ps.directFileMode {
 			inFile.partialPath = partialFile
@@ -656,11 +817,19 @@ func (h *peerAPIHandler) handlePeerPut(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			err = redactErr(err)
 			f.Close()
+			// Keep what we got so the sender can resume.
+			keepPartial = true
 			h.logf("put Copy error: %v", err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		finalSize = n
+		finalSize += n
+	}
+	if !checkSHA256(r, sum) {
+		f.Close()
+		h.logf("put of %s failed SHA-256 check", approxSize(finalSize))
+		http.Error(w, "SHA-256 mismatch", 400)
+		return
 	}
 	if err := redactErr(f.Close()); err != nil {
 		h.logf("put Close error: %v", err)
@@ -681,7 +850,11 @@ func (h *peerAPIHandler) handlePeerPut(w http.ResponseWriter, r *http.Request) {
 	}
 
 	d := time.Since(t0).Round(time.Second / 10)
-	h.logf("got put of %s in %v from %v/%v", approxSize(finalSize), d, h.remoteAddr.IP, h.peerNode.ComputedName)
+	var resumed string
+	if offset > 0 {
+		resumed = fmt.Sprintf(" (resumed at %s)", approxSize(offset))
+	}
+	h.logf("got put of %s%s in %v from %v/%v", approxSize(finalSize), resumed, d, h.remoteAddr.IP, h.peerNode.ComputedName)
 
 	// TODO: set modtime
 	// TODO: some real response
@@ -689,6 +862,112 @@ func (h *peerAPIHandler) handlePeerPut(w http.ResponseWriter, r *http.Request) {
 	io.WriteString(w, "{}\n")
 	h.ps.knownEmpty.Set(false)
 	h.ps.b.sendFileNotify()
+	h.fileReceived(baseName, dstFile, false)
+}
+
+// checkSHA256 reports whether sum, the hash of r's body, is the
+// SHA-256 the sender declared, if any. The body must be fully read.
+func checkSHA256(r *http.Request, sum hash.Hash) bool {
+	want := r.Header.Get(apitype.FileSHA256Header)
+	if v := r.Trailer.Get(apitype.FileSHA256Header); v != "" {
+		want = v
+	}
+	return want == "" || strings.EqualFold(want, hex.EncodeToString(sum.Sum(nil)))
+}
+
+// handlePeerPutDir handles a PUT of a directory tree, sent as a tar
+// archive, to be received as baseName at dstDir.
+func (h *peerAPIHandler) handlePeerPutDir(w http.ResponseWriter, r *http.Request, baseName, dstDir string) {
+	t0 := time.Now()
+	partialDir := dstDir + partialSuffix
+	if err := os.RemoveAll(partialDir); err != nil {
+		err = redactErr(err)
+		h.logf("put dir RemoveAll error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var success bool
+	defer func() {
+		if !success {
+			os.RemoveAll(partialDir)
+		}
+	}()
+	sum := sha256.New()
+	inFile := &incomingFile{
+		name:    baseName,
+		started: time.Now(),
+		size:    r.ContentLength,
+		w:       sum,
+		ph:      h,
+	}
+	if h.ps.directFileMode {
+		inFile.partialPath = partialDir
+	}
+	h.ps.b.registerIncomingFile(inFile, true)
+	defer h.ps.b.registerIncomingFile(inFile, false)
+	body := io.TeeReader(r.Body, inFile)
+	err := dirtar.Extract(body, partialDir, validFilename)
+	if err == nil {
+		// Read the end of the body, and so any trailer.
+		_, err = io.Copy(ioutil.Discard, body)
+	}
+	if err != nil {
+		err = redactErr(err)
+		h.logf("put dir error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !checkSHA256(r, sum) {
+		h.logf("put of directory failed SHA-256 check")
+		http.Error(w, "SHA-256 mismatch", 400)
+		return
+	}
+	if h.ps.directFileMode {
+		inFile.markAndNotifyDone()
+	} else {
+		// Like a file, replace anything waiting of the same name.
+		err := os.RemoveAll(dstDir)
+		if err == nil {
+			err = os.Rename(partialDir, dstDir)
+		}
+		if err != nil {
+			err = redactErr(err)
+			h.logf("put dir final rename: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	d := time.Since(t0).Round(time.Second / 10)
+	h.logf("got put of directory (%s archive) in %v from %v/%v", approxSize(inFile.PartialFile().Received), d, h.remoteAddr.IP, h.peerNode.ComputedName)
+
+	success = true
+	io.WriteString(w, "{}\n")
+	h.ps.knownEmpty.Set(false)
+	h.ps.b.sendFileNotify()
+	h.fileReceived(baseName, dstDir, true)
+}
+
+// servePartialFile serves the state of the partial file for a
+// GET of baseName's PUT URL.
+func (h *peerAPIHandler) servePartialFile(w http.ResponseWriter, baseName, partialFile string) {
+	if h.ps.isIncoming(baseName) {
+		http.Error(w, "file already being received", http.StatusConflict)
+		return
+	}
+	size, sum, err := hashPartial(partialFile)
+	if err != nil {
+		err = redactErr(err)
+		h.logf("hashing partial file: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(apitype.PartialFile{
+		Name:   baseName,
+		Size:   size,
+		SHA256: sum,
+	})
 }
 
 func approxSize(n int64) string {
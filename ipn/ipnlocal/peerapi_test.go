@@ -5,7 +5,12 @@
 package ipnlocal
 
 import (
+	"archive/tar"
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
@@ -19,8 +24,10 @@ import (
 	"strings"
 	"testing"
 
+	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/tailcfg"
 	"tailscale.com/tstest"
+	"tailscale.com/util/dirtar"
 )
 
 type peerAPITestEnv struct {
@@ -568,3 +575,231 @@ func TestDeletedMarkers(t *testing.T) {
 	}
 
 }
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) { return 0, errors.New("connection lost") }
+
+func TestPutResume(t *testing.T) {
+	dir := t.TempDir()
+	ph := &peerAPIHandler{
+		isSelf: true,
+		peerNode: &tailcfg.Node{
+			ComputedName: "some-peer-name",
+		},
+		ps: &peerAPIServer{
+			b: &LocalBackend{
+				logf:           t.Logf,
+				capFileSharing: true,
+			},
+			rootDir: dir,
+		},
+	}
+	do := func(req *http.Request) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		ph.ServeHTTP(rr, req)
+		return rr
+	}
+	getPartial := func() apitype.PartialFile {
+		t.Helper()
+		rr := do(httptest.NewRequest("GET", "/v0/put/foo", nil))
+		if rr.Code != 200 {
+			t.Fatalf("GET = %v: %s", rr.Code, rr.Body)
+		}
+		var pf apitype.PartialFile
+		if err := json.Unmarshal(rr.Body.Bytes(), &pf); err != nil {
+			t.Fatal(err)
+		}
+		return pf
+	}
+
+	if pf := getPartial(); pf.Size != 0 || pf.SHA256 != sha256Hex("") {
+		t.Errorf("before any PUT, got %+v", pf)
+	}
+
+	// A dropped connection leaves the partial file for resuming.
+	req := httptest.NewRequest("PUT", "/v0/put/foo", io.MultiReader(strings.NewReader("hello "), failingReader{}))
+	if rr := do(req); rr.Code != 500 {
+		t.Fatalf("interrupted PUT = %v; want 500", rr.Code)
+	}
+	if pf := getPartial(); pf.Size != 6 || pf.SHA256 != sha256Hex("hello ") {
+		t.Errorf("after interrupted PUT, got %+v", pf)
+	}
+
+	// Resuming past the end of the partial file fails.
+	if rr := do(httptest.NewRequest("PUT", "/v0/put/foo?offset=7", strings.NewReader("orld"))); rr.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("PUT at bad offset = %v; want 416", rr.Code)
+	}
+
+	req = httptest.NewRequest("PUT", "/v0/put/foo?offset=6", strings.NewReader("world"))
+	req.Header.Set(apitype.FileSHA256Header, sha256Hex("hello world"))
+	if rr := do(req); rr.Code != 200 {
+		t.Fatalf("resumed PUT = %v: %s", rr.Code, rr.Body)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(dir, "foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello world" {
+		t.Errorf("got %q; want %q", got, "hello world")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "foo.partial")); !os.IsNotExist(err) {
+		t.Errorf("partial file remains after PUT: %v", err)
+	}
+}
+
+func TestPutChecksum(t *testing.T) {
+	tests := []struct {
+		name     string
+		sum      string
+		trailer  bool
+		wantCode int
+	}{
+		{"none", "", false, 200},
+		{"header", sha256Hex("contents"), false, 200},
+		{"header_upper", strings.ToUpper(sha256Hex("contents")), false, 200},
+		{"header_mismatch", sha256Hex("other"), false, 400},
+		{"trailer", sha256Hex("contents"), true, 200},
+		{"trailer_mismatch", sha256Hex("other"), true, 400},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			ph := &peerAPIHandler{
+				isSelf: true,
+				peerNode: &tailcfg.Node{
+					ComputedName: "some-peer-name",
+				},
+				ps: &peerAPIServer{
+					b: &LocalBackend{
+						logf:           t.Logf,
+						capFileSharing: true,
+					},
+					rootDir: dir,
+				},
+			}
+			req := httptest.NewRequest("PUT", "/v0/put/foo", strings.NewReader("contents"))
+			if tt.trailer {
+				req.Trailer = http.Header{apitype.FileSHA256Header: {tt.sum}}
+			} else if tt.sum != "" {
+				req.Header.Set(apitype.FileSHA256Header, tt.sum)
+			}
+			rr := httptest.NewRecorder()
+			ph.ServeHTTP(rr, req)
+			if rr.Code != tt.wantCode {
+				t.Fatalf("PUT = %v; want %v: %s", rr.Code, tt.wantCode, rr.Body)
+			}
+			_, err := os.Stat(filepath.Join(dir, "foo"))
+			if gotFile := err == nil; gotFile != (tt.wantCode == 200) {
+				t.Errorf("file exists = %v; want %v", gotFile, !gotFile)
+			}
+			if _, err := os.Stat(filepath.Join(dir, "foo.partial")); !os.IsNotExist(err) {
+				t.Errorf("partial file remains: %v", err)
+			}
+		})
+	}
+}
+
+func TestPutDir(t *testing.T) {
+	dir := t.TempDir()
+	ps := &peerAPIServer{
+		b: &LocalBackend{
+			logf:           t.Logf,
+			capFileSharing: true,
+		},
+		rootDir: dir,
+	}
+	ph := &peerAPIHandler{
+		isSelf: true,
+		peerNode: &tailcfg.Node{
+			ComputedName: "some-peer-name",
+		},
+		ps: ps,
+	}
+	put := func(archive []byte, sum string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PUT", "/v0/put/photos", bytes.NewReader(archive))
+		req.Header.Set("Content-Type", dirtar.ContentType)
+		req.Trailer = http.Header{apitype.FileSHA256Header: {sum}}
+		rr := httptest.NewRecorder()
+		ph.ServeHTTP(rr, req)
+		return rr
+	}
+
+	src := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(src, "2021"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "a.jpg"), []byte("aaa"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "2021", "b.jpg"), []byte("bb"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := dirtar.WriteDir(&buf, src); err != nil {
+		t.Fatal(err)
+	}
+	archive := buf.Bytes()
+
+	if rr := put(archive, sha256Hex("wrong")); rr.Code != 400 {
+		t.Errorf("PUT with bad checksum = %v; want 400", rr.Code)
+	}
+	if rr := put(archive, sha256Hex(string(archive))); rr.Code != 200 {
+		t.Fatalf("PUT = %v: %s", rr.Code, rr.Body)
+	}
+	if got, err := ioutil.ReadFile(filepath.Join(dir, "photos", "2021", "b.jpg")); err != nil || string(got) != "bb" {
+		t.Errorf("photos/2021/b.jpg = %q, %v; want bb", got, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "photos.partial")); !os.IsNotExist(err) {
+		t.Errorf("partial directory remains: %v", err)
+	}
+
+	wfs, err := ps.WaitingFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (apitype.WaitingFile{Name: "photos", Size: 5, Dir: true}); len(wfs) != 1 || wfs[0] != want {
+		t.Errorf("WaitingFiles = %+v; want [%+v]", wfs, want)
+	}
+	rc, size, err := ps.OpenFile("photos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != -1 {
+		t.Errorf("OpenFile size = %v; want -1", size)
+	}
+	out := filepath.Join(t.TempDir(), "photos")
+	err = dirtar.Extract(rc, out, nil)
+	rc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadFile(filepath.Join(out, "a.jpg")); err != nil || string(got) != "aaa" {
+		t.Errorf("a.jpg = %q, %v; want aaa", got, err)
+	}
+	if err := ps.DeleteFile("photos"); err != nil {
+		t.Fatal(err)
+	}
+	if wfs, _ := ps.WaitingFiles(); len(wfs) != 0 {
+		t.Errorf("after delete, WaitingFiles = %+v", wfs)
+	}
+
+	// An archive writing outside the directory is rejected.
+	buf.Reset()
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "../evil", Size: 1})
+	tw.Write([]byte("x"))
+	tw.Close()
+	if rr := put(buf.Bytes(), ""); rr.Code != 500 {
+		t.Errorf("PUT of unsafe archive = %v; want 500", rr.Code)
+	}
+	des, _ := os.ReadDir(dir)
+	if len(des) != 0 {
+		t.Errorf("files left after unsafe archive: %v", des)
+	}
+}
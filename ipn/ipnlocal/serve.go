@@ -0,0 +1,287 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/ipn"
+	"tailscale.com/types/logger"
+	"tailscale.com/types/netmap"
+)
+
+// serveListener is a listener on one of the node's Tailscale
+// IP:ports, serving a port of the serve config.
+type serveListener struct {
+	h      *ipn.TCPPortHandler // what it serves; not mutated
+	closer io.Closer           // stops it
+}
+
+// SetListenTCPFunc sets the function used to listen on the node's
+// Tailscale IPs for the serve config, for when those IPs are handled
+// by netstack rather than the OS. If nil (the default), the OS's
+// network stack is used.
+func (b *LocalBackend) SetListenTCPFunc(fn func(netaddr.IPPort) (net.Listener, error)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.listenTCP = fn
+}
+
+// updateServeListeners starts and stops listeners on the node's
+// Tailscale IPs so that they match the serve config in the prefs.
+// Listeners whose config didn't change are left alone.
+func (b *LocalBackend) updateServeListeners() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	want := map[netaddr.IPPort]*ipn.TCPPortHandler{}
+	if nm := b.netMap; nm != nil && b.prefs != nil && b.prefs.WantRunning && b.prefs.Serve != nil {
+		for port, h := range b.prefs.Serve.TCP {
+			for _, a := range nm.Addresses {
+				if a.IsSingleIP() {
+					want[netaddr.IPPortFrom(a.IP(), port)] = h
+				}
+			}
+		}
+	}
+	for ipp, sl := range b.serveListeners {
+		if h, ok := want[ipp]; ok && h.Equal(sl.h) {
+			continue
+		}
+		sl.closer.Close()
+		delete(b.serveListeners, ipp)
+	}
+	for ipp, h := range want {
+		if _, ok := b.serveListeners[ipp]; ok {
+			continue
+		}
+		sl, err := b.startServeListenerLocked(ipp, h.Clone())
+		if err != nil {
+			b.logf("serve: listening on %v: %v", ipp, err)
+			continue
+		}
+		if b.serveListeners == nil {
+			b.serveListeners = make(map[netaddr.IPPort]*serveListener)
+		}
+		b.serveListeners[ipp] = sl
+	}
+}
+
+// closeServeListenersLocked closes all the serve config's listeners.
+//
+// b.mu must be held.
+func (b *LocalBackend) closeServeListenersLocked() {
+	for ipp, sl := range b.serveListeners {
+		sl.closer.Close()
+		delete(b.serveListeners, ipp)
+	}
+}
+
+// startServeListenerLocked listens on ipp and starts serving h there.
+//
+// b.mu must be held.
+func (b *LocalBackend) startServeListenerLocked(ipp netaddr.IPPort, h *ipn.TCPPortHandler) (*serveListener, error) {
+	var ln net.Listener
+	var err error
+	if b.listenTCP != nil {
+		ln, err = b.listenTCP(ipp)
+	} else {
+		tcp4or6 := "tcp4"
+		if ipp.IP().Is6() {
+			tcp4or6 = "tcp6"
+		}
+		ln, err = net.Listen(tcp4or6, ipp.String())
+	}
+	if err != nil {
+		return nil, err
+	}
+	if h.TCPForward != "" {
+		b.logf("serve: forwarding %v to %v", ipp, h.TCPForward)
+		go b.serveTCPForward(ln, h.TCPForward)
+		return &serveListener{h: h, closer: ln}, nil
+	}
+	hs := &http.Server{
+		Handler:   b.newServeWebHandler(h.Web),
+		TLSConfig: &tls.Config{GetCertificate: b.getServeCert},
+		ErrorLog:  logger.StdLogger(logger.WithPrefix(b.logf, "serve: ")),
+	}
+	b.logf("serve: serving HTTPS on %v", ipp)
+	go hs.ServeTLS(ln, "", "")
+	return &serveListener{h: h, closer: hs}, nil
+}
+
+// serveTCPForward forwards connections accepted from ln to target
+// until ln is closed.
+func (b *LocalBackend) serveTCPForward(ln net.Listener, target string) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			var d net.Dialer
+			ctx, cancel := context.WithTimeout(b.ctx, 10*time.Second)
+			bc, err := d.DialContext(ctx, "tcp", target)
+			cancel()
+			if err != nil {
+				b.logf("serve: forwarding %v to %v: %v", c.RemoteAddr(), target, err)
+				return
+			}
+			defer bc.Close()
+			errc := make(chan error, 2)
+			go func() {
+				_, err := io.Copy(bc, c)
+				errc <- err
+			}()
+			go func() {
+				_, err := io.Copy(c, bc)
+				errc <- err
+			}()
+			<-errc
+		}()
+	}
+}
+
+// newServeWebHandler returns the HTTP handler for an HTTPS port of the
+// serve config, which has been validated by ServeConfig.Check.
+func (b *LocalBackend) newServeWebHandler(web map[string]*ipn.HTTPHandler) http.Handler {
+	mux := http.NewServeMux()
+	for mount, wh := range web {
+		var h http.Handler
+		if wh.Proxy != "" {
+			u, err := url.Parse(wh.Proxy)
+			if err != nil {
+				b.logf("serve: bad proxy URL for %q: %v", mount, err)
+				continue
+			}
+			h = b.newServeProxy(u)
+		} else {
+			h = serveFileHandler(wh.Path)
+		}
+		mux.Handle(mount, http.StripPrefix(strings.TrimSuffix(mount, "/"), h))
+	}
+	return mux
+}
+
+// newServeProxy returns a reverse proxy to the local HTTP server at u
+// that tells it who each request is from with the identity headers
+// (see ipn.HeaderUserLogin), overwriting any the client sent.
+func (b *LocalBackend) newServeProxy(u *url.URL) *httputil.ReverseProxy {
+	rp := httputil.NewSingleHostReverseProxy(u)
+	director := rp.Director
+	rp.Director = func(r *http.Request) {
+		director(r)
+		ipp, err := netaddr.ParseIPPort(r.RemoteAddr)
+		if err != nil {
+			ipn.StripIdentityHeaders(r.Header)
+			return
+		}
+		n, up, ok := b.WhoIs(ipp)
+		if !ok {
+			ipn.StripIdentityHeaders(r.Header)
+			return
+		}
+		ipn.SetIdentityHeaders(r.Header, n, &up)
+	}
+	return rp
+}
+
+// serveFileHandler returns a handler serving the file or directory at
+// path.
+func serveFileHandler(path string) http.Handler {
+	if fi, err := os.Stat(path); err == nil && !fi.IsDir() {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.ServeFile(w, r, path)
+		})
+	}
+	return http.FileServer(http.Dir(path))
+}
+
+// serveDomain returns the node's MagicDNS name, without the trailing
+// dot, for which its HTTPS ports get TLS certs. It returns the empty
+// string if the node doesn't have one.
+func serveDomain(nm *netmap.NetworkMap) string {
+	if nm == nil {
+		return ""
+	}
+	return strings.TrimSuffix(nm.Name, ".")
+}
+
+// getServeCert is the tls.Config.GetCertificate func for the serve
+// config's HTTPS ports.
+func (b *LocalBackend) getServeCert(hi *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	b.mu.Lock()
+	domain := serveDomain(b.netMap)
+	b.mu.Unlock()
+	if domain == "" {
+		return nil, errors.New("no MagicDNS name to get a TLS cert for")
+	}
+	if hi.ServerName != "" && !strings.EqualFold(hi.ServerName, domain) {
+		return nil, fmt.Errorf("no TLS cert for %q", hi.ServerName)
+	}
+	ctx, cancel := context.WithTimeout(hi.Context(), time.Minute)
+	defer cancel()
+	pair, err := b.GetCertPEM(ctx, domain)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(pair.CertPEM, pair.KeyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// serveStatusLocked returns what the serve config serves, keyed by the
+// URL it's served at, for ipnstate.Status.Serve.
+//
+// b.mu must be held.
+func (b *LocalBackend) serveStatusLocked() map[string]string {
+	if b.prefs == nil || b.prefs.Serve.IsEmpty() || b.netMap == nil {
+		return nil
+	}
+	host := serveDomain(b.netMap)
+	if host == "" {
+		for _, a := range b.netMap.Addresses {
+			if a.IsSingleIP() {
+				host = a.IP().String()
+				break
+			}
+		}
+	}
+	if host == "" {
+		return nil
+	}
+	m := make(map[string]string)
+	for port, h := range b.prefs.Serve.TCP {
+		hostPort := net.JoinHostPort(host, strconv.Itoa(int(port)))
+		if h.TCPForward != "" {
+			m["tcp://"+hostPort] = "tcp://" + h.TCPForward
+			continue
+		}
+		base := "https://" + hostPort
+		if port == 443 && !strings.Contains(host, ":") {
+			base = "https://" + host
+		}
+		for mount, wh := range h.Web {
+			m[base+mount] = wh.String()
+		}
+	}
+	return m
+}
@@ -0,0 +1,123 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"inet.af/netaddr"
+	"tailscale.com/ipn"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/netmap"
+)
+
+func TestServeWebHandler(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "proxied "+r.URL.Path+" for "+r.Header.Get(ipn.HeaderUserLogin))
+	}))
+	defer backend.Close()
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("file a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The test client connects from 127.0.0.1; make it a peer.
+	b := &LocalBackend{
+		logf: t.Logf,
+		nodeByAddr: map[netaddr.IP]*tailcfg.Node{
+			netaddr.IPv4(127, 0, 0, 1): {Name: "peer.example.ts.net.", User: 1},
+		},
+		netMap: &netmap.NetworkMap{
+			UserProfiles: map[tailcfg.UserID]tailcfg.UserProfile{
+				1: {LoginName: "alice@example.com"},
+			},
+		},
+	}
+	ts := httptest.NewServer(b.newServeWebHandler(map[string]*ipn.HTTPHandler{
+		"/":      {Proxy: backend.URL},
+		"/docs/": {Path: dir},
+		"/a/":    {Path: filepath.Join(dir, "a.txt")},
+	}))
+	defer ts.Close()
+
+	for path, want := range map[string]string{
+		"/":            "proxied / for alice@example.com",
+		"/foo/bar":     "proxied /foo/bar for alice@example.com",
+		"/docs/a.txt":  "file a",
+		"/a/":          "file a",
+		"/docsx/a.txt": "proxied /docsx/a.txt for alice@example.com",
+	} {
+		req, err := http.NewRequest("GET", ts.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(ipn.HeaderUserLogin, "mallory@example.com")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("GET %s = %q; want %q", path, got, want)
+		}
+	}
+}
+
+func TestServeTCPForward(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	b := &LocalBackend{logf: t.Logf, ctx: context.Background()}
+	go b.serveTCPForward(ln, echo.Addr().String())
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := io.WriteString(c, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Errorf("got %q; want hello", buf)
+	}
+}
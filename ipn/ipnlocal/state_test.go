@@ -997,3 +997,91 @@ func TestWGEngineStatusRace(t *testing.T) {
 	wg.Wait()
 	wantState(ipn.Running)
 }
+
+func TestSwitchProfile(t *testing.T) {
+	c := qt.New(t)
+	logf := t.Logf
+	store := new(ipn.MemoryStore)
+	e, err := wgengine.NewFakeUserspaceEngine(logf, 0)
+	c.Assert(err, qt.IsNil)
+	t.Cleanup(e.Close)
+
+	// Two profiles that have both logged in before, to different
+	// control servers.
+	workKey, homeKey := key.NewNode(), key.NewNode()
+	writePrefs := func(k ipn.StateKey, controlURL string, nodeKey key.NodePrivate) {
+		p := ipn.NewPrefs()
+		p.ControlURL = controlURL
+		p.Persist = &persist.Persist{PrivateNodeKey: nodeKey}
+		c.Assert(store.WriteState(k, p.ToBytes()), qt.IsNil)
+	}
+	writePrefs(ipn.GlobalDaemonStateKey, "https://work.example.com", workKey)
+	writePrefs(ipn.ProfileStateKey(ipn.GlobalDaemonStateKey, "home"), "https://home.example.com", homeKey)
+
+	b, err := NewLocalBackend(logf, "logid", store, e)
+	c.Assert(err, qt.IsNil)
+	var ccs []*mockControl
+	b.SetControlClientGetterForTesting(func(opts controlclient.Options) (controlclient.Client, error) {
+		cc := newMockControl(t)
+		cc.opts = opts
+		cc.logf = opts.Logf
+		cc.persist = opts.Persist
+		ccs = append(ccs, cc)
+		return cc, nil
+	})
+
+	// wantClient checks that the newest control client is for
+	// controlURL and persisted nodeKey, and that a non-zero nodeKey
+	// is used to log in straight away.
+	wantClient := func(n int, controlURL string, nodeKey key.NodePrivate) {
+		t.Helper()
+		c.Assert(ccs, qt.HasLen, n)
+		cc := ccs[n-1]
+		c.Assert(cc.opts.ServerURL, qt.Equals, controlURL)
+		c.Assert(cc.opts.Persist.PrivateNodeKey.Equal(nodeKey), qt.IsTrue)
+		if !nodeKey.IsZero() {
+			cc.mu.Lock()
+			defer cc.mu.Unlock()
+			c.Assert(cc.calls, qt.Contains, "Login")
+		}
+	}
+
+	c.Assert(b.Start(ipn.Options{StateKey: ipn.GlobalDaemonStateKey}), qt.IsNil)
+	wantClient(1, "https://work.example.com", workKey)
+
+	c.Assert(b.SwitchProfile("home"), qt.IsNil)
+	wantClient(2, "https://home.example.com", homeKey)
+	ccs[0].mu.Lock()
+	c.Assert(ccs[0].calls, qt.Contains, "Shutdown")
+	ccs[0].mu.Unlock()
+
+	// Switching to the current profile does nothing.
+	c.Assert(b.SwitchProfile("home"), qt.IsNil)
+	c.Assert(ccs, qt.HasLen, 2)
+
+	profiles, err := b.Profiles()
+	c.Assert(err, qt.IsNil)
+	c.Assert(profiles, qt.DeepEquals, &ipn.Profiles{
+		Current: "home",
+		Names:   []string{ipn.DefaultProfile, "home"},
+	})
+
+	// Prefs changes are saved to the current profile.
+	p := b.Prefs()
+	p.Hostname = "laptop"
+	b.SetPrefs(p)
+	bs, err := store.ReadState(ipn.ProfileStateKey(ipn.GlobalDaemonStateKey, "home"))
+	c.Assert(err, qt.IsNil)
+	saved, err := ipn.PrefsFromBytes(bs, false)
+	c.Assert(err, qt.IsNil)
+	c.Assert(saved.Hostname, qt.Equals, "laptop")
+
+	// A new profile starts out logged out.
+	c.Assert(b.SwitchProfile("test"), qt.IsNil)
+	wantClient(3, ipn.DefaultControlURL, key.NodePrivate{})
+
+	c.Assert(b.SwitchProfile(ipn.DefaultProfile), qt.IsNil)
+	wantClient(4, "https://work.example.com", workKey)
+
+	c.Assert(b.SwitchProfile("not/valid"), qt.IsNotNil)
+}
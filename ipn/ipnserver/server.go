@@ -1062,6 +1062,13 @@ func (s *Server) ServeHTMLStatus(w http.ResponseWriter, r *http.Request) {
 	st.WriteHTML(w)
 }
 
+// ServeMetrics serves the node's metrics in the Prometheus text
+// exposition format.
+func (s *Server) ServeMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	s.b.WritePrometheusMetrics(w)
+}
+
 func peerPid(entries []netstat.Entry, la, ra netaddr.IPPort) int {
 	for _, e := range entries {
 		if e.Local == ra && e.Remote == la {
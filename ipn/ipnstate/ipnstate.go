@@ -56,6 +56,19 @@ type Status struct {
 	// trailing periods, and without any "_acme-challenge." prefix.
 	CertDomains []string
 
+	// Serve maps the URLs at which this node serves local services
+	// to the tailnet, as configured by "tailscale serve", to what's
+	// served at each: a local URL, file, directory or TCP address.
+	Serve map[string]string `json:",omitempty"`
+
+	// AutoExitNode is whether the exit node is picked automatically
+	// from ExitNodeCandidates (see ipn.Prefs.AutoExitNode).
+	AutoExitNode bool `json:",omitempty"`
+
+	// ExitNodeCandidates are the peers offering to be an exit node,
+	// best first, as ranked for picking one automatically.
+	ExitNodeCandidates []*ExitNodeCandidate `json:",omitempty"`
+
 	Peer map[key.NodePublic]*PeerStatus
 	User map[tailcfg.UserID]tailcfg.UserProfile
 }
@@ -91,14 +104,17 @@ type PeerStatus struct {
 	CurAddr string // one of Addrs, or unique if roaming
 	Relay   string // DERP region
 
-	RxBytes       int64
-	TxBytes       int64
-	Created       time.Time // time registered with tailcontrol
-	LastWrite     time.Time // time last packet sent
-	LastSeen      time.Time // last seen to tailcontrol
-	LastHandshake time.Time // with local wireguard
-	KeepAlive     bool
-	ExitNode      bool // true if this is the currently selected exit node.
+	RxBytes        int64
+	TxBytes        int64
+	RxPackets      int64     // WireGuard packets received, including handshakes and keepalives
+	TxPackets      int64     // WireGuard packets sent, including handshakes and keepalives
+	Created        time.Time // time registered with tailcontrol
+	LastWrite      time.Time // time last packet sent
+	LastSeen       time.Time // last seen to tailcontrol
+	LastHandshake  time.Time // with local wireguard
+	KeepAlive      bool
+	ExitNode       bool // true if this is the currently selected exit node.
+	ExitNodeOption bool // true if this node offers to be an exit node.
 
 	// Active is whether the node was recently active. The
 	// definition is somewhat undefined but has historically and
@@ -258,6 +274,12 @@ func (sb *StatusBuilder) AddPeer(peer key.NodePublic, st *PeerStatus) {
 	if v := st.TxBytes; v != 0 {
 		e.TxBytes = v
 	}
+	if v := st.RxPackets; v != 0 {
+		e.RxPackets = v
+	}
+	if v := st.TxPackets; v != 0 {
+		e.TxPackets = v
+	}
 	if v := st.LastHandshake; !v.IsZero() {
 		e.LastHandshake = v
 	}
@@ -285,6 +307,9 @@ func (sb *StatusBuilder) AddPeer(peer key.NodePublic, st *PeerStatus) {
 	if st.ExitNode {
 		e.ExitNode = true
 	}
+	if st.ExitNodeOption {
+		e.ExitNodeOption = true
+	}
 	if st.ShareeNode {
 		e.ShareeNode = true
 	}
@@ -293,6 +318,28 @@ func (sb *StatusBuilder) AddPeer(peer key.NodePublic, st *PeerStatus) {
 	}
 }
 
+// ExitNodeCandidate is a peer offering to be an exit node, as ranked
+// for picking one automatically.
+type ExitNodeCandidate struct {
+	ID           tailcfg.StableNodeID
+	DNSName      string
+	TailscaleIPs []netaddr.IP
+
+	// Online is whether the control server thinks the node is
+	// connected. Offline nodes are never picked.
+	Online bool
+
+	// LatencySeconds is the round-trip time to the node, if known.
+	// It's from a disco ping of the node if there's been one
+	// (LatencySource "ping"), else it's the latency to the node's
+	// home DERP region from the last netcheck (LatencySource "derp").
+	LatencySeconds float64 `json:",omitempty"`
+	LatencySource  string  `json:",omitempty"`
+
+	// Selected is whether the node is the current exit node.
+	Selected bool `json:",omitempty"`
+}
+
 type StatusUpdater interface {
 	UpdateStatus(*StatusBuilder)
 }
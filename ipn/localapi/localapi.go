@@ -30,9 +30,11 @@ import (
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/net/netknob"
 	"tailscale.com/tailcfg"
+	"tailscale.com/types/ipproto"
 	"tailscale.com/types/logger"
-	"tailscale.com/util/clientmetric"
+	"tailscale.com/util/dirtar"
 	"tailscale.com/version"
+	"tailscale.com/wgengine/filter"
 )
 
 func randHex(n int) string {
@@ -104,6 +106,12 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		h.serveLogout(w, r)
 	case "/localapi/v0/prefs":
 		h.servePrefs(w, r)
+	case "/localapi/v0/profiles":
+		h.serveProfiles(w, r)
+	case "/localapi/v0/switch-profile":
+		h.serveSwitchProfile(w, r)
+	case "/localapi/v0/dial":
+		h.serveDial(w, r)
 	case "/localapi/v0/check-ip-forwarding":
 		h.serveCheckIPForwarding(w, r)
 	case "/localapi/v0/bugreport":
@@ -116,6 +124,10 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		h.serveDERPMap(w, r)
 	case "/localapi/v0/metrics":
 		h.serveMetrics(w, r)
+	case "/localapi/v0/debug-filter":
+		h.serveDebugFilter(w, r)
+	case "/localapi/v0/debug-filter-check":
+		h.serveDebugFilterCheck(w, r)
 	case "/":
 		io.WriteString(w, "tailscaled\n")
 	default:
@@ -195,7 +207,7 @@ func (h *Handler) serveMetrics(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	w.Header().Set("Content-Type", "text/plain")
-	clientmetric.WritePrometheusExpositionFormat(w)
+	h.b.WritePrometheusMetrics(w)
 }
 
 // serveProfileFunc is the implementation of Handler.serveProfile, after auth,
@@ -302,6 +314,101 @@ func (h *Handler) servePrefs(w http.ResponseWriter, r *http.Request) {
 	e.Encode(prefs)
 }
 
+func (h *Handler) serveProfiles(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "profiles access denied", http.StatusForbidden)
+		return
+	}
+	profiles, err := h.b.Profiles()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	e.Encode(profiles)
+}
+
+func (h *Handler) serveSwitchProfile(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "switch-profile access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "want POST", 400)
+		return
+	}
+	name := r.FormValue("name")
+	if err := ipn.CheckProfileName(name); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if err := h.b.SwitchProfile(name); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveDial dials the Dial-Host and Dial-Port in the request headers
+// with LocalBackend.UserDial and, on success, switches the LocalAPI
+// connection to the "ts-dial" protocol: raw bytes copied to and from
+// the dialed TCP connection. See LocalClient.DialTCP.
+func (h *Handler) serveDial(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "dial access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "want POST", 400)
+		return
+	}
+	if r.Header.Get("Upgrade") != "ts-dial" {
+		http.Error(w, "missing Upgrade: ts-dial header", 400)
+		return
+	}
+	host, port := r.Header.Get("Dial-Host"), r.Header.Get("Dial-Port")
+	if host == "" || port == "" {
+		http.Error(w, "missing Dial-Host or Dial-Port header", 400)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "connection can't be hijacked", 500)
+		return
+	}
+	outConn, err := h.b.UserDial(r.Context(), "tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		http.Error(w, "dial failure: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer outConn.Close()
+
+	reqConn, brw, err := hj.Hijack()
+	if err != nil {
+		h.logf("dial: hijack: %v", err)
+		return
+	}
+	defer reqConn.Close()
+	io.WriteString(brw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: ts-dial\r\nConnection: upgrade\r\n\r\n")
+	if err := brw.Flush(); err != nil {
+		return
+	}
+	go func() {
+		// Read via brw, which may have buffered some of the
+		// client's first bytes. When the client is done sending,
+		// pass that on, so it still gets the rest of the reply.
+		io.Copy(outConn, brw)
+		if cw, ok := outConn.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		} else {
+			outConn.Close()
+		}
+	}()
+	io.Copy(reqConn, outConn)
+}
+
 func (h *Handler) serveFiles(w http.ResponseWriter, r *http.Request) {
 	if !h.PermitWrite {
 		http.Error(w, "file access denied", http.StatusForbidden)
@@ -341,7 +448,11 @@ func (h *Handler) serveFiles(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer rc.Close()
-	w.Header().Set("Content-Length", fmt.Sprint(size))
+	if size < 0 {
+		w.Header().Set("Content-Type", dirtar.ContentType)
+	} else {
+		w.Header().Set("Content-Length", fmt.Sprint(size))
+	}
 	io.Copy(w, rc)
 }
 
@@ -457,6 +568,125 @@ func (h *Handler) serveDERPMap(w http.ResponseWriter, r *http.Request) {
 	e.Encode(h.b.DERPMap())
 }
 
+func (h *Handler) serveDebugFilter(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "debug filter access denied", http.StatusForbidden)
+		return
+	}
+	f := h.b.PacketFilter()
+	if f == nil {
+		http.Error(w, "no packet filter", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	e.Encode(filterStatus(f))
+}
+
+// filterStatus returns the rules, counters and tracked flows of f.
+func filterStatus(f *filter.Filter) *apitype.FilterStatus {
+	res := &apitype.FilterStatus{ShieldsUp: f.ShieldsUp()}
+	for _, rs := range f.RuleStats() {
+		res.Rules = append(res.Rules, apitype.FilterRule{
+			Rule: rs.Match.String(),
+			Hits: rs.Hits,
+		})
+	}
+	for _, dc := range f.DropCounts() {
+		res.Drops = append(res.Drops, apitype.FilterDropCount{
+			Reason: dc.Reason,
+			In:     dc.In,
+			Out:    dc.Out,
+		})
+	}
+	for _, fi := range f.Flows() {
+		res.Flows = append(res.Flows, apitype.FilterFlow{
+			Proto:      fi.Proto.String(),
+			Src:        fi.Src,
+			Dst:        fi.Dst,
+			Outbound:   fi.Outbound,
+			TCPState:   fi.TCPState,
+			Expires:    fi.Expires,
+			PacketsIn:  fi.PacketsIn,
+			PacketsOut: fi.PacketsOut,
+			BytesIn:    fi.BytesIn,
+			BytesOut:   fi.BytesOut,
+		})
+	}
+	res.PeerFlows = f.FlowCountsByPeer()
+	return res
+}
+
+func (h *Handler) serveDebugFilterCheck(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "debug filter access denied", http.StatusForbidden)
+		return
+	}
+	f := h.b.PacketFilter()
+	if f == nil {
+		http.Error(w, "no packet filter", http.StatusServiceUnavailable)
+		return
+	}
+	res, err := filterCheck(f, r.FormValue("src"), r.FormValue("dst"), r.FormValue("proto"))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// filterCheck runs f.Check on the src and dst ip:ports and protocol
+// named by proto.
+func filterCheck(f *filter.Filter, srcStr, dstStr, protoStr string) (*apitype.FilterCheckResponse, error) {
+	src, err := netaddr.ParseIPPort(srcStr)
+	if err != nil {
+		return nil, errors.New("invalid 'src' parameter")
+	}
+	dst, err := netaddr.ParseIPPort(dstStr)
+	if err != nil {
+		return nil, errors.New("invalid 'dst' parameter")
+	}
+	proto, err := parseProto(protoStr, dst.IP().Is6())
+	if err != nil {
+		return nil, err
+	}
+	cr := f.Check(src, dst, proto)
+	res := &apitype.FilterCheckResponse{
+		Verdict: cr.Response.String(),
+		Reason:  cr.Reason,
+		Rule:    cr.Rule,
+	}
+	if cr.Rule >= 0 {
+		res.RuleText = f.RuleStats()[cr.Rule].Match.String()
+	}
+	return res, nil
+}
+
+// parseProto parses an IP protocol name or number. The name "icmp"
+// means ICMPv6 if v6 is true.
+func parseProto(s string, v6 bool) (ipproto.Proto, error) {
+	switch strings.ToLower(s) {
+	case "", "tcp":
+		return ipproto.TCP, nil
+	case "udp":
+		return ipproto.UDP, nil
+	case "sctp":
+		return ipproto.SCTP, nil
+	case "icmp":
+		if v6 {
+			return ipproto.ICMPv6, nil
+		}
+		return ipproto.ICMPv4, nil
+	}
+	n, err := strconv.ParseUint(s, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("invalid 'proto' parameter %q", s)
+	}
+	return ipproto.Proto(n), nil
+}
+
 var dialPeerTransportOnce struct {
 	sync.Once
 	v *http.Transport
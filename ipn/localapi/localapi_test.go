@@ -0,0 +1,211 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package localapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"tailscale.com/client/tailscale"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnlocal"
+	"tailscale.com/types/ipproto"
+	"tailscale.com/types/logger"
+	"tailscale.com/wgengine"
+	"tailscale.com/wgengine/filter"
+)
+
+func TestParseProto(t *testing.T) {
+	tests := []struct {
+		in      string
+		v6      bool
+		want    ipproto.Proto
+		wantErr bool
+	}{
+		{in: "", want: ipproto.TCP},
+		{in: "tcp", want: ipproto.TCP},
+		{in: "TCP", want: ipproto.TCP},
+		{in: "udp", want: ipproto.UDP},
+		{in: "sctp", want: ipproto.SCTP},
+		{in: "icmp", want: ipproto.ICMPv4},
+		{in: "icmp", v6: true, want: ipproto.ICMPv6},
+		{in: "17", want: ipproto.UDP},
+		{in: "255", want: ipproto.Proto(255)},
+		{in: "256", wantErr: true},
+		{in: "-1", wantErr: true},
+		{in: "gre", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseProto(tt.in, tt.v6)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseProto(%q, %v) error = %v; wantErr %v", tt.in, tt.v6, err, tt.wantErr)
+			continue
+		}
+		if err == nil && got != tt.want {
+			t.Errorf("parseProto(%q, %v) = %v; want %v", tt.in, tt.v6, got, tt.want)
+		}
+	}
+}
+
+func TestFilterCheck(t *testing.T) {
+	f := filter.NewAllowAllForTest(t.Logf)
+
+	res, err := filterCheck(f, "100.101.102.103:40000", "100.64.0.1:22", "tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Verdict != "Accept" || res.Rule != 0 || res.RuleText == "" {
+		t.Errorf("filterCheck = %+v; want Accept by rule 0", res)
+	}
+
+	for _, args := range [][3]string{
+		{"bogus", "100.64.0.1:22", "tcp"},
+		{"100.101.102.103:40000", "100.64.0.1", "tcp"},
+		{"100.101.102.103:40000", "100.64.0.1:22", "bogus"},
+	} {
+		if _, err := filterCheck(f, args[0], args[1], args[2]); err == nil {
+			t.Errorf("filterCheck(%q) succeeded; want error", args)
+		}
+	}
+
+	st := filterStatus(f)
+	if len(st.Rules) != 2 || st.ShieldsUp {
+		t.Errorf("filterStatus = %+v; want 2 rules, shields down", st)
+	}
+}
+
+func TestDebugFilterHandlers(t *testing.T) {
+	var logf logger.Logf = logger.Discard
+	eng, err := wgengine.NewFakeUserspaceEngine(logf, 0)
+	if err != nil {
+		t.Fatalf("NewFakeUserspaceEngine: %v", err)
+	}
+	t.Cleanup(eng.Close)
+	lb, err := ipnlocal.NewLocalBackend(logf, "logid", new(ipn.MemoryStore), eng)
+	if err != nil {
+		t.Fatalf("NewLocalBackend: %v", err)
+	}
+	h := NewHandler(lb, logf, "logid")
+
+	get := func(url string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", url, nil))
+		return rec
+	}
+
+	// Read access is required.
+	if rec := get("/localapi/v0/debug-filter"); rec.Code != http.StatusForbidden {
+		t.Errorf("debug-filter without PermitRead = %d; want 403", rec.Code)
+	}
+	if rec := get("/localapi/v0/debug-filter-check?src=100.101.102.103:1&dst=100.64.0.1:22"); rec.Code != http.StatusForbidden {
+		t.Errorf("debug-filter-check without PermitRead = %d; want 403", rec.Code)
+	}
+	h.PermitRead = true
+
+	// The backend starts with a filter that allows nothing.
+	rec := get("/localapi/v0/debug-filter")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("debug-filter = %d: %s", rec.Code, rec.Body)
+	}
+	var st apitype.FilterStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &st); err != nil {
+		t.Fatal(err)
+	}
+	if len(st.Rules) != 0 {
+		t.Errorf("rules = %v; want none", st.Rules)
+	}
+
+	rec = get("/localapi/v0/debug-filter-check?src=100.101.102.103:40000&dst=100.64.0.1:22&proto=udp")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("debug-filter-check = %d: %s", rec.Code, rec.Body)
+	}
+	var res apitype.FilterCheckResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Verdict != "Drop" || res.Rule != -1 {
+		t.Errorf("debug-filter-check = %+v; want Drop by no rule", res)
+	}
+
+	if rec := get("/localapi/v0/debug-filter-check?src=bogus&dst=100.64.0.1:22"); rec.Code != http.StatusBadRequest {
+		t.Errorf("debug-filter-check with bad src = %d; want 400", rec.Code)
+	}
+}
+
+func TestDial(t *testing.T) {
+	// The dial target reads everything, then replies with it
+	// uppercased, so it only replies once the client half-closes.
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		c, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		b, _ := io.ReadAll(c)
+		c.Write(bytes.ToUpper(b))
+	}()
+
+	var logf logger.Logf = logger.Discard
+	eng, err := wgengine.NewFakeUserspaceEngine(logf, 0)
+	if err != nil {
+		t.Fatalf("NewFakeUserspaceEngine: %v", err)
+	}
+	t.Cleanup(eng.Close)
+	lb, err := ipnlocal.NewLocalBackend(logf, "logid", new(ipn.MemoryStore), eng)
+	if err != nil {
+		t.Fatalf("NewLocalBackend: %v", err)
+	}
+	h := NewHandler(lb, logf, "logid")
+	h.PermitWrite = true
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	lc := &tailscale.LocalClient{
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "tcp", ts.Listener.Addr().String())
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	port := uint16(target.Addr().(*net.TCPAddr).Port)
+	c, err := lc.DialTCP(ctx, "127.0.0.1", port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := io.WriteString(c, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.(interface{ CloseWrite() error }).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "HELLO" {
+		t.Errorf("got %q; want HELLO", got)
+	}
+
+	// Nothing is listening on the target anymore.
+	target.Close()
+	if _, err := lc.DialTCP(ctx, "127.0.0.1", port); err == nil {
+		t.Error("dial to closed port succeeded")
+	}
+}
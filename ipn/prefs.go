@@ -14,6 +14,7 @@ import (
 	"path/filepath"
 	"reflect"
 	"runtime"
+	"sort"
 	"strings"
 
 	"inet.af/netaddr"
@@ -90,6 +91,15 @@ type Prefs struct {
 	ExitNodeID tailcfg.StableNodeID
 	ExitNodeIP netaddr.IP
 
+	// AutoExitNode specifies that ipnlocal.LocalBackend should pick
+	// the exit node itself, among the peers offering to be one, and
+	// keep ExitNodeID pointed at its choice. It prefers the lowest
+	// latency and fails over to another node when its choice goes
+	// offline. ExitNodeIP is ignored. Until a node is picked,
+	// internet traffic is blackholed as for an exit node that
+	// doesn't exist.
+	AutoExitNode bool
+
 	// ExitNodeAllowLANAccess indicates whether locally accessible subnets should be
 	// routed directly or via the exit node.
 	ExitNodeAllowLANAccess bool
@@ -166,6 +176,14 @@ type Prefs struct {
 	// Linux-only.
 	NoSNAT bool
 
+	// NoSNATRoutes specifies which of AdvertiseRoutes not to source
+	// NAT when NoSNAT is false, so that traffic to them keeps the
+	// peer's Tailscale IP as its source. As with NoSNAT, the network
+	// must route that traffic back to this machine.
+	//
+	// Linux-only.
+	NoSNATRoutes []netaddr.IPPrefix `json:",omitempty"`
+
 	// NetfilterMode specifies how much to manage netfilter rules for
 	// Tailscale, if at all.
 	NetfilterMode preftype.NetfilterMode
@@ -174,6 +192,11 @@ type Prefs struct {
 	// operate tailscaled without being root or using sudo.
 	OperatorUser string `json:",omitempty"`
 
+	// Serve is the configuration of the local services served to
+	// the tailnet on this node's Tailscale IPs, as set by
+	// "tailscale serve". It's not changed by "tailscale up".
+	Serve *ServeConfig `json:",omitempty"`
+
 	// The Persist field is named 'Config' in the file for backward
 	// compatibility with earlier versions.
 	// TODO(apenwarr): We should move this out of here, it's not a pref.
@@ -191,6 +214,7 @@ type MaskedPrefs struct {
 	AllowSingleHostsSet       bool `json:",omitempty"`
 	ExitNodeIDSet             bool `json:",omitempty"`
 	ExitNodeIPSet             bool `json:",omitempty"`
+	AutoExitNodeSet           bool `json:",omitempty"`
 	ExitNodeAllowLANAccessSet bool `json:",omitempty"`
 	CorpDNSSet                bool `json:",omitempty"`
 	WantRunningSet            bool `json:",omitempty"`
@@ -202,8 +226,10 @@ type MaskedPrefs struct {
 	ForceDaemonSet            bool `json:",omitempty"`
 	AdvertiseRoutesSet        bool `json:",omitempty"`
 	NoSNATSet                 bool `json:",omitempty"`
+	NoSNATRoutesSet           bool `json:",omitempty"`
 	NetfilterModeSet          bool `json:",omitempty"`
 	OperatorUserSet           bool `json:",omitempty"`
+	ServeSet                  bool `json:",omitempty"`
 }
 
 // ApplyEdits mutates p, assigning fields from m.Prefs for each MaskedPrefs
@@ -289,7 +315,9 @@ func (p *Prefs) pretty(goos string) string {
 	if p.ShieldsUp {
 		sb.WriteString("shields=true ")
 	}
-	if !p.ExitNodeIP.IsZero() {
+	if p.AutoExitNode {
+		fmt.Fprintf(&sb, "exit=auto(%v) lan=%t ", p.ExitNodeID, p.ExitNodeAllowLANAccess)
+	} else if !p.ExitNodeIP.IsZero() {
 		fmt.Fprintf(&sb, "exit=%v lan=%t ", p.ExitNodeIP, p.ExitNodeAllowLANAccess)
 	} else if !p.ExitNodeID.IsZero() {
 		fmt.Fprintf(&sb, "exit=%v lan=%t ", p.ExitNodeID, p.ExitNodeAllowLANAccess)
@@ -300,6 +328,9 @@ func (p *Prefs) pretty(goos string) string {
 	if len(p.AdvertiseRoutes) > 0 || p.NoSNAT {
 		fmt.Fprintf(&sb, "snat=%v ", !p.NoSNAT)
 	}
+	if len(p.NoSNATRoutes) > 0 {
+		fmt.Fprintf(&sb, "nosnat=%v ", p.NoSNATRoutes)
+	}
 	if len(p.AdvertiseTags) > 0 {
 		fmt.Fprintf(&sb, "tags=%s ", strings.Join(p.AdvertiseTags, ","))
 	}
@@ -315,6 +346,14 @@ func (p *Prefs) pretty(goos string) string {
 	if p.OperatorUser != "" {
 		fmt.Fprintf(&sb, "op=%q ", p.OperatorUser)
 	}
+	if !p.Serve.IsEmpty() {
+		ports := make([]int, 0, len(p.Serve.TCP))
+		for port := range p.Serve.TCP {
+			ports = append(ports, int(port))
+		}
+		sort.Ints(ports)
+		fmt.Fprintf(&sb, "serve=%v ", ports)
+	}
 	if p.Persist != nil {
 		sb.WriteString(p.Persist.Pretty())
 	} else {
@@ -346,6 +385,7 @@ func (p *Prefs) Equals(p2 *Prefs) bool {
 		p.AllowSingleHosts == p2.AllowSingleHosts &&
 		p.ExitNodeID == p2.ExitNodeID &&
 		p.ExitNodeIP == p2.ExitNodeIP &&
+		p.AutoExitNode == p2.AutoExitNode &&
 		p.ExitNodeAllowLANAccess == p2.ExitNodeAllowLANAccess &&
 		p.CorpDNS == p2.CorpDNS &&
 		p.WantRunning == p2.WantRunning &&
@@ -355,9 +395,11 @@ func (p *Prefs) Equals(p2 *Prefs) bool {
 		p.NoSNAT == p2.NoSNAT &&
 		p.NetfilterMode == p2.NetfilterMode &&
 		p.OperatorUser == p2.OperatorUser &&
+		p.Serve.Equal(p2.Serve) &&
 		p.Hostname == p2.Hostname &&
 		p.ForceDaemon == p2.ForceDaemon &&
 		compareIPNets(p.AdvertiseRoutes, p2.AdvertiseRoutes) &&
+		compareIPNets(p.NoSNATRoutes, p2.NoSNATRoutes) &&
 		compareStrings(p.AdvertiseTags, p2.AdvertiseTags) &&
 		p.Persist.Equals(p2.Persist)
 }
@@ -40,6 +40,7 @@ func TestPrefsEqual(t *testing.T) {
 		"AllowSingleHosts",
 		"ExitNodeID",
 		"ExitNodeIP",
+		"AutoExitNode",
 		"ExitNodeAllowLANAccess",
 		"CorpDNS",
 		"WantRunning",
@@ -51,8 +52,10 @@ func TestPrefsEqual(t *testing.T) {
 		"ForceDaemon",
 		"AdvertiseRoutes",
 		"NoSNAT",
+		"NoSNATRoutes",
 		"NetfilterMode",
 		"OperatorUser",
+		"Serve",
 		"Persist",
 	}
 	if have := fieldsOf(reflect.TypeOf(Prefs{})); !reflect.DeepEqual(have, prefsHandles) {
@@ -145,6 +148,17 @@ func TestPrefsEqual(t *testing.T) {
 			true,
 		},
 
+		{
+			&Prefs{AutoExitNode: true},
+			&Prefs{},
+			false,
+		},
+		{
+			&Prefs{AutoExitNode: true, ExitNodeID: "n1234"},
+			&Prefs{AutoExitNode: true, ExitNodeID: "n1234"},
+			true,
+		},
+
 		{
 			&Prefs{},
 			&Prefs{ExitNodeAllowLANAccess: true},
@@ -188,6 +202,16 @@ func TestPrefsEqual(t *testing.T) {
 			&Prefs{NoSNAT: true},
 			true,
 		},
+		{
+			&Prefs{NoSNATRoutes: nets("10.1.0.0/16")},
+			&Prefs{NoSNATRoutes: nets("10.2.0.0/16")},
+			false,
+		},
+		{
+			&Prefs{NoSNATRoutes: nets("10.1.0.0/16")},
+			&Prefs{NoSNATRoutes: nets("10.1.0.0/16")},
+			true,
+		},
 
 		{
 			&Prefs{Hostname: "android-host01"},
@@ -258,6 +282,26 @@ func TestPrefsEqual(t *testing.T) {
 			&Prefs{NetfilterMode: preftype.NetfilterOn},
 			true,
 		},
+		{
+			&Prefs{Serve: &ServeConfig{}},
+			&Prefs{},
+			true,
+		},
+		{
+			&Prefs{Serve: &ServeConfig{TCP: map[uint16]*TCPPortHandler{443: {Web: map[string]*HTTPHandler{"/": {Proxy: "http://127.0.0.1:3000"}}}}}},
+			&Prefs{Serve: &ServeConfig{TCP: map[uint16]*TCPPortHandler{443: {Web: map[string]*HTTPHandler{"/": {Proxy: "http://127.0.0.1:3000"}}}}}},
+			true,
+		},
+		{
+			&Prefs{Serve: &ServeConfig{TCP: map[uint16]*TCPPortHandler{443: {Web: map[string]*HTTPHandler{"/": {Proxy: "http://127.0.0.1:3000"}}}}}},
+			&Prefs{Serve: &ServeConfig{TCP: map[uint16]*TCPPortHandler{443: {Web: map[string]*HTTPHandler{"/": {Path: "/var/www"}}}}}},
+			false,
+		},
+		{
+			&Prefs{Serve: &ServeConfig{TCP: map[uint16]*TCPPortHandler{5432: {TCPForward: "127.0.0.1:5432"}}}},
+			&Prefs{Serve: &ServeConfig{TCP: map[uint16]*TCPPortHandler{5433: {TCPForward: "127.0.0.1:5432"}}}},
+			false,
+		},
 
 		{
 			&Prefs{Persist: &persist.Persist{}},
@@ -433,6 +477,14 @@ func TestPrefsPretty(t *testing.T) {
 			"linux",
 			`Prefs{ra=false mesh=false dns=false want=false exit=myNodeABC lan=true routes=[] nf=off Persist=nil}`,
 		},
+		{
+			Prefs{
+				ExitNodeID:   tailcfg.StableNodeID("myNodeABC"),
+				AutoExitNode: true,
+			},
+			"linux",
+			`Prefs{ra=false mesh=false dns=false want=false exit=auto(myNodeABC) lan=false routes=[] nf=off Persist=nil}`,
+		},
 		{
 			Prefs{
 				ExitNodeAllowLANAccess: true,
@@ -0,0 +1,116 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// DefaultProfile is the name of the login profile whose prefs are
+// stored under the base StateKey itself. It's the profile in use
+// until another one is switched to.
+const DefaultProfile = "default"
+
+// Profiles is the set of login profiles of a base StateKey (such as
+// GlobalDaemonStateKey). Each profile has its own Prefs, including
+// the node key and login, stored under ProfileStateKey. The machine
+// key is shared by all of them.
+type Profiles struct {
+	// Current is the name of the profile in use.
+	Current string
+
+	// Names are the names of all known profiles, sorted. It always
+	// includes DefaultProfile.
+	Names []string
+}
+
+// Has reports whether name is a known profile.
+func (p *Profiles) Has(name string) bool {
+	for _, n := range p.Names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Add adds name to p.Names if it's not already there.
+func (p *Profiles) Add(name string) {
+	if p.Has(name) {
+		return
+	}
+	p.Names = append(p.Names, name)
+	sort.Strings(p.Names)
+}
+
+// ProfileStateKey returns the StateKey under which the prefs of the
+// named profile of base are stored.
+func ProfileStateKey(base StateKey, name string) StateKey {
+	if name == "" || name == DefaultProfile {
+		return base
+	}
+	return base + "-profile-" + StateKey(name)
+}
+
+// ProfilesStateKey returns the StateKey under which the Profiles of
+// base are stored, as JSON.
+func ProfilesStateKey(base StateKey) StateKey {
+	return base + "-profiles"
+}
+
+// CheckProfileName reports whether name is a valid profile name.
+// Names are limited to the characters that every StateStore (including
+// KubeStore's Secret keys) can use in a key.
+func CheckProfileName(name string) error {
+	if name == "" {
+		return errors.New("empty profile name")
+	}
+	if len(name) > 64 {
+		return fmt.Errorf("profile name %q too long", name)
+	}
+	for _, r := range name {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+		case r == '-', r == '_', r == '.':
+		default:
+			return fmt.Errorf("invalid character %q in profile name %q", r, name)
+		}
+	}
+	return nil
+}
+
+// ReadProfiles returns the Profiles of base from store. If none have
+// been written, only DefaultProfile exists and it is current.
+func ReadProfiles(store StateStore, base StateKey) (*Profiles, error) {
+	p := &Profiles{Current: DefaultProfile}
+	bs, err := store.ReadState(ProfilesStateKey(base))
+	switch {
+	case errors.Is(err, ErrStateNotExist):
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(bs, p); err != nil {
+			return nil, fmt.Errorf("parsing profiles of %q: %w", base, err)
+		}
+		if p.Current == "" {
+			p.Current = DefaultProfile
+		}
+	}
+	p.Add(DefaultProfile)
+	p.Add(p.Current)
+	return p, nil
+}
+
+// WriteProfiles saves p as the Profiles of base in store.
+func WriteProfiles(store StateStore, base StateKey, p *Profiles) error {
+	bs, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return store.WriteState(ProfilesStateKey(base), bs)
+}
@@ -0,0 +1,59 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestProfiles(t *testing.T) {
+	store := new(MemoryStore)
+	p, err := ReadProfiles(store, GlobalDaemonStateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Profiles{Current: DefaultProfile, Names: []string{DefaultProfile}}
+	if !reflect.DeepEqual(p, want) {
+		t.Fatalf("empty store: got %+v; want %+v", p, want)
+	}
+
+	p.Current = "work"
+	p.Add("work")
+	p.Add("home")
+	p.Add("work")
+	if err := WriteProfiles(store, GlobalDaemonStateKey, p); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadProfiles(store, GlobalDaemonStateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = &Profiles{Current: "work", Names: []string{DefaultProfile, "home", "work"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v; want %+v", got, want)
+	}
+
+	if got := ProfileStateKey(GlobalDaemonStateKey, DefaultProfile); got != GlobalDaemonStateKey {
+		t.Errorf("default profile key = %q; want %q", got, GlobalDaemonStateKey)
+	}
+	if got, want := ProfileStateKey(GlobalDaemonStateKey, "work"), StateKey("_daemon-profile-work"); got != want {
+		t.Errorf("work profile key = %q; want %q", got, want)
+	}
+}
+
+func TestCheckProfileName(t *testing.T) {
+	for _, name := range []string{"default", "work", "Test-2.b_c"} {
+		if err := CheckProfileName(name); err != nil {
+			t.Errorf("CheckProfileName(%q) = %v", name, err)
+		}
+	}
+	for _, name := range []string{"", "a/b", "a b", "é", strings.Repeat("a", 65)} {
+		if err := CheckProfileName(name); err == nil {
+			t.Errorf("CheckProfileName(%q) succeeded", name)
+		}
+	}
+}
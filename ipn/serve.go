@@ -0,0 +1,182 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+// ServeConfig is the configuration of the local services that
+// tailscaled serves to the tailnet on the node's Tailscale IPs, as set
+// by "tailscale serve".
+type ServeConfig struct {
+	// TCP maps a port on the node's Tailscale IPs to what's served
+	// on it.
+	TCP map[uint16]*TCPPortHandler `json:",omitempty"`
+}
+
+// TCPPortHandler describes what's served on a TCP port. Exactly one of
+// its fields is set.
+type TCPPortHandler struct {
+	// Web, if non-empty, makes the port an HTTPS server: TLS is
+	// terminated with a cert for the node's MagicDNS name, and
+	// requests are handled by the HTTPHandler whose mount point (a
+	// path ending in "/") is the longest prefix of the request's
+	// path. The mount point is stripped from the path before it's
+	// handled.
+	Web map[string]*HTTPHandler `json:",omitempty"`
+
+	// TCPForward, if non-empty, is the host:port on this machine to
+	// which connections are forwarded as-is. The host must be
+	// localhost, 127.0.0.1 or ::1.
+	TCPForward string `json:",omitempty"`
+}
+
+// HTTPHandler describes how HTTPS requests under a mount point are
+// handled. Exactly one of its fields is set.
+type HTTPHandler struct {
+	// Path is the absolute path of a local file or directory to
+	// serve.
+	Path string `json:",omitempty"`
+
+	// Proxy is the URL of a local HTTP server to reverse proxy
+	// requests to, such as "http://127.0.0.1:3000". Its host must be
+	// localhost, 127.0.0.1 or ::1.
+	Proxy string `json:",omitempty"`
+}
+
+// Equal reports whether sc and sc2 are equal.
+func (sc *ServeConfig) Equal(sc2 *ServeConfig) bool {
+	if sc.IsEmpty() || sc2.IsEmpty() {
+		return sc.IsEmpty() == sc2.IsEmpty()
+	}
+	if len(sc.TCP) != len(sc2.TCP) {
+		return false
+	}
+	for port, h := range sc.TCP {
+		h2, ok := sc2.TCP[port]
+		if !ok || !h.Equal(h2) {
+			return false
+		}
+	}
+	return true
+}
+
+// IsEmpty reports whether sc is nil or serves nothing.
+func (sc *ServeConfig) IsEmpty() bool { return sc == nil || len(sc.TCP) == 0 }
+
+// Equal reports whether h and h2 are equal.
+func (h *TCPPortHandler) Equal(h2 *TCPPortHandler) bool {
+	if h == nil || h2 == nil {
+		return h == h2
+	}
+	if h.TCPForward != h2.TCPForward || len(h.Web) != len(h2.Web) {
+		return false
+	}
+	for mount, wh := range h.Web {
+		wh2, ok := h2.Web[mount]
+		if !ok || (wh == nil) != (wh2 == nil) || (wh != nil && *wh != *wh2) {
+			return false
+		}
+	}
+	return true
+}
+
+// Check reports whether sc is a valid ServeConfig.
+func (sc *ServeConfig) Check() error {
+	if sc == nil {
+		return nil
+	}
+	for port, h := range sc.TCP {
+		if err := h.check(); err != nil {
+			return fmt.Errorf("port %d: %w", port, err)
+		}
+	}
+	return nil
+}
+
+func (h *TCPPortHandler) check() error {
+	if h == nil {
+		return errors.New("no handler")
+	}
+	switch {
+	case len(h.Web) > 0 && h.TCPForward != "":
+		return errors.New("both Web and TCPForward set")
+	case h.TCPForward != "":
+		host, _, err := net.SplitHostPort(h.TCPForward)
+		if err != nil {
+			return fmt.Errorf("invalid TCPForward %q: %w", h.TCPForward, err)
+		}
+		if !isLocalHost(host) {
+			return fmt.Errorf("TCPForward %q is not to localhost", h.TCPForward)
+		}
+	case len(h.Web) > 0:
+		for mount, wh := range h.Web {
+			if !strings.HasPrefix(mount, "/") || !strings.HasSuffix(mount, "/") {
+				return fmt.Errorf("invalid mount point %q; must start and end with /", mount)
+			}
+			if err := wh.check(); err != nil {
+				return fmt.Errorf("mount point %q: %w", mount, err)
+			}
+		}
+	default:
+		return errors.New("neither Web nor TCPForward set")
+	}
+	return nil
+}
+
+func (h *HTTPHandler) check() error {
+	if h == nil {
+		return errors.New("no handler")
+	}
+	switch {
+	case h.Path != "" && h.Proxy != "":
+		return errors.New("both Path and Proxy set")
+	case h.Path != "":
+		if !filepath.IsAbs(h.Path) {
+			return fmt.Errorf("path %q is not absolute", h.Path)
+		}
+	case h.Proxy != "":
+		u, err := url.Parse(h.Proxy)
+		if err != nil {
+			return fmt.Errorf("invalid proxy URL: %w", err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid proxy URL %q; want http://host:port", h.Proxy)
+		}
+		if !isLocalHost(u.Hostname()) {
+			return fmt.Errorf("proxy URL %q is not to localhost", h.Proxy)
+		}
+	default:
+		return errors.New("neither Path nor Proxy set")
+	}
+	return nil
+}
+
+// isLocalHost reports whether host, a hostname or IP address, is one
+// of the loopback names that serving may forward to. Other hosts,
+// even ones resolving to loopback addresses, are rejected so that
+// serving can't be used to reach other machines.
+func isLocalHost(host string) bool {
+	switch host {
+	case "localhost", "127.0.0.1", "::1":
+		return true
+	}
+	return false
+}
+
+// String returns a description of what h serves, such as
+// "http://127.0.0.1:3000" or "/var/www".
+func (h *HTTPHandler) String() string {
+	if h.Proxy != "" {
+		return h.Proxy
+	}
+	return h.Path
+}
@@ -0,0 +1,45 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import "testing"
+
+func TestServeConfigCheck(t *testing.T) {
+	web := func(mount string, h *HTTPHandler) *ServeConfig {
+		return &ServeConfig{TCP: map[uint16]*TCPPortHandler{
+			443: {Web: map[string]*HTTPHandler{mount: h}},
+		}}
+	}
+	tests := []struct {
+		name string
+		sc   *ServeConfig
+		ok   bool
+	}{
+		{"nil", nil, true},
+		{"empty", &ServeConfig{}, true},
+		{"proxy", web("/", &HTTPHandler{Proxy: "http://127.0.0.1:3000"}), true},
+		{"proxy-localhost", web("/", &HTTPHandler{Proxy: "https://localhost:3000/app"}), true},
+		{"proxy-ipv6", web("/", &HTTPHandler{Proxy: "http://[::1]:3000"}), true},
+		{"proxy-remote", web("/", &HTTPHandler{Proxy: "http://example.com:3000"}), false},
+		{"proxy-lan", web("/", &HTTPHandler{Proxy: "http://192.168.1.2:3000"}), false},
+		{"proxy-metadata", web("/", &HTTPHandler{Proxy: "http://169.254.169.254/"}), false},
+		{"path", web("/docs/", &HTTPHandler{Path: "/var/www"}), true},
+		{"tcp", &ServeConfig{TCP: map[uint16]*TCPPortHandler{5432: {TCPForward: "127.0.0.1:5432"}}}, true},
+		{"relative-path", web("/", &HTTPHandler{Path: "www"}), false},
+		{"mount-no-slash", web("/docs", &HTTPHandler{Path: "/var/www"}), false},
+		{"proxy-not-url", web("/", &HTTPHandler{Proxy: "127.0.0.1:3000"}), false},
+		{"both", web("/", &HTTPHandler{Path: "/var/www", Proxy: "http://127.0.0.1:3000"}), false},
+		{"neither", web("/", &HTTPHandler{}), false},
+		{"bad-forward", &ServeConfig{TCP: map[uint16]*TCPPortHandler{5432: {TCPForward: "5432"}}}, false},
+		{"remote-forward", &ServeConfig{TCP: map[uint16]*TCPPortHandler{5432: {TCPForward: "db.example.com:5432"}}}, false},
+		{"nil-handler", &ServeConfig{TCP: map[uint16]*TCPPortHandler{80: nil}}, false},
+	}
+	for _, tt := range tests {
+		err := tt.sc.Check()
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: Check() = %v; want ok=%v", tt.name, err, tt.ok)
+		}
+	}
+}
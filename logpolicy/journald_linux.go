@@ -0,0 +1,141 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package logpolicy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+	"tailscale.com/logtail"
+	"tailscale.com/version"
+)
+
+// journalSocket is the socket of systemd-journald's native protocol.
+// See https://systemd.io/JOURNAL_NATIVE_PROTOCOL/.
+const journalSocket = "/run/systemd/journal/socket"
+
+// journalMaxTruncated is the length to which messages are truncated
+// when an entry is too big for a datagram and can't be passed in a
+// memfd instead.
+const journalMaxTruncated = 16 << 10
+
+func init() {
+	newJournaldWriter = func(jsonLines bool) (io.Writer, error) {
+		c, err := net.Dial("unixgram", journalSocket)
+		if err != nil {
+			return nil, err
+		}
+		uc := c.(*net.UnixConn)
+		ident := version.CmdName()
+		return entryWriter{
+			json: jsonLines,
+			write: func(e *logtail.LocalEntry, line string) error {
+				return writeJournal(uc, journalEntry(e, ident, line), func() []byte {
+					return journalEntry(e, ident, truncateJournalMessage(line))
+				})
+			},
+		}, nil
+	}
+}
+
+// writeJournal sends the journal entry msg to the journal over c. If
+// it's too big for a datagram, it's passed in a sealed memfd instead,
+// as journald's native protocol allows, and if that fails, the entry
+// returned by truncated is sent instead.
+func writeJournal(c *net.UnixConn, msg []byte, truncated func() []byte) error {
+	_, err := c.Write(msg)
+	if !errors.Is(err, syscall.EMSGSIZE) && !errors.Is(err, syscall.ENOBUFS) {
+		return err
+	}
+	if err := writeJournalMemfd(c, msg); err == nil {
+		return nil
+	}
+	_, err = c.Write(truncated())
+	return err
+}
+
+// writeJournalMemfd sends msg to the journal over c in a sealed memfd.
+func writeJournalMemfd(c *net.UnixConn, msg []byte) error {
+	fd, err := unix.MemfdCreate("journal-entry", unix.MFD_CLOEXEC|unix.MFD_ALLOW_SEALING)
+	if err != nil {
+		return err
+	}
+	f := os.NewFile(uintptr(fd), "journal-entry")
+	defer f.Close()
+	if _, err := f.Write(msg); err != nil {
+		return err
+	}
+	// journald only accepts memfds sealed against changes.
+	if _, err := unix.FcntlInt(f.Fd(), unix.F_ADD_SEALS, unix.F_SEAL_SHRINK|unix.F_SEAL_GROW|unix.F_SEAL_WRITE|unix.F_SEAL_SEAL); err != nil {
+		return err
+	}
+	// WriteMsgUnix refuses connected datagram sockets, so send
+	// the fd with sendmsg directly.
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	rights := unix.UnixRights(int(f.Fd()))
+	var sendErr error
+	if err := rc.Write(func(s uintptr) bool {
+		sendErr = unix.Sendmsg(int(s), nil, rights, nil, 0)
+		return sendErr != unix.EAGAIN
+	}); err != nil {
+		return err
+	}
+	return sendErr
+}
+
+// truncateJournalMessage returns line truncated to
+// journalMaxTruncated bytes, noting how much was cut, if it's longer.
+func truncateJournalMessage(line string) string {
+	if len(line) <= journalMaxTruncated {
+		return line
+	}
+	return fmt.Sprintf("%s... [truncated %d bytes]", line[:journalMaxTruncated], len(line)-journalMaxTruncated)
+}
+
+// journalEntry returns the datagram logging line for e to the journal.
+func journalEntry(e *logtail.LocalEntry, ident, line string) []byte {
+	var b bytes.Buffer
+	appendJournalField(&b, "MESSAGE", line)
+	priority := "6" // LOG_INFO
+	if e.Level != "info" {
+		priority = "7" // LOG_DEBUG
+	}
+	appendJournalField(&b, "PRIORITY", priority)
+	appendJournalField(&b, "SYSLOG_IDENTIFIER", ident)
+	if e.Subsystem != "" {
+		appendJournalField(&b, "TAILSCALE_SUBSYSTEM", e.Subsystem)
+	}
+	return b.Bytes()
+}
+
+// appendJournalField appends a field in the journal's native format
+// to b: "KEY=value\n", or for values containing newlines, the key, a
+// newline, the value's little-endian 64-bit length, and the value.
+func appendJournalField(b *bytes.Buffer, key, value string) {
+	b.WriteString(key)
+	if !strings.Contains(value, "\n") {
+		b.WriteByte('=')
+		b.WriteString(value)
+		b.WriteByte('\n')
+		return
+	}
+	b.WriteByte('\n')
+	var n [8]byte
+	binary.LittleEndian.PutUint64(n[:], uint64(len(value)))
+	b.Write(n[:])
+	b.WriteString(value)
+	b.WriteByte('\n')
+}
@@ -0,0 +1,106 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package logpolicy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+	"tailscale.com/logtail"
+)
+
+func TestJournalEntry(t *testing.T) {
+	tests := []struct {
+		e    logtail.LocalEntry
+		line string
+		want string
+	}{
+		{
+			logtail.LocalEntry{Level: "info", Subsystem: "magicsock", Message: "hi"},
+			"magicsock: hi",
+			"MESSAGE=magicsock: hi\nPRIORITY=6\nSYSLOG_IDENTIFIER=tailscaled\nTAILSCALE_SUBSYSTEM=magicsock\n",
+		},
+		{
+			logtail.LocalEntry{Level: "debug", Message: "a\nb"},
+			"a\nb",
+			"MESSAGE\n\x03\x00\x00\x00\x00\x00\x00\x00a\nb\nPRIORITY=7\nSYSLOG_IDENTIFIER=tailscaled\n",
+		},
+	}
+	for _, tt := range tests {
+		if got := string(journalEntry(&tt.e, "tailscaled", tt.line)); got != tt.want {
+			t.Errorf("journalEntry(%+v) = %q; want %q", tt.e, got, tt.want)
+		}
+	}
+}
+
+func TestWriteJournalOversize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.sock")
+	ln, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	c, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Bigger than the maximum datagram size.
+	msg := journalEntry(&logtail.LocalEntry{Level: "info"}, "tailscaled", strings.Repeat("x", 4<<20))
+	if err := writeJournal(c, msg, func() []byte { return []byte("truncated") }); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1024)
+	oob := make([]byte, unix.CmsgSpace(4))
+	n, oobn, _, _, err := ln.ReadMsgUnix(buf, oob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) == "truncated" {
+		t.Skip("memfd not supported; sent the truncated entry")
+	}
+	if n != 0 {
+		t.Fatalf("got %d byte datagram; want an empty one with a memfd", n)
+	}
+	cmsgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(cmsgs) != 1 {
+		t.Fatalf("control messages = %v, %v; want one", cmsgs, err)
+	}
+	fds, err := unix.ParseUnixRights(&cmsgs[0])
+	if err != nil || len(fds) != 1 {
+		t.Fatalf("rights = %v, %v; want one fd", fds, err)
+	}
+	f := os.NewFile(uintptr(fds[0]), "memfd")
+	defer f.Close()
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Errorf("memfd has %d bytes; want the %d byte entry", len(got), len(msg))
+	}
+}
+
+func TestTruncateJournalMessage(t *testing.T) {
+	if got := truncateJournalMessage("short"); got != "short" {
+		t.Errorf("truncateJournalMessage(short) = %q", got)
+	}
+	long := strings.Repeat("x", journalMaxTruncated+10)
+	want := long[:journalMaxTruncated] + "... [truncated 10 bytes]"
+	if got := truncateJournalMessage(long); got != want {
+		t.Errorf("truncateJournalMessage(long) = ...%q; want ...%q", got[len(got)-30:], want[len(want)-30:])
+	}
+}
@@ -12,7 +12,9 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
@@ -69,6 +71,41 @@ type Config struct {
 	PublicID   logtail.PublicID
 }
 
+// Options are the options for NewWithOptions.
+type Options struct {
+	// JSON, if true, writes local logs as JSON lines (see
+	// logtail.LocalEntry) rather than as text.
+	JSON bool
+
+	// Output is where local logs are written. It's one of:
+	//
+	//	"" or "stderr": standard error
+	//	"file:<path>": the file path, rotated every 10MB, keeping
+	//	    the 4 previous files as path.1 (newest) to path.4
+	//	"syslog": the local syslog daemon, on Unix
+	//	"journald": the systemd journal, on Linux
+	//
+	// If the output is invalid (see CheckOutput) or can't be opened,
+	// logs go to standard error.
+	Output string
+
+	// NoUpload, if true, disables uploading logs to the log server.
+	NoUpload bool
+}
+
+const (
+	logFileMaxSize = 10 << 20
+	logFileBackups = 4
+)
+
+// newSyslogWriter and newJournaldWriter, if non-nil, return writers
+// of logtail.LocalEntry JSON lines to syslog or the systemd journal,
+// which log each entry as JSON if jsonLines, or else as text.
+var (
+	newSyslogWriter   func(jsonLines bool) (io.Writer, error)
+	newJournaldWriter func(jsonLines bool) (io.Writer, error)
+)
+
 // Policy is a logger and its public ID.
 type Policy struct {
 	// Logtail is the logger.
@@ -382,6 +419,12 @@ func tryFixLogStateLocation(dir, cmdname string) {
 // New returns a new log policy (a logger and its instance ID) for a
 // given collection name.
 func New(collection string) *Policy {
+	return NewWithOptions(collection, Options{})
+}
+
+// NewWithOptions is like New, but with options for local log output
+// and uploading.
+func NewWithOptions(collection string, opts Options) *Policy {
 	var lflags int
 	if term.IsTerminal(2) || runtime.GOOS == "windows" {
 		lflags = 0
@@ -396,7 +439,6 @@ func New(collection string) *Policy {
 		// anyway, no need to add one.
 		lflags = 0
 	}
-	console := log.New(stderrWriter{}, "", lflags)
 
 	var earlyErrBuf bytes.Buffer
 	earlyLogf := func(format string, a ...interface{}) {
@@ -487,10 +529,25 @@ func New(collection string) *Policy {
 		}
 	}
 
+	var filchBuf *filch.Filch
+	var filchErr error
+	if !opts.NoUpload {
+		filchBuf, filchErr = filch.New(filepath.Join(dir, cmdName), filch.Options{
+			ReplaceStderr: redirectStderrToLogPanics(),
+		})
+	}
+	var stderr io.Writer = stderrWriter{}
+	if filchBuf != nil && filchBuf.OrigStderr != nil {
+		stderr = filchBuf.OrigStderr
+	}
+	localOut, localJSON := localOutput(opts, stderr, lflags, earlyLogf)
+
 	c := logtail.Config{
 		Collection: newc.Collection,
 		PrivateID:  newc.PrivateID,
-		Stderr:     logWriter{console},
+		Stderr:     localOut,
+		StderrJSON: localJSON,
+		NoUpload:   opts.NoUpload,
 		NewZstdEncoder: func() logtail.Encoder {
 			w, err := smallzstd.NewEncoder(nil)
 			if err != nil {
@@ -501,21 +558,15 @@ func New(collection string) *Policy {
 		HTTPC: &http.Client{Transport: newLogtailTransport(logtail.DefaultHost)},
 	}
 
-	if val := getLogTarget(); val != "" {
+	if val := getLogTarget(); val != "" && !opts.NoUpload {
 		log.Println("You have enabled a non-default log target. Doing without being told to by Tailscale staff or your network administrator will make getting support difficult.")
 		c.BaseURL = val
 		u, _ := url.Parse(val)
 		c.HTTPC = &http.Client{Transport: newLogtailTransport(u.Host)}
 	}
 
-	filchBuf, filchErr := filch.New(filepath.Join(dir, cmdName), filch.Options{
-		ReplaceStderr: redirectStderrToLogPanics(),
-	})
 	if filchBuf != nil {
 		c.Buffer = filchBuf
-		if filchBuf.OrigStderr != nil {
-			c.Stderr = filchBuf.OrigStderr
-		}
 	}
 	lw := logtail.NewLogger(c, log.Printf)
 	log.SetFlags(0) // other logflags are set on console, not here
@@ -526,6 +577,9 @@ func New(collection string) *Policy {
 		goVersion(),
 		os.Args)
 	log.Printf("LogID: %v", newc.PublicID)
+	if opts.NoUpload {
+		log.Printf("logpolicy: log uploading disabled")
+	}
 	if filchErr != nil {
 		log.Printf("filch failed: %v", filchErr)
 	}
@@ -539,6 +593,101 @@ func New(collection string) *Policy {
 	}
 }
 
+// CheckOutput reports whether output is a valid Options.Output.
+func CheckOutput(output string) error {
+	switch {
+	case output == "", output == "stderr", output == "syslog", output == "journald":
+		return nil
+	case strings.HasPrefix(output, "file:"):
+		if strings.TrimPrefix(output, "file:") == "" {
+			return errors.New(`"file:" must be followed by a path`)
+		}
+		return nil
+	}
+	return fmt.Errorf(`unknown log output %q; want "stderr", "file:<path>", "syslog" or "journald"`, output)
+}
+
+// localOutput returns the writer for the local logs described by
+// opts, and whether it takes JSON lines (logtail.Config.StderrJSON).
+// stderr is the process's standard error, and lflags are the log
+// flags for text written to it.
+func localOutput(opts Options, stderr io.Writer, lflags int, logf logger.Logf) (w io.Writer, jsonLines bool) {
+	if err := CheckOutput(opts.Output); err != nil {
+		logf("logpolicy: %v; logging to stderr", err)
+		opts.Output = ""
+	}
+	switch out := opts.Output; {
+	case out == "" || out == "stderr":
+	case strings.HasPrefix(out, "file:"):
+		f, err := openRotatingFile(strings.TrimPrefix(out, "file:"), logFileMaxSize, logFileBackups)
+		if err != nil {
+			logf("logpolicy: %v; logging to stderr", err)
+			break
+		}
+		if opts.JSON {
+			return f, true
+		}
+		return logWriter{log.New(f, "", log.LstdFlags)}, false
+	case out == "syslog" || out == "journald":
+		newWriter := newSyslogWriter
+		if out == "journald" {
+			newWriter = newJournaldWriter
+		}
+		if newWriter == nil {
+			logf("logpolicy: log output %q not supported on %s; logging to stderr", out, runtime.GOOS)
+			break
+		}
+		w, err := newWriter(opts.JSON)
+		if err != nil {
+			logf("logpolicy: %s: %v; logging to stderr", out, err)
+			break
+		}
+		// syslog and journald want levels, so always get entries as
+		// JSON, and render them as text themselves if needed.
+		return w, true
+	}
+	if opts.JSON {
+		return stderr, true
+	}
+	return logWriter{log.New(stderr, "", lflags)}, false
+}
+
+// entryWriter is an io.Writer of logtail.LocalEntry JSON lines,
+// passing each entry to write along with the line to log for it: the
+// JSON line itself if json, or else the entry as text.
+type entryWriter struct {
+	json  bool
+	write func(e *logtail.LocalEntry, line string) error
+}
+
+func (w entryWriter) Write(buf []byte) (int, error) {
+	var e logtail.LocalEntry
+	if err := json.Unmarshal(buf, &e); err != nil {
+		return 0, err
+	}
+	line := strings.TrimSuffix(string(buf), "\n")
+	if !w.json {
+		line = entryText(&e)
+	}
+	if err := w.write(&e, line); err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
+
+// entryText returns e as a text log line, without its time or level.
+func entryText(e *logtail.LocalEntry) string {
+	s := e.Message
+	if e.Subsystem != "" {
+		s = e.Subsystem + ": " + s
+	}
+	if len(e.Fields) > 0 {
+		fields, _ := json.Marshal(e.Fields)
+		s = strings.TrimPrefix(s+" "+string(fields), " ")
+	}
+	return s
+}
+
 // SetVerbosityLevel controls the verbosity level that should be
 // written to stderr. 0 is the default (not verbose). Levels 1 or higher
 // are increasingly verbose.
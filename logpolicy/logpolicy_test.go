@@ -0,0 +1,24 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package logpolicy
+
+import "testing"
+
+func TestCheckOutput(t *testing.T) {
+	for output, ok := range map[string]bool{
+		"":                     true,
+		"stderr":               true,
+		"syslog":               true,
+		"journald":             true,
+		"file:/var/log/ts.log": true,
+		"file:":                false,
+		"stdout":               false,
+		"/var/log/tailscaled":  false,
+	} {
+		if err := CheckOutput(output); (err == nil) != ok {
+			t.Errorf("CheckOutput(%q) = %v; want ok=%v", output, err, ok)
+		}
+	}
+}
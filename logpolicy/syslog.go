@@ -0,0 +1,34 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !windows && !plan9 && !js
+// +build !windows,!plan9,!js
+
+package logpolicy
+
+import (
+	"io"
+	"log/syslog"
+
+	"tailscale.com/logtail"
+	"tailscale.com/version"
+)
+
+func init() {
+	newSyslogWriter = func(jsonLines bool) (io.Writer, error) {
+		w, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, version.CmdName())
+		if err != nil {
+			return nil, err
+		}
+		return entryWriter{
+			json: jsonLines,
+			write: func(e *logtail.LocalEntry, line string) error {
+				if e.Level == "info" {
+					return w.Info(line)
+				}
+				return w.Debug(line)
+			},
+		}, nil
+	}
+}
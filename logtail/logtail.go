@@ -15,6 +15,7 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"sync/atomic"
 	"time"
 
@@ -43,6 +44,8 @@ type Config struct {
 	TimeNow        func() time.Time // if set, subsitutes uses of time.Now
 	Stderr         io.Writer        // if set, logs are sent here instead of os.Stderr
 	StderrLevel    int              // max verbosity level to write to stderr; 0 means the non-verbose messages only
+	StderrJSON     bool             // if true, logs are written to Stderr as JSON lines (see LocalEntry) rather than text
+	NoUpload       bool             // if true, logs are only written to Stderr, never uploaded
 	Buffer         Buffer           // temp storage, if nil a MemoryBuffer
 	NewZstdEncoder func() Encoder   // if set, used to compress logs for transmission
 
@@ -74,6 +77,8 @@ func NewLogger(cfg Config, logf tslogger.Logf) *Logger {
 	l := &Logger{
 		stderr:         cfg.Stderr,
 		stderrLevel:    int64(cfg.StderrLevel),
+		stderrJSON:     cfg.StderrJSON,
+		noUpload:       cfg.NoUpload,
 		httpc:          cfg.HTTPC,
 		url:            cfg.BaseURL + "/c/" + cfg.Collection + "/" + cfg.PrivateID.String(),
 		lowMem:         cfg.LowMemory,
@@ -95,7 +100,11 @@ func NewLogger(cfg Config, logf tslogger.Logf) *Logger {
 	ctx, cancel := context.WithCancel(context.Background())
 	l.uploadCancel = cancel
 
-	go l.uploading(ctx)
+	if l.noUpload {
+		close(l.shutdownDone)
+	} else {
+		go l.uploading(ctx)
+	}
 	l.Write([]byte("logtail started"))
 	return l
 }
@@ -105,6 +114,8 @@ func NewLogger(cfg Config, logf tslogger.Logf) *Logger {
 type Logger struct {
 	stderr         io.Writer
 	stderrLevel    int64 // accessed atomically
+	stderrJSON     bool
+	noUpload       bool
 	httpc          *http.Client
 	url            string
 	lowMem         bool
@@ -513,7 +524,9 @@ func (l *Logger) Write(buf []byte) (int, error) {
 	}
 	level, buf := parseAndRemoveLogLevel(buf)
 	if l.stderr != nil && l.stderr != ioutil.Discard && int64(level) <= atomic.LoadInt64(&l.stderrLevel) {
-		if buf[len(buf)-1] == '\n' {
+		if l.stderrJSON {
+			l.stderr.Write(l.encodeLocal(level, buf))
+		} else if buf[len(buf)-1] == '\n' {
 			l.stderr.Write(buf)
 		} else {
 			// The log package always line-terminates logs,
@@ -522,11 +535,71 @@ func (l *Logger) Write(buf []byte) (int, error) {
 			l.stderr.Write(withNL)
 		}
 	}
+	if l.noUpload {
+		return len(buf), nil
+	}
 	b := l.encode(buf)
 	_, err := l.send(b)
 	return len(buf), err
 }
 
+// LocalEntry is a log entry as written to Config.Stderr, one JSON
+// object per line, when Config.StderrJSON is set.
+type LocalEntry struct {
+	Time time.Time `json:"time"`
+
+	// Level is "info", or "debug" or "trace" for verbosity levels 1
+	// ("[v1]") and 2 ("[v2]").
+	Level string `json:"level"`
+
+	// Subsystem is the message's prefix naming the part of the
+	// program that logged it, such as "magicsock", if any.
+	Subsystem string `json:"subsystem,omitempty"`
+
+	Message string `json:"msg"`
+
+	// Fields are the fields of a JSON log entry other than its
+	// "text", which is its Message.
+	Fields map[string]interface{} `json:"fields,omitempty"`
+}
+
+var levelNames = [...]string{"info", "debug", "trace"}
+
+// encodeLocal returns buf, logged at the given verbosity level, as a
+// LocalEntry JSON line.
+func (l *Logger) encodeLocal(level int, buf []byte) []byte {
+	e := LocalEntry{
+		Time:  l.timeNow(),
+		Level: levelNames[level],
+	}
+	if len(buf) > 0 && buf[0] == '{' && json.Unmarshal(buf, &e.Fields) == nil {
+		if txt, ok := e.Fields["text"].(string); ok {
+			e.Message = txt
+			delete(e.Fields, "text")
+		}
+	} else {
+		e.Fields = nil
+		e.Subsystem, e.Message = splitSubsystem(string(bytes.TrimSuffix(buf, []byte("\n"))))
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		// Only possible with unencodable floats in Fields.
+		b, _ = json.Marshal(LocalEntry{Time: e.Time, Level: e.Level, Message: string(buf)})
+	}
+	return append(b, '\n')
+}
+
+// splitSubsystem splits a log message like "magicsock: foo" into its
+// subsystem prefix and the rest of the message. A subsystem starts
+// with a lowercase letter and has no spaces.
+func splitSubsystem(s string) (subsystem, msg string) {
+	i := strings.Index(s, ": ")
+	if i <= 0 || s[0] < 'a' || s[0] > 'z' || strings.ContainsAny(s[:i], " \t") {
+		return "", s
+	}
+	return s[:i], s[i+2:]
+}
+
 var (
 	openBracketV = []byte("[v")
 	v1           = []byte("[v1] ")
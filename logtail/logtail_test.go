@@ -289,6 +289,74 @@ func TestParseAndRemoveLogLevel(t *testing.T) {
 	}
 }
 
+func TestEncodeLocal(t *testing.T) {
+	now := time.Date(2021, 7, 1, 12, 0, 0, 0, time.UTC)
+	lg := &Logger{timeNow: func() time.Time { return now }}
+	tests := []struct {
+		level int
+		log   string
+		want  string
+	}{
+		{0, "magicsock: home is now derp-1\n", `{"time":"2021-07-01T12:00:00Z","level":"info","subsystem":"magicsock","msg":"home is now derp-1"}`},
+		{1, "wg: handshake did not complete\n", `{"time":"2021-07-01T12:00:00Z","level":"debug","subsystem":"wg","msg":"handshake did not complete"}`},
+		{2, "no subsystem here", `{"time":"2021-07-01T12:00:00Z","level":"trace","msg":"no subsystem here"}`},
+		{0, "Program starting: v1.10", `{"time":"2021-07-01T12:00:00Z","level":"info","msg":"Program starting: v1.10"}`},
+		{0, "two words: not a subsystem", `{"time":"2021-07-01T12:00:00Z","level":"info","msg":"two words: not a subsystem"}`},
+		{0, `{"text":"hi","foo":1}`, `{"time":"2021-07-01T12:00:00Z","level":"info","msg":"hi","fields":{"foo":1}}`},
+		{0, `{"foo":"bar"}`, `{"time":"2021-07-01T12:00:00Z","level":"info","msg":"","fields":{"foo":"bar"}}`},
+		{0, `{not json`, `{"time":"2021-07-01T12:00:00Z","level":"info","msg":"{not json"}`},
+	}
+	for _, tt := range tests {
+		got := string(lg.encodeLocal(tt.level, []byte(tt.log)))
+		if got != tt.want+"\n" {
+			t.Errorf("encodeLocal(%d, %q):\n got: %s\nwant: %s", tt.level, tt.log, got, tt.want)
+		}
+	}
+}
+
+func TestStderrJSONNoUpload(t *testing.T) {
+	uploaded := make(chan bool, 1)
+	testServ := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case uploaded <- true:
+			default:
+			}
+		}))
+	defer testServ.Close()
+
+	var stderr strings.Builder
+	l := NewLogger(Config{
+		BaseURL:     testServ.URL,
+		Stderr:      &stderr,
+		StderrLevel: 1,
+		StderrJSON:  true,
+		NoUpload:    true,
+	}, t.Logf)
+	l.Write([]byte("[v1] magicsock: verbose\n"))
+	l.Write([]byte("[v2] too verbose\n"))
+	if err := l.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var msgs []string
+	for _, line := range strings.Split(strings.TrimSpace(stderr.String()), "\n") {
+		var e LocalEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("stderr line %q: %v", line, err)
+		}
+		msgs = append(msgs, e.Level+" "+e.Subsystem+" "+e.Message)
+	}
+	if got, want := strings.Join(msgs, ","), "info  logtail started,debug magicsock verbose,info  logger closing down"; got != want {
+		t.Errorf("stderr entries = %q; want %q", got, want)
+	}
+	select {
+	case <-uploaded:
+		t.Error("logs were uploaded with NoUpload set")
+	default:
+	}
+}
+
 func TestPublicIDUnmarshalText(t *testing.T) {
 	const hexStr = "6c60a9e0e7af57170bb1347b2d477e4cbc27d4571a4923b21651456f931e3d55"
 	x := []byte(hexStr)
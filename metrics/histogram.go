@@ -0,0 +1,103 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Histogram is a distribution of observed values in fixed buckets. It
+// satisfies the expvar.Var interface, and tsweb's Prometheus exporter
+// writes it as a Prometheus histogram.
+//
+// It's safe for concurrent use.
+type Histogram struct {
+	bounds []float64 // sorted upper bounds, exclusive of +Inf
+	counts []uint64  // atomic; len(bounds)+1, the last for +Inf
+	sum    uint64    // atomic; math.Float64bits of the sum
+}
+
+// NewHistogram returns a histogram with buckets for values less than
+// or equal to each of bounds, plus one for larger values.
+func NewHistogram(bounds ...float64) *Histogram {
+	b := append([]float64(nil), bounds...)
+	sort.Float64s(b)
+	return &Histogram{
+		bounds: b,
+		counts: make([]uint64, len(b)+1),
+	}
+}
+
+// Observe adds v to the histogram.
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	atomic.AddUint64(&h.counts[i], 1)
+	for {
+		old := atomic.LoadUint64(&h.sum)
+		new := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&h.sum, old, new) {
+			return
+		}
+	}
+}
+
+// snapshot returns the cumulative count of each bucket, the total
+// count and the sum.
+func (h *Histogram) snapshot() (cum []uint64, count uint64, sum float64) {
+	cum = make([]uint64, len(h.counts))
+	for i := range h.counts {
+		count += atomic.LoadUint64(&h.counts[i])
+		cum[i] = count
+	}
+	return cum, count, math.Float64frombits(atomic.LoadUint64(&h.sum))
+}
+
+// WritePrometheus writes h to w in the Prometheus text exposition
+// format as the histogram name. labels, if non-empty, are extra
+// labels for every sample, in the form `k1="v1",k2="v2"`.
+func (h *Histogram) WritePrometheus(w io.Writer, name, labels string) {
+	cum, count, sum := h.snapshot()
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	for i, c := range cum {
+		le := "+Inf"
+		if i < len(h.bounds) {
+			le = strconv.FormatFloat(h.bounds[i], 'g', -1, 64)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s%sle=%q} %d\n", name, labels, sep, le, c)
+	}
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %v\n", name, labels, sum)
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, count)
+}
+
+// String returns h as JSON, for expvar.
+func (h *Histogram) String() string {
+	cum, count, sum := h.snapshot()
+	var sb strings.Builder
+	sb.WriteString(`{"buckets":{`)
+	for i, c := range cum {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		le := "+Inf"
+		if i < len(h.bounds) {
+			le = strconv.FormatFloat(h.bounds[i], 'g', -1, 64)
+		}
+		fmt.Fprintf(&sb, "%q:%d", le, c)
+	}
+	fmt.Fprintf(&sb, `},"count":%d,"sum":%v}`, count, sum)
+	return sb.String()
+}
@@ -5,6 +5,8 @@
 package metrics
 
 import (
+	"bytes"
+	"encoding/json"
 	"os"
 	"runtime"
 	"testing"
@@ -51,3 +53,41 @@ func BenchmarkCurrentFileDescriptors(b *testing.B) {
 		_ = CurrentFDs()
 	}
 }
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram(1, 0.5, 2)
+	for _, v := range []float64{0.1, 0.5, 0.7, 1, 3, 4} {
+		h.Observe(v)
+	}
+
+	var buf bytes.Buffer
+	h.WritePrometheus(&buf, "h", `a="b"`)
+	const want = `h_bucket{a="b",le="0.5"} 2
+h_bucket{a="b",le="1"} 4
+h_bucket{a="b",le="2"} 4
+h_bucket{a="b",le="+Inf"} 6
+h_sum{a="b"} 9.3
+h_count{a="b"} 6
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	var js struct {
+		Buckets map[string]uint64
+		Count   uint64
+	}
+	if err := json.Unmarshal([]byte(h.String()), &js); err != nil {
+		t.Fatalf("String() isn't JSON: %v", err)
+	}
+	if js.Count != 6 || js.Buckets["+Inf"] != 6 || js.Buckets["0.5"] != 2 {
+		t.Errorf("String() = %s", h.String())
+	}
+
+	err := tstest.MinAllocsPerRun(t, 0, func() {
+		h.Observe(0.2)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -40,6 +40,9 @@ type Config struct {
 	// it to resolve, you also need to add appropriate routes to
 	// Routes.
 	Hosts map[dnsname.FQDN][]netaddr.IP
+	// Records maps DNS FQDNs to their SRV, TXT and CNAME records,
+	// which are served like Hosts.
+	Records map[dnsname.FQDN][]resolver.Record
 }
 
 // WriteToBufioWriter write a debug version of c for logs to w, omitting
@@ -53,6 +56,7 @@ func (c *Config) WriteToBufioWriter(w *bufio.Writer) {
 
 	fmt.Fprintf(w, " SearchDomains:%v", c.SearchDomains)
 	fmt.Fprintf(w, " Hosts:%v", len(c.Hosts))
+	fmt.Fprintf(w, " Records:%v", len(c.Records))
 	w.WriteString("}")
 }
 
@@ -0,0 +1,315 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package resolver
+
+import (
+	"container/list"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/util/clientmetric"
+	"tailscale.com/util/dnsname"
+)
+
+const (
+	// maxCacheTTL caps how long a positive answer is cached,
+	// whatever its records' TTLs.
+	maxCacheTTL = 24 * time.Hour
+
+	// maxNegativeCacheTTL caps how long a negative answer (NXDOMAIN
+	// or no data) is cached. RFC 2308 section 5 suggests 1 to 3
+	// hours.
+	maxNegativeCacheTTL = time.Hour
+)
+
+// maxCacheEntries returns the maximum number of responses the
+// forwarder caches.
+func maxCacheEntries() int {
+	if runtime.GOOS == "ios" {
+		// Responses can be up to maxResponseBytes each, and
+		// memory on iOS is tight.
+		return 100
+	}
+	return 1000
+}
+
+var (
+	metricCacheHit   = clientmetric.NewCounter("dns_forward_cache_hit")
+	metricCacheMiss  = clientmetric.NewCounter("dns_forward_cache_miss")
+	metricCacheFlush = clientmetric.NewCounter("dns_forward_cache_flush")
+)
+
+// cacheKey identifies a cached response.
+type cacheKey struct {
+	name  string // lowercase
+	typ   dns.Type
+	class dns.Class
+	route dnsname.FQDN // suffix of the route the query was forwarded by
+
+	// do and cd are whether the query set the EDNS DNSSEC OK bit
+	// and the Checking Disabled header bit, which change the
+	// upstream's response.
+	do, cd bool
+}
+
+// cacheEntry is a cached response.
+type cacheEntry struct {
+	key     cacheKey
+	resp    []byte // as received from upstream
+	added   time.Time
+	expires time.Time
+}
+
+// responseCache is a bounded LRU cache of forwarded DNS responses. It
+// honors the TTLs of the records in responses, and caches negative
+// answers per RFC 2308.
+//
+// It's safe for concurrent use.
+type responseCache struct {
+	now func() time.Time // time.Now, except in tests
+	max int              // maximum number of entries
+
+	mu sync.Mutex
+	m  map[cacheKey]*list.Element // of *cacheEntry
+	ll *list.List                 // most recently used first
+}
+
+func newResponseCache() *responseCache {
+	return &responseCache{
+		now: time.Now,
+		max: maxCacheEntries(),
+		m:   make(map[cacheKey]*list.Element),
+		ll:  list.New(),
+	}
+}
+
+// cacheKeyFor returns the key for query, a DNS request forwarded by
+// route. It returns ok false if query shouldn't be answered from the
+// cache.
+func cacheKeyFor(query []byte, route dnsname.FQDN) (k cacheKey, ok bool) {
+	var p dns.Parser
+	h, err := p.Start(query)
+	if err != nil || h.Response || h.OpCode != 0 {
+		return k, false
+	}
+	q, err := p.Question()
+	if err != nil {
+		return k, false
+	}
+	if _, err := p.Question(); err != dns.ErrSectionDone {
+		// Not exactly one question.
+		return k, false
+	}
+	k = cacheKey{
+		name:  strings.ToLower(q.Name.String()),
+		typ:   q.Type,
+		class: q.Class,
+		route: route,
+		// dnsmessage doesn't parse the CD bit; it's the 0x10 bit
+		// of the second flags byte, which p.Start checked is
+		// there.
+		cd: query[3]&0x10 != 0,
+	}
+	if err := p.SkipAllAnswers(); err != nil {
+		return k, false
+	}
+	if err := p.SkipAllAuthorities(); err != nil {
+		return k, false
+	}
+	for {
+		h, err := p.AdditionalHeader()
+		if err == dns.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return k, false
+		}
+		if h.Type == dns.TypeOPT {
+			// The OPT pseudo-record's TTL field holds the
+			// extended flags, whose top bit is DO (RFC 6891
+			// section 6.1.3).
+			k.do = h.TTL&0x8000 != 0
+		}
+		if err := p.SkipAdditional(); err != nil {
+			return k, false
+		}
+	}
+	return k, true
+}
+
+// get returns the cached response for query, whose key is k, with its
+// ID and question rewritten to match query and its TTLs reduced by
+// the time it's been cached.
+func (c *responseCache) get(k cacheKey, query []byte) (resp []byte, ok bool) {
+	now := c.now()
+	c.mu.Lock()
+	ele, ok := c.m[k]
+	if !ok {
+		c.mu.Unlock()
+		metricCacheMiss.Add(1)
+		return nil, false
+	}
+	e := ele.Value.(*cacheEntry)
+	if !now.Before(e.expires) {
+		c.removeLocked(ele)
+		c.mu.Unlock()
+		metricCacheMiss.Add(1)
+		return nil, false
+	}
+	c.ll.MoveToFront(ele)
+	cached, added := e.resp, e.added
+	c.mu.Unlock()
+
+	resp, err := rewriteCached(cached, query, now.Sub(added))
+	if err != nil {
+		metricCacheMiss.Add(1)
+		return nil, false
+	}
+	metricCacheHit.Add(1)
+	return resp, true
+}
+
+// put caches resp, the upstream's response to a query with key k, if
+// it's cacheable.
+func (c *responseCache) put(k cacheKey, resp []byte) {
+	ttl, ok := cacheTTL(resp)
+	if !ok || ttl <= 0 {
+		return
+	}
+	now := c.now()
+	e := &cacheEntry{
+		key:     k,
+		resp:    append([]byte(nil), resp...),
+		added:   now,
+		expires: now.Add(ttl),
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ele, ok := c.m[k]; ok {
+		ele.Value = e
+		c.ll.MoveToFront(ele)
+		return
+	}
+	c.m[k] = c.ll.PushFront(e)
+	for c.ll.Len() > c.max {
+		c.removeLocked(c.ll.Back())
+	}
+}
+
+// flush removes all cached responses.
+func (c *responseCache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ll.Len() == 0 {
+		return
+	}
+	c.m = make(map[cacheKey]*list.Element)
+	c.ll.Init()
+	metricCacheFlush.Add(1)
+}
+
+// len returns the number of cached responses.
+func (c *responseCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
+
+// c.mu must be held.
+func (c *responseCache) removeLocked(ele *list.Element) {
+	c.ll.Remove(ele)
+	delete(c.m, ele.Value.(*cacheEntry).key)
+}
+
+// cacheTTL returns how long resp may be cached: the smallest TTL of
+// its answers for a positive response, or, for a negative response,
+// the smaller of its SOA record's TTL and MINIMUM field (RFC 2308
+// section 5). It returns ok false for responses that mustn't be
+// cached: errors other than NXDOMAIN, truncated responses, and
+// negative responses without an SOA.
+func cacheTTL(resp []byte) (ttl time.Duration, ok bool) {
+	var msg dns.Message
+	if err := msg.Unpack(resp); err != nil {
+		return 0, false
+	}
+	if msg.Truncated || len(msg.Questions) != 1 {
+		return 0, false
+	}
+	switch msg.RCode {
+	case dns.RCodeSuccess:
+		if len(msg.Answers) > 0 {
+			minTTL := uint32(maxCacheTTL / time.Second)
+			for _, rr := range msg.Answers {
+				if rr.Header.TTL < minTTL {
+					minTTL = rr.Header.TTL
+				}
+			}
+			return time.Duration(minTTL) * time.Second, true
+		}
+	case dns.RCodeNameError:
+	default:
+		return 0, false
+	}
+
+	// Negative response: NXDOMAIN, or NOERROR with no answers.
+	for _, rr := range msg.Authorities {
+		soa, isSOA := rr.Body.(*dns.SOAResource)
+		if !isSOA {
+			continue
+		}
+		minTTL := rr.Header.TTL
+		if soa.MinTTL < minTTL {
+			minTTL = soa.MinTTL
+		}
+		ttl := time.Duration(minTTL) * time.Second
+		if ttl > maxNegativeCacheTTL {
+			ttl = maxNegativeCacheTTL
+		}
+		return ttl, true
+	}
+	return 0, false
+}
+
+// rewriteCached returns a copy of the cached response resp as a
+// response to query: with query's ID and question (whose name may
+// differ in case), and with the TTLs of its records reduced by age.
+func rewriteCached(resp, query []byte, age time.Duration) ([]byte, error) {
+	var msg dns.Message
+	if err := msg.Unpack(resp); err != nil {
+		return nil, err
+	}
+	var p dns.Parser
+	qh, err := p.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+	msg.ID = qh.ID
+	msg.RecursionDesired = qh.RecursionDesired
+	msg.Questions = []dns.Question{q}
+
+	elapsed := uint32(age / time.Second)
+	for _, rrs := range [][]dns.Resource{msg.Answers, msg.Authorities, msg.Additionals} {
+		for i := range rrs {
+			h := &rrs[i].Header
+			if h.Type == dns.TypeOPT {
+				// The OPT pseudo-record's TTL field holds flags.
+				continue
+			}
+			if h.TTL > elapsed {
+				h.TTL -= elapsed
+			} else {
+				h.TTL = 0
+			}
+		}
+	}
+	return msg.Pack()
+}
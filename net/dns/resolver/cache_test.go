@@ -0,0 +1,290 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package resolver
+
+import (
+	"testing"
+	"time"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/types/dnstype"
+	"tailscale.com/util/dnsname"
+)
+
+func cacheQuery(t *testing.T, id uint16, name string, typ dns.Type) []byte {
+	t.Helper()
+	msg := dns.Message{
+		Header:    dns.Header{ID: id, RecursionDesired: true},
+		Questions: []dns.Question{{Name: dns.MustNewName(name), Type: typ, Class: dns.ClassINET}},
+	}
+	b, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func cacheResponse(t *testing.T, name string, rcode dns.RCode, answers, authorities []dns.Resource) []byte {
+	t.Helper()
+	msg := dns.Message{
+		Header:      dns.Header{ID: 1, Response: true, RCode: rcode},
+		Questions:   []dns.Question{{Name: dns.MustNewName(name), Type: dns.TypeA, Class: dns.ClassINET}},
+		Answers:     answers,
+		Authorities: authorities,
+	}
+	b, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func aRecord(name string, ttl uint32) dns.Resource {
+	return dns.Resource{
+		Header: dns.ResourceHeader{Name: dns.MustNewName(name), Type: dns.TypeA, Class: dns.ClassINET, TTL: ttl},
+		Body:   &dns.AResource{A: [4]byte{1, 2, 3, 4}},
+	}
+}
+
+func soaRecord(ttl, minTTL uint32) dns.Resource {
+	return dns.Resource{
+		Header: dns.ResourceHeader{Name: dns.MustNewName("example.com."), Type: dns.TypeSOA, Class: dns.ClassINET, TTL: ttl},
+		Body: &dns.SOAResource{
+			NS:     dns.MustNewName("ns.example.com."),
+			MBox:   dns.MustNewName("hostmaster.example.com."),
+			MinTTL: minTTL,
+		},
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	tests := []struct {
+		name   string
+		resp   []byte
+		want   time.Duration
+		wantOK bool
+	}{
+		{
+			name:   "positive",
+			resp:   cacheResponse(t, "a.example.com.", dns.RCodeSuccess, []dns.Resource{aRecord("a.example.com.", 300), aRecord("a.example.com.", 60)}, nil),
+			want:   60 * time.Second,
+			wantOK: true,
+		},
+		{
+			name:   "positive_capped",
+			resp:   cacheResponse(t, "a.example.com.", dns.RCodeSuccess, []dns.Resource{aRecord("a.example.com.", 1<<30)}, nil),
+			want:   maxCacheTTL,
+			wantOK: true,
+		},
+		{
+			name:   "nxdomain_soa",
+			resp:   cacheResponse(t, "a.example.com.", dns.RCodeNameError, nil, []dns.Resource{soaRecord(3600, 30)}),
+			want:   30 * time.Second,
+			wantOK: true,
+		},
+		{
+			name:   "nodata_soa",
+			resp:   cacheResponse(t, "a.example.com.", dns.RCodeSuccess, nil, []dns.Resource{soaRecord(20, 900)}),
+			want:   20 * time.Second,
+			wantOK: true,
+		},
+		{
+			name:   "negative_capped",
+			resp:   cacheResponse(t, "a.example.com.", dns.RCodeNameError, nil, []dns.Resource{soaRecord(86400, 86400)}),
+			want:   maxNegativeCacheTTL,
+			wantOK: true,
+		},
+		{
+			name: "nxdomain_without_soa",
+			resp: cacheResponse(t, "a.example.com.", dns.RCodeNameError, nil, nil),
+		},
+		{
+			name: "servfail",
+			resp: cacheResponse(t, "a.example.com.", dns.RCodeServerFailure, nil, []dns.Resource{soaRecord(60, 60)}),
+		},
+		{
+			name: "garbage",
+			resp: []byte{1, 2, 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := cacheTTL(tt.resp)
+			if ok != tt.wantOK || got != tt.want {
+				t.Errorf("cacheTTL = %v, %v; want %v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+
+	truncated := cacheResponse(t, "a.example.com.", dns.RCodeSuccess, []dns.Resource{aRecord("a.example.com.", 60)}, nil)
+	truncated[2] |= 0x02 // TC bit
+	if _, ok := cacheTTL(truncated); ok {
+		t.Error("truncated response is cacheable")
+	}
+}
+
+func TestResponseCache(t *testing.T) {
+	c := newResponseCache()
+	now := time.Unix(1000, 0)
+	c.now = func() time.Time { return now }
+
+	const route = dnsname.FQDN(".")
+	query := cacheQuery(t, 42, "A.Example.com.", dns.TypeA)
+	k, ok := cacheKeyFor(query, route)
+	if !ok {
+		t.Fatal("query not cacheable")
+	}
+	if _, ok := c.get(k, query); ok {
+		t.Fatal("hit in empty cache")
+	}
+	c.put(k, cacheResponse(t, "a.example.com.", dns.RCodeSuccess, []dns.Resource{aRecord("a.example.com.", 60)}, nil))
+
+	// A query differing only in case and ID is answered from the
+	// cache, with its own ID and question, and an aged TTL.
+	now = now.Add(25 * time.Second)
+	query2 := cacheQuery(t, 43, "a.EXAMPLE.com.", dns.TypeA)
+	k2, _ := cacheKeyFor(query2, route)
+	resp, ok := c.get(k2, query2)
+	if !ok {
+		t.Fatal("miss; want hit")
+	}
+	var msg dns.Message
+	if err := msg.Unpack(resp); err != nil {
+		t.Fatal(err)
+	}
+	if msg.ID != 43 {
+		t.Errorf("ID = %d; want 43", msg.ID)
+	}
+	if got := msg.Questions[0].Name.String(); got != "a.EXAMPLE.com." {
+		t.Errorf("question = %q; want the query's", got)
+	}
+	if got := msg.Answers[0].Header.TTL; got != 35 {
+		t.Errorf("TTL = %d; want 35", got)
+	}
+
+	// Other types and routes are cached separately.
+	kAAAA, _ := cacheKeyFor(cacheQuery(t, 44, "a.example.com.", dns.TypeAAAA), route)
+	if _, ok := c.get(kAAAA, query); ok {
+		t.Error("AAAA query hit A response")
+	}
+	kOther, _ := cacheKeyFor(query, "example.com.")
+	if _, ok := c.get(kOther, query); ok {
+		t.Error("query by another route hit")
+	}
+
+	// The entry expires with its TTL.
+	now = now.Add(35 * time.Second)
+	if _, ok := c.get(k, query); ok {
+		t.Error("hit after TTL expired")
+	}
+	if n := c.len(); n != 0 {
+		t.Errorf("len = %d after expiry; want 0", n)
+	}
+}
+
+func TestResponseCacheLimit(t *testing.T) {
+	c := newResponseCache()
+	c.max = 2
+	const route = dnsname.FQDN(".")
+	keys := make([]cacheKey, 3)
+	queries := make([][]byte, 3)
+	for i, name := range []string{"a.example.com.", "b.example.com.", "c.example.com."} {
+		queries[i] = cacheQuery(t, 1, name, dns.TypeA)
+		keys[i], _ = cacheKeyFor(queries[i], route)
+		c.put(keys[i], cacheResponse(t, name, dns.RCodeSuccess, []dns.Resource{aRecord(name, 60)}, nil))
+		if i == 1 {
+			// Use a, so b is least recently used.
+			c.get(keys[0], queries[0])
+		}
+	}
+	if n := c.len(); n != 2 {
+		t.Errorf("len = %d; want 2", n)
+	}
+	if _, ok := c.get(keys[1], queries[1]); ok {
+		t.Error("least recently used entry not evicted")
+	}
+	for _, i := range []int{0, 2} {
+		if _, ok := c.get(keys[i], queries[i]); !ok {
+			t.Errorf("entry %d evicted", i)
+		}
+	}
+}
+
+func TestCacheFlushedOnSetRoutes(t *testing.T) {
+	f := newForwarder(t.Logf, nil, nil, nil)
+	defer f.Close()
+	query := cacheQuery(t, 1, "a.example.com.", dns.TypeA)
+	k, _ := cacheKeyFor(query, ".")
+	f.cache.put(k, cacheResponse(t, "a.example.com.", dns.RCodeSuccess, []dns.Resource{aRecord("a.example.com.", 60)}, nil))
+	if n := f.cache.len(); n != 1 {
+		t.Fatalf("len = %d; want 1", n)
+	}
+	f.setRoutes(map[dnsname.FQDN][]dnstype.Resolver{
+		".": {{Addr: "8.8.8.8:53"}},
+	})
+	if n := f.cache.len(); n != 0 {
+		t.Errorf("len = %d after setRoutes; want 0", n)
+	}
+}
+
+func TestCacheKeyFor(t *testing.T) {
+	if _, ok := cacheKeyFor([]byte{1, 2}, "."); ok {
+		t.Error("short packet is cacheable")
+	}
+	resp := cacheResponse(t, "a.example.com.", dns.RCodeSuccess, nil, nil)
+	if _, ok := cacheKeyFor(resp, "."); ok {
+		t.Error("response packet is cacheable")
+	}
+	msg := dns.Message{
+		Questions: []dns.Question{
+			{Name: dns.MustNewName("a.example.com."), Type: dns.TypeA, Class: dns.ClassINET},
+			{Name: dns.MustNewName("b.example.com."), Type: dns.TypeA, Class: dns.ClassINET},
+		},
+	}
+	two, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cacheKeyFor(two, "."); ok {
+		t.Error("query with two questions is cacheable")
+	}
+
+	// Queries with the DO or CD bits set get different responses,
+	// so they're cached separately.
+	plain := cacheQuery(t, 1, "a.example.com.", dns.TypeA)
+	msg = dns.Message{
+		Header:    dns.Header{ID: 1, RecursionDesired: true},
+		Questions: []dns.Question{{Name: dns.MustNewName("a.example.com."), Type: dns.TypeA, Class: dns.ClassINET}},
+		Additionals: []dns.Resource{{
+			Header: dns.ResourceHeader{Name: dns.MustNewName("."), Type: dns.TypeOPT, Class: 4096, TTL: 0x8000},
+			Body:   &dns.OPTResource{},
+		}},
+	}
+	withDO, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Additionals[0].Header.TTL = 0
+	withEDNS, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	withCD := append([]byte(nil), plain...)
+	withCD[3] |= 0x10
+
+	kPlain, ok := cacheKeyFor(plain, ".")
+	if !ok || kPlain.do || kPlain.cd {
+		t.Fatalf("plain query key = %+v, %v", kPlain, ok)
+	}
+	if k, ok := cacheKeyFor(withEDNS, "."); !ok || k != kPlain {
+		t.Errorf("EDNS query without DO key = %+v, %v; want %+v", k, ok, kPlain)
+	}
+	if k, ok := cacheKeyFor(withDO, "."); !ok || !k.do || k.cd {
+		t.Errorf("DO query key = %+v, %v; want do", k, ok)
+	}
+	if k, ok := cacheKeyFor(withCD, "."); !ok || k.do || !k.cd {
+		t.Errorf("CD query key = %+v, %v; want cd", k, ok)
+	}
+}
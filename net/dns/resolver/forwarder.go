@@ -9,6 +9,7 @@ import (
 	"context"
 	"encoding/binary"
 	"errors"
+	"expvar"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -25,6 +26,8 @@ import (
 	dns "golang.org/x/net/dns/dnsmessage"
 	"inet.af/netaddr"
 	"tailscale.com/hostinfo"
+	"tailscale.com/metrics"
+	"tailscale.com/net/interfaces"
 	"tailscale.com/net/netns"
 	"tailscale.com/types/dnstype"
 	"tailscale.com/types/logger"
@@ -52,6 +55,14 @@ const (
 
 var errNoUpstreams = errors.New("upstream nameservers not set")
 
+// forwardLatency is the time taken to get answers to forwarded
+// queries from upstream nameservers, in seconds.
+var forwardLatency = metrics.NewHistogram(0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5)
+
+func init() {
+	expvar.Publish("dns_forward_latency_seconds", forwardLatency)
+}
+
 // txid identifies a DNS transaction.
 //
 // As the standard DNS Request ID is only 16 bits, we extend it:
@@ -165,6 +176,11 @@ type forwarder struct {
 	ctx       context.Context    // good until Close
 	ctxCancel context.CancelFunc // closes ctx
 
+	// cache caches responses from upstream nameservers. It's
+	// flushed when the routes or the network change.
+	cache        *responseCache
+	unregLinkMon func() // or nil
+
 	// responses is a channel by which responses are returned.
 	responses chan packet
 
@@ -212,13 +228,26 @@ func newForwarder(logf logger.Logf, responses chan packet, linkMon *monitor.Mon,
 		linkSel:   linkSel,
 		responses: responses,
 		dohSem:    make(chan struct{}, maxDoHInFlight(runtime.GOOS)),
+		cache:     newResponseCache(),
 	}
 	f.ctx, f.ctxCancel = context.WithCancel(context.Background())
+	if linkMon != nil {
+		f.unregLinkMon = linkMon.RegisterChangeCallback(func(changed bool, _ *interfaces.State) {
+			if changed {
+				// Answers may depend on the network we're on,
+				// such as for split-horizon DNS.
+				f.cache.flush()
+			}
+		})
+	}
 	return f
 }
 
 func (f *forwarder) Close() error {
 	f.ctxCancel()
+	if f.unregLinkMon != nil {
+		f.unregLinkMon()
+	}
 	return nil
 }
 
@@ -305,6 +334,7 @@ func (f *forwarder) setRoutes(routesBySuffix map[dnsname.FQDN][]dnstype.Resolver
 	f.mu.Lock()
 	defer f.mu.Unlock()
 	f.routes = routes
+	f.cache.flush()
 }
 
 var stdNetPacketListener packetListener = new(net.ListenConfig)
@@ -509,17 +539,18 @@ func (f *forwarder) send(ctx context.Context, fq *forwardQuery, rr resolverAndDe
 	return out, nil
 }
 
-// resolvers returns the resolvers to use for domain.
-func (f *forwarder) resolvers(domain dnsname.FQDN) []resolverAndDelay {
+// resolvers returns the resolvers to use for domain, and the suffix
+// of the route they're from.
+func (f *forwarder) resolvers(domain dnsname.FQDN) (suffix dnsname.FQDN, rr []resolverAndDelay) {
 	f.mu.Lock()
 	routes := f.routes
 	f.mu.Unlock()
 	for _, route := range routes {
 		if route.Suffix == "." || route.Suffix.Contains(domain) {
-			return route.Resolvers
+			return route.Suffix, route.Resolvers
 		}
 	}
-	return nil
+	return "", nil
 }
 
 // forwardQuery is information and state about a forwarded DNS query that's
@@ -563,11 +594,23 @@ func (f *forwarder) forward(query packet) error {
 
 	clampEDNSSize(query.bs, maxResponseBytes)
 
-	resolvers := f.resolvers(domain)
+	suffix, resolvers := f.resolvers(domain)
 	if len(resolvers) == 0 {
 		return errNoUpstreams
 	}
 
+	ck, cacheable := cacheKeyFor(query.bs, suffix)
+	if cacheable {
+		if resp, ok := f.cache.get(ck, query.bs); ok {
+			select {
+			case <-f.ctx.Done():
+				return f.ctx.Err()
+			case f.responses <- packet{resp, query.addr}:
+				return nil
+			}
+		}
+	}
+
 	fq := &forwardQuery{
 		txid:           getTxID(query.bs),
 		packet:         query.bs,
@@ -578,6 +621,7 @@ func (f *forwarder) forward(query packet) error {
 	ctx, cancel := context.WithTimeout(f.ctx, responseTimeout)
 	defer cancel()
 
+	start := time.Now()
 	resc := make(chan []byte, 1)
 	var (
 		mu       sync.Mutex
@@ -613,6 +657,10 @@ func (f *forwarder) forward(query packet) error {
 
 	select {
 	case v := <-resc:
+		forwardLatency.Observe(time.Since(start).Seconds())
+		if cacheable {
+			f.cache.put(ck, v)
+		}
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
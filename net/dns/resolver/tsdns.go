@@ -14,6 +14,7 @@ import (
 	"io"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -66,7 +67,7 @@ type packet struct {
 
 // Config is a resolver configuration.
 // Given a Config, queries are resolved in the following order:
-// If the query is an exact match for an entry in LocalHosts, return that.
+// If the query is an exact match for an entry in Hosts or Records, return that.
 // Else if the query suffix matches an entry in LocalDomains, return NXDOMAIN.
 // Else forward the query to the most specific matching entry in Routes.
 // Else return SERVFAIL.
@@ -78,6 +79,10 @@ type Config struct {
 	Routes map[dnsname.FQDN][]dnstype.Resolver
 	// LocalHosts is a map of FQDNs to corresponding IPs.
 	Hosts map[dnsname.FQDN][]netaddr.IP
+	// Records is a map of FQDNs to their SRV, TXT and CNAME records.
+	// A name with a CNAME record must have no other records,
+	// including addresses in Hosts.
+	Records map[dnsname.FQDN][]Record
 	// LocalDomains is a list of DNS name suffixes that should not be
 	// routed to upstream resolvers.
 	LocalDomains []dnsname.FQDN
@@ -88,7 +93,7 @@ type Config struct {
 func (c *Config) WriteToBufioWriter(w *bufio.Writer) {
 	w.WriteString("{Routes:")
 	WriteRoutes(w, c.Routes)
-	fmt.Fprintf(w, " Hosts:%v LocalDomains:[", len(c.Hosts))
+	fmt.Fprintf(w, " Hosts:%v Records:%v LocalDomains:[", len(c.Hosts), len(c.Records))
 	space := false
 	arpa := 0
 	for _, d := range c.LocalDomains {
@@ -109,6 +114,80 @@ func (c *Config) WriteToBufioWriter(w *bufio.Writer) {
 	w.WriteString("}")
 }
 
+// Record is a DNS record, other than an address, served by the
+// resolver from its local zone.
+type Record struct {
+	// Type is the record type: dns.TypeSRV, dns.TypeTXT or
+	// dns.TypeCNAME.
+	Type dns.Type
+
+	// Target is the target of an SRV or CNAME record.
+	Target dnsname.FQDN
+
+	// Priority, Weight and Port are the remaining fields of an SRV
+	// record.
+	Priority uint16
+	Weight   uint16
+	Port     uint16
+
+	// TXT is the strings of a TXT record, each at most 255 bytes.
+	TXT []string
+}
+
+// ParseRecord parses the value of a record of type typ, which is one
+// of "SRV", "TXT" or "CNAME", as sent by the control plane in a
+// tailcfg.DNSRecord:
+//
+//   SRV:   "priority weight port target", as in a zone file
+//   TXT:   the text, which is split into strings of at most 255 bytes
+//   CNAME: the target name
+func ParseRecord(typ, value string) (Record, error) {
+	switch typ {
+	case "SRV":
+		f := strings.Fields(value)
+		if len(f) != 4 {
+			return Record{}, fmt.Errorf("SRV value %q is not of the form \"priority weight port target\"", value)
+		}
+		var nums [3]uint16
+		for i := range nums {
+			n, err := strconv.ParseUint(f[i], 10, 16)
+			if err != nil {
+				return Record{}, fmt.Errorf("SRV value %q: %w", value, err)
+			}
+			nums[i] = uint16(n)
+		}
+		target, err := dnsname.ToFQDN(f[3])
+		if err != nil {
+			return Record{}, err
+		}
+		return Record{
+			Type:     dns.TypeSRV,
+			Priority: nums[0],
+			Weight:   nums[1],
+			Port:     nums[2],
+			Target:   target,
+		}, nil
+	case "TXT":
+		var txt []string
+		for len(value) > 255 {
+			txt = append(txt, value[:255])
+			value = value[255:]
+		}
+		txt = append(txt, value)
+		return Record{Type: dns.TypeTXT, TXT: txt}, nil
+	case "CNAME":
+		target, err := dnsname.ToFQDN(value)
+		if err != nil {
+			return Record{}, err
+		}
+		if target == "." {
+			return Record{}, errors.New("empty CNAME target")
+		}
+		return Record{Type: dns.TypeCNAME, Target: target}, nil
+	}
+	return Record{}, fmt.Errorf("unsupported record type %q", typ)
+}
+
 // WriteIPPorts writes vv to w.
 func WriteIPPorts(w *bufio.Writer, vv []netaddr.IPPort) {
 	w.WriteByte('[')
@@ -200,10 +279,11 @@ type Resolver struct {
 	wg sync.WaitGroup
 
 	// mu guards the following fields from being updated while used.
-	mu           sync.Mutex
-	localDomains []dnsname.FQDN
-	hostToIP     map[dnsname.FQDN][]netaddr.IP
-	ipToHost     map[netaddr.IP]dnsname.FQDN
+	mu            sync.Mutex
+	localDomains  []dnsname.FQDN
+	hostToIP      map[dnsname.FQDN][]netaddr.IP
+	ipToHost      map[netaddr.IP]dnsname.FQDN
+	nameToRecords map[dnsname.FQDN][]Record
 }
 
 type ForwardLinkSelector interface {
@@ -244,6 +324,23 @@ func (r *Resolver) SetConfig(cfg Config) error {
 		}
 	}
 
+	records := make(map[dnsname.FQDN][]Record, len(cfg.Records))
+	for name, recs := range cfg.Records {
+		records[name] = recs
+		for _, rec := range recs {
+			if rec.Type != dns.TypeCNAME {
+				continue
+			}
+			if len(recs) > 1 || len(cfg.Hosts[name]) > 0 {
+				// A CNAME record must be the only record at its
+				// name (RFC 1034, section 3.6.2). Serve the others.
+				r.logf("ignoring CNAME record for %v, which has other records", name)
+				records[name] = withoutCNAMEs(recs)
+			}
+			break
+		}
+	}
+
 	r.forwarder.setRoutes(cfg.Routes)
 
 	r.mu.Lock()
@@ -251,9 +348,21 @@ func (r *Resolver) SetConfig(cfg Config) error {
 	r.localDomains = cfg.LocalDomains
 	r.hostToIP = cfg.Hosts
 	r.ipToHost = reverse
+	r.nameToRecords = records
 	return nil
 }
 
+// withoutCNAMEs returns a copy of recs without its CNAME records.
+func withoutCNAMEs(recs []Record) []Record {
+	var ret []Record
+	for _, rec := range recs {
+		if rec.Type != dns.TypeCNAME {
+			ret = append(ret, rec)
+		}
+	}
+	return ret
+}
+
 // Close shuts down the resolver and ensures poll goroutines have exited.
 // The Resolver cannot be used again after Close is called.
 func (r *Resolver) Close() {
@@ -298,80 +407,87 @@ func (r *Resolver) NextResponse() (packet []byte, to netaddr.IPPort, err error)
 	}
 }
 
-// resolveLocal returns an IP for the given domain, if domain is in
-// the local hosts map and has an IP corresponding to the requested
-// typ (A, AAAA, ALL).
+// maxCNAMEChain is the maximum number of CNAME records resolveLocal
+// follows within the local zone before giving up on a probable loop.
+const maxCNAMEChain = 8
+
+// localAnswer is the local zone's answer to a query.
+type localAnswer struct {
+	// CNAMEs is the chain of CNAME targets followed from the queried
+	// name, if it has a CNAME record. IPs and Records then belong to
+	// the last target. A target outside the local zone has neither.
+	CNAMEs []dnsname.FQDN
+	// IPs are the name's addresses, of both families. Only those
+	// matching the query type are served.
+	IPs []netaddr.IP
+	// Records are the name's other records. Only those matching the
+	// query type are served.
+	Records []Record
+}
+
+// resolveLocal returns the records for the given domain, if domain
+// is in the local hosts or records maps. marshalResponse serves those
+// matching the requested typ.
 // Returns dns.RCodeRefused to indicate that the local map is not
 // authoritative for domain.
-func (r *Resolver) resolveLocal(domain dnsname.FQDN, typ dns.Type) (netaddr.IP, dns.RCode) {
+func (r *Resolver) resolveLocal(domain dnsname.FQDN, typ dns.Type) (localAnswer, dns.RCode) {
 	// Reject .onion domains per RFC 7686.
 	if dnsname.HasSuffix(domain.WithoutTrailingDot(), ".onion") {
-		return netaddr.IP{}, dns.RCodeNameError
+		return localAnswer{}, dns.RCodeNameError
 	}
 
 	r.mu.Lock()
 	hosts := r.hostToIP
+	records := r.nameToRecords
 	localDomains := r.localDomains
 	r.mu.Unlock()
 
 	addrs, found := hosts[domain]
-	if !found {
+	recs, foundRecs := records[domain]
+	if !found && !foundRecs {
 		for _, suffix := range localDomains {
 			if suffix.Contains(domain) {
 				// We are authoritative for the queried domain.
-				return netaddr.IP{}, dns.RCodeNameError
+				return localAnswer{}, dns.RCodeNameError
 			}
 		}
 		// Not authoritative, signal that forwarding is advisable.
-		return netaddr.IP{}, dns.RCodeRefused
+		return localAnswer{}, dns.RCodeRefused
 	}
 
 	// Refactoring note: this must happen after we check suffixes,
 	// otherwise we will respond with NOTIMP to requests that should be forwarded.
-	//
-	// DNS semantics subtlety: when a DNS name exists, but no records
-	// are available for the requested record type, we must return
-	// RCodeSuccess with no data, not NXDOMAIN.
 	switch typ {
-	case dns.TypeA:
-		for _, ip := range addrs {
-			if ip.Is4() {
-				return ip, dns.RCodeSuccess
-			}
-		}
-		return netaddr.IP{}, dns.RCodeSuccess
-	case dns.TypeAAAA:
-		for _, ip := range addrs {
-			if ip.Is6() {
-				return ip, dns.RCodeSuccess
-			}
-		}
-		return netaddr.IP{}, dns.RCodeSuccess
-	case dns.TypeALL:
-		// Answer with whatever we've got.
-		// It could be IPv4, IPv6, or a zero addr.
-		// TODO: Return all available resolutions (A and AAAA, if we have them).
-		if len(addrs) == 0 {
-			return netaddr.IP{}, dns.RCodeSuccess
-		}
-		return addrs[0], dns.RCodeSuccess
-
 	// Leave some some record types explicitly unimplemented.
 	// These types relate to recursive resolution or special
 	// DNS semantics and might be implemented in the future.
 	case dns.TypeNS, dns.TypeSOA, dns.TypeAXFR, dns.TypeHINFO:
-		return netaddr.IP{}, dns.RCodeNotImplemented
+		return localAnswer{}, dns.RCodeNotImplemented
+	}
 
-	// For everything except for the few types above that are explicitly not implemented, return no records.
-	// This is what other DNS systems do: always return NOERROR
-	// without any records whenever the requested record type is unknown.
+	ans := localAnswer{IPs: addrs, Records: recs}
+	// Follow CNAMEs, unless the CNAME itself was asked for. SetConfig
+	// ensures a CNAME record is alone at its name.
+	for typ != dns.TypeCNAME && len(ans.Records) == 1 && ans.Records[0].Type == dns.TypeCNAME {
+		if len(ans.CNAMEs) == maxCNAMEChain {
+			r.logf("CNAME chain from %v too long", domain)
+			return localAnswer{}, dns.RCodeServerFailure
+		}
+		target := ans.Records[0].Target
+		ans.CNAMEs = append(ans.CNAMEs, target)
+		ans.IPs, ans.Records = hosts[target], records[target]
+	}
+
+	// DNS semantics subtlety: when a DNS name exists, but no records
+	// are available for the requested record type, we must return
+	// RCodeSuccess with no data, not NXDOMAIN.
+	//
+	// This is also what other DNS systems do for record types they
+	// don't know: always return NOERROR without any records.
 	// You can try this with:
 	//   dig -t TYPE9824 example.com
 	// and note that NOERROR is returned, despite that record type being made up.
-	default:
-		// The name exists, but no records exist of the requested type.
-		return netaddr.IP{}, dns.RCodeSuccess
-	}
+	return ans, dns.RCodeSuccess
 }
 
 // resolveReverse returns the unique domain name that maps to the given address.
@@ -436,8 +552,8 @@ type response struct {
 	Question dns.Question
 	// Name is the response to a PTR query.
 	Name dnsname.FQDN
-	// IP is the response to an A, AAAA, or ALL query.
-	IP netaddr.IP
+	// Answer is the response to any other query.
+	Answer localAnswer
 }
 
 var dnsParserPool = &sync.Pool{
@@ -531,6 +647,106 @@ func marshalPTRRecord(queryName dns.Name, name dnsname.FQDN, builder *dns.Builde
 	return builder.PTRResource(answerHeader, answer)
 }
 
+// marshalSRVRecord serializes an SRV record into an active builder.
+// The caller may continue using the builder following the call.
+func marshalSRVRecord(queryName dns.Name, rec Record, builder *dns.Builder) error {
+	answer := dns.SRVResource{
+		Priority: rec.Priority,
+		Weight:   rec.Weight,
+		Port:     rec.Port,
+	}
+	var err error
+
+	answerHeader := dns.ResourceHeader{
+		Name:  queryName,
+		Type:  dns.TypeSRV,
+		Class: dns.ClassINET,
+		TTL:   uint32(defaultTTL / time.Second),
+	}
+	answer.Target, err = dns.NewName(rec.Target.WithTrailingDot())
+	if err != nil {
+		return err
+	}
+	return builder.SRVResource(answerHeader, answer)
+}
+
+// marshalTXTRecord serializes a TXT record into an active builder.
+// The caller may continue using the builder following the call.
+func marshalTXTRecord(queryName dns.Name, txt []string, builder *dns.Builder) error {
+	answerHeader := dns.ResourceHeader{
+		Name:  queryName,
+		Type:  dns.TypeTXT,
+		Class: dns.ClassINET,
+		TTL:   uint32(defaultTTL / time.Second),
+	}
+	return builder.TXTResource(answerHeader, dns.TXTResource{TXT: txt})
+}
+
+// marshalCNAMERecord serializes a CNAME record into an active builder.
+// The caller may continue using the builder following the call.
+func marshalCNAMERecord(queryName dns.Name, target dnsname.FQDN, builder *dns.Builder) error {
+	var answer dns.CNAMEResource
+	var err error
+
+	answerHeader := dns.ResourceHeader{
+		Name:  queryName,
+		Type:  dns.TypeCNAME,
+		Class: dns.ClassINET,
+		TTL:   uint32(defaultTTL / time.Second),
+	}
+	answer.CNAME, err = dns.NewName(target.WithTrailingDot())
+	if err != nil {
+		return err
+	}
+	return builder.CNAMEResource(answerHeader, answer)
+}
+
+// marshalLocalAnswer serializes the records of ans matching typ, the
+// type of the query for name, into an active builder.
+// The caller may continue using the builder following the call.
+func marshalLocalAnswer(name dns.Name, typ dns.Type, ans localAnswer, builder *dns.Builder) error {
+	for _, target := range ans.CNAMEs {
+		if err := marshalCNAMERecord(name, target, builder); err != nil {
+			return err
+		}
+		var err error
+		name, err = dns.NewName(target.WithTrailingDot())
+		if err != nil {
+			return err
+		}
+	}
+	for _, ip := range ans.IPs {
+		var err error
+		switch {
+		case ip.Is4() && (typ == dns.TypeA || typ == dns.TypeALL):
+			err = marshalARecord(name, ip, builder)
+		case ip.Is6() && (typ == dns.TypeAAAA || typ == dns.TypeALL):
+			err = marshalAAAARecord(name, ip, builder)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for _, rec := range ans.Records {
+		if rec.Type != typ && typ != dns.TypeALL {
+			continue
+		}
+		var err error
+		switch rec.Type {
+		case dns.TypeSRV:
+			err = marshalSRVRecord(name, rec, builder)
+		case dns.TypeTXT:
+			err = marshalTXTRecord(name, rec.TXT, builder)
+		case dns.TypeCNAME:
+			err = marshalCNAMERecord(name, rec.Target, builder)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // marshalResponse serializes the DNS response into a new buffer.
 func marshalResponse(resp *response) ([]byte, error) {
 	resp.Header.Response = true
@@ -566,14 +782,10 @@ func marshalResponse(resp *response) ([]byte, error) {
 	}
 
 	switch resp.Question.Type {
-	case dns.TypeA, dns.TypeAAAA, dns.TypeALL:
-		if resp.IP.Is4() {
-			err = marshalARecord(resp.Question.Name, resp.IP, &builder)
-		} else if resp.IP.Is6() {
-			err = marshalAAAARecord(resp.Question.Name, resp.IP, &builder)
-		}
 	case dns.TypePTR:
 		err = marshalPTRRecord(resp.Question.Name, resp.Name, &builder)
+	default:
+		err = marshalLocalAnswer(resp.Question.Name, resp.Question.Type, resp.Answer, &builder)
 	}
 	if err != nil {
 		return nil, err
@@ -740,13 +952,13 @@ func (r *Resolver) respond(query []byte) ([]byte, error) {
 		return r.respondReverse(query, name, parser.response())
 	}
 
-	ip, rcode := r.resolveLocal(name, parser.Question.Type)
+	ans, rcode := r.resolveLocal(name, parser.Question.Type)
 	if rcode == dns.RCodeRefused {
 		return nil, errNotOurName // sentinel error return value: it requests forwarding
 	}
 
 	resp := parser.response()
 	resp.Header.RCode = rcode
-	resp.IP = ip
+	resp.Answer = ans
 	return marshalResponse(resp)
 }
@@ -11,6 +11,7 @@ import (
 	"fmt"
 	"math/rand"
 	"net"
+	"reflect"
 	"runtime"
 	"strconv"
 	"strings"
@@ -339,10 +340,17 @@ func TestResolveLocal(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			ip, code := r.resolveLocal(tt.qname, tt.qtype)
+			ans, code := r.resolveLocal(tt.qname, tt.qtype)
 			if code != tt.code {
 				t.Errorf("code = %v; want %v", code, tt.code)
 			}
+			var ip netaddr.IP
+			for _, a := range ans.IPs {
+				if (tt.qtype == dns.TypeA && a.Is4()) || (tt.qtype == dns.TypeAAAA && a.Is6()) {
+					ip = a
+					break
+				}
+			}
 			// Only check ip for non-err
 			if ip != tt.ip {
 				t.Errorf("ip = %v; want %v", ip, tt.ip)
@@ -351,6 +359,155 @@ func TestResolveLocal(t *testing.T) {
 	}
 }
 
+// answerStrings returns the rcode of the DNS response payload and its
+// answers, formatted as "name TYPE data".
+func answerStrings(t *testing.T, payload []byte) (dns.RCode, []string) {
+	t.Helper()
+	var msg dns.Message
+	if err := msg.Unpack(payload); err != nil {
+		t.Fatal(err)
+	}
+	var ret []string
+	for _, rr := range msg.Answers {
+		var data string
+		switch b := rr.Body.(type) {
+		case *dns.AResource:
+			data = netaddr.IPv4(b.A[0], b.A[1], b.A[2], b.A[3]).String()
+		case *dns.AAAAResource:
+			data = netaddr.IPFrom16(b.AAAA).String()
+		case *dns.SRVResource:
+			data = fmt.Sprintf("%d %d %d %s", b.Priority, b.Weight, b.Port, b.Target)
+		case *dns.TXTResource:
+			data = fmt.Sprintf("%q", b.TXT)
+		case *dns.CNAMEResource:
+			data = b.CNAME.String()
+		default:
+			t.Fatalf("unexpected answer %v", rr)
+		}
+		ret = append(ret, fmt.Sprintf("%s %s %s", rr.Header.Name, strings.TrimPrefix(rr.Header.Type.String(), "Type"), data))
+	}
+	return msg.RCode, ret
+}
+
+func TestResolveLocalRecords(t *testing.T) {
+	r := newResolver(t)
+	defer r.Close()
+
+	r.SetConfig(Config{
+		Hosts: map[dnsname.FQDN][]netaddr.IP{
+			"test1.ipn.dev.": {testipv4},
+			"multi.ipn.dev.": {mustIP("1.2.3.5"), mustIP("1.2.3.6"), mustIP("fd7a::5")},
+		},
+		Records: map[dnsname.FQDN][]Record{
+			"_http._tcp.ipn.dev.": {
+				{Type: dns.TypeSRV, Priority: 10, Weight: 5, Port: 8080, Target: "test1.ipn.dev."},
+				{Type: dns.TypeSRV, Priority: 20, Weight: 5, Port: 8080, Target: "multi.ipn.dev."},
+			},
+			"test1.ipn.dev.":    {{Type: dns.TypeTXT, TXT: []string{"v=1", "x"}}},
+			"www.ipn.dev.":      {{Type: dns.TypeCNAME, Target: "multi.ipn.dev."}},
+			"ext.ipn.dev.":      {{Type: dns.TypeCNAME, Target: "example.com."}},
+			"loop1.ipn.dev.":    {{Type: dns.TypeCNAME, Target: "loop2.ipn.dev."}},
+			"loop2.ipn.dev.":    {{Type: dns.TypeCNAME, Target: "loop1.ipn.dev."}},
+			"conflict.ipn.dev.": {{Type: dns.TypeCNAME, Target: "example.com."}, {Type: dns.TypeTXT, TXT: []string{"kept"}}},
+		},
+		LocalDomains: []dnsname.FQDN{"ipn.dev."},
+	})
+
+	tests := []struct {
+		name  string
+		qname dnsname.FQDN
+		qtype dns.Type
+		code  dns.RCode
+		want  []string
+	}{
+		{"multi-a", "multi.ipn.dev.", dns.TypeA, dns.RCodeSuccess, []string{
+			"multi.ipn.dev. A 1.2.3.5",
+			"multi.ipn.dev. A 1.2.3.6",
+		}},
+		{"multi-aaaa", "multi.ipn.dev.", dns.TypeAAAA, dns.RCodeSuccess, []string{
+			"multi.ipn.dev. AAAA fd7a::5",
+		}},
+		{"multi-all", "multi.ipn.dev.", dns.TypeALL, dns.RCodeSuccess, []string{
+			"multi.ipn.dev. A 1.2.3.5",
+			"multi.ipn.dev. A 1.2.3.6",
+			"multi.ipn.dev. AAAA fd7a::5",
+		}},
+		{"srv", "_http._tcp.ipn.dev.", dns.TypeSRV, dns.RCodeSuccess, []string{
+			"_http._tcp.ipn.dev. SRV 10 5 8080 test1.ipn.dev.",
+			"_http._tcp.ipn.dev. SRV 20 5 8080 multi.ipn.dev.",
+		}},
+		{"txt", "test1.ipn.dev.", dns.TypeTXT, dns.RCodeSuccess, []string{
+			`test1.ipn.dev. TXT ["v=1" "x"]`,
+		}},
+		{"txt-with-a", "test1.ipn.dev.", dns.TypeA, dns.RCodeSuccess, []string{
+			"test1.ipn.dev. A 1.2.3.4",
+		}},
+		{"no-srv", "test1.ipn.dev.", dns.TypeSRV, dns.RCodeSuccess, nil},
+		{"cname-followed", "www.ipn.dev.", dns.TypeA, dns.RCodeSuccess, []string{
+			"www.ipn.dev. CNAME multi.ipn.dev.",
+			"multi.ipn.dev. A 1.2.3.5",
+			"multi.ipn.dev. A 1.2.3.6",
+		}},
+		{"cname-query", "www.ipn.dev.", dns.TypeCNAME, dns.RCodeSuccess, []string{
+			"www.ipn.dev. CNAME multi.ipn.dev.",
+		}},
+		{"cname-external", "ext.ipn.dev.", dns.TypeA, dns.RCodeSuccess, []string{
+			"ext.ipn.dev. CNAME example.com.",
+		}},
+		{"cname-loop", "loop1.ipn.dev.", dns.TypeA, dns.RCodeServerFailure, nil},
+		{"cname-conflict", "conflict.ipn.dev.", dns.TypeTXT, dns.RCodeSuccess, []string{
+			`conflict.ipn.dev. TXT ["kept"]`,
+		}},
+		{"cname-conflict-a", "conflict.ipn.dev.", dns.TypeA, dns.RCodeSuccess, nil},
+		{"nxdomain", "nx.ipn.dev.", dns.TypeSRV, dns.RCodeNameError, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := syncRespond(r, dnspacket(tt.qname, tt.qtype, noEdns))
+			if err != nil {
+				t.Fatal(err)
+			}
+			code, got := answerStrings(t, resp)
+			if code != tt.code {
+				t.Errorf("code = %v; want %v", code, tt.code)
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("answers:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestParseRecord(t *testing.T) {
+	long := strings.Repeat("a", 300)
+	tests := []struct {
+		typ, value string
+		want       Record
+		wantErr    bool
+	}{
+		{typ: "SRV", value: "10 5 5060 sip.example.com", want: Record{Type: dns.TypeSRV, Priority: 10, Weight: 5, Port: 5060, Target: "sip.example.com."}},
+		{typ: "SRV", value: "0 0 0 .", want: Record{Type: dns.TypeSRV, Target: "."}},
+		{typ: "SRV", value: "10 5 sip.example.com", wantErr: true},
+		{typ: "SRV", value: "10 5 65536 sip.example.com", wantErr: true},
+		{typ: "TXT", value: "v=spf1 -all", want: Record{Type: dns.TypeTXT, TXT: []string{"v=spf1 -all"}}},
+		{typ: "TXT", value: long, want: Record{Type: dns.TypeTXT, TXT: []string{long[:255], long[255:]}}},
+		{typ: "CNAME", value: "foo.example.com", want: Record{Type: dns.TypeCNAME, Target: "foo.example.com."}},
+		{typ: "CNAME", value: "", wantErr: true},
+		{typ: "MX", value: "10 mx.example.com", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseRecord(tt.typ, tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseRecord(%q, %q) error = %v; wantErr %v", tt.typ, tt.value, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseRecord(%q, %q) = %+v; want %+v", tt.typ, tt.value, got, tt.want)
+		}
+	}
+}
+
 func TestResolveLocalReverse(t *testing.T) {
 	r := newResolver(t)
 	defer r.Close()
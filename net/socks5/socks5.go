@@ -14,13 +14,18 @@
 package socks5
 
 import (
+	"bytes"
 	"context"
+	"crypto/subtle"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"strconv"
+	"sync"
 	"time"
 
 	"tailscale.com/types/logger"
@@ -28,11 +33,32 @@ import (
 
 const (
 	noAuthRequired   byte = 0
+	passwordAuth     byte = 2
 	noAcceptableAuth byte = 255
 
 	// socks5Version is the byte that represents the SOCKS version
 	// in requests.
 	socks5Version byte = 5
+
+	// passwordAuthVersion is the version of the username/password
+	// authentication subnegotiation, as described in RFC 1929.
+	passwordAuthVersion byte = 1
+	passwordAuthSuccess byte = 0
+	passwordAuthFailure byte = 1
+)
+
+const (
+	// bindTimeout is how long a BIND request waits for the incoming
+	// connection.
+	bindTimeout = 2 * time.Minute
+
+	// maxUDPPacketSize is the largest UDP datagram relayed, including
+	// the SOCKS5 UDP request header.
+	maxUDPPacketSize = 1 << 16
+
+	// maxUDPDestinations is the most destinations one UDP
+	// association relays to at once.
+	maxUDPDestinations = 64
 )
 
 // commandType are the bytes sent in SOCKS5 packets
@@ -83,7 +109,22 @@ type Server struct {
 
 	// Dialer optionally specifies the dialer to use for outgoing connections.
 	// If nil, the net package's standard dialer is used.
+	//
+	// It's called with network "tcp" for CONNECT requests, and
+	// "udp" for each destination of a UDP ASSOCIATE request.
 	Dialer func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// Listen optionally specifies how to listen for the incoming
+	// connection of a BIND request. It's called with network "tcp"
+	// and the address of the host expected to connect.
+	// If nil, the net package's Listen is used, on all addresses.
+	Listen func(ctx context.Context, network, remoteAddr string) (net.Listener, error)
+
+	// Username and Password, if either is non-empty, are the
+	// credentials clients must authenticate with, as described in
+	// RFC 1929. Otherwise, no authentication is required.
+	Username string
+	Password string
 }
 
 func (s *Server) dial(ctx context.Context, network, addr string) (net.Conn, error) {
@@ -95,6 +136,18 @@ func (s *Server) dial(ctx context.Context, network, addr string) (net.Conn, erro
 	return dial(ctx, network, addr)
 }
 
+func (s *Server) listen(ctx context.Context, network, remoteAddr string) (net.Listener, error) {
+	if s.Listen != nil {
+		return s.Listen(ctx, network, remoteAddr)
+	}
+	var lc net.ListenConfig
+	return lc.Listen(ctx, network, ":0")
+}
+
+func (s *Server) requiresAuth() bool {
+	return s.Username != "" || s.Password != ""
+}
+
 func (s *Server) logf(format string, args ...interface{}) {
 	logf := s.Logf
 	if logf == nil {
@@ -112,11 +165,11 @@ func (s *Server) Serve(l net.Listener) error {
 			return err
 		}
 		go func() {
+			defer c.Close()
 			conn := &Conn{clientConn: c, srv: s}
 			err := conn.Run()
 			if err != nil {
 				s.logf("client connection failed: %v", err)
-				conn.clientConn.Close()
 			}
 		}()
 	}
@@ -135,31 +188,100 @@ type Conn struct {
 
 // Run starts the new connection.
 func (c *Conn) Run() error {
-	err := parseClientGreeting(c.clientConn)
+	method := noAuthRequired
+	if c.srv.requiresAuth() {
+		method = passwordAuth
+	}
+	err := parseClientGreeting(c.clientConn, method)
 	if err != nil {
 		c.clientConn.Write([]byte{socks5Version, noAcceptableAuth})
 		return err
 	}
-	c.clientConn.Write([]byte{socks5Version, noAuthRequired})
+	c.clientConn.Write([]byte{socks5Version, method})
+	if method == passwordAuth {
+		if err := c.authenticate(); err != nil {
+			return err
+		}
+	}
 	return c.handleRequest()
 }
 
+// authenticate reads the client's username and password, and
+// checks them against the server's, as described in RFC 1929.
+func (c *Conn) authenticate() error {
+	user, pass, err := parseClientAuth(c.clientConn)
+	if err != nil {
+		c.clientConn.Write([]byte{passwordAuthVersion, passwordAuthFailure})
+		return err
+	}
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(c.srv.Username)) == 1
+	passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(c.srv.Password)) == 1
+	if !userOK || !passOK {
+		c.clientConn.Write([]byte{passwordAuthVersion, passwordAuthFailure})
+		return fmt.Errorf("authentication failed for user %q", user)
+	}
+	_, err = c.clientConn.Write([]byte{passwordAuthVersion, passwordAuthSuccess})
+	return err
+}
+
+func (c *Conn) writeReply(reply replyCode) {
+	res := &response{reply: reply}
+	buf, _ := res.marshal()
+	c.clientConn.Write(buf)
+}
+
+// writeSuccess writes a success reply with the bound address addr.
+// If addr's IP is unspecified, the address the client reached the
+// server on is used instead, as that's one the client can reach.
+func (c *Conn) writeSuccess(addr net.Addr) error {
+	host, portStr, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		c.writeReply(generalFailure)
+		return err
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		if local, _, err := net.SplitHostPort(c.clientConn.LocalAddr().String()); err == nil {
+			host = local
+		}
+	}
+	port, _ := strconv.Atoi(portStr)
+	res := &response{
+		reply:        success,
+		bindAddrType: addrTypeOf(host),
+		bindAddr:     host,
+		bindPort:     uint16(port),
+	}
+	buf, err := res.marshal()
+	if err != nil {
+		c.writeReply(generalFailure)
+		return err
+	}
+	_, err = c.clientConn.Write(buf)
+	return err
+}
+
 func (c *Conn) handleRequest() error {
 	req, err := parseClientRequest(c.clientConn)
 	if err != nil {
-		res := &response{reply: generalFailure}
-		buf, _ := res.marshal()
-		c.clientConn.Write(buf)
+		c.writeReply(generalFailure)
 		return err
 	}
-	if req.command != connect {
-		res := &response{reply: commandNotSupported}
-		buf, _ := res.marshal()
-		c.clientConn.Write(buf)
+	c.request = req
+
+	switch req.command {
+	case connect:
+		return c.handleConnect()
+	case bind:
+		return c.handleBind()
+	case udpAssociate:
+		return c.handleUDPAssociate()
+	default:
+		c.writeReply(commandNotSupported)
 		return fmt.Errorf("unsupported command %v", req.command)
 	}
-	c.request = req
+}
 
+func (c *Conn) handleConnect() error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	srv, err := c.srv.dial(
@@ -168,51 +290,248 @@ func (c *Conn) handleRequest() error {
 		net.JoinHostPort(c.request.destination, strconv.Itoa(int(c.request.port))),
 	)
 	if err != nil {
-		res := &response{reply: generalFailure}
-		buf, _ := res.marshal()
-		c.clientConn.Write(buf)
+		c.writeReply(generalFailure)
 		return err
 	}
 	defer srv.Close()
-	serverAddr, serverPortStr, err := net.SplitHostPort(srv.LocalAddr().String())
+	if err := c.writeSuccess(srv.LocalAddr()); err != nil {
+		return err
+	}
+	return relay(c.clientConn, srv)
+}
+
+// handleBind handles a BIND request: it listens for one incoming
+// connection from the requested destination, replying once with the
+// address it listens on, and again with the address of the
+// connection, and then relays the connection.
+func (c *Conn) handleBind() error {
+	remoteAddr := net.JoinHostPort(c.request.destination, strconv.Itoa(int(c.request.port)))
+	ctx, cancel := context.WithTimeout(context.Background(), bindTimeout)
+	defer cancel()
+	ln, err := c.srv.listen(ctx, "tcp", remoteAddr)
 	if err != nil {
+		c.writeReply(generalFailure)
+		return err
+	}
+	defer ln.Close()
+	if err := c.writeSuccess(ln.Addr()); err != nil {
 		return err
 	}
-	serverPort, _ := strconv.Atoi(serverPortStr)
 
-	var bindAddrType addrType
-	if ip := net.ParseIP(serverAddr); ip != nil {
-		if ip.To4() != nil {
-			bindAddrType = ipv4
-		} else {
-			bindAddrType = ipv6
+	// Stop waiting if it takes too long.
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	want := net.ParseIP(c.request.destination)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			c.writeReply(generalFailure)
+			return fmt.Errorf("bind: %w", err)
+		}
+		if want != nil && !want.IsUnspecified() && !addrHasIP(conn.RemoteAddr(), want) {
+			c.srv.logf("bind: ignoring connection from %v; want %v", conn.RemoteAddr(), want)
+			conn.Close()
+			continue
+		}
+		ln.Close()
+		defer conn.Close()
+		if err := c.writeSuccess(conn.RemoteAddr()); err != nil {
+			return err
 		}
-	} else {
-		bindAddrType = domainName
+		return relay(c.clientConn, conn)
 	}
-	res := &response{
-		reply:        success,
-		bindAddrType: bindAddrType,
-		bindAddr:     serverAddr,
-		bindPort:     uint16(serverPort),
+}
+
+// handleUDPAssociate handles a UDP ASSOCIATE request: it relays UDP
+// datagrams between the client and their destinations until the
+// client closes its TCP connection.
+func (c *Conn) handleUDPAssociate() error {
+	localHost, _, err := net.SplitHostPort(c.clientConn.LocalAddr().String())
+	if err != nil {
+		c.writeReply(generalFailure)
+		return err
 	}
-	buf, err := res.marshal()
+	clientHost, _, err := net.SplitHostPort(c.clientConn.RemoteAddr().String())
 	if err != nil {
-		res = &response{reply: generalFailure}
-		buf, _ = res.marshal()
+		c.writeReply(generalFailure)
+		return err
 	}
-	c.clientConn.Write(buf)
+	pc, err := net.ListenPacket("udp", net.JoinHostPort(localHost, "0"))
+	if err != nil {
+		c.writeReply(generalFailure)
+		return err
+	}
+	defer pc.Close()
+	if err := c.writeSuccess(pc.LocalAddr()); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r := &udpRelay{
+		srv:      c.srv,
+		ctx:      ctx,
+		pc:       pc,
+		clientIP: net.ParseIP(clientHost),
+		conns:    make(map[string]net.Conn),
+	}
+	// The client may say which port it'll send from.
+	if c.request.port != 0 {
+		r.clientPort = int(c.request.port)
+	}
+	defer r.close()
+	go r.serve()
+
+	// The association lasts as long as the TCP connection.
+	io.Copy(ioutil.Discard, c.clientConn)
+	return nil
+}
+
+// udpRelay relays the datagrams of a UDP association.
+type udpRelay struct {
+	srv        *Server
+	ctx        context.Context // canceled when the association ends
+	pc         net.PacketConn  // to and from the client
+	clientIP   net.IP
+	clientPort int // or zero if not yet known
+
+	mu         sync.Mutex
+	clientAddr net.Addr            // where replies go; nil until the client sends
+	conns      map[string]net.Conn // by destination host:port
+	closed     bool
+}
+
+func (r *udpRelay) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	for _, c := range r.conns {
+		c.Close()
+	}
+}
+
+// serve reads the client's datagrams and forwards them to their
+// destinations.
+func (r *udpRelay) serve() {
+	buf := make([]byte, maxUDPPacketSize)
+	for {
+		n, from, err := r.pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if !r.fromClient(from) {
+			continue
+		}
+		dst, payload, err := parseUDPRequest(buf[:n])
+		if err != nil {
+			r.srv.logf("udp: %v", err)
+			continue
+		}
+		conn, err := r.conn(dst)
+		if err != nil {
+			r.srv.logf("udp: %v", err)
+			continue
+		}
+		conn.Write(payload)
+	}
+}
+
+// fromClient reports whether a datagram from addr is from the client,
+// remembering its address for replies.
+func (r *udpRelay) fromClient(addr net.Addr) bool {
+	ua, ok := addr.(*net.UDPAddr)
+	if !ok || !ua.IP.Equal(r.clientIP) {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.clientPort != 0 && ua.Port != r.clientPort {
+		return false
+	}
+	r.clientPort = ua.Port
+	r.clientAddr = ua
+	return true
+}
+
+// conn returns the connection to dst, dialing it if needed.
+func (r *udpRelay) conn(dst string) (net.Conn, error) {
+	r.mu.Lock()
+	c, ok := r.conns[dst]
+	n := len(r.conns)
+	r.mu.Unlock()
+	if ok {
+		return c, nil
+	}
+	if n >= maxUDPDestinations {
+		return nil, fmt.Errorf("too many destinations; dropping datagram to %v", dst)
+	}
+
+	ctx, cancel := context.WithTimeout(r.ctx, 5*time.Second)
+	defer cancel()
+	c, err := r.srv.dial(ctx, "udp", dst)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		c.Close()
+		return nil, errors.New("association closed")
+	}
+	r.conns[dst] = c
+	go r.readReplies(dst, c)
+	return c, nil
+}
+
+// readReplies sends datagrams from c, the connection to dst, back to
+// the client.
+func (r *udpRelay) readReplies(dst string, c net.Conn) {
+	host, portStr, _ := net.SplitHostPort(dst)
+	if ra := c.RemoteAddr(); ra != nil {
+		// Reply from the resolved address, if dst was a name.
+		if h, p, err := net.SplitHostPort(ra.String()); err == nil {
+			host, portStr = h, p
+		}
+	}
+	port, _ := strconv.Atoi(portStr)
+	hdr, err := appendUDPHeader(nil, host, uint16(port))
+	if err != nil {
+		r.srv.logf("udp: %v", err)
+		return
+	}
+	buf := make([]byte, maxUDPPacketSize)
+	copy(buf, hdr)
+	for {
+		n, err := c.Read(buf[len(hdr):])
+		if err != nil {
+			return
+		}
+		r.mu.Lock()
+		to := r.clientAddr
+		r.mu.Unlock()
+		if to == nil {
+			continue
+		}
+		r.pc.WriteTo(buf[:len(hdr)+n], to)
+	}
+}
 
+// relay copies data between the client and the backend until either
+// closes.
+func relay(client, backend net.Conn) error {
 	errc := make(chan error, 2)
 	go func() {
-		_, err := io.Copy(c.clientConn, srv)
+		_, err := io.Copy(client, backend)
 		if err != nil {
 			err = fmt.Errorf("from backend to client: %w", err)
 		}
 		errc <- err
 	}()
 	go func() {
-		_, err := io.Copy(srv, c.clientConn)
+		_, err := io.Copy(backend, client)
 		if err != nil {
 			err = fmt.Errorf("from client to backend: %w", err)
 		}
@@ -221,10 +540,30 @@ func (c *Conn) handleRequest() error {
 	return <-errc
 }
 
+// addrHasIP reports whether addr, a TCP or UDP address, has the IP ip.
+func addrHasIP(addr net.Addr, ip net.IP) bool {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	return net.ParseIP(host).Equal(ip)
+}
+
+// addrTypeOf returns the type of the SOCKS5 address host.
+func addrTypeOf(host string) addrType {
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.To4() != nil {
+			return ipv4
+		}
+		return ipv6
+	}
+	return domainName
+}
+
 // parseClientGreeting parses a request initiation packet
-// and returns a slice that contains the acceptable auth methods
-// for the client.
-func parseClientGreeting(r io.Reader) error {
+// and returns an error if the client doesn't offer the auth
+// method method.
+func parseClientGreeting(r io.Reader, method byte) error {
 	var hdr [2]byte
 	_, err := io.ReadFull(r, hdr[:])
 	if err != nil {
@@ -240,13 +579,38 @@ func parseClientGreeting(r io.Reader) error {
 		return fmt.Errorf("could not read methods")
 	}
 	for _, m := range methods {
-		if m == noAuthRequired {
+		if m == method {
 			return nil
 		}
 	}
 	return fmt.Errorf("no acceptable auth methods")
 }
 
+// parseClientAuth parses a username/password authentication request,
+// as described in RFC 1929.
+func parseClientAuth(r io.Reader) (user, pass string, err error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return "", "", fmt.Errorf("could not read auth packet header")
+	}
+	if hdr[0] != passwordAuthVersion {
+		return "", "", fmt.Errorf("unsupported auth version %d", hdr[0])
+	}
+	userBytes := make([]byte, hdr[1])
+	if _, err := io.ReadFull(r, userBytes); err != nil {
+		return "", "", fmt.Errorf("could not read username")
+	}
+	var passLen [1]byte
+	if _, err := io.ReadFull(r, passLen[:]); err != nil {
+		return "", "", fmt.Errorf("could not read password length")
+	}
+	passBytes := make([]byte, passLen[0])
+	if _, err := io.ReadFull(r, passBytes); err != nil {
+		return "", "", fmt.Errorf("could not read password")
+	}
+	return string(userBytes), string(passBytes), nil
+}
+
 // request represents data contained within a SOCKS5
 // connection request packet.
 type request struct {
@@ -267,52 +631,107 @@ func parseClientRequest(r io.Reader) (*request, error) {
 	cmd := hdr[1]
 	destAddrType := addrType(hdr[3])
 
-	var destination string
-	var port uint16
+	destination, port, err := parseAddr(r, destAddrType)
+	if err != nil {
+		return nil, err
+	}
 
-	if destAddrType == ipv4 {
+	return &request{
+		command:      commandType(cmd),
+		destination:  destination,
+		port:         port,
+		destAddrType: destAddrType,
+	}, nil
+}
+
+// parseAddr reads an address of type typ, followed by a port, from r.
+func parseAddr(r io.Reader, typ addrType) (host string, port uint16, err error) {
+	switch typ {
+	case ipv4:
 		var ip [4]byte
-		_, err = io.ReadFull(r, ip[:])
-		if err != nil {
-			return nil, fmt.Errorf("could not read IPv4 address")
+		if _, err := io.ReadFull(r, ip[:]); err != nil {
+			return "", 0, fmt.Errorf("could not read IPv4 address")
 		}
-		destination = net.IP(ip[:]).String()
-	} else if destAddrType == domainName {
+		host = net.IP(ip[:]).String()
+	case domainName:
 		var dstSizeByte [1]byte
-		_, err = io.ReadFull(r, dstSizeByte[:])
-		if err != nil {
-			return nil, fmt.Errorf("could not read domain name size")
+		if _, err := io.ReadFull(r, dstSizeByte[:]); err != nil {
+			return "", 0, fmt.Errorf("could not read domain name size")
 		}
-		dstSize := int(dstSizeByte[0])
-		domainName := make([]byte, dstSize)
-		_, err = io.ReadFull(r, domainName)
-		if err != nil {
-			return nil, fmt.Errorf("could not read domain name")
+		domainName := make([]byte, dstSizeByte[0])
+		if _, err := io.ReadFull(r, domainName); err != nil {
+			return "", 0, fmt.Errorf("could not read domain name")
 		}
-		destination = string(domainName)
-	} else if destAddrType == ipv6 {
+		host = string(domainName)
+	case ipv6:
 		var ip [16]byte
-		_, err = io.ReadFull(r, ip[:])
-		if err != nil {
-			return nil, fmt.Errorf("could not read IPv6 address")
+		if _, err := io.ReadFull(r, ip[:]); err != nil {
+			return "", 0, fmt.Errorf("could not read IPv6 address")
+		}
+		host = net.IP(ip[:]).String()
+	default:
+		return "", 0, fmt.Errorf("unsupported address type")
+	}
+	var portBytes [2]byte
+	if _, err := io.ReadFull(r, portBytes[:]); err != nil {
+		return "", 0, fmt.Errorf("could not read port")
+	}
+	return host, binary.BigEndian.Uint16(portBytes[:]), nil
+}
+
+// appendAddr appends host, an address of type typ, and port to b.
+func appendAddr(b []byte, typ addrType, host string, port uint16) ([]byte, error) {
+	switch typ {
+	case ipv4:
+		ip := net.ParseIP(host).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IPv4 address %q", host)
+		}
+		b = append(b, ip...)
+	case domainName:
+		if len(host) > 255 {
+			return nil, fmt.Errorf("domain name too long")
+		}
+		b = append(b, byte(len(host)))
+		b = append(b, host...)
+	case ipv6:
+		ip := net.ParseIP(host).To16()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IPv6 address %q", host)
 		}
-		destination = net.IP(ip[:]).String()
-	} else {
+		b = append(b, ip...)
+	default:
 		return nil, fmt.Errorf("unsupported address type")
 	}
 	var portBytes [2]byte
-	_, err = io.ReadFull(r, portBytes[:])
+	binary.BigEndian.PutUint16(portBytes[:], port)
+	return append(b, portBytes[:]...), nil
+}
+
+// parseUDPRequest parses a datagram from a UDP association's client,
+// returning its destination host:port and payload. Fragmented
+// datagrams aren't supported.
+func parseUDPRequest(pkt []byte) (dst string, payload []byte, err error) {
+	if len(pkt) < 4 {
+		return "", nil, fmt.Errorf("short UDP request")
+	}
+	if frag := pkt[2]; frag != 0 {
+		return "", nil, fmt.Errorf("fragmented UDP request not supported")
+	}
+	r := bytes.NewReader(pkt[4:])
+	host, port, err := parseAddr(r, addrType(pkt[3]))
 	if err != nil {
-		return nil, fmt.Errorf("could not read port")
+		return "", nil, err
 	}
-	port = binary.BigEndian.Uint16(portBytes[:])
+	payload = pkt[len(pkt)-r.Len():]
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), payload, nil
+}
 
-	return &request{
-		command:      commandType(cmd),
-		destination:  destination,
-		port:         port,
-		destAddrType: destAddrType,
-	}, nil
+// appendUDPHeader appends the header of a datagram to a UDP
+// association's client, from host and port, to b.
+func appendUDPHeader(b []byte, host string, port uint16) ([]byte, error) {
+	b = append(b, 0, 0, 0, byte(addrTypeOf(host))) // RSV, RSV, FRAG, ATYP
+	return appendAddr(b, addrTypeOf(host), host, port)
 }
 
 // response contains the contents of
@@ -339,33 +758,5 @@ func (res *response) marshal() ([]byte, error) {
 		return pkt, nil
 	}
 
-	var addr []byte
-	switch res.bindAddrType {
-	case ipv4:
-		addr = net.ParseIP(res.bindAddr).To4()
-		if addr == nil {
-			return nil, fmt.Errorf("invalid IPv4 address for binding")
-		}
-	case domainName:
-		if len(res.bindAddr) > 255 {
-			return nil, fmt.Errorf("invalid domain name for binding")
-		}
-		addr = make([]byte, 0, len(res.bindAddr)+1)
-		addr = append(addr, byte(len(res.bindAddr)))
-		addr = append(addr, []byte(res.bindAddr)...)
-	case ipv6:
-		addr = net.ParseIP(res.bindAddr).To16()
-		if addr == nil {
-			return nil, fmt.Errorf("invalid IPv6 address for binding")
-		}
-	default:
-		return nil, fmt.Errorf("unsupported address type")
-	}
-
-	pkt = append(pkt, addr...)
-	port := make([]byte, 2)
-	binary.BigEndian.PutUint16(port, uint16(res.bindPort))
-	pkt = append(pkt, port...)
-
-	return pkt, nil
+	return appendAddr(pkt, res.bindAddrType, res.bindAddr, res.bindPort)
 }
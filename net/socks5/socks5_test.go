@@ -0,0 +1,237 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package socks5
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+func startServer(t *testing.T, s *Server) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go s.Serve(ln)
+	return ln.Addr().String()
+}
+
+func startTCPEcho(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestConnectAuth(t *testing.T) {
+	backend := startTCPEcho(t)
+	addr := startServer(t, &Server{Logf: t.Logf, Username: "user", Password: "secret"})
+
+	d, err := proxy.SOCKS5("tcp", addr, &proxy.Auth{User: "user", Password: "secret"}, proxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := d.Dial("tcp", backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Errorf("got %q; want hello", buf)
+	}
+
+	for _, auth := range []*proxy.Auth{
+		{User: "user", Password: "wrong"},
+		{User: "other", Password: "secret"},
+		nil,
+	} {
+		d, err := proxy.SOCKS5("tcp", addr, auth, proxy.Direct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c, err := d.Dial("tcp", backend); err == nil {
+			c.Close()
+			t.Errorf("dial with auth %+v succeeded", auth)
+		}
+	}
+}
+
+// greet connects to the SOCKS5 server at addr without authentication
+// and sends a request of type cmd for host:port.
+func greet(t *testing.T, addr string, cmd commandType, host string, port uint16) net.Conn {
+	t.Helper()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := c.Write([]byte{socks5Version, 1, noAuthRequired}); err != nil {
+		t.Fatal(err)
+	}
+	var res [2]byte
+	if _, err := io.ReadFull(c, res[:]); err != nil {
+		t.Fatal(err)
+	}
+	if res[1] != noAuthRequired {
+		t.Fatalf("server chose auth method %d", res[1])
+	}
+	req, err := appendAddr([]byte{socks5Version, byte(cmd), 0, byte(addrTypeOf(host))}, addrTypeOf(host), host, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// readReply reads a successful reply from c, returning its address.
+func readReply(t *testing.T, c net.Conn) string {
+	t.Helper()
+	var hdr [4]byte
+	if _, err := io.ReadFull(c, hdr[:]); err != nil {
+		t.Fatal(err)
+	}
+	if replyCode(hdr[1]) != success {
+		t.Fatalf("reply %d; want success", hdr[1])
+	}
+	host, port, err := parseAddr(c, addrType(hdr[3]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port)))
+}
+
+func TestUDPAssociate(t *testing.T) {
+	backend, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := backend.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			backend.WriteTo(append([]byte("echo:"), buf[:n]...), from)
+		}
+	}()
+
+	addr := startServer(t, &Server{Logf: t.Logf})
+	c := greet(t, addr, udpAssociate, "0.0.0.0", 0)
+	relayAddr, err := net.ResolveUDPAddr("udp", readReply(t, c))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uc.Close()
+	uc.SetDeadline(time.Now().Add(10 * time.Second))
+
+	bu := backend.LocalAddr().(*net.UDPAddr)
+	pkt, err := appendUDPHeader(nil, bu.IP.String(), uint16(bu.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkt = append(pkt, "ping"...)
+	if _, err := uc.WriteTo(pkt, relayAddr); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 1500)
+	n, _, err := uc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	from, payload, err := parseUDPRequest(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from != bu.String() {
+		t.Errorf("reply from %v; want %v", from, bu)
+	}
+	if string(payload) != "echo:ping" {
+		t.Errorf("payload = %q; want echo:ping", payload)
+	}
+
+	// Fragmented datagrams are dropped.
+	frag := append([]byte(nil), pkt...)
+	frag[2] = 1
+	if _, _, err := parseUDPRequest(frag); err == nil {
+		t.Error("fragmented datagram parsed")
+	}
+}
+
+func TestBind(t *testing.T) {
+	addr := startServer(t, &Server{Logf: t.Logf})
+	c := greet(t, addr, bind, "127.0.0.1", 0)
+	listenAddr := readReply(t, c)
+
+	remote, err := net.Dial("tcp", listenAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+	remote.SetDeadline(time.Now().Add(10 * time.Second))
+	if got, want := readReply(t, c), remote.LocalAddr().String(); got != want {
+		t.Errorf("connection from %v; want %v", got, want)
+	}
+
+	if _, err := remote.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Errorf("client got %q; want hello", buf)
+	}
+	if _, err := c.Write([]byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(remote, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, []byte("world")) {
+		t.Errorf("remote got %q; want world", buf)
+	}
+}
@@ -7,7 +7,9 @@ package tssocks
 
 import (
 	"context"
+	"fmt"
 	"net"
+	"strings"
 	"sync"
 
 	"inet.af/netaddr"
@@ -32,21 +34,38 @@ func NewServer(logf logger.Logf, e wgengine.Engine, ns *netstack.Impl) *socks5.S
 	return &socks5.Server{
 		Logf:   logf,
 		Dialer: d.DialContext,
+		Listen: d.Listen,
 	}
 }
 
+// NewDialer returns a DialContext func that dials like the SOCKS5
+// server returned by NewServer: addresses may be MagicDNS names, and
+// Tailscale IPs are dialed via ns if it's non-nil.
+func NewDialer(e wgengine.Engine, ns *netstack.Impl) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	d := &dialer{ns: ns}
+	e.AddNetworkMapCallback(d.onNewNetmap)
+	return d.DialContext
+}
+
 // dialer is the Tailscale SOCKS5 dialer.
 type dialer struct {
 	ns *netstack.Impl
 
-	mu  sync.Mutex
-	dns netstack.DNSMap
+	mu      sync.Mutex
+	dns     netstack.DNSMap
+	selfIPs []netaddr.IP // this node's Tailscale IPs
 }
 
 func (d *dialer) onNewNetmap(nm *netmap.NetworkMap) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 	d.dns = netstack.DNSMapFromNetworkMap(nm)
+	d.selfIPs = d.selfIPs[:0]
+	for _, p := range nm.Addresses {
+		if p.IsSingleIP() {
+			d.selfIPs = append(d.selfIPs, p.IP())
+		}
+	}
 }
 
 func (d *dialer) resolve(ctx context.Context, addr string) (netaddr.IPPort, error) {
@@ -62,12 +81,37 @@ func (d *dialer) DialContext(ctx context.Context, network, addr string) (net.Con
 		return nil, err
 	}
 	if d.ns != nil && d.useNetstackForIP(ipp.IP()) {
+		if strings.HasPrefix(network, "udp") {
+			return d.ns.DialContextUDP(ctx, ipp.String())
+		}
 		return d.ns.DialContextTCP(ctx, ipp.String())
 	}
 	var stdDialer net.Dialer
 	return stdDialer.DialContext(ctx, network, ipp.String())
 }
 
+// Listen listens for the incoming connection of a SOCKS5 BIND request
+// from remoteAddr. Connections from Tailscale IPs are listened for on
+// this node's Tailscale IP of the same family, in netstack.
+func (d *dialer) Listen(ctx context.Context, network, remoteAddr string) (net.Listener, error) {
+	ipp, err := d.resolve(ctx, remoteAddr)
+	if err != nil {
+		return nil, err
+	}
+	if d.ns != nil && d.ns.ProcessLocalIPs && d.useNetstackForIP(ipp.IP()) {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		for _, ip := range d.selfIPs {
+			if ip.BitLen() == ipp.IP().BitLen() {
+				return d.ns.ListenTCP(netaddr.IPPortFrom(ip, 0))
+			}
+		}
+		return nil, fmt.Errorf("no Tailscale IP to listen for %v on", ipp.IP())
+	}
+	var lc net.ListenConfig
+	return lc.Listen(ctx, network, ":0")
+}
+
 func (d *dialer) useNetstackForIP(ip netaddr.IP) bool {
 	if d.ns == nil {
 		return false
@@ -501,6 +501,14 @@ func (t *Wrapper) Read(buf []byte, offset int) (int, error) {
 		}
 	}
 
+	// Injected packets (such as those from netstack) still need to
+	// be tracked, so that replies to them pass the inbound filter.
+	if isInjectedPacket && !t.disableFilter {
+		if filt, _ := t.filter.Load().(*filter.Filter); filt != nil {
+			filt.TrackOutbound(p)
+		}
+	}
+
 	t.noteActivity()
 	return n, nil
 }
@@ -48,7 +48,9 @@ import (
 //    23: 2021-08-25: DNSConfig.Routes values may be empty (for ExtraRecords support in 1.14.1+)
 //    24: 2021-09-18: MapResponse.Health from control to node; node shows in "tailscale status"
 //    25: 2021-11-01: MapResponse.Debug.Exit
-const CurrentMapRequestVersion = 25
+//    26: 2021-11-08: client serves DNSConfig.ExtraRecords of type SRV, TXT and CNAME
+//    27: 2021-11-10: client understands ServerKeyResponse; can use the Noise control transport
+const CurrentMapRequestVersion = 27
 
 type StableID string
 
@@ -611,10 +613,34 @@ func (st SignatureType) String() string {
 	}
 }
 
+// ServerKeyResponse is the JSON response to a request for the control
+// server's public keys, sent to:
+//	https://login.tailscale.com/key?v=<CurrentMapRequestVersion>
+//
+// Control servers that predate it reply to such requests with just
+// the legacy key, as plain text in hex.
+type ServerKeyResponse struct {
+	// LegacyPublicKey is the key that requests and responses are
+	// encrypted with golang.org/x/crypto/nacl/box to and from.
+	LegacyPublicKey key.MachinePublic `json:"legacyPublicKey"`
+
+	// PublicKey is the server's static key for the Noise control
+	// transport, reached by upgrading an HTTP request to:
+	//	https://login.tailscale.com/ts2021
+	// Over it, requests and responses are sent unboxed, over
+	// HTTP/2, to the same paths with the machine key omitted, as
+	// in /machine/map. The zero value means the server doesn't
+	// support the Noise transport.
+	PublicKey key.MachinePublic `json:"publicKey"`
+}
+
 // RegisterRequest is sent by a client to register the key for a node.
 // It is encoded to JSON, encrypted with golang.org/x/crypto/nacl/box,
 // using the local machine key, and sent to:
 //	https://login.tailscale.com/machine/<mkey hex>
+//
+// Over the Noise control transport it is sent unencrypted to
+// /machine/register instead. See ServerKeyResponse.
 type RegisterRequest struct {
 	_          structs.Incomparable
 	Version    int // currently 1
@@ -917,10 +943,15 @@ type DNSRecord struct {
 
 	// Type is the DNS record type.
 	// Empty means A or AAAA, depending on value.
+	// Since MapRequest.Version 26, "SRV", "TXT" and "CNAME" are
+	// also supported.
 	// Other values are currently ignored.
 	Type string `json:",omitempty"`
 
-	// Value is the IP address in string form.
+	// Value is the record's data in string form: for A and AAAA
+	// records, the IP address; for SRV records, "priority weight
+	// port target", as in a zone file; for TXT records, the text;
+	// and for CNAME records, the target name.
 	// TODO(bradfitz): if we ever add support for record types
 	// with non-UTF8 binary data, add ValueBytes []byte that
 	// would take precedence.
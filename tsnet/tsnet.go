@@ -8,6 +8,7 @@
 package tsnet
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
@@ -20,6 +21,7 @@ import (
 	"sync"
 	"time"
 
+	"inet.af/netaddr"
 	"tailscale.com/client/tailscale"
 	"tailscale.com/control/controlclient"
 	"tailscale.com/ipn"
@@ -35,7 +37,7 @@ import (
 
 // Server is an embedded Tailscale server.
 //
-// Its exported fields may be changed until the first call to Listen.
+// Its exported fields may be changed until the first method call.
 type Server struct {
 	// Dir specifies the name of the directory to use for
 	// state. If empty, a directory is selected automatically
@@ -51,17 +53,52 @@ type Server struct {
 	// log.Printf is used.
 	Logf logger.Logf
 
-	initOnce sync.Once
-	initErr  error
-	lb       *ipnlocal.LocalBackend
+	// Store specifies the state store to use.
+	//
+	// If nil, a new FileStore is initialized at `Dir/tailscaled.state`.
+	// See tailscale.com/ipn for available implementations, such as
+	// ipn.MemoryStore for tests and short-lived processes.
+	Store ipn.StateStore
+
+	// AuthKey, if non-empty, is the auth key to create the node
+	// and will be preferred over the TS_AUTHKEY environment
+	// variable. If the node is already created (from state
+	// previously stored in in Store), then this field is not
+	// used.
+	AuthKey string
+
+	// Ephemeral, if true, specifies that the instance should register
+	// as an Ephemeral node, which the control server removes shortly
+	// after it goes offline. Close logs out ephemeral nodes
+	// explicitly so they're removed right away.
+	Ephemeral bool
+
+	// ControlURL optionally specifies the coordination server URL.
+	// If empty, the Tailscale default is used.
+	ControlURL string
+
+	initOnce       sync.Once
+	initErr        error
+	lb             *ipnlocal.LocalBackend
+	linkMon        *monitor.Mon
+	netstack       *netstack.Impl
+	localClient    *tailscale.LocalClient
+	localAPIServer *http.Server
 	// the state directory
 	dir      string
 	hostname string
 
+	closeOnce sync.Once
+	closeErr  error
+
 	mu        sync.Mutex
+	closed    bool
 	listeners map[listenKey]*listener
 }
 
+// errClosed is returned by the methods of a closed Server.
+var errClosed = fmt.Errorf("tsnet: %w", net.ErrClosed)
+
 func (s *Server) doInit() {
 	if err := s.start(); err != nil {
 		s.initErr = fmt.Errorf("tsnet: %w", err)
@@ -101,10 +138,7 @@ func (s *Server) start() error {
 		return fmt.Errorf("%v is not a directory", s.dir)
 	}
 
-	logf := s.Logf
-	if logf == nil {
-		logf = log.Printf
-	}
+	logf := logger.Logf(s.logf)
 
 	// TODO(bradfitz): start logtail? don't use filch, perhaps?
 	// only upload plumbed Logf?
@@ -113,6 +147,7 @@ func (s *Server) start() error {
 	if err != nil {
 		return err
 	}
+	s.linkMon = linkMon
 
 	eng, err := wgengine.NewUserspaceEngine(logf, wgengine.Config{
 		ListenPort:  0,
@@ -136,11 +171,15 @@ func (s *Server) start() error {
 	if err := ns.Start(); err != nil {
 		return fmt.Errorf("failed to start netstack: %w", err)
 	}
+	s.netstack = ns
 
-	statePath := filepath.Join(s.dir, "tailscaled.state")
-	store, err := ipn.NewFileStore(statePath)
-	if err != nil {
-		return err
+	store := s.Store
+	if store == nil {
+		statePath := filepath.Join(s.dir, "tailscaled.state")
+		store, err = ipn.NewFileStore(statePath)
+		if err != nil {
+			return err
+		}
 	}
 	logid := "tslib-TODO"
 
@@ -149,22 +188,30 @@ func (s *Server) start() error {
 		return fmt.Errorf("NewLocalBackend: %v", err)
 	}
 	lb.SetVarRoot(s.dir)
+	lb.SetUserDialFunc(s.Dial)
 	s.lb = lb
 	lb.SetDecompressor(func() (controlclient.Decompressor, error) {
 		return smallzstd.NewDecoder(nil)
 	})
+	if s.Ephemeral {
+		lb.SetLoginFlags(controlclient.LoginEphemeral)
+	}
 	prefs := ipn.NewPrefs()
 	prefs.Hostname = s.hostname
 	prefs.WantRunning = true
+	if s.ControlURL != "" {
+		prefs.ControlURL = s.ControlURL
+	}
+	authKey := s.getAuthKey()
 	err = lb.Start(ipn.Options{
 		StateKey:    ipn.GlobalDaemonStateKey,
 		UpdatePrefs: prefs,
-		AuthKey:     os.Getenv("TS_AUTHKEY"),
+		AuthKey:     authKey,
 	})
 	if err != nil {
 		return fmt.Errorf("starting backend: %w", err)
 	}
-	if os.Getenv("TS_LOGIN") == "1" || os.Getenv("TS_AUTHKEY") != "" {
+	if os.Getenv("TS_LOGIN") == "1" || authKey != "" {
 		s.lb.StartLoginInteractive()
 	}
 
@@ -178,16 +225,91 @@ func (s *Server) start() error {
 	// TODO(maisem): Rename nettest package to remove "test".
 	lal := nettest.Listen("local-tailscaled.sock:80")
 
-	// Override the Tailscale client to use the in-process listener.
-	tailscale.TailscaledDialer = lal.Dial
+	s.localClient = &tailscale.LocalClient{Dial: lal.Dial}
+	s.localAPIServer = &http.Server{Handler: lah}
 	go func() {
-		if err := http.Serve(lal, lah); err != nil {
+		if err := s.localAPIServer.Serve(lal); err != nil && err != http.ErrServerClosed {
 			logf("localapi serve error: %v", err)
 		}
 	}()
 	return nil
 }
 
+func (s *Server) getAuthKey() string {
+	if v := s.AuthKey; v != "" {
+		return v
+	}
+	return os.Getenv("TS_AUTHKEY")
+}
+
+func (s *Server) logf(format string, a ...interface{}) {
+	if s.Logf != nil {
+		s.Logf(format, a...)
+		return
+	}
+	log.Printf(format, a...)
+}
+
+// Close stops the server, closing all its listeners and shutting down
+// its engine and network stack. If the server is Ephemeral, its node
+// is logged out first so the control server removes it right away.
+// Teardown continues past errors; the first one is returned.
+//
+// It must not be called concurrently with the first use of s. After
+// Close, s can no longer be used; its methods return errors wrapping
+// net.ErrClosed.
+func (s *Server) Close() error {
+	// If s was never started, make any later use fail rather than
+	// start it.
+	s.initOnce.Do(func() { s.initErr = errClosed })
+
+	s.closeOnce.Do(func() {
+		// setErr records the first error from closing.
+		setErr := func(err error) {
+			if err != nil && s.closeErr == nil {
+				s.closeErr = fmt.Errorf("tsnet: %w", err)
+			}
+		}
+		if s.Ephemeral && s.lb != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			err := s.lb.LogoutSync(ctx)
+			cancel()
+			if err != nil {
+				setErr(fmt.Errorf("logging out ephemeral node: %w", err))
+			}
+		}
+
+		s.mu.Lock()
+		s.closed = true
+		for key, ln := range s.listeners {
+			delete(s.listeners, key)
+			close(ln.closed)
+		}
+		s.mu.Unlock()
+
+		if s.localAPIServer != nil {
+			setErr(s.localAPIServer.Close())
+		}
+		if s.lb != nil {
+			s.lb.Shutdown() // closes the engine
+		}
+		if s.netstack != nil {
+			setErr(s.netstack.Close())
+		}
+		if s.linkMon != nil {
+			setErr(s.linkMon.Close())
+		}
+	})
+	return s.closeErr
+}
+
+// isClosed reports whether Close has been called.
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
 func (s *Server) forwardTCP(c net.Conn, port uint16) {
 	s.mu.Lock()
 	ln, ok := s.listeners[listenKey{"tcp", "", fmt.Sprint(port)}]
@@ -200,11 +322,154 @@ func (s *Server) forwardTCP(c net.Conn, port uint16) {
 	defer t.Stop()
 	select {
 	case ln.conn <- c:
+	case <-ln.closed:
+		c.Close()
 	case <-t.C:
 		c.Close()
 	}
 }
 
+// LocalClient returns a LocalClient that speaks to s's in-process
+// LocalAPI, for querying the embedded node's status, looking up
+// peers with WhoIs, fetching certs, etc.
+//
+// The package-level functions in tailscale.com/client/tailscale
+// talk to the system tailscaled, not to s; use the returned
+// LocalClient instead.
+func (s *Server) LocalClient() (*tailscale.LocalClient, error) {
+	s.initOnce.Do(s.doInit)
+	if s.initErr != nil {
+		return nil, s.initErr
+	}
+	if s.isClosed() {
+		return nil, errClosed
+	}
+	return s.localClient, nil
+}
+
+// IdentityHandler returns a handler that calls h with the identity
+// headers (see ipn.HeaderUserLogin) of the tailnet user and node the
+// request came from, as tailscaled's "tailscale serve" proxy does.
+// Identity headers sent by the client are removed first, so h can
+// trust them. h must be served on a listener from s.Listen.
+func (s *Server) IdentityHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.initOnce.Do(s.doInit)
+		if s.initErr != nil {
+			http.Error(w, s.initErr.Error(), http.StatusInternalServerError)
+			return
+		}
+		r2 := r.Clone(r.Context())
+		if ipp, err := netaddr.ParseIPPort(r.RemoteAddr); err != nil {
+			ipn.StripIdentityHeaders(r2.Header)
+		} else if n, u, ok := s.lb.WhoIs(ipp); ok {
+			ipn.SetIdentityHeaders(r2.Header, n, &u)
+		} else {
+			ipn.StripIdentityHeaders(r2.Header)
+		}
+		h.ServeHTTP(w, r2)
+	})
+}
+
+// Dial connects to the address on the tailnet.
+// It will start the server if it has not been started yet.
+//
+// The network must be one of "tcp", "tcp4", "tcp6", "udp", "udp4"
+// or "udp6". The address may be a MagicDNS name or an IP, with a port.
+// For the "4" and "6" networks, the address must be (or resolve to)
+// an IP of that family.
+func (s *Server) Dial(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6":
+	default:
+		return nil, fmt.Errorf("tsnet: unsupported network %q", network)
+	}
+	s.initOnce.Do(s.doInit)
+	if s.initErr != nil {
+		return nil, s.initErr
+	}
+	if s.isClosed() {
+		return nil, errClosed
+	}
+	ipp, err := s.netstack.Resolve(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkFamily(network, ipp.IP()); err != nil {
+		return nil, err
+	}
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		c, err := s.netstack.DialContextTCP(ctx, ipp.String())
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	default:
+		c, err := s.netstack.DialContextUDP(ctx, ipp.String())
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+}
+
+// checkFamily returns an error if ip isn't allowed for network, such as
+// an IPv6 address for "tcp4". Networks without a family allow any IP.
+func checkFamily(network string, ip netaddr.IP) error {
+	switch {
+	case strings.HasSuffix(network, "4") && !ip.Is4():
+		return fmt.Errorf("tsnet: %v is not an IPv4 address", ip)
+	case strings.HasSuffix(network, "6") && !ip.Is6():
+		return fmt.Errorf("tsnet: %v is not an IPv6 address", ip)
+	}
+	return nil
+}
+
+// ListenPacket announces on the tailnet for UDP packets.
+// It will start the server if it has not been started yet.
+//
+// The network must be "udp", "udp4" or "udp6". The addr must be of
+// the form "ip:port" (or "[ip]:port") where ip is one of the
+// Tailscale IP addresses of this node; an empty or unspecified IP
+// is not supported.
+//
+// The node's Tailscale IPs are only known once it has logged in, so
+// ListenPacket fails until then. Callers can wait for the node's
+// IPs to appear in the Self status returned by LocalClient.
+func (s *Server) ListenPacket(network, addr string) (net.PacketConn, error) {
+	ipp, err := netaddr.ParseIPPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("tsnet: ListenPacket requires an IP:port address: %w", err)
+	}
+	if ipp.IP().IsUnspecified() {
+		return nil, errors.New("tsnet: ListenPacket requires a specific Tailscale IP address")
+	}
+	switch network {
+	case "udp", "udp4", "udp6":
+	default:
+		return nil, fmt.Errorf("tsnet: unsupported network %q", network)
+	}
+	if err := checkFamily(network, ipp.IP()); err != nil {
+		return nil, err
+	}
+
+	s.initOnce.Do(s.doInit)
+	if s.initErr != nil {
+		return nil, s.initErr
+	}
+	if s.isClosed() {
+		return nil, errClosed
+	}
+	pc, err := s.netstack.ListenPacket(ipp)
+	if err != nil {
+		return nil, fmt.Errorf("tsnet: %w", err)
+	}
+	return pc, nil
+}
+
+// Listen announces only on the Tailscale network.
+// It will start the server if it has not been started yet.
 func (s *Server) Listen(network, addr string) (net.Listener, error) {
 	host, port, err := net.SplitHostPort(addr)
 	if err != nil {
@@ -222,9 +487,14 @@ func (s *Server) Listen(network, addr string) (net.Listener, error) {
 		key:  key,
 		addr: addr,
 
-		conn: make(chan net.Conn),
+		conn:   make(chan net.Conn),
+		closed: make(chan struct{}),
 	}
 	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil, errClosed
+	}
 	if s.listeners == nil {
 		s.listeners = map[listenKey]*listener{}
 	}
@@ -244,18 +514,20 @@ type listenKey struct {
 }
 
 type listener struct {
-	s    *Server
-	key  listenKey
-	addr string
-	conn chan net.Conn
+	s      *Server
+	key    listenKey
+	addr   string
+	conn   chan net.Conn
+	closed chan struct{} // closed when the listener is closed
 }
 
 func (ln *listener) Accept() (net.Conn, error) {
-	c, ok := <-ln.conn
-	if !ok {
+	select {
+	case c := <-ln.conn:
+		return c, nil
+	case <-ln.closed:
 		return nil, fmt.Errorf("tsnet: %w", net.ErrClosed)
 	}
-	return c, nil
 }
 
 func (ln *listener) Addr() net.Addr { return addr{ln} }
@@ -264,7 +536,7 @@ func (ln *listener) Close() error {
 	defer ln.s.mu.Unlock()
 	if v, ok := ln.s.listeners[ln.key]; ok && v == ln {
 		delete(ln.s.listeners, ln.key)
-		close(ln.conn)
+		close(ln.closed)
 	}
 	return nil
 }
@@ -0,0 +1,297 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsnet
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/ipn"
+	"tailscale.com/tstest"
+	"tailscale.com/tstest/integration"
+	"tailscale.com/tstest/integration/testcontrol"
+	"tailscale.com/types/logger"
+)
+
+func TestMain(m *testing.M) {
+	os.Setenv("TAILSCALE_USE_WIP_CODE", "true")
+	// Disable UPnP, which hits the network.
+	os.Setenv("TS_DISABLE_UPNP", "true")
+	os.Exit(m.Run())
+}
+
+// startControl starts a test control server with its own DERP and
+// STUN servers, returning its URL.
+func startControl(t *testing.T) string {
+	t.Helper()
+	derpMap := integration.RunDERPAndSTUN(t, logger.Discard, "127.0.0.1")
+	control := &testcontrol.Server{
+		DERPMap: derpMap,
+	}
+	control.HTTPTestServer = httptest.NewUnstartedServer(control)
+	control.HTTPTestServer.Start()
+	t.Cleanup(control.HTTPTestServer.Close)
+	return control.HTTPTestServer.URL
+}
+
+// startServer starts a Server using controlURL and waits for it to get
+// its Tailscale IPv4 address.
+func startServer(t *testing.T, ctx context.Context, controlURL, hostname string) (*Server, netaddr.IP) {
+	t.Helper()
+	s := &Server{
+		Dir:        t.TempDir(),
+		ControlURL: controlURL,
+		Hostname:   hostname,
+		Store:      new(ipn.MemoryStore),
+		AuthKey:    "tskey-test",
+		Ephemeral:  true,
+		Logf:       logger.WithPrefix(t.Logf, hostname+": "),
+	}
+	lc, err := s.LocalClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		st, err := lc.StatusWithoutPeers(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.BackendState == "Running" && st.Self != nil {
+			for _, ip := range st.Self.TailscaleIPs {
+				if ip.Is4() {
+					return s, ip
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("%s: timed out waiting for IP; last state %q", hostname, st.BackendState)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+func TestCheckFamily(t *testing.T) {
+	v4 := netaddr.MustParseIP("100.64.0.1")
+	v6 := netaddr.MustParseIP("fd7a:115c:a1e0::1")
+	tests := []struct {
+		network string
+		ip      netaddr.IP
+		ok      bool
+	}{
+		{"tcp", v4, true},
+		{"tcp", v6, true},
+		{"tcp4", v4, true},
+		{"tcp4", v6, false},
+		{"tcp6", v4, false},
+		{"tcp6", v6, true},
+		{"udp4", v6, false},
+		{"udp6", v6, true},
+	}
+	for _, tt := range tests {
+		if err := checkFamily(tt.network, tt.ip); (err == nil) != tt.ok {
+			t.Errorf("checkFamily(%q, %v) = %v; want ok=%v", tt.network, tt.ip, err, tt.ok)
+		}
+	}
+}
+
+func TestDialAndListenPacket(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	controlURL := startControl(t)
+	s1, ip1 := startServer(t, ctx, controlURL, "s1")
+	defer s1.Close()
+	s2, _ := startServer(t, ctx, controlURL, "s2")
+	defer s2.Close()
+
+	// TCP: s2 dials a listener on s1.
+	ln, err := s1.Listen("tcp", ":8081")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.WriteString(c, "hello")
+	}()
+	addr := netaddr.IPPortFrom(ip1, 8081).String()
+	c, err := s2.Dial(ctx, "tcp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(c)
+	c.Close()
+	if err != nil || string(got) != "hello" {
+		t.Fatalf("read %q, %v; want %q", got, err, "hello")
+	}
+
+	if _, err := s2.Dial(ctx, "tcp6", addr); err == nil {
+		t.Error("Dial(tcp6) of an IPv4 address succeeded")
+	}
+	if _, err := s2.Dial(ctx, "ip", addr); err == nil {
+		t.Error("Dial(ip) succeeded")
+	}
+
+	// UDP: s2 sends to a PacketConn on s1.
+	pc, err := s1.ListenPacket("udp4", netaddr.IPPortFrom(ip1, 8082).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	uc, err := s2.Dial(ctx, "udp", netaddr.IPPortFrom(ip1, 8082).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uc.Close()
+	buf := make([]byte, 100)
+	for {
+		// The first packets may be lost while the peers find
+		// each other, so keep sending until one arrives.
+		if _, err := uc.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		pc.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := pc.ReadFrom(buf)
+		if err == nil {
+			if got := string(buf[:n]); got != "ping" {
+				t.Fatalf("got %q; want %q", got, "ping")
+			}
+			break
+		}
+		if ctx.Err() != nil {
+			t.Fatalf("no UDP packet received: %v", err)
+		}
+	}
+
+	if _, err := s1.ListenPacket("udp6", netaddr.IPPortFrom(ip1, 8083).String()); err == nil {
+		t.Error("ListenPacket(udp6) of an IPv4 address succeeded")
+	}
+	if _, err := s1.ListenPacket("udp", "100.64.99.99:8083"); err == nil {
+		t.Error("ListenPacket on a non-local IP succeeded")
+	}
+}
+
+func TestIdentityHandler(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	controlURL := startControl(t)
+	s1, ip1 := startServer(t, ctx, controlURL, "s1")
+	defer s1.Close()
+	s2, ip2 := startServer(t, ctx, controlURL, "s2")
+	defer s2.Close()
+
+	ln, err := s1.Listen("tcp", ":80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go http.Serve(ln, s1.IdentityHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get(ipn.HeaderUserLogin))
+	})))
+
+	lc1, err := s1.LocalClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	who, err := lc1.WhoIs(ctx, netaddr.IPPortFrom(ip2, 0).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hc := &http.Client{Transport: &http.Transport{DialContext: s2.Dial}}
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://"+ip1.String()+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(ipn.HeaderUserLogin, "mallory@example.com")
+	res, err := hc.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := who.UserProfile.LoginName; string(got) != want {
+		t.Errorf("%s = %q; want %q", ipn.HeaderUserLogin, got, want)
+	}
+}
+
+func TestClose(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	controlURL := startControl(t)
+
+	// Start and close a server once first, so goroutines started
+	// lazily on first use of packages aren't counted as leaks.
+	s0, _ := startServer(t, ctx, controlURL, "warmup")
+	if err := s0.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	tstest.ResourceCheck(t)
+
+	s, _ := startServer(t, ctx, controlURL, "s1")
+	if b, err := s.Store.ReadState(ipn.GlobalDaemonStateKey); err != nil || len(b) == 0 {
+		t.Errorf("Store has no state after login: %v", err)
+	}
+	ln, err := s.Listen("tcp", ":8081")
+	if err != nil {
+		t.Fatal(err)
+	}
+	acceptErr := make(chan error, 1)
+	go func() {
+		_, err := ln.Accept()
+		acceptErr <- err
+	}()
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("second Close: %v", err)
+	}
+	if err := <-acceptErr; !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Accept after Close = %v; want net.ErrClosed", err)
+	}
+	if _, err := s.Listen("tcp", ":8082"); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Listen after Close = %v; want net.ErrClosed", err)
+	}
+	if _, err := s.LocalClient(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("LocalClient after Close = %v; want net.ErrClosed", err)
+	}
+	if _, err := s.Dial(ctx, "tcp", "100.64.0.1:80"); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Dial after Close = %v; want net.ErrClosed", err)
+	}
+	if _, err := s.ListenPacket("udp", "100.64.0.1:8083"); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("ListenPacket after Close = %v; want net.ErrClosed", err)
+	}
+}
+
+func TestCloseUnstarted(t *testing.T) {
+	s := new(Server)
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if _, err := s.LocalClient(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("LocalClient after Close = %v; want net.ErrClosed", err)
+	}
+}
@@ -84,6 +84,29 @@ func TestOneNodeUp_NoAuth(t *testing.T) {
 	t.Logf("number of HTTP logcatcher requests: %v", env.LogCatcher.numRequests())
 }
 
+func TestOneNodeUp_Noise(t *testing.T) {
+	t.Parallel()
+	bins := BuildTestBinaries(t)
+
+	env := newTestEnv(t, bins, configureControl(func(control *testcontrol.Server) {
+		control.RequireNoise = true
+	}))
+	defer env.Close()
+
+	n1 := newTestNode(t, env)
+	n1.controlNoise = true
+
+	d1 := n1.StartDaemon(t)
+	defer d1.Kill()
+	n1.AwaitResponding(t)
+	n1.MustUp()
+
+	t.Logf("Got IP: %v", n1.AwaitIP(t))
+	n1.AwaitRunning(t)
+
+	d1.MustCleanShutdown(t)
+}
+
 func TestOneNodeExpiredKey(t *testing.T) {
 	t.Parallel()
 	bins := BuildTestBinaries(t)
@@ -538,6 +561,8 @@ type testNode struct {
 	stateFile  string
 	upFlagGOOS string // if non-empty, sets TS_DEBUG_UP_FLAG_GOOS for cmd/tailscale CLI
 
+	controlNoise bool // if true, sets TS_DEBUG_CONTROL_NOISE for tailscaled
+
 	mu        sync.Mutex
 	onLogLine []func([]byte)
 }
@@ -716,6 +741,9 @@ func (n *testNode) StartDaemonAsIPNGOOS(t testing.TB, ipnGOOS string) *Daemon {
 		"TS_DEBUG_TAILSCALED_IPN_GOOS="+ipnGOOS,
 		"TS_LOGS_DIR="+t.TempDir(),
 	)
+	if n.controlNoise {
+		cmd.Env = append(cmd.Env, "TS_DEBUG_CONTROL_NOISE=1")
+	}
 	cmd.Stderr = &nodeOutputParser{n: n}
 	if *verboseTailscaled {
 		cmd.Stdout = os.Stdout
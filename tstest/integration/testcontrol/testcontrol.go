@@ -27,7 +27,9 @@ import (
 
 	"github.com/klauspost/compress/zstd"
 	"go4.org/mem"
+	"golang.org/x/net/http2"
 	"inet.af/netaddr"
+	"tailscale.com/control/noise"
 	"tailscale.com/net/tsaddr"
 	"tailscale.com/smallzstd"
 	"tailscale.com/tailcfg"
@@ -46,6 +48,10 @@ type Server struct {
 	Verbose     bool
 	DNSConfig   *tailcfg.DNSConfig // nil means no DNS config
 
+	// RequireNoise, if true, rejects machine requests that don't
+	// use the Noise control transport.
+	RequireNoise bool
+
 	// ExplicitBaseURL or HTTPTestServer must be set.
 	ExplicitBaseURL string           // e.g. "http://127.0.0.1:1234" with no trailing URL
 	HTTPTestServer  *httptest.Server // if non-nil, used to get BaseURL
@@ -58,6 +64,7 @@ type Server struct {
 	cond          *sync.Cond // lazily initialized by condLocked
 	pubKey        key.MachinePublic
 	privKey       key.ControlPrivate // not strictly needed vs. MachinePrivate, but handy to test type interactions.
+	noisePrivKey  key.MachinePrivate
 	nodes         map[key.NodePublic]*tailcfg.Node
 	users         map[key.NodePublic]*tailcfg.User
 	logins        map[key.NodePublic]*tailcfg.Login
@@ -198,6 +205,7 @@ func (s *Server) initMux() {
 	s.mux.HandleFunc("/", s.serveUnhandled)
 	s.mux.HandleFunc("/key", s.serveKey)
 	s.mux.HandleFunc("/machine/", s.serveMachine)
+	s.mux.HandleFunc(noise.UpgradePath, s.serveNoiseUpgrade)
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -231,7 +239,24 @@ func (s *Server) keyPair() (pub key.MachinePublic, priv key.ControlPrivate) {
 	return s.pubKey, s.privKey
 }
 
+func (s *Server) noisePrivateKey() key.MachinePrivate {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.noisePrivKey.IsZero() {
+		s.noisePrivKey = key.NewMachine()
+	}
+	return s.noisePrivKey
+}
+
 func (s *Server) serveKey(w http.ResponseWriter, r *http.Request) {
+	if r.FormValue("v") != "" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&tailcfg.ServerKeyResponse{
+			LegacyPublicKey: s.publicKey(),
+			PublicKey:       s.noisePrivateKey().Public(),
+		})
+		return
+	}
 	w.Header().Set("Content-Type", "text/plain")
 	w.WriteHeader(200)
 	io.WriteString(w, s.publicKey().UntypedHexString())
@@ -255,12 +280,76 @@ func (s *Server) serveMachine(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "POST required", 400)
 		return
 	}
+	if s.RequireNoise {
+		http.Error(w, "Noise transport required", 400)
+		return
+	}
 
 	switch rem {
 	case "":
-		s.serveRegister(w, r, mkey)
+		s.serveRegister(w, r, mkey, false)
 	case "/map":
-		s.serveMap(w, r, mkey)
+		s.serveMap(w, r, mkey, false)
+	default:
+		s.serveUnhandled(w, r)
+	}
+}
+
+// serveNoiseUpgrade switches the connection to the Noise control
+// transport, and then serves machine requests over it, as HTTP/2.
+func (s *Server) serveNoiseUpgrade(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || !strings.EqualFold(r.Header.Get("Upgrade"), noise.UpgradeProtocol) {
+		http.Error(w, "Noise upgrade required", 400)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "can't hijack connection", 500)
+		return
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		s.logf("noise upgrade: hijack: %v", err)
+		return
+	}
+	defer conn.Close()
+	fmt.Fprintf(brw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: %s\r\nConnection: upgrade\r\n\r\n", noise.UpgradeProtocol)
+	if err := brw.Flush(); err != nil {
+		s.logf("noise upgrade: %v", err)
+		return
+	}
+	if brw.Reader.Buffered() > 0 {
+		s.logf("noise upgrade: unexpected data before handshake")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	nc, err := noise.Server(ctx, conn, s.noisePrivateKey())
+	cancel()
+	if err != nil {
+		s.logf("noise upgrade: handshake: %v", err)
+		return
+	}
+	mkey := nc.Peer()
+	new(http2.Server).ServeConn(nc, &http2.ServeConnOpts{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			s.serveNoiseMachine(w, r, mkey)
+		}),
+	})
+}
+
+// serveNoiseMachine serves a machine request from mkey over the Noise
+// transport.
+func (s *Server) serveNoiseMachine(w http.ResponseWriter, r *http.Request, mkey key.MachinePublic) {
+	if r.Method != "POST" {
+		http.Error(w, "POST required", 400)
+		return
+	}
+	switch r.URL.Path {
+	case "/machine/register":
+		s.serveRegister(w, r, mkey, true)
+	case "/machine/map":
+		s.serveMap(w, r, mkey, true)
 	default:
 		s.serveUnhandled(w, r)
 	}
@@ -406,7 +495,7 @@ func (s *Server) CompleteAuth(authPathOrURL string) bool {
 	return true
 }
 
-func (s *Server) serveRegister(w http.ResponseWriter, r *http.Request, mkey key.MachinePublic) {
+func (s *Server) serveRegister(w http.ResponseWriter, r *http.Request, mkey key.MachinePublic, overNoise bool) {
 	msg, err := ioutil.ReadAll(io.LimitReader(r.Body, msgLimit))
 	if err != nil {
 		r.Body.Close()
@@ -416,7 +505,7 @@ func (s *Server) serveRegister(w http.ResponseWriter, r *http.Request, mkey key.
 	r.Body.Close()
 
 	var req tailcfg.RegisterRequest
-	if err := s.decode(mkey, msg, &req); err != nil {
+	if err := s.decode(mkey, overNoise, msg, &req); err != nil {
 		go panic(fmt.Sprintf("serveRegister: decode: %v", err))
 	}
 	if req.Version != 1 {
@@ -492,7 +581,7 @@ func (s *Server) serveRegister(w http.ResponseWriter, r *http.Request, mkey key.
 		authURL = s.BaseURL() + authPath
 	}
 
-	res, err := s.encode(mkey, false, tailcfg.RegisterResponse{
+	res, err := s.encode(mkey, overNoise, false, tailcfg.RegisterResponse{
 		User:              *user,
 		Login:             *login,
 		NodeKeyExpired:    allExpired,
@@ -574,7 +663,7 @@ func (s *Server) InServeMap() int {
 	return s.inServeMap
 }
 
-func (s *Server) serveMap(w http.ResponseWriter, r *http.Request, mkey key.MachinePublic) {
+func (s *Server) serveMap(w http.ResponseWriter, r *http.Request, mkey key.MachinePublic, overNoise bool) {
 	s.incrInServeMap(1)
 	defer s.incrInServeMap(-1)
 	ctx := r.Context()
@@ -588,7 +677,7 @@ func (s *Server) serveMap(w http.ResponseWriter, r *http.Request, mkey key.Machi
 	r.Body.Close()
 
 	req := new(tailcfg.MapRequest)
-	if err := s.decode(mkey, msg, req); err != nil {
+	if err := s.decode(mkey, overNoise, msg, req); err != nil {
 		go panic(fmt.Sprintf("bad map request: %v", err))
 	}
 
@@ -669,7 +758,7 @@ func (s *Server) serveMap(w http.ResponseWriter, r *http.Request, mkey key.Machi
 			s.logf("json.Marshal: %v", err)
 			return
 		}
-		if err := s.sendMapMsg(w, mkey, compress, resBytes); err != nil {
+		if err := s.sendMapMsg(w, mkey, overNoise, compress, resBytes); err != nil {
 			return
 		}
 		if !streaming {
@@ -696,7 +785,7 @@ func (s *Server) serveMap(w http.ResponseWriter, r *http.Request, mkey key.Machi
 				}
 				break keepAliveLoop
 			case <-keepAliveTimerCh:
-				if err := s.sendMapMsg(w, mkey, compress, keepAliveMsg); err != nil {
+				if err := s.sendMapMsg(w, mkey, overNoise, compress, keepAliveMsg); err != nil {
 					return
 				}
 			}
@@ -760,8 +849,8 @@ func (s *Server) MapResponse(req *tailcfg.MapRequest) (res *tailcfg.MapResponse,
 	return res, nil
 }
 
-func (s *Server) sendMapMsg(w http.ResponseWriter, mkey key.MachinePublic, compress bool, msg interface{}) error {
-	resBytes, err := s.encode(mkey, compress, msg)
+func (s *Server) sendMapMsg(w http.ResponseWriter, mkey key.MachinePublic, overNoise, compress bool, msg interface{}) error {
+	resBytes, err := s.encode(mkey, overNoise, compress, msg)
 	if err != nil {
 		return err
 	}
@@ -784,10 +873,15 @@ func (s *Server) sendMapMsg(w http.ResponseWriter, mkey key.MachinePublic, compr
 	return nil
 }
 
-func (s *Server) decode(mkey key.MachinePublic, msg []byte, v interface{}) error {
+// decode decodes msg from mkey into v. Unless it came over the Noise
+// transport, it's boxed.
+func (s *Server) decode(mkey key.MachinePublic, overNoise bool, msg []byte, v interface{}) error {
 	if len(msg) == msgLimit {
 		return errors.New("encrypted message too long")
 	}
+	if overNoise {
+		return json.Unmarshal(msg, v)
+	}
 
 	decrypted, ok := s.privateKey().OpenFrom(mkey, msg)
 	if !ok {
@@ -806,7 +900,9 @@ var zstdEncoderPool = &sync.Pool{
 	},
 }
 
-func (s *Server) encode(mkey key.MachinePublic, compress bool, v interface{}) (b []byte, err error) {
+// encode encodes v for mkey. Unless it's sent over the Noise
+// transport, it's boxed.
+func (s *Server) encode(mkey key.MachinePublic, overNoise, compress bool, v interface{}) (b []byte, err error) {
 	var isBytes bool
 	if b, isBytes = v.([]byte); !isBytes {
 		b, err = json.Marshal(v)
@@ -820,6 +916,9 @@ func (s *Server) encode(mkey key.MachinePublic, compress bool, v interface{}) (b
 		encoder.Close()
 		zstdEncoderPool.Put(encoder)
 	}
+	if overNoise {
+		return b, nil
+	}
 	return s.privateKey().SealTo(mkey, b), nil
 }
 
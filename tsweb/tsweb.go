@@ -387,6 +387,10 @@ func writePromExpVar(w io.Writer, prefix string, kv expvar.KeyValue) {
 			writePromExpVar(w, name+"_", kv)
 		})
 		return
+	case *metrics.Histogram:
+		fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+		v.WritePrometheus(w, name, "")
+		return
 	case PrometheusMetricsReflectRooter:
 		root := v.PrometheusMetricsReflectRoot()
 		rv := reflect.ValueOf(root)
@@ -489,6 +493,7 @@ func writePromExpVar(w io.Writer, prefix string, kv expvar.KeyValue) {
 // It makes the following assumptions:
 //
 //   * *expvar.Int are counters (unless marked as a gauge_; see below)
+//   * *tailscale/metrics.Histogram are histograms
 //   * a *tailscale/metrics.Set is descended into, joining keys with
 //     underscores. So use underscores as your metric names.
 //   * an expvar named starting with "gauge_" or "counter_" is of that
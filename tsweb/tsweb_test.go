@@ -432,6 +432,25 @@ func TestVarzHandler(t *testing.T) {
 			}(),
 			"# TYPE m counter\nm{keyname=\"bar\"} 2\nm{keyname=\"foo\"} 1\n",
 		},
+		{
+			"histogram",
+			"latency_seconds",
+			func() *metrics.Histogram {
+				h := metrics.NewHistogram(0.1, 1)
+				h.Observe(0.05)
+				h.Observe(0.5)
+				h.Observe(2)
+				return h
+			}(),
+			strings.TrimSpace(`
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 1
+latency_seconds_bucket{le="1"} 2
+latency_seconds_bucket{le="+Inf"} 3
+latency_seconds_sum 2.55
+latency_seconds_count 3
+`) + "\n",
+		},
 		{
 			"struct_reflect",
 			"foo",
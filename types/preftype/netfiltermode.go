@@ -16,6 +16,7 @@ const (
 	NetfilterOff      NetfilterMode = 0 // remove all tailscale netfilter state
 	NetfilterNoDivert NetfilterMode = 1 // manage tailscale chains, but don't call them
 	NetfilterOn       NetfilterMode = 2 // manage tailscale chains and call them from main chains
+	NetfilterNFTables NetfilterMode = 3 // like NetfilterOn, but with nftables instead of iptables
 )
 
 func (m NetfilterMode) String() string {
@@ -26,6 +27,8 @@ func (m NetfilterMode) String() string {
 		return "nodivert"
 	case NetfilterOn:
 		return "on"
+	case NetfilterNFTables:
+		return "nftables"
 	default:
 		return "???"
 	}
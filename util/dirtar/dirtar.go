@@ -0,0 +1,197 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package dirtar writes trees of files as tar archives and extracts
+// them again without writing outside the target directory, for
+// sending directories with Taildrop.
+package dirtar
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ContentType is the MIME type of the archives.
+const ContentType = "application/x-tar"
+
+// errBadName is returned by Extract for an unsafe or invalid name.
+// It doesn't include the name, so it can be logged.
+var errBadName = errors.New("bad file name in archive")
+
+// WriteDir writes the directories and regular files under dir to w,
+// named relative to dir. It fails on any other kind of file, such as
+// a symlink.
+func WriteDir(w io.Writer, dir string) error {
+	tw := tar.NewWriter(w)
+	if err := addTree(tw, dir, ""); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// WriteFiles writes paths, each a regular file or a directory, to w,
+// named by their base names. A directory's contents are written as
+// with WriteDir, under its base name.
+func WriteFiles(w io.Writer, paths []string) error {
+	tw := tar.NewWriter(w)
+	seen := map[string]bool{}
+	for _, p := range paths {
+		name := filepath.Base(p)
+		if seen[name] {
+			return fmt.Errorf("more than one file named %q", name)
+		}
+		seen[name] = true
+		if err := addTree(tw, p, name); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// addTree writes path to tw as name and, if it's a directory, its
+// contents under name. An empty name means to only write the
+// contents.
+func addTree(tw *tar.Writer, path, name string) error {
+	return filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(path, p)
+		if err != nil {
+			return err
+		}
+		entry := name
+		if rel != "." {
+			entry = strings.TrimPrefix(name+"/"+filepath.ToSlash(rel), "/")
+		}
+		if entry == "" {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case fi.IsDir():
+			return tw.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeDir,
+				Name:     entry + "/",
+				Mode:     0777,
+				ModTime:  fi.ModTime(),
+			})
+		case fi.Mode().IsRegular():
+			return addFile(tw, p, entry, fi)
+		}
+		return fmt.Errorf("%s: not a regular file or directory", p)
+	})
+}
+
+func addFile(tw *tar.Writer, path, name string, fi fs.FileInfo) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	err = tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     fi.Size(),
+		Mode:     int64(fi.Mode().Perm()),
+		ModTime:  fi.ModTime(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(tw, f, fi.Size())
+	return err
+}
+
+// Extract extracts the tar archive r into dir, which it creates and
+// which must not exist. The archive may only contain directories and
+// regular files, and each element of their names must be a valid file
+// name (and, if validName is non-nil, pass it), so Extract never
+// writes outside dir.
+//
+// Extract stops at the end of the archive, so the caller should drain
+// r if it needs anything after it.
+func Extract(r io.Reader, dir string, validName func(string) bool) error {
+	if err := os.Mkdir(dir, 0777); err != nil {
+		return err
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name, ok := cleanName(hdr.Name, validName)
+		if !ok {
+			return errBadName
+		}
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0777); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+				return err
+			}
+			if err := extractFile(path, hdr, tr); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unsupported archive entry type %q", hdr.Typeflag)
+		}
+	}
+}
+
+func extractFile(path string, hdr *tar.Header, r io.Reader) error {
+	var mode fs.FileMode = 0666
+	if hdr.Mode&0111 != 0 {
+		mode = 0777
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// cleanName returns the archive entry name as a slash-separated path
+// relative to the extraction directory, reporting whether it's safe
+// and valid.
+func cleanName(name string, validName func(string) bool) (string, bool) {
+	name = strings.TrimSuffix(name, "/")
+	if name == "" || strings.HasPrefix(name, "/") {
+		return "", false
+	}
+	for _, elem := range strings.Split(name, "/") {
+		switch elem {
+		case "", ".", "..":
+			return "", false
+		}
+		if strings.ContainsAny(elem, "\\:\x00") {
+			return "", false
+		}
+		if validName != nil && !validName(elem) {
+			return "", false
+		}
+	}
+	return name, true
+}
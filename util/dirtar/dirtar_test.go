@@ -0,0 +1,198 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dirtar
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func writeTree(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, contents := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if strings.HasSuffix(name, "/") {
+			if err := os.MkdirAll(path, 0777); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readTree returns the files under dir, with directories named with a
+// trailing slash and mapped to "".
+func readTree(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	got := map[string]string{}
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		rel = filepath.ToSlash(rel)
+		if fi.IsDir() {
+			got[rel+"/"] = ""
+			return nil
+		}
+		b, err := os.ReadFile(path)
+		got[rel] = string(b)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestRoundTrip(t *testing.T) {
+	tree := map[string]string{
+		"a.txt":         "a",
+		"empty/":        "",
+		"sub/b.txt":     "bb",
+		"sub/deep/c.sh": "#!/bin/sh\n",
+		"Ünïcode.txt":   "ü",
+	}
+	src := t.TempDir()
+	writeTree(t, src, tree)
+
+	var buf bytes.Buffer
+	if err := WriteDir(&buf, src); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(t.TempDir(), "out")
+	if err := Extract(&buf, dst, nil); err != nil {
+		t.Fatal(err)
+	}
+	got := readTree(t, dst)
+	want := map[string]string{"sub/": "", "sub/deep/": ""}
+	for k, v := range tree {
+		want[k] = v
+	}
+	if len(got) != len(want) {
+		t.Errorf("got %d entries %v; want %d", len(got), got, len(want))
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %q; want %q", k, got[k], v)
+		}
+	}
+
+	// Extracting into an existing directory fails.
+	if err := Extract(bytes.NewReader(nil), dst, nil); err == nil {
+		t.Error("Extract into existing directory succeeded")
+	}
+}
+
+func TestWriteFiles(t *testing.T) {
+	src := t.TempDir()
+	writeTree(t, src, map[string]string{
+		"a.txt":     "a",
+		"d/b.txt":   "b",
+		"x/a.txt":   "other a",
+		"empty.txt": "",
+	})
+	var buf bytes.Buffer
+	paths := []string{filepath.Join(src, "a.txt"), filepath.Join(src, "d"), filepath.Join(src, "empty.txt")}
+	if err := WriteFiles(&buf, paths); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(t.TempDir(), "out")
+	if err := Extract(&buf, dst, nil); err != nil {
+		t.Fatal(err)
+	}
+	got := readTree(t, dst)
+	want := map[string]string{"a.txt": "a", "d/": "", "d/b.txt": "b", "empty.txt": ""}
+	if len(got) != len(want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %q; want %q", k, got[k], v)
+		}
+	}
+
+	// Two files with the same base name can't be sent together.
+	paths = append(paths, filepath.Join(src, "x", "a.txt"))
+	if err := WriteFiles(&bytes.Buffer{}, paths); err == nil {
+		t.Error("WriteFiles with duplicate names succeeded")
+	}
+}
+
+func TestWriteDirSymlink(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks need privileges on Windows")
+	}
+	src := t.TempDir()
+	writeTree(t, src, map[string]string{"a.txt": "a"})
+	if err := os.Symlink("a.txt", filepath.Join(src, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteDir(&bytes.Buffer{}, src); err == nil {
+		t.Error("WriteDir with symlink succeeded")
+	}
+}
+
+func TestExtractUnsafe(t *testing.T) {
+	tests := []struct {
+		name string
+		hdr  tar.Header
+	}{
+		{"dotdot", tar.Header{Typeflag: tar.TypeReg, Name: "../evil"}},
+		{"dotdot_inner", tar.Header{Typeflag: tar.TypeReg, Name: "a/../../evil"}},
+		{"absolute", tar.Header{Typeflag: tar.TypeReg, Name: "/etc/evil"}},
+		{"backslash", tar.Header{Typeflag: tar.TypeReg, Name: "..\\evil"}},
+		{"empty_elem", tar.Header{Typeflag: tar.TypeReg, Name: "a//evil"}},
+		{"dot", tar.Header{Typeflag: tar.TypeDir, Name: "./"}},
+		{"symlink", tar.Header{Typeflag: tar.TypeSymlink, Name: "link", Linkname: "/etc"}},
+		{"hardlink", tar.Header{Typeflag: tar.TypeLink, Name: "link", Linkname: "/etc/passwd"}},
+		{"invalid", tar.Header{Typeflag: tar.TypeReg, Name: "bad.txt"}},
+	}
+	validName := func(name string) bool { return !strings.HasPrefix(name, "bad") }
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			tw := tar.NewWriter(&buf)
+			if err := tw.WriteHeader(&tt.hdr); err != nil {
+				t.Fatal(err)
+			}
+			if err := tw.Close(); err != nil {
+				t.Fatal(err)
+			}
+			root := t.TempDir()
+			dst := filepath.Join(root, "out")
+			if err := Extract(&buf, dst, validName); err == nil {
+				t.Fatal("Extract succeeded")
+			}
+			if got := readTree(t, root); len(got) != 1 {
+				t.Errorf("wrote %v; want only out/", got)
+			}
+		})
+	}
+}
+
+func TestExtractDuplicate(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for i := 0; i < 2; i++ {
+		tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "a.txt", Size: 1})
+		tw.Write([]byte("a"))
+	}
+	tw.Close()
+	if err := Extract(&buf, filepath.Join(t.TempDir(), "out"), nil); err == nil {
+		t.Error("Extract of duplicate file succeeded")
+	}
+}
@@ -0,0 +1,743 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filter
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/net/flowtrack"
+	"tailscale.com/net/packet"
+	"tailscale.com/tstime/mono"
+	"tailscale.com/types/ipproto"
+)
+
+// ConntrackTimeouts are the idle timeouts after which the filter
+// forgets a tracked flow. A flow's timer is reset by every packet in
+// either direction.
+type ConntrackTimeouts struct {
+	TCPHandshake   time.Duration // SYN seen, handshake not yet complete
+	TCPEstablished time.Duration // handshake complete, no FIN or RST seen
+	TCPClosing     time.Duration // FIN seen in at least one direction
+	TCPClosed      time.Duration // RST seen, or FIN seen in both directions
+	UDP            time.Duration // UDP and SCTP flows
+	ICMP           time.Duration // ICMP echo flows
+}
+
+// DefaultConntrackTimeouts are the timeouts used by a new Filter.
+var DefaultConntrackTimeouts = ConntrackTimeouts{
+	TCPHandshake:   time.Minute,
+	TCPEstablished: 5 * 24 * time.Hour,
+	TCPClosing:     2 * time.Minute,
+	TCPClosed:      10 * time.Second,
+	UDP:            2 * time.Minute,
+	ICMP:           30 * time.Second,
+}
+
+// ParseConntrackTimeouts parses a comma-separated list of
+// name=duration pairs, such as "udp=30s,tcp-established=1h", and
+// returns DefaultConntrackTimeouts with those timeouts replaced. The
+// names are tcp-handshake, tcp-established, tcp-closing, tcp-closed,
+// udp and icmp.
+func ParseConntrackTimeouts(s string) (ConntrackTimeouts, error) {
+	to := DefaultConntrackTimeouts
+	fields := map[string]*time.Duration{
+		"tcp-handshake":   &to.TCPHandshake,
+		"tcp-established": &to.TCPEstablished,
+		"tcp-closing":     &to.TCPClosing,
+		"tcp-closed":      &to.TCPClosed,
+		"udp":             &to.UDP,
+		"icmp":            &to.ICMP,
+	}
+	for _, kv := range strings.Split(s, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		i := strings.IndexByte(kv, '=')
+		if i == -1 {
+			return ConntrackTimeouts{}, fmt.Errorf("conntrack timeout %q: missing =", kv)
+		}
+		name, val := kv[:i], kv[i+1:]
+		p, ok := fields[name]
+		if !ok {
+			return ConntrackTimeouts{}, fmt.Errorf("unknown conntrack timeout %q", name)
+		}
+		d, err := time.ParseDuration(val)
+		if err != nil {
+			return ConntrackTimeouts{}, fmt.Errorf("conntrack timeout %s: %w", name, err)
+		}
+		if d <= 0 {
+			return ConntrackTimeouts{}, fmt.Errorf("conntrack timeout %s must be positive", name)
+		}
+		*p = d
+	}
+	return to, nil
+}
+
+// conntrackMaxEntries is the maximum number of flows tracked at once.
+// When the table is full, new flows aren't tracked until existing
+// ones expire, rather than evicting flows that may still be in use.
+const conntrackMaxEntries = 8192
+
+// conntrackMaxPerPeer is the maximum number of flows tracked at once
+// with a single peer IP, so that one peer can't use up the whole
+// table. New flows with a peer at its limit aren't tracked.
+const conntrackMaxPerPeer = conntrackMaxEntries / 4
+
+// conntrackShards is the number of shards the table is split into,
+// by tuple hash, so that packets of different flows rarely contend
+// for the same lock.
+const conntrackShards = 64
+
+// conntrackSweepInterval is how often expired flows are removed from
+// the table, as a side effect of tracking new flows. When the table
+// is full, they're removed at most every conntrackFullSweepInterval.
+const (
+	conntrackSweepInterval     = 30 * time.Second
+	conntrackFullSweepInterval = time.Second
+)
+
+// tcpState is the state of a tracked TCP connection.
+type tcpState uint8
+
+const (
+	tcpNone        tcpState = iota // not TCP
+	tcpSynSent                     // originator sent SYN
+	tcpSynRecv                     // responder sent SYN-ACK
+	tcpEstablished                 // handshake complete
+	tcpClosing                     // FIN seen in at least one direction
+	tcpClosed                      // RST seen, or FIN seen both ways
+)
+
+func (s tcpState) String() string {
+	switch s {
+	case tcpNone:
+		return ""
+	case tcpSynSent:
+		return "syn-sent"
+	case tcpSynRecv:
+		return "syn-recv"
+	case tcpEstablished:
+		return "established"
+	case tcpClosing:
+		return "closing"
+	case tcpClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// connEntry is the state of a single tracked flow.
+//
+// The counters and expiry are accessed atomically, as they're updated
+// with only a read lock on the entry's shard. The other fields only
+// change with the shard's lock held exclusively.
+type connEntry struct {
+	// The 64-bit atomic fields are first, for alignment on 32-bit
+	// platforms.
+	packetsIn, packetsOut uint64
+	bytesIn, bytesOut     uint64
+	expires               int64 // mono.Time
+
+	t        flowtrack.Tuple
+	outbound bool // whether this node sent the flow's first packet
+	tcp      tcpState
+	finIn    bool // FIN seen from the peer
+	finOut   bool // FIN seen from this node
+}
+
+func (e *connEntry) expiry() mono.Time {
+	return mono.Time(atomic.LoadInt64(&e.expires))
+}
+
+// ctShard is one shard of a conntrack table.
+type ctShard struct {
+	mu    sync.RWMutex
+	flows map[flowtrack.Tuple]*connEntry
+	free  []*connEntry // removed entries, for reuse
+}
+
+// conntrack is a connection tracking table. It is shared between
+// successive Filters so that rule changes don't break established
+// flows.
+//
+// Flows are keyed by their tuple as seen on inbound packets: Src is
+// the peer and Dst is this node (or a subnet behind it).
+//
+// The table is split into shards by tuple hash. Packets of tracked
+// flows only take their shard's read lock, unless they change the
+// state of a TCP connection; new flows take the shard's lock
+// exclusively. Removed entries are reused, so tracking a new flow
+// doesn't allocate once the table has warmed up.
+type conntrack struct {
+	lastSweep int64 // mono.Time; accessed atomically, first for alignment
+
+	// now returns the current time. It's only changed by tests.
+	now func() mono.Time
+
+	timeouts atomic.Value // of *ConntrackTimeouts
+
+	shards [conntrackShards]ctShard
+
+	// mu guards the flow counts. It's acquired after a shard's mu.
+	mu    sync.Mutex
+	n     int                // number of flows, including expired ones not yet removed
+	peers map[netaddr.IP]int // number of flows by peer IP
+}
+
+func newConntrack() *conntrack {
+	ct := &conntrack{
+		now:   mono.Now,
+		peers: make(map[netaddr.IP]int),
+	}
+	ct.setTimeouts(DefaultConntrackTimeouts)
+	for i := range ct.shards {
+		ct.shards[i].flows = make(map[flowtrack.Tuple]*connEntry)
+	}
+	return ct
+}
+
+// shard returns the shard that tracks t.
+func (ct *conntrack) shard(t flowtrack.Tuple) *ctShard {
+	// FNV-1a over the parts of the tuple that vary most between
+	// flows: the ports and the low bytes of the peer IP.
+	const prime = 16777619
+	h := uint32(2166136261)
+	ip := t.Src.IP().As16()
+	for _, b := range ip[12:] {
+		h = (h ^ uint32(b)) * prime
+	}
+	h = (h ^ uint32(t.Src.Port())) * prime
+	h = (h ^ uint32(t.Dst.Port())) * prime
+	return &ct.shards[h%conntrackShards]
+}
+
+// inTuple returns the inbound-oriented tuple for q.
+func inTuple(q *packet.Parsed, dir direction) flowtrack.Tuple {
+	if dir == out {
+		return flowtrack.Tuple{Proto: q.IPProto, Src: q.Dst, Dst: q.Src}
+	}
+	return flowtrack.Tuple{Proto: q.IPProto, Src: q.Src, Dst: q.Dst}
+}
+
+// icmpTuple returns the inbound-oriented tuple used for ICMP echo
+// flows, which are tracked per IP pair.
+func icmpTuple(q *packet.Parsed, dir direction) flowtrack.Tuple {
+	src, dst := q.Src.IP(), q.Dst.IP()
+	if dir == out {
+		src, dst = dst, src
+	}
+	return flowtrack.Tuple{
+		Proto: q.IPProto,
+		Src:   netaddr.IPPortFrom(src, 0),
+		Dst:   netaddr.IPPortFrom(dst, 0),
+	}
+}
+
+// icmpErrorTuple returns the inbound-oriented tuple of the flow that
+// the ICMP error q is about, parsed from the start of the offending
+// packet that q quotes. That packet was sent to the peer, so it must
+// come from q's destination. It reports false if q quotes no such
+// packet.
+func icmpErrorTuple(q *packet.Parsed) (t flowtrack.Tuple, ok bool) {
+	// The quoted packet follows the 4 bytes of the ICMP header
+	// after the type, code and checksum.
+	b := q.Payload()
+	if len(b) < 4 {
+		return t, false
+	}
+	b = b[4:]
+	var src, dst netaddr.IP
+	var sub []byte
+	switch q.IPProto {
+	case ipproto.ICMPv4:
+		if len(b) < 20 || b[0]>>4 != 4 {
+			return t, false
+		}
+		hlen := int(b[0]&0x0F) << 2
+		if hlen < 20 || len(b) < hlen+8 || binary.BigEndian.Uint16(b[6:8])&0x1FFF != 0 {
+			// Truncated, or not a first fragment.
+			return t, false
+		}
+		t.Proto = ipproto.Proto(b[9])
+		src = netaddr.IPv4(b[12], b[13], b[14], b[15])
+		dst = netaddr.IPv4(b[16], b[17], b[18], b[19])
+		sub = b[hlen:]
+	case ipproto.ICMPv6:
+		if len(b) < 48 || b[0]>>4 != 6 {
+			return t, false
+		}
+		t.Proto = ipproto.Proto(b[6])
+		var a16 [16]byte
+		copy(a16[:], b[8:24])
+		src = netaddr.IPFrom16(a16)
+		copy(a16[:], b[24:40])
+		dst = netaddr.IPFrom16(a16)
+		sub = b[40:]
+	default:
+		return t, false
+	}
+	if src != q.Dst.IP() {
+		return t, false
+	}
+	var sport, dport uint16
+	switch t.Proto {
+	case ipproto.TCP, ipproto.UDP, ipproto.SCTP:
+		sport = binary.BigEndian.Uint16(sub[0:2])
+		dport = binary.BigEndian.Uint16(sub[2:4])
+	case ipproto.ICMPv4:
+		if packet.ICMP4Type(sub[0]) != packet.ICMP4EchoRequest {
+			return t, false
+		}
+	case ipproto.ICMPv6:
+		if packet.ICMP6Type(sub[0]) != packet.ICMP6EchoRequest {
+			return t, false
+		}
+	default:
+		return t, false
+	}
+	t.Src = netaddr.IPPortFrom(dst, dport)
+	t.Dst = netaddr.IPPortFrom(src, sport)
+	return t, true
+}
+
+// lookupIn reports whether the inbound packet q belongs to a flow that
+// is already tracked and, if so, updates the flow's state. A nil
+// conntrack tracks no flows; Filter.Check uses one to evaluate only
+// the rules.
+func (ct *conntrack) lookupIn(q *packet.Parsed) bool {
+	if ct == nil {
+		return false
+	}
+	t := inTuple(q, in)
+	now := ct.now()
+	sh := ct.shard(t)
+	found, done := ct.updateShared(sh, t, q, in, now)
+	if !found || done {
+		return found
+	}
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	e := sh.get(t, now)
+	if e == nil {
+		return false
+	}
+	if e.tcp == tcpClosed && q.IsTCPSyn() && e.outbound {
+		// A new connection from the peer reusing the tuple of
+		// one this node opened; it's up to the rules.
+		return false
+	}
+	ct.update(e, q, in, now)
+	return true
+}
+
+// icmpResponseOK reports whether the inbound ICMP echo response or
+// error q should be allowed: echo responses must answer a tracked
+// echo request, and errors must be about a tracked flow. Errors may
+// come from any router on the path, such as one behind a subnet
+// router, not just from the peer. A nil conntrack tracks no flows, as
+// in lookupIn.
+func (ct *conntrack) icmpResponseOK(q *packet.Parsed) bool {
+	if ct == nil {
+		return false
+	}
+	now := ct.now()
+	if q.IsEchoResponse() {
+		t := icmpTuple(q, in)
+		found, _ := ct.updateShared(ct.shard(t), t, q, in, now)
+		return found
+	}
+	t, ok := icmpErrorTuple(q)
+	if !ok {
+		return false
+	}
+	sh := ct.shard(t)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	return sh.get(t, now) != nil
+}
+
+// acceptedIn records that the inbound packet q was accepted by the
+// filter rules, starting to track its flow if it isn't already.
+func (ct *conntrack) acceptedIn(q *packet.Parsed) {
+	switch q.IPProto {
+	case ipproto.TCP:
+		if !q.IsTCPSyn() {
+			return
+		}
+	case ipproto.UDP, ipproto.SCTP:
+	default:
+		return
+	}
+	t := inTuple(q, in)
+	now := ct.now()
+	ct.maybeSweep(now)
+	sh := ct.shard(t)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	e := sh.get(t, now)
+	if e == nil || e.tcp == tcpClosed {
+		if e = ct.addLocked(sh, t, false, now); e == nil {
+			return
+		}
+	}
+	ct.update(e, q, in, now)
+}
+
+// trackOut records the outbound packet q, starting to track its flow
+// if it isn't already. Outbound packets come from this node (or a
+// subnet behind it), so they're trusted to open flows.
+func (ct *conntrack) trackOut(q *packet.Parsed) {
+	var t flowtrack.Tuple
+	switch q.IPProto {
+	case ipproto.TCP, ipproto.UDP, ipproto.SCTP:
+		t = inTuple(q, out)
+	case ipproto.ICMPv4, ipproto.ICMPv6:
+		if !q.IsEchoRequest() {
+			return
+		}
+		t = icmpTuple(q, out)
+	default:
+		return
+	}
+	now := ct.now()
+	sh := ct.shard(t)
+	if _, done := ct.updateShared(sh, t, q, out, now); done {
+		return
+	}
+	ct.maybeSweep(now)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	e := sh.get(t, now)
+	if e == nil || (e.tcp == tcpClosed && q.IsTCPSyn()) {
+		if q.IPProto == ipproto.TCP && q.TCPFlags&packet.TCPRst != 0 {
+			// Don't start tracking a flow just to reset it.
+			return
+		}
+		// A SYN-ACK without state means the peer opened the
+		// connection (e.g. to a port allowed by a previous
+		// filter); otherwise assume we did.
+		outbound := !(q.IPProto == ipproto.TCP && q.TCPFlags&packet.TCPSynAck == packet.TCPSynAck)
+		if e = ct.addLocked(sh, t, outbound, now); e == nil {
+			return
+		}
+		if q.IPProto == ipproto.TCP && outbound && !q.IsTCPSyn() {
+			// Picked up mid-stream, such as after a restart.
+			e.tcp = tcpEstablished
+		}
+	}
+	ct.update(e, q, out, now)
+}
+
+// updateShared updates the tracked flow t for packet q flowing in
+// dir, holding only sh's read lock. It reports whether t is tracked,
+// and whether it was updated: it isn't if q might change the flow's
+// TCP state, which requires sh's lock to be held exclusively.
+func (ct *conntrack) updateShared(sh *ctShard, t flowtrack.Tuple, q *packet.Parsed, dir direction, now mono.Time) (found, done bool) {
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	e := sh.get(t, now)
+	if e == nil {
+		return false, false
+	}
+	if q.IPProto == ipproto.TCP && (q.TCPFlags&(packet.TCPSyn|packet.TCPFin|packet.TCPRst) != 0 || e.tcp == tcpSynRecv) {
+		return true, false
+	}
+	ct.update(e, q, dir, now)
+	return true, true
+}
+
+// get returns the unexpired flow for t, or nil.
+// sh.mu must be held, for reading or writing.
+func (sh *ctShard) get(t flowtrack.Tuple, now mono.Time) *connEntry {
+	e := sh.flows[t]
+	if e == nil || now.After(e.expiry()) {
+		return nil
+	}
+	return e
+}
+
+// addLocked starts tracking a new flow t in sh, replacing any existing
+// one. It returns nil, tracking nothing, if the table or t's peer is
+// full.
+// sh.mu must be held.
+func (ct *conntrack) addLocked(sh *ctShard, t flowtrack.Tuple, outbound bool, now mono.Time) *connEntry {
+	if e, ok := sh.flows[t]; ok {
+		ct.removeLocked(sh, e)
+	}
+	peer := t.Src.IP()
+	ct.mu.Lock()
+	if ct.n >= conntrackMaxEntries || ct.peers[peer] >= conntrackMaxPerPeer {
+		ct.mu.Unlock()
+		return nil
+	}
+	ct.n++
+	ct.peers[peer]++
+	ct.mu.Unlock()
+
+	var e *connEntry
+	if n := len(sh.free); n > 0 {
+		e = sh.free[n-1]
+		sh.free = sh.free[:n-1]
+		*e = connEntry{}
+	} else {
+		e = new(connEntry)
+	}
+	e.t = t
+	e.outbound = outbound
+	if t.Proto == ipproto.TCP {
+		e.tcp = tcpSynSent
+	}
+	sh.flows[t] = e
+	return e
+}
+
+// removeLocked stops tracking the flow e in sh.
+// sh.mu must be held.
+func (ct *conntrack) removeLocked(sh *ctShard, e *connEntry) {
+	delete(sh.flows, e.t)
+	sh.free = append(sh.free, e)
+
+	peer := e.t.Src.IP()
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	ct.n--
+	if n := ct.peers[peer] - 1; n > 0 {
+		ct.peers[peer] = n
+	} else {
+		delete(ct.peers, peer)
+	}
+}
+
+// maybeSweep removes all expired flows if it's been
+// conntrackSweepInterval since the last sweep, or
+// conntrackFullSweepInterval if the table is full. Sweeps are O(n),
+// so they're rate limited.
+func (ct *conntrack) maybeSweep(now mono.Time) {
+	last := atomic.LoadInt64(&ct.lastSweep)
+	since := now.Sub(mono.Time(last))
+	if since < conntrackFullSweepInterval {
+		return
+	}
+	if since < conntrackSweepInterval {
+		ct.mu.Lock()
+		full := ct.n >= conntrackMaxEntries
+		ct.mu.Unlock()
+		if !full {
+			return
+		}
+	}
+	if !atomic.CompareAndSwapInt64(&ct.lastSweep, last, int64(now)) {
+		// Another goroutine is sweeping.
+		return
+	}
+	for i := range ct.shards {
+		sh := &ct.shards[i]
+		sh.mu.Lock()
+		for _, e := range sh.flows {
+			if now.After(e.expiry()) {
+				ct.removeLocked(sh, e)
+			}
+		}
+		sh.mu.Unlock()
+	}
+}
+
+// update advances e's state for packet q flowing in dir and extends
+// its expiry.
+// e's shard's mu must be held, exclusively if q might change e's TCP
+// state (see updateShared).
+func (ct *conntrack) update(e *connEntry, q *packet.Parsed, dir direction, now mono.Time) {
+	n := uint64(len(q.Buffer()))
+	if dir == in {
+		atomic.AddUint64(&e.packetsIn, 1)
+		atomic.AddUint64(&e.bytesIn, n)
+	} else {
+		atomic.AddUint64(&e.packetsOut, 1)
+		atomic.AddUint64(&e.bytesOut, n)
+	}
+
+	to := ct.timeouts.Load().(*ConntrackTimeouts)
+	var timeout time.Duration
+	switch q.IPProto {
+	case ipproto.TCP:
+		e.updateTCP(q.TCPFlags, dir)
+		switch e.tcp {
+		case tcpSynSent, tcpSynRecv:
+			timeout = to.TCPHandshake
+		case tcpEstablished:
+			timeout = to.TCPEstablished
+		case tcpClosing:
+			timeout = to.TCPClosing
+		default:
+			timeout = to.TCPClosed
+		}
+	case ipproto.ICMPv4, ipproto.ICMPv6:
+		timeout = to.ICMP
+	default:
+		timeout = to.UDP
+	}
+	atomic.StoreInt64(&e.expires, int64(now.Add(timeout)))
+}
+
+// updateTCP advances e's TCP state machine for a packet with the
+// given flags flowing in dir.
+func (e *connEntry) updateTCP(flags packet.TCPFlag, dir direction) {
+	fromOriginator := (dir == out) == e.outbound
+	switch {
+	case flags&packet.TCPRst != 0:
+		e.tcp = tcpClosed
+	case flags&packet.TCPSynAck == packet.TCPSyn:
+		if e.tcp == tcpClosed && fromOriginator {
+			// Port reuse after the previous connection closed.
+			e.tcp = tcpSynSent
+			e.finIn, e.finOut = false, false
+			atomic.StoreUint64(&e.packetsIn, 0)
+			atomic.StoreUint64(&e.packetsOut, 0)
+			atomic.StoreUint64(&e.bytesIn, 0)
+			atomic.StoreUint64(&e.bytesOut, 0)
+		}
+	case flags&packet.TCPSynAck == packet.TCPSynAck:
+		if e.tcp == tcpSynSent && !fromOriginator {
+			e.tcp = tcpSynRecv
+		}
+	default:
+		if flags&packet.TCPAck != 0 && e.tcp == tcpSynRecv && fromOriginator {
+			e.tcp = tcpEstablished
+		}
+		if flags&packet.TCPFin != 0 && e.tcp != tcpClosed {
+			if dir == in {
+				e.finIn = true
+			} else {
+				e.finOut = true
+			}
+			if e.finIn && e.finOut {
+				e.tcp = tcpClosed
+			} else {
+				e.tcp = tcpClosing
+			}
+		}
+	}
+}
+
+// setTimeouts changes the timeouts used for flows from now on.
+func (ct *conntrack) setTimeouts(to ConntrackTimeouts) {
+	ct.timeouts.Store(&to)
+}
+
+// FlowInfo describes a flow tracked by the filter.
+type FlowInfo struct {
+	Proto ipproto.Proto
+
+	// Src and Dst are the flow's endpoints, oriented in the
+	// direction of the flow's first packet.
+	Src, Dst netaddr.IPPort
+
+	// Peer is the remote (Tailscale side) IP of the flow.
+	Peer netaddr.IP
+
+	// Outbound is whether this node (or a subnet behind it)
+	// opened the flow.
+	Outbound bool
+
+	// TCPState is the state of a TCP flow, such as "established".
+	// It's empty for other protocols.
+	TCPState string `json:",omitempty"`
+
+	// Expires is when the flow will be forgotten if idle.
+	Expires time.Time
+
+	PacketsIn, PacketsOut uint64
+	BytesIn, BytesOut     uint64
+}
+
+// snapshot returns all unexpired flows, sorted by peer and then by
+// tuple.
+func (ct *conntrack) snapshot() []FlowInfo {
+	now := ct.now()
+	var ret []FlowInfo
+	for i := range ct.shards {
+		sh := &ct.shards[i]
+		sh.mu.RLock()
+		for t, e := range sh.flows {
+			expires := e.expiry()
+			if now.After(expires) {
+				continue
+			}
+			fi := FlowInfo{
+				Proto:      t.Proto,
+				Src:        t.Src,
+				Dst:        t.Dst,
+				Peer:       t.Src.IP(),
+				Outbound:   e.outbound,
+				TCPState:   e.tcp.String(),
+				Expires:    time.Now().Add(expires.Sub(now)),
+				PacketsIn:  atomic.LoadUint64(&e.packetsIn),
+				PacketsOut: atomic.LoadUint64(&e.packetsOut),
+				BytesIn:    atomic.LoadUint64(&e.bytesIn),
+				BytesOut:   atomic.LoadUint64(&e.bytesOut),
+			}
+			if e.outbound {
+				fi.Src, fi.Dst = fi.Dst, fi.Src
+			}
+			ret = append(ret, fi)
+		}
+		sh.mu.RUnlock()
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		a, b := ret[i], ret[j]
+		if a.Peer != b.Peer {
+			return a.Peer.Less(b.Peer)
+		}
+		if a.Proto != b.Proto {
+			return a.Proto < b.Proto
+		}
+		if a.Src != b.Src {
+			return a.Src.IP().Less(b.Src.IP()) || (a.Src.IP() == b.Src.IP() && a.Src.Port() < b.Src.Port())
+		}
+		return a.Dst.IP().Less(b.Dst.IP()) || (a.Dst.IP() == b.Dst.IP() && a.Dst.Port() < b.Dst.Port())
+	})
+	return ret
+}
+
+// Flows returns the flows currently tracked by f's connection
+// tracker, grouped by peer.
+func (f *Filter) Flows() []FlowInfo {
+	return f.state.snapshot()
+}
+
+// FlowCountsByPeer returns the number of flows currently tracked for
+// each peer IP.
+func (f *Filter) FlowCountsByPeer() map[netaddr.IP]int {
+	f.state.mu.Lock()
+	defer f.state.mu.Unlock()
+	ret := make(map[netaddr.IP]int, len(f.state.peers))
+	for ip, n := range f.state.peers {
+		ret[ip] = n
+	}
+	return ret
+}
+
+// SetConntrackTimeouts sets the idle timeouts of f's connection
+// tracker. The tracker is shared with Filters created from f with
+// shareStateWith, so the change applies to them too.
+func (f *Filter) SetConntrackTimeouts(to ConntrackTimeouts) {
+	f.state.setTimeouts(to)
+}
+
+// TrackOutbound records that q is being sent to a Tailscale peer
+// without otherwise filtering it. It's used for packets that bypass
+// RunOut, such as those injected by netstack, so that replies to them
+// are permitted.
+func (f *Filter) TrackOutbound(q *packet.Parsed) {
+	f.state.trackOut(q)
+}
@@ -0,0 +1,433 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filter
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/net/packet"
+	"tailscale.com/tstest"
+	"tailscale.com/tstime/mono"
+	"tailscale.com/types/ipproto"
+)
+
+// fakeClock returns a func suitable for conntrack.now and a func to
+// advance it.
+func fakeClock() (now func() mono.Time, advance func(time.Duration)) {
+	t := mono.Now()
+	return func() mono.Time { return t }, func(d time.Duration) { t = t.Add(d) }
+}
+
+func tcpParsed(src, dst string, sport, dport uint16, flags packet.TCPFlag) *packet.Parsed {
+	p := parsed(ipproto.TCP, src, dst, sport, dport)
+	p.TCPFlags = flags
+	return &p
+}
+
+func TestConntrackTCP(t *testing.T) {
+	acl := newFilter(t.Logf)
+	now, advance := fakeClock()
+	acl.state.now = now
+
+	// 8.1.1.1 may only connect to 1.2.3.4:22, not 1.2.3.4:80.
+	const peer, local = "8.1.1.1", "1.2.3.4"
+
+	// Unsolicited non-SYN segments to a port that isn't open are
+	// dropped.
+	if got := acl.RunIn(tcpParsed(peer, local, 80, 5000, packet.TCPAck), 0); got != Drop {
+		t.Fatalf("injected ACK = %v; want Drop", got)
+	}
+	if got := acl.RunIn(tcpParsed(peer, local, 80, 5000, packet.TCPSynAck), 0); got != Drop {
+		t.Fatalf("injected SYN-ACK = %v; want Drop", got)
+	}
+
+	// We open a connection to the peer; its replies get in.
+	if got := acl.RunOut(tcpParsed(local, peer, 5000, 80, packet.TCPSyn), 0); got != Accept {
+		t.Fatalf("outbound SYN = %v; want Accept", got)
+	}
+	if got := acl.RunIn(tcpParsed(peer, local, 80, 5000, packet.TCPSynAck), 0); got != Accept {
+		t.Fatalf("SYN-ACK = %v; want Accept", got)
+	}
+	acl.RunOut(tcpParsed(local, peer, 5000, 80, packet.TCPAck), 0)
+	if got := acl.RunIn(tcpParsed(peer, local, 80, 5000, packet.TCPAck), 0); got != Accept {
+		t.Fatalf("ACK = %v; want Accept", got)
+	}
+	flows := acl.Flows()
+	if len(flows) != 1 {
+		t.Fatalf("got %d flows; want 1: %+v", len(flows), flows)
+	}
+	fl := flows[0]
+	if !fl.Outbound || fl.TCPState != "established" || fl.Peer != mustIP(peer) {
+		t.Errorf("unexpected flow %+v", fl)
+	}
+	if fl.Src != netaddr.IPPortFrom(mustIP(local), 5000) || fl.Dst != netaddr.IPPortFrom(mustIP(peer), 80) {
+		t.Errorf("flow endpoints = %v -> %v; want %v:5000 -> %v:80", fl.Src, fl.Dst, local, peer)
+	}
+	if fl.PacketsIn != 2 || fl.PacketsOut != 2 {
+		t.Errorf("packets in/out = %d/%d; want 2/2", fl.PacketsIn, fl.PacketsOut)
+	}
+	if got := acl.FlowCountsByPeer()[mustIP(peer)]; got != 1 {
+		t.Errorf("FlowCountsByPeer = %d; want 1", got)
+	}
+
+	// A RST closes the connection, after which it expires quickly.
+	if got := acl.RunIn(tcpParsed(peer, local, 80, 5000, packet.TCPRst), 0); got != Accept {
+		t.Fatalf("RST = %v; want Accept", got)
+	}
+	advance(DefaultConntrackTimeouts.TCPClosed + time.Second)
+	if got := acl.RunIn(tcpParsed(peer, local, 80, 5000, packet.TCPAck), 0); got != Drop {
+		t.Fatalf("ACK after close = %v; want Drop", got)
+	}
+	if flows := acl.Flows(); len(flows) != 0 {
+		t.Errorf("flows after close = %+v; want none", flows)
+	}
+}
+
+func TestConntrackTCPInbound(t *testing.T) {
+	acl := newFilter(t.Logf)
+	now, advance := fakeClock()
+	acl.state.now = now
+
+	const peer, local = "8.1.1.1", "1.2.3.4"
+	if got := acl.RunIn(tcpParsed(peer, local, 5000, 22, packet.TCPSyn), 0); got != Accept {
+		t.Fatalf("SYN = %v; want Accept", got)
+	}
+
+	// Switch to a filter that no longer allows port 22, sharing
+	// state: the established connection keeps working, but new
+	// connections are refused.
+	acl2 := NewAllowNone(t.Logf, &netaddr.IPSet{})
+	acl2.state = acl.state
+	acl2.local = acl.local
+	acl2.RunOut(tcpParsed(local, peer, 22, 5000, packet.TCPSynAck), 0)
+	if got := acl2.RunIn(tcpParsed(peer, local, 5000, 22, packet.TCPAck), 0); got != Accept {
+		t.Fatalf("ACK = %v; want Accept", got)
+	}
+	if fl := acl2.Flows(); len(fl) != 1 || fl[0].Outbound || fl[0].TCPState != "established" {
+		t.Fatalf("unexpected flows %+v", fl)
+	}
+	if got := acl2.RunIn(tcpParsed(peer, local, 5001, 22, packet.TCPSyn), 0); got != Drop {
+		t.Fatalf("new SYN = %v; want Drop", got)
+	}
+
+	// FIN in both directions closes the connection.
+	acl2.RunIn(tcpParsed(peer, local, 5000, 22, packet.TCPFin|packet.TCPAck), 0)
+	if fl := acl2.Flows(); len(fl) != 1 || fl[0].TCPState != "closing" {
+		t.Fatalf("unexpected flows after FIN %+v", fl)
+	}
+	acl2.RunOut(tcpParsed(local, peer, 22, 5000, packet.TCPFin|packet.TCPAck), 0)
+	advance(DefaultConntrackTimeouts.TCPClosed + time.Second)
+	if got := acl2.RunIn(tcpParsed(peer, local, 5000, 22, packet.TCPAck), 0); got != Drop {
+		t.Fatalf("ACK after FINs = %v; want Drop", got)
+	}
+}
+
+func TestConntrackUDPExpiry(t *testing.T) {
+	acl := newFilter(t.Logf)
+	now, advance := fakeClock()
+	acl.state.now = now
+	acl.SetConntrackTimeouts(ConntrackTimeouts{UDP: time.Minute})
+
+	a4 := parsed(ipproto.UDP, "119.119.119.119", "102.102.102.102", 4242, 4343)
+	b4 := parsed(ipproto.UDP, "102.102.102.102", "119.119.119.119", 4343, 4242)
+
+	acl.RunOut(&b4, 0)
+	advance(59 * time.Second)
+	if got := acl.RunIn(&a4, 0); got != Accept {
+		t.Fatalf("reply before expiry = %v; want Accept", got)
+	}
+	// The reply extended the flow.
+	advance(59 * time.Second)
+	if got := acl.RunIn(&a4, 0); got != Accept {
+		t.Fatalf("reply after extension = %v; want Accept", got)
+	}
+	advance(61 * time.Second)
+	if got := acl.RunIn(&a4, 0); got != Drop {
+		t.Fatalf("reply after expiry = %v; want Drop", got)
+	}
+}
+
+func TestConntrackICMP(t *testing.T) {
+	// A filter with no rules, so ICMP is only allowed in when
+	// related to a tracked flow.
+	var localNets netaddr.IPSetBuilder
+	localNets.AddPrefix(netaddr.MustParseIPPrefix("102.102.102.102/32"))
+	localSet, _ := localNets.IPSet()
+	acl := New(nil, localSet, &netaddr.IPSet{}, nil, t.Logf)
+
+	icmp := func(src, dst string, typ packet.ICMP4Type, payload []byte) *packet.Parsed {
+		h := packet.ICMP4Header{
+			IP4Header: packet.IP4Header{
+				IPProto: ipproto.ICMPv4,
+				Src:     mustIP(src),
+				Dst:     mustIP(dst),
+			},
+			Type: typ,
+		}
+		p := new(packet.Parsed)
+		p.Decode(packet.Generate(h, payload))
+		return p
+	}
+	// icmpErr returns an ICMP error quoting the start of a UDP
+	// packet from src to dst.
+	icmpErr := func(from, src, dst string, typ packet.ICMP4Type) *packet.Parsed {
+		quoted := packet.Generate(packet.UDP4Header{
+			IP4Header: packet.IP4Header{
+				IPProto: ipproto.UDP,
+				Src:     mustIP(src),
+				Dst:     mustIP(dst),
+			},
+			SrcPort: 4000,
+			DstPort: 53,
+		}, []byte("query payload"))
+		return icmp(from, src, typ, append(make([]byte, 4), quoted[:28]...))
+	}
+
+	// The peer may not send us echo replies we didn't ask for.
+	const peer, local = "17.1.1.1", "102.102.102.102"
+	if got := acl.RunIn(icmp(peer, local, packet.ICMP4EchoReply, []byte("payload")), 0); got != Drop {
+		t.Fatalf("unsolicited echo reply = %v; want Drop", got)
+	}
+	acl.RunOut(icmp(local, peer, packet.ICMP4EchoRequest, []byte("payload")), 0)
+	if got := acl.RunIn(icmp(peer, local, packet.ICMP4EchoReply, []byte("payload")), 0); got != Accept {
+		t.Fatalf("echo reply = %v; want Accept", got)
+	}
+
+	// ICMP errors about flows we didn't open are dropped.
+	if got := acl.RunIn(icmpErr(peer, local, peer, packet.ICMP4Unreachable), 0); got != Drop {
+		t.Fatalf("unreachable for untracked flow = %v; want Drop", got)
+	}
+	if got := acl.RunIn(icmp(peer, local, packet.ICMP4Unreachable, []byte("too short")), 0); got != Drop {
+		t.Fatalf("unreachable without quoted packet = %v; want Drop", got)
+	}
+
+	// Errors about a tracked flow are allowed from anywhere, as
+	// they may come from routers behind a subnet router.
+	udp := parsed(ipproto.UDP, local, peer, 4000, 53)
+	acl.RunOut(&udp, 0)
+	if got := acl.RunIn(icmpErr("17.9.9.9", local, peer, packet.ICMP4Unreachable), 0); got != Accept {
+		t.Fatalf("unreachable = %v; want Accept", got)
+	}
+	if got := acl.RunIn(icmpErr("17.9.9.9", local, peer, packet.ICMP4TimeExceeded), 0); got != Accept {
+		t.Fatalf("time exceeded = %v; want Accept", got)
+	}
+	// But not if they quote a packet we didn't send.
+	if got := acl.RunIn(icmpErr(peer, "102.102.102.103", peer, packet.ICMP4Unreachable), 0); got != Drop {
+		t.Fatalf("unreachable for another sender = %v; want Drop", got)
+	}
+
+	// Errors about our echo requests are allowed too.
+	echo := packet.Generate(packet.ICMP4Header{
+		IP4Header: packet.IP4Header{
+			IPProto: ipproto.ICMPv4,
+			Src:     mustIP(local),
+			Dst:     mustIP(peer),
+		},
+		Type: packet.ICMP4EchoRequest,
+	}, make([]byte, 8))
+	if got := acl.RunIn(icmp("17.9.9.9", local, packet.ICMP4TimeExceeded, append(make([]byte, 4), echo[:28]...)), 0); got != Accept {
+		t.Fatalf("time exceeded for echo request = %v; want Accept", got)
+	}
+}
+
+func TestConntrackFull(t *testing.T) {
+	ct := newConntrack()
+	now, advance := fakeClock()
+	ct.now = now
+
+	// Fill the table with flows from 8 peers.
+	const peers = conntrackMaxEntries / conntrackMaxPerPeer * 2
+	peerIP := func(i int) string { return fmt.Sprintf("8.1.1.%d", i+1) }
+	for i := 0; i < conntrackMaxEntries; i++ {
+		p := parsed(ipproto.UDP, "1.2.3.4", peerIP(i%peers), uint16(i), 53)
+		ct.trackOut(&p)
+		advance(time.Millisecond)
+	}
+	if got := ct.n; got != conntrackMaxEntries {
+		t.Fatalf("flows = %d; want %d", got, conntrackMaxEntries)
+	}
+
+	// A new flow isn't tracked, and doesn't evict any flows.
+	p := parsed(ipproto.UDP, "1.2.3.4", "8.2.2.2", 1, 53)
+	ct.trackOut(&p)
+	if got := ct.n; got != conntrackMaxEntries {
+		t.Errorf("flows = %d; want %d", got, conntrackMaxEntries)
+	}
+	reply := parsed(ipproto.UDP, "8.2.2.2", "1.2.3.4", 53, 1)
+	if ct.lookupIn(&reply) {
+		t.Errorf("new flow tracked in full table")
+	}
+	oldest := parsed(ipproto.UDP, peerIP(0), "1.2.3.4", 53, 0)
+	if !ct.lookupIn(&oldest) {
+		t.Errorf("oldest flow not tracked")
+	}
+	checkConntrackCounts(t, ct)
+
+	// Once the other flows expire, there's room again.
+	advance(DefaultConntrackTimeouts.UDP - time.Second)
+	ct.lookupIn(&oldest)
+	advance(2 * time.Second)
+	ct.trackOut(&p)
+	if !ct.lookupIn(&reply) {
+		t.Errorf("new flow not tracked after others expired")
+	}
+	if !ct.lookupIn(&oldest) {
+		t.Errorf("active flow removed")
+	}
+	if got := ct.n; got != 2 {
+		t.Errorf("flows = %d; want 2", got)
+	}
+	checkConntrackCounts(t, ct)
+}
+
+func TestConntrackPerPeerLimit(t *testing.T) {
+	ct := newConntrack()
+	now, advance := fakeClock()
+	ct.now = now
+
+	other := parsed(ipproto.UDP, "1.2.3.4", "8.2.2.2", 1000, 53)
+	ct.trackOut(&other)
+	advance(time.Millisecond)
+
+	// A busy peer only ever gets conntrackMaxPerPeer flows, and
+	// doesn't affect the other peer's flow.
+	for i := 0; i < conntrackMaxPerPeer*2; i++ {
+		p := parsed(ipproto.UDP, "8.1.1.1", "1.2.3.4", uint16(i), 53)
+		ct.acceptedIn(&p)
+		advance(time.Millisecond)
+	}
+	if got := ct.peers[mustIP("8.1.1.1")]; got != conntrackMaxPerPeer {
+		t.Errorf("busy peer flows = %d; want %d", got, conntrackMaxPerPeer)
+	}
+	if got := ct.n; got != conntrackMaxPerPeer+1 {
+		t.Errorf("flows = %d; want %d", got, conntrackMaxPerPeer+1)
+	}
+	reply := parsed(ipproto.UDP, "8.2.2.2", "1.2.3.4", 53, 1000)
+	if !ct.lookupIn(&reply) {
+		t.Errorf("other peer's flow not tracked")
+	}
+	// The busy peer's oldest flows are kept; its newest weren't
+	// tracked.
+	oldest := parsed(ipproto.UDP, "8.1.1.1", "1.2.3.4", 0, 53)
+	if !ct.lookupIn(&oldest) {
+		t.Errorf("busy peer's oldest flow not tracked")
+	}
+	newest := parsed(ipproto.UDP, "8.1.1.1", "1.2.3.4", uint16(conntrackMaxPerPeer*2-1), 53)
+	if ct.lookupIn(&newest) {
+		t.Errorf("busy peer's newest flow tracked over its limit")
+	}
+	checkConntrackCounts(t, ct)
+}
+
+func TestConntrackNewFlowNoAllocs(t *testing.T) {
+	ct := newConntrack()
+	now, advance := fakeClock()
+	ct.now = now
+
+	// Each new flow is started after the previous ones have
+	// expired, so it reuses the entry of one swept away.
+	var port uint16
+	newFlow := func() {
+		port++
+		p := parsed(ipproto.UDP, "8.1.1.1", "1.2.3.4", port, 53)
+		ct.acceptedIn(&p)
+		advance(conntrackSweepInterval + DefaultConntrackTimeouts.UDP)
+	}
+	for i := 0; i < conntrackMaxEntries; i++ {
+		newFlow()
+	}
+	if err := tstest.MinAllocsPerRun(t, 0, newFlow); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConntrackConcurrent(t *testing.T) {
+	acl := newFilter(t.Logf)
+	const peer, local = "8.1.1.1", "1.2.3.4"
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(sport uint16) {
+			defer wg.Done()
+			acl.RunOut(tcpParsed(local, peer, sport, 80, packet.TCPSyn), 0)
+			acl.RunIn(tcpParsed(peer, local, 80, sport, packet.TCPSynAck), 0)
+			acl.RunOut(tcpParsed(local, peer, sport, 80, packet.TCPAck), 0)
+			for i := 0; i < 1000; i++ {
+				if got := acl.RunIn(tcpParsed(peer, local, 80, sport, packet.TCPAck), 0); got != Accept {
+					t.Errorf("ACK = %v; want Accept", got)
+					return
+				}
+				acl.RunOut(tcpParsed(local, peer, sport, 80, packet.TCPAck), 0)
+			}
+		}(uint16(5000 + g))
+	}
+	for i := 0; i < 100; i++ {
+		acl.Flows()
+	}
+	wg.Wait()
+	for _, fl := range acl.Flows() {
+		if fl.TCPState != "established" || fl.PacketsIn != 1001 || fl.PacketsOut != 1002 {
+			t.Errorf("unexpected flow %+v", fl)
+		}
+	}
+}
+
+// checkConntrackCounts checks that ct's flow counts are consistent
+// with its shards.
+func checkConntrackCounts(t *testing.T, ct *conntrack) {
+	t.Helper()
+	n := 0
+	peers := make(map[netaddr.IP]int)
+	for i := range ct.shards {
+		sh := &ct.shards[i]
+		for tu, e := range sh.flows {
+			if e.t != tu {
+				t.Fatalf("flow %v has tuple %v", tu, e.t)
+			}
+			if ct.shard(tu) != sh {
+				t.Fatalf("flow %v in wrong shard %d", tu, i)
+			}
+			peers[tu.Src.IP()]++
+			n++
+		}
+	}
+	if n != ct.n {
+		t.Errorf("shards have %d flows; n = %d", n, ct.n)
+	}
+	if len(peers) != len(ct.peers) {
+		t.Errorf("shards have flows for %d peers; peers has %d", len(peers), len(ct.peers))
+	}
+	for ip, m := range peers {
+		if ct.peers[ip] != m {
+			t.Errorf("peer %v has %d flows; peers has %d", ip, m, ct.peers[ip])
+		}
+	}
+}
+
+func TestParseConntrackTimeouts(t *testing.T) {
+	to, err := ParseConntrackTimeouts("udp=30s, tcp-established=1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := DefaultConntrackTimeouts
+	want.UDP = 30 * time.Second
+	want.TCPEstablished = time.Hour
+	if to != want {
+		t.Errorf("got %+v; want %+v", to, want)
+	}
+
+	if to, err := ParseConntrackTimeouts(""); err != nil || to != DefaultConntrackTimeouts {
+		t.Errorf("empty = %+v, %v; want defaults", to, err)
+	}
+	for _, s := range []string{"udp", "udp=x", "udp=-1s", "udp=0s", "gre=1s"} {
+		if _, err := ParseConntrackTimeouts(s); err == nil {
+			t.Errorf("ParseConntrackTimeouts(%q) succeeded; want error", s)
+		}
+	}
+}
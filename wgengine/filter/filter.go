@@ -8,11 +8,10 @@ package filter
 import (
 	"fmt"
 	"os"
-	"sync"
+	"sync/atomic"
 	"time"
 
 	"inet.af/netaddr"
-	"tailscale.com/net/flowtrack"
 	"tailscale.com/net/packet"
 	"tailscale.com/tstime/rate"
 	"tailscale.com/types/ipproto"
@@ -38,24 +37,28 @@ type Filter struct {
 	// match is to drop the packet.
 	matches4 matches
 	matches6 matches
+	// rules is the list of matches the filter was created
+	// with. ruleIdx4 and ruleIdx6 map indexes in matches4 and
+	// matches6 back to indexes in rules.
+	rules    []Match
+	ruleIdx4 []int
+	ruleIdx6 []int
+	// hits counts the packets accepted by each of rules. Its
+	// elements are accessed atomically.
+	hits []uint64
 	// state is the connection tracking state attached to this
-	// filter. It is used to allow incoming traffic that is a response
-	// to an outbound connection that this node made, even if those
-	// incoming packets don't get accepted by matches above.
-	state *filterState
+	// filter. It is used to allow incoming traffic that is part of
+	// a flow that this node opened, or that was previously accepted
+	// by matches, even if those incoming packets don't get accepted
+	// by matches above.
+	state *conntrack
+	// drops counts dropped packets by reason. Like state, it's
+	// shared with filters that replace this one.
+	drops *dropCounts
 
 	shieldsUp bool
 }
 
-// filterState is a state cache of past seen packets.
-type filterState struct {
-	mu  sync.Mutex
-	lru *flowtrack.Cache // from flowtrack.Tuple -> nil
-}
-
-// lruMax is the size of the LRU cache in filterState.
-const lruMax = 512
-
 // Response is a verdict from the packet filter.
 type Response int
 
@@ -160,30 +163,34 @@ func NewShieldsUpFilter(localNets *netaddr.IPSet, logIPs *netaddr.IPSet, shareSt
 // shares state with the previous one, to enable changing rules at
 // runtime without breaking existing stateful flows.
 func New(matches []Match, localNets *netaddr.IPSet, logIPs *netaddr.IPSet, shareStateWith *Filter, logf logger.Logf) *Filter {
-	var state *filterState
+	var state *conntrack
+	var drops *dropCounts
 	if shareStateWith != nil {
 		state = shareStateWith.state
+		drops = shareStateWith.drops
 	} else {
-		state = &filterState{
-			lru: &flowtrack.Cache{MaxEntries: lruMax},
-		}
+		state = newConntrack()
+		drops = new(dropCounts)
 	}
 	f := &Filter{
-		logf:     logf,
-		matches4: matchesFamily(matches, netaddr.IP.Is4),
-		matches6: matchesFamily(matches, netaddr.IP.Is6),
-		local:    localNets,
-		logIPs:   logIPs,
-		state:    state,
+		logf:   logf,
+		rules:  matches,
+		hits:   make([]uint64, len(matches)),
+		local:  localNets,
+		logIPs: logIPs,
+		state:  state,
+		drops:  drops,
 	}
+	f.matches4, f.ruleIdx4 = matchesFamily(matches, netaddr.IP.Is4)
+	f.matches6, f.ruleIdx6 = matchesFamily(matches, netaddr.IP.Is6)
 	return f
 }
 
 // matchesFamily returns the subset of ms for which keep(srcNet.IP)
-// and keep(dstNet.IP) are both true.
-func matchesFamily(ms matches, keep func(netaddr.IP) bool) matches {
-	var ret matches
-	for _, m := range ms {
+// and keep(dstNet.IP) are both true, along with the index in ms of
+// each returned match.
+func matchesFamily(ms matches, keep func(netaddr.IP) bool) (ret matches, idx []int) {
+	for i, m := range ms {
 		var retm Match
 		retm.IPProto = m.IPProto
 		for _, src := range m.Srcs {
@@ -198,9 +205,10 @@ func matchesFamily(ms matches, keep func(netaddr.IP) bool) matches {
 		}
 		if len(retm.Srcs) > 0 && len(retm.Dsts) > 0 {
 			ret = append(ret, retm)
+			idx = append(idx, i)
 		}
 	}
-	return ret
+	return ret, idx
 }
 
 func maybeHexdump(flag RunFlags, b []byte) string {
@@ -231,7 +239,20 @@ func init() {
 	dropBucket = rate.NewLimiter(rate.Every(time.Millisecond), 10)
 }
 
-func (f *Filter) logRateLimit(runflags RunFlags, q *packet.Parsed, dir direction, r Response, why string) {
+// noteVerdict counts the verdict r for q, which was reached because of
+// why (and, for accepts, rule), and then logs it subject to rate
+// limits.
+func (f *Filter) noteVerdict(runflags RunFlags, q *packet.Parsed, dir direction, r Response, why reason, rule int) {
+	switch {
+	case r == Accept && rule >= 0:
+		atomic.AddUint64(&f.hits[rule], 1)
+	case r.IsDrop():
+		f.drops.add(dir, why)
+	}
+	f.logRateLimit(runflags, q, dir, r, why)
+}
+
+func (f *Filter) logRateLimit(runflags RunFlags, q *packet.Parsed, dir direction, r Response, why reason) {
 	if !f.loggingAllowed(q) {
 		return
 	}
@@ -286,7 +307,10 @@ func (f *Filter) CheckTCP(srcIP, dstIP netaddr.IP, dstPort uint16) Response {
 	pkt.IPProto = ipproto.TCP
 	pkt.TCPFlags = packet.TCPSyn
 
-	return f.RunIn(pkt, 0)
+	// Use verdictIn rather than RunIn so the synthesized packet
+	// doesn't create connection tracking state or count as a hit.
+	r, _, _ := f.verdictIn(pkt)
+	return r
 }
 
 // ShieldsUp reports whether this is a "shields up" (block everything
@@ -296,24 +320,34 @@ func (f *Filter) ShieldsUp() bool { return f.shieldsUp }
 // RunIn determines whether this node is allowed to receive q from a
 // Tailscale peer.
 func (f *Filter) RunIn(q *packet.Parsed, rf RunFlags) Response {
-	dir := in
-	r := f.pre(q, rf, dir)
-	if r == Accept || r == Drop {
-		// already logged
-		return r
+	r, why, rule := f.verdictIn(q)
+	if why != reasonNone {
+		f.noteVerdict(rf, q, in, r, why, rule)
+	}
+	if r == Accept && rule >= 0 {
+		// Accepted by a rule rather than as part of a tracked
+		// flow, so it may start a new one.
+		f.state.acceptedIn(q)
 	}
+	return r
+}
 
-	var why string
+// verdictIn returns RunIn's verdict for q, the reason for it, and the
+// index of the rule that accepted q (or -1), without logging,
+// counting or recording newly accepted flows.
+func (f *Filter) verdictIn(q *packet.Parsed) (r Response, why reason, rule int) {
+	r, why = f.preVerdict(q)
+	if r != noVerdict {
+		return r, why, -1
+	}
 	switch q.IPVersion {
 	case 4:
-		r, why = f.runIn4(q)
+		return f.runIn4(q)
 	case 6:
-		r, why = f.runIn6(q)
+		return f.runIn6(q)
 	default:
-		r, why = Drop, "not-ip"
+		return Drop, reasonNotIP, -1
 	}
-	f.logRateLimit(rf, q, dir, r, why)
-	return r
 }
 
 // RunOut determines whether this node is allowed to send q to a
@@ -326,137 +360,112 @@ func (f *Filter) RunOut(q *packet.Parsed, rf RunFlags) Response {
 		return r
 	}
 	r, why := f.runOut(q)
-	f.logRateLimit(rf, q, dir, r, why)
+	f.noteVerdict(rf, q, dir, r, why, -1)
 	return r
 }
 
-func (f *Filter) runIn4(q *packet.Parsed) (r Response, why string) {
+func (f *Filter) runIn4(q *packet.Parsed) (r Response, why reason, rule int) {
 	// A compromised peer could try to send us packets for
 	// destinations we didn't explicitly advertise. This check is to
 	// prevent that.
 	if !f.local.Contains(q.Dst.IP()) {
-		return Drop, "destination not allowed"
+		return Drop, reasonDstNotAllowed, -1
 	}
 
 	switch q.IPProto {
 	case ipproto.ICMPv4:
-		if q.IsEchoResponse() || q.IsError() {
-			// ICMP responses are allowed.
-			// TODO(apenwarr): consider using conntrack state.
-			//  We could choose to reject all packets that aren't
-			//  related to an existing ICMP-Echo, TCP, or UDP
-			//  session.
-			return Accept, "icmp response ok"
-		} else if f.matches4.matchIPsOnly(q) {
+		if (q.IsEchoResponse() || q.IsError()) && f.state.icmpResponseOK(q) {
+			// ICMP responses related to a tracked flow are allowed.
+			return Accept, reasonICMPResponse, -1
+		}
+		if i := f.matches4.matchIPsOnly(q); i >= 0 {
 			// If any port is open to an IP, allow ICMP to it.
-			return Accept, "icmp ok"
+			return Accept, reasonICMPOK, f.ruleIdx4[i]
 		}
 	case ipproto.TCP:
-		// For TCP, we want to allow *outgoing* connections,
-		// which means we want to allow return packets on those
-		// connections. To make this restriction work, we need to
-		// allow non-SYN packets (continuation of an existing session)
-		// to arrive. This should be okay since a new incoming session
-		// can't be initiated without first sending a SYN.
-		// It happens to also be much faster.
-		// TODO(apenwarr): Skip the rest of decoding in this path?
-		if !q.IsTCPSyn() {
-			return Accept, "tcp non-syn"
+		// Packets that are part of a tracked connection (one this
+		// node opened, or one whose SYN was accepted by matches)
+		// are allowed. Otherwise, even non-SYN packets
+		// (continuations of a session) must be allowed by
+		// matches, so peers can't inject segments into ports that
+		// were never opened to them.
+		if f.state.lookupIn(q) {
+			return Accept, reasonTCPTracked, -1
+		}
+		if i := f.matches4.match(q); i >= 0 {
+			return Accept, reasonTCPOK, f.ruleIdx4[i]
 		}
-		if f.matches4.match(q) {
-			return Accept, "tcp ok"
+		if !q.IsTCPSyn() {
+			return Drop, reasonTCPNonSYN, -1
 		}
 	case ipproto.UDP, ipproto.SCTP:
-		t := flowtrack.Tuple{Proto: q.IPProto, Src: q.Src, Dst: q.Dst}
-
-		f.state.mu.Lock()
-		_, ok := f.state.lru.Get(t)
-		f.state.mu.Unlock()
-
-		if ok {
-			return Accept, "cached"
+		if f.state.lookupIn(q) {
+			return Accept, reasonCached, -1
 		}
-		if f.matches4.match(q) {
-			return Accept, "ok"
+		if i := f.matches4.match(q); i >= 0 {
+			return Accept, reasonOK, f.ruleIdx4[i]
 		}
 	case ipproto.TSMP:
-		return Accept, "tsmp ok"
+		return Accept, reasonTSMP, -1
 	default:
-		return Drop, "Unknown proto"
+		return Drop, reasonUnknownProto, -1
 	}
-	return Drop, "no rules matched"
+	return Drop, reasonNoRulesMatched, -1
 }
 
-func (f *Filter) runIn6(q *packet.Parsed) (r Response, why string) {
+func (f *Filter) runIn6(q *packet.Parsed) (r Response, why reason, rule int) {
 	// A compromised peer could try to send us packets for
 	// destinations we didn't explicitly advertise. This check is to
 	// prevent that.
 	if !f.local.Contains(q.Dst.IP()) {
-		return Drop, "destination not allowed"
+		return Drop, reasonDstNotAllowed, -1
 	}
 
 	switch q.IPProto {
 	case ipproto.ICMPv6:
-		if q.IsEchoResponse() || q.IsError() {
-			// ICMP responses are allowed.
-			// TODO(apenwarr): consider using conntrack state.
-			//  We could choose to reject all packets that aren't
-			//  related to an existing ICMP-Echo, TCP, or UDP
-			//  session.
-			return Accept, "icmp response ok"
-		} else if f.matches6.matchIPsOnly(q) {
+		if (q.IsEchoResponse() || q.IsError()) && f.state.icmpResponseOK(q) {
+			// ICMP responses related to a tracked flow are allowed.
+			return Accept, reasonICMPResponse, -1
+		}
+		if i := f.matches6.matchIPsOnly(q); i >= 0 {
 			// If any port is open to an IP, allow ICMP to it.
-			return Accept, "icmp ok"
+			return Accept, reasonICMPOK, f.ruleIdx6[i]
 		}
 	case ipproto.TCP:
-		// For TCP, we want to allow *outgoing* connections,
-		// which means we want to allow return packets on those
-		// connections. To make this restriction work, we need to
-		// allow non-SYN packets (continuation of an existing session)
-		// to arrive. This should be okay since a new incoming session
-		// can't be initiated without first sending a SYN.
-		// It happens to also be much faster.
-		// TODO(apenwarr): Skip the rest of decoding in this path?
-		if q.IPProto == ipproto.TCP && !q.IsTCPSyn() {
-			return Accept, "tcp non-syn"
+		// Packets that are part of a tracked connection (one this
+		// node opened, or one whose SYN was accepted by matches)
+		// are allowed. Otherwise, even non-SYN packets
+		// (continuations of a session) must be allowed by
+		// matches, so peers can't inject segments into ports that
+		// were never opened to them.
+		if f.state.lookupIn(q) {
+			return Accept, reasonTCPTracked, -1
+		}
+		if i := f.matches6.match(q); i >= 0 {
+			return Accept, reasonTCPOK, f.ruleIdx6[i]
 		}
-		if f.matches6.match(q) {
-			return Accept, "tcp ok"
+		if !q.IsTCPSyn() {
+			return Drop, reasonTCPNonSYN, -1
 		}
 	case ipproto.UDP, ipproto.SCTP:
-		t := flowtrack.Tuple{Proto: q.IPProto, Src: q.Src, Dst: q.Dst}
-
-		f.state.mu.Lock()
-		_, ok := f.state.lru.Get(t)
-		f.state.mu.Unlock()
-
-		if ok {
-			return Accept, "cached"
+		if f.state.lookupIn(q) {
+			return Accept, reasonCached, -1
 		}
-		if f.matches6.match(q) {
-			return Accept, "ok"
+		if i := f.matches6.match(q); i >= 0 {
+			return Accept, reasonOK, f.ruleIdx6[i]
 		}
 	case ipproto.TSMP:
-		return Accept, "tsmp ok"
+		return Accept, reasonTSMP, -1
 	default:
-		return Drop, "Unknown proto"
+		return Drop, reasonUnknownProto, -1
 	}
-	return Drop, "no rules matched"
+	return Drop, reasonNoRulesMatched, -1
 }
 
-// runIn runs the output-specific part of the filter logic.
-func (f *Filter) runOut(q *packet.Parsed) (r Response, why string) {
-	switch q.IPProto {
-	case ipproto.UDP, ipproto.SCTP:
-		tuple := flowtrack.Tuple{
-			Proto: q.IPProto,
-			Src:   q.Dst, Dst: q.Src, // src/dst reversed
-		}
-		f.state.mu.Lock()
-		f.state.lru.Add(tuple, nil)
-		f.state.mu.Unlock()
-	}
-	return Accept, "ok out"
+// runOut runs the output-specific part of the filter logic.
+func (f *Filter) runOut(q *packet.Parsed) (r Response, why reason) {
+	f.state.trackOut(q)
+	return Accept, reasonOut
 }
 
 // direction is whether a packet was flowing in to this machine, or
@@ -482,39 +491,44 @@ func (d direction) String() string {
 var gcpDNSAddr = netaddr.IPv4(169, 254, 169, 254)
 
 // pre runs the direction-agnostic filter logic. dir is only used for
-// logging.
+// logging and counting.
 func (f *Filter) pre(q *packet.Parsed, rf RunFlags, dir direction) Response {
+	r, why := f.preVerdict(q)
+	if r != noVerdict && why != reasonNone {
+		f.noteVerdict(rf, q, dir, r, why, -1)
+	}
+	return r
+}
+
+// preVerdict is pre without logging or counting. It returns
+// reasonNone for packets that are never logged.
+func (f *Filter) preVerdict(q *packet.Parsed) (r Response, why reason) {
 	if len(q.Buffer()) == 0 {
 		// wireguard keepalive packet, always permit.
-		return Accept
+		return Accept, reasonNone
 	}
 	if len(q.Buffer()) < 20 {
-		f.logRateLimit(rf, q, dir, Drop, "too short")
-		return Drop
+		return Drop, reasonTooShort
 	}
 
 	if q.Dst.IP().IsMulticast() {
-		f.logRateLimit(rf, q, dir, Drop, "multicast")
-		return Drop
+		return Drop, reasonMulticast
 	}
 	if q.Dst.IP().IsLinkLocalUnicast() && q.Dst.IP() != gcpDNSAddr {
-		f.logRateLimit(rf, q, dir, Drop, "link-local-unicast")
-		return Drop
+		return Drop, reasonLinkLocal
 	}
 
 	switch q.IPProto {
 	case ipproto.Unknown:
 		// Unknown packets are dangerous; always drop them.
-		f.logRateLimit(rf, q, dir, Drop, "unknown")
-		return Drop
+		return Drop, reasonUnknown
 	case ipproto.Fragment:
 		// Fragments after the first always need to be passed through.
 		// Very small fragments are considered Junk by Parsed.
-		f.logRateLimit(rf, q, dir, Accept, "fragment")
-		return Accept
+		return Accept, reasonFragment
 	}
 
-	return noVerdict
+	return noVerdict, reasonNone
 }
 
 // loggingAllowed reports whether p can appear in logs at all.
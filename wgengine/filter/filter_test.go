@@ -10,6 +10,7 @@ import (
 	"reflect"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -118,7 +119,7 @@ func TestFilter(t *testing.T) {
 		if test.p.IPVersion == 6 {
 			aclFunc = acl.runIn6
 		}
-		if got, why := aclFunc(&test.p); test.want != got {
+		if got, why, _ := aclFunc(&test.p); test.want != got {
 			t.Errorf("#%d runIn got=%v want=%v why=%q packet:%v", i, got, test.want, why, test.p)
 		}
 		if test.p.IPProto == ipproto.TCP {
@@ -133,7 +134,7 @@ func TestFilter(t *testing.T) {
 			}
 			// TCP and UDP are treated equivalently in the filter - verify that.
 			test.p.IPProto = ipproto.UDP
-			if got, why := aclFunc(&test.p); test.want != got {
+			if got, why, _ := aclFunc(&test.p); test.want != got {
 				t.Errorf("#%d runIn (UDP) got=%v want=%v why=%q packet:%v", i, got, test.want, why, test.p)
 			}
 		}
@@ -310,6 +311,66 @@ func BenchmarkFilter(b *testing.B) {
 	}
 }
 
+func BenchmarkConntrack(b *testing.B) {
+	// An established TCP flow opened by this node.
+	b.Run("tcp4_tracked_in", func(b *testing.B) {
+		acl := newFilter(b.Logf)
+		syn := parsed(ipproto.TCP, "1.2.3.4", "8.1.1.1", 999, 22)
+		acl.RunOut(&syn, 0)
+		q := parsed(ipproto.TCP, "8.1.1.1", "1.2.3.4", 22, 999)
+		q.TCPFlags = packet.TCPSynAck
+		acl.RunIn(&q, 0)
+		q.TCPFlags = packet.TCPAck
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if acl.RunIn(&q, 0) != Accept {
+				b.Fatal("dropped")
+			}
+		}
+	})
+
+	// A new flow for every packet, from a few peers, so that once
+	// the peers' flow limits are reached new flows aren't tracked.
+	b.Run("udp4_new_flow_in", func(b *testing.B) {
+		acl := newFilter(b.Logf)
+		peers := []string{"8.1.1.1", "8.2.2.2"}
+		qs := make([]packet.Parsed, len(peers))
+		for i, p := range peers {
+			qs[i] = parsed(ipproto.UDP, p, "1.2.3.4", 0, 22)
+		}
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			q := &qs[i%len(qs)]
+			q.Src = netaddr.IPPortFrom(q.Src.IP(), uint16(i))
+			if acl.RunIn(q, 0) != Accept {
+				b.Fatal("dropped")
+			}
+		}
+	})
+
+	// Tracked flows from many goroutines at once, to measure
+	// contention on the connection tracker.
+	b.Run("tcp4_tracked_in_parallel", func(b *testing.B) {
+		acl := newFilter(b.Logf)
+		var port uint32
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			sport := uint16(atomic.AddUint32(&port, 1))
+			syn := parsed(ipproto.TCP, "1.2.3.4", "8.1.1.1", sport, 22)
+			acl.RunOut(&syn, 0)
+			q := parsed(ipproto.TCP, "8.1.1.1", "1.2.3.4", 22, sport)
+			q.TCPFlags = packet.TCPSynAck
+			acl.RunIn(&q, 0)
+			q.TCPFlags = packet.TCPAck
+			for pb.Next() {
+				acl.RunIn(&q, 0)
+			}
+		})
+	})
+}
+
 func TestPreFilter(t *testing.T) {
 	packets := []struct {
 		desc string
@@ -80,8 +80,10 @@ func (m Match) String() string {
 
 type matches []Match
 
-func (ms matches) match(q *packet.Parsed) bool {
-	for _, m := range ms {
+// match returns the index of the first match in ms that permits q,
+// or -1 if none do.
+func (ms matches) match(q *packet.Parsed) int {
+	for i, m := range ms {
 		if !protoInList(q.IPProto, m.IPProto) {
 			continue
 		}
@@ -95,24 +97,25 @@ func (ms matches) match(q *packet.Parsed) bool {
 			if !dst.Ports.contains(q.Dst.Port()) {
 				continue
 			}
-			return true
+			return i
 		}
 	}
-	return false
+	return -1
 }
 
-func (ms matches) matchIPsOnly(q *packet.Parsed) bool {
-	for _, m := range ms {
+// matchIPsOnly is like match, but ignores the protocol and ports.
+func (ms matches) matchIPsOnly(q *packet.Parsed) int {
+	for i, m := range ms {
 		if !ipInList(q.Src.IP(), m.Srcs) {
 			continue
 		}
 		for _, dst := range m.Dsts {
 			if dst.Net.Contains(q.Dst.IP()) {
-				return true
+				return i
 			}
 		}
 	}
-	return false
+	return -1
 }
 
 func ipInList(ip netaddr.IP, netlist []netaddr.IPPrefix) bool {
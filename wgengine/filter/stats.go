@@ -0,0 +1,214 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filter
+
+import (
+	"sync/atomic"
+
+	"inet.af/netaddr"
+	"tailscale.com/net/packet"
+	"tailscale.com/types/ipproto"
+)
+
+// reason is why the filter reached a verdict.
+type reason uint8
+
+const (
+	reasonNone reason = iota // not logged or counted (e.g. keepalives)
+
+	// Drops.
+	reasonTooShort
+	reasonMulticast
+	reasonLinkLocal
+	reasonUnknown
+	reasonNotIP
+	reasonDstNotAllowed
+	reasonUnknownProto
+	reasonTCPNonSYN
+	reasonNoRulesMatched
+
+	// Accepts.
+	reasonFragment
+	reasonICMPResponse
+	reasonICMPOK
+	reasonTCPTracked
+	reasonTCPOK
+	reasonCached
+	reasonOK
+	reasonTSMP
+	reasonOut
+
+	numReasons
+)
+
+// reasonText is the text of each reason, as it appears in logs.
+var reasonText = [numReasons]string{
+	reasonTooShort:       "too short",
+	reasonMulticast:      "multicast",
+	reasonLinkLocal:      "link-local-unicast",
+	reasonUnknown:        "unknown",
+	reasonNotIP:          "not-ip",
+	reasonDstNotAllowed:  "destination not allowed",
+	reasonUnknownProto:   "Unknown proto",
+	reasonTCPNonSYN:      "tcp non-syn without state",
+	reasonNoRulesMatched: "no rules matched",
+	reasonFragment:       "fragment",
+	reasonICMPResponse:   "icmp response ok",
+	reasonICMPOK:         "icmp ok",
+	reasonTCPTracked:     "tcp tracked",
+	reasonTCPOK:          "tcp ok",
+	reasonCached:         "cached",
+	reasonOK:             "ok",
+	reasonTSMP:           "tsmp ok",
+	reasonOut:            "ok out",
+}
+
+func (r reason) String() string {
+	if r < numReasons {
+		return reasonText[r]
+	}
+	return "???"
+}
+
+// dropCounts counts dropped packets by direction and reason. Its
+// fields are indexed by reason and accessed atomically.
+type dropCounts struct {
+	in  [numReasons]uint64
+	out [numReasons]uint64
+}
+
+func (c *dropCounts) add(dir direction, why reason) {
+	if dir == out {
+		atomic.AddUint64(&c.out[why], 1)
+	} else {
+		atomic.AddUint64(&c.in[why], 1)
+	}
+}
+
+// RuleStats is a rule in a Filter and the number of packets it has
+// accepted.
+type RuleStats struct {
+	Match Match
+	Hits  uint64
+}
+
+// RuleStats returns the filter's rules, in the order they were passed
+// to New, along with how many packets each has accepted.
+//
+// Counts start at zero for each new Filter.
+func (f *Filter) RuleStats() []RuleStats {
+	ret := make([]RuleStats, len(f.rules))
+	for i, m := range f.rules {
+		ret[i] = RuleStats{
+			Match: m,
+			Hits:  atomic.LoadUint64(&f.hits[i]),
+		}
+	}
+	return ret
+}
+
+// DropCount is the number of packets dropped for a reason.
+type DropCount struct {
+	Reason string
+	In     uint64 // packets from peers
+	Out    uint64 // packets to peers
+}
+
+// DropCounts returns the number of packets dropped for each reason
+// that has dropped any packets.
+//
+// Counts are carried over to filters created with this filter as
+// their shareStateWith.
+func (f *Filter) DropCounts() []DropCount {
+	var ret []DropCount
+	for r := reasonNone + 1; r < numReasons; r++ {
+		dc := DropCount{
+			Reason: r.String(),
+			In:     atomic.LoadUint64(&f.drops.in[r]),
+			Out:    atomic.LoadUint64(&f.drops.out[r]),
+		}
+		if dc.In != 0 || dc.Out != 0 {
+			ret = append(ret, dc)
+		}
+	}
+	return ret
+}
+
+// CheckResult is the result of Filter.Check.
+type CheckResult struct {
+	Response Response
+	// Reason is why the filter reached Response, as it would
+	// appear in the filter's logs.
+	Reason string
+	// Rule is the index of the rule that accepted the packet, as
+	// returned by RuleStats, or -1 if no rule was involved.
+	Rule int
+}
+
+// Check reports whether a new flow of proto from src to dst would be
+// allowed into this node, and why. TCP is checked as a SYN, and ICMP
+// as an echo request.
+//
+// Check uses the same rules as RunIn, but ignores connection
+// tracking state and doesn't affect any counters.
+func (f *Filter) Check(src, dst netaddr.IPPort, proto ipproto.Proto) CheckResult {
+	pkt, ok := checkPacket(src, dst, proto)
+	if !ok {
+		return CheckResult{Response: Drop, Reason: "mismatched address families", Rule: -1}
+	}
+
+	// Evaluate with a nil conntrack, which tracks no flows, so
+	// that only the rules decide.
+	stateless := *f
+	stateless.state = nil
+	r, why, rule := stateless.verdictIn(pkt)
+	return CheckResult{Response: r, Reason: why.String(), Rule: rule}
+}
+
+// checkPacket returns the packet that Check evaluates for a new flow
+// of proto from src to dst. It reports false if src, dst and proto
+// aren't all of the same address family.
+func checkPacket(src, dst netaddr.IPPort, proto ipproto.Proto) (pkt *packet.Parsed, ok bool) {
+	is4 := src.IP().Is4()
+	if dst.IP().Is4() != is4 || (proto == ipproto.ICMPv4 && !is4) || (proto == ipproto.ICMPv6 && is4) {
+		return nil, false
+	}
+	pkt = &packet.Parsed{}
+	switch proto {
+	case ipproto.ICMPv4:
+		pkt.Decode(packet.Generate(packet.ICMP4Header{
+			IP4Header: packet.IP4Header{
+				IPProto: proto,
+				Src:     src.IP(),
+				Dst:     dst.IP(),
+			},
+			Type: packet.ICMP4EchoRequest,
+		}, make([]byte, 4)))
+		return pkt, true
+	case ipproto.ICMPv6:
+		// Type, code, checksum, and the echo identifier and
+		// sequence number.
+		icmp := []byte{byte(packet.ICMP6EchoRequest), 0, 0, 0, 0, 0, 0, 0}
+		pkt.Decode(packet.Generate(packet.IP6Header{
+			IPProto: proto,
+			Src:     src.IP(),
+			Dst:     dst.IP(),
+		}, icmp))
+		return pkt, true
+	}
+	pkt.Decode(dummyPacket) // initialize private fields
+	if is4 {
+		pkt.IPVersion = 4
+	} else {
+		pkt.IPVersion = 6
+	}
+	pkt.Src = src
+	pkt.Dst = dst
+	pkt.IPProto = proto
+	if proto == ipproto.TCP {
+		pkt.TCPFlags = packet.TCPSyn
+	}
+	return pkt, true
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filter
+
+import (
+	"reflect"
+	"testing"
+
+	"inet.af/netaddr"
+	"tailscale.com/net/packet"
+	"tailscale.com/types/ipproto"
+)
+
+func TestRuleStats(t *testing.T) {
+	acl := newFilter(t.Logf)
+	stats := acl.RuleStats()
+	if len(stats) != len(acl.rules) {
+		t.Fatalf("got %d rules; want %d", len(stats), len(acl.rules))
+	}
+
+	ssh := tcpParsed("8.1.1.1", "1.2.3.4", 5000, 22, packet.TCPSyn)
+	want := acl.Check(ssh.Src, ssh.Dst, ipproto.TCP)
+	if want.Response != Accept || want.Rule < 0 {
+		t.Fatalf("Check = %+v; want Accept by a rule", want)
+	}
+	// Three connections. Only their first SYNs count as hits;
+	// retransmitted ones are accepted as part of tracked flows.
+	for i := 0; i < 3; i++ {
+		ssh.Src = ssh.Src.WithPort(uint16(5000 + i))
+		acl.RunIn(ssh, 0)
+		acl.RunIn(ssh, 0)
+	}
+	for i, st := range acl.RuleStats() {
+		wantHits := uint64(0)
+		if i == want.Rule {
+			wantHits = 3
+		}
+		if st.Hits != wantHits {
+			t.Errorf("rule %d (%v) hits = %d; want %d", i, st.Match, st.Hits, wantHits)
+		}
+	}
+}
+
+func TestDropCounts(t *testing.T) {
+	acl := newFilter(t.Logf)
+	acl.RunIn(tcpParsed("8.1.1.1", "1.2.3.4", 5000, 80, packet.TCPSyn), 0)
+	acl.RunIn(tcpParsed("8.1.1.1", "1.2.3.4", 5000, 80, packet.TCPSyn), 0)
+	acl.RunIn(tcpParsed("8.1.1.1", "1.2.3.4", 5000, 80, packet.TCPAck), 0)
+	acl.RunIn(tcpParsed("8.1.1.1", "16.32.48.64", 5000, 443, packet.TCPSyn), 0)
+
+	want := []DropCount{
+		{Reason: "destination not allowed", In: 1},
+		{Reason: "tcp non-syn without state", In: 1},
+		{Reason: "no rules matched", In: 2},
+	}
+	if got := acl.DropCounts(); !reflect.DeepEqual(got, want) {
+		t.Errorf("DropCounts = %+v; want %+v", got, want)
+	}
+
+	// Drop counts carry over to replacement filters.
+	acl2 := New(nil, acl.local, acl.logIPs, acl, t.Logf)
+	if got := acl2.DropCounts(); !reflect.DeepEqual(got, want) {
+		t.Errorf("shared DropCounts = %+v; want %+v", got, want)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	acl := newFilter(t.Logf)
+	ipp := netaddr.MustParseIPPort
+	tests := []struct {
+		src, dst string
+		proto    ipproto.Proto
+		want     Response
+		why      string
+	}{
+		{"8.1.1.1:5000", "1.2.3.4:22", ipproto.TCP, Accept, "tcp ok"},
+		{"8.1.1.1:5000", "1.2.3.4:80", ipproto.TCP, Drop, "no rules matched"},
+		{"8.1.1.1:5000", "16.32.48.64:443", ipproto.TCP, Drop, "destination not allowed"},
+		{"9.1.1.1:999", "1.2.3.4:22", ipproto.SCTP, Accept, "ok"},
+		{"8.1.1.1:5000", "[2001::1]:443", ipproto.TCP, Drop, "mismatched address families"},
+		{"8.1.1.1:0", "1.2.3.4:0", ipproto.ICMPv4, Accept, "icmp ok"},
+		{"8.1.1.1:0", "16.32.48.64:0", ipproto.ICMPv4, Drop, "destination not allowed"},
+		{"[::1]:0", "[2001::1]:0", ipproto.ICMPv6, Accept, "icmp ok"},
+		{"[::1]:0", "[2001::1]:0", ipproto.ICMPv4, Drop, "mismatched address families"},
+	}
+	for _, tt := range tests {
+		got := acl.Check(ipp(tt.src), ipp(tt.dst), tt.proto)
+		if got.Response != tt.want || got.Reason != tt.why {
+			t.Errorf("Check(%s -> %s/%v) = %+v; want %v %q", tt.src, tt.dst, tt.proto, got, tt.want, tt.why)
+		}
+		if (got.Rule >= 0) != (got.Response == Accept) {
+			t.Errorf("Check(%s -> %s/%v) rule = %d", tt.src, tt.dst, tt.proto, got.Rule)
+		}
+	}
+
+	// ICMP is checked as an echo request.
+	for _, tt := range []struct {
+		src, dst string
+		proto    ipproto.Proto
+	}{
+		{"8.1.1.1:0", "1.2.3.4:0", ipproto.ICMPv4},
+		{"[::1]:0", "[2001::1]:0", ipproto.ICMPv6},
+	} {
+		pkt, ok := checkPacket(ipp(tt.src), ipp(tt.dst), tt.proto)
+		if !ok || pkt.IPProto != tt.proto || !pkt.IsEchoRequest() || pkt.Src.IP() != ipp(tt.src).IP() || pkt.Dst.IP() != ipp(tt.dst).IP() {
+			t.Errorf("checkPacket(%s -> %s/%v) = %v, %v; want echo request", tt.src, tt.dst, tt.proto, pkt, ok)
+		}
+	}
+
+	// Check neither counts nor creates flows.
+	if got := acl.DropCounts(); len(got) != 0 {
+		t.Errorf("DropCounts after Check = %+v; want none", got)
+	}
+	if got := acl.Flows(); len(got) != 0 {
+		t.Errorf("Flows after Check = %+v; want none", got)
+	}
+}
@@ -1686,6 +1686,7 @@ func (c *Conn) receiveIP(b []byte, ipp netaddr.IPPort, cache *ippEndpointCache)
 		ep = de
 	}
 	ep.noteRecvActivity()
+	atomic.AddUint64(&ep.rxPackets, 1)
 	return ep, true
 }
 
@@ -1741,6 +1742,7 @@ func (c *Conn) processDERPReadResult(dm derpReadResult, b []byte) (n int, ep *en
 	}
 
 	ep.noteRecvActivity()
+	atomic.AddUint64(&ep.rxPackets, 1)
 	return n, ep
 }
 
@@ -3174,6 +3176,7 @@ type endpoint struct {
 	// atomically accessed; declared first for alignment reasons
 	lastRecv              mono.Time
 	numStopAndResetAtomic int64
+	rxPackets, txPackets  uint64 // WireGuard packets from and to the peer
 
 	// These fields are initialized once and never modified.
 	c          *Conn
@@ -3499,6 +3502,7 @@ func (de *endpoint) send(b []byte) error {
 	if udpAddr.IsZero() && derpAddr.IsZero() {
 		return errors.New("no UDP or DERP addr")
 	}
+	atomic.AddUint64(&de.txPackets, 1)
 	var err error
 	if !udpAddr.IsZero() {
 		_, err = de.c.sendAddr(udpAddr, de.publicKey, b)
@@ -3799,6 +3803,9 @@ func (de *endpoint) handlePongConnLocked(m *disco.Pong, di *discoInfo, src netad
 		thisPong := addrLatency{sp.to, latency}
 		if betterAddr(thisPong, de.bestAddr) {
 			de.c.logf("magicsock: disco: node %v %v now using %v", de.publicKey.ShortString(), de.discoShort, sp.to)
+			if de.bestAddr.IPPort != thisPong.IPPort {
+				metricEndpointChanged.Add(1)
+			}
 			de.bestAddr = thisPong
 		}
 		if de.bestAddr.IPPort == thisPong.IPPort {
@@ -3930,6 +3937,8 @@ func (de *endpoint) populatePeerStatus(ps *ipnstate.PeerStatus) {
 	defer de.mu.Unlock()
 
 	ps.Relay = de.c.derpRegionCodeOfIDLocked(int(de.derpAddr.Port()))
+	ps.RxPackets = int64(atomic.LoadUint64(&de.rxPackets))
+	ps.TxPackets = int64(atomic.LoadUint64(&de.txPackets))
 
 	if de.lastSend.IsZero() {
 		return
@@ -4079,4 +4088,7 @@ var (
 	metricRecvDiscoCallMeMaybe         = clientmetric.NewCounter("magicsock_disco_recv_callmemaybe")
 	metricRecvDiscoCallMeMaybeBadNode  = clientmetric.NewCounter("magicsock_disco_recv_callmemaybe_bad_node")
 	metricRecvDiscoCallMeMaybeBadDisco = clientmetric.NewCounter("magicsock_disco_recv_callmemaybe_bad_disco")
+
+	// Peer paths
+	metricEndpointChanged = clientmetric.NewCounter("magicsock_endpoint_changed")
 )
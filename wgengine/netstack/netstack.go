@@ -65,12 +65,14 @@ type Impl struct {
 	// It can only be set before calling Start.
 	ProcessSubnets bool
 
-	ipstack *stack.Stack
-	linkEP  *channel.Endpoint
-	tundev  *tstun.Wrapper
-	e       wgengine.Engine
-	mc      *magicsock.Conn
-	logf    logger.Logf
+	ipstack   *stack.Stack
+	linkEP    *channel.Endpoint
+	tundev    *tstun.Wrapper
+	e         wgengine.Engine
+	mc        *magicsock.Conn
+	logf      logger.Logf
+	ctx       context.Context    // alive until Close
+	ctxCancel context.CancelFunc // called on Close
 
 	// atomicIsLocalIPFunc holds a func that reports whether an IP
 	// is a local (non-subnet) Tailscale IP address of this
@@ -132,8 +134,11 @@ func Create(logf logger.Logf, tundev *tstun.Wrapper, e wgengine.Engine, mc *magi
 			NIC:         nicID,
 		},
 	})
+	ctx, cancel := context.WithCancel(context.Background())
 	ns := &Impl{
 		logf:                logf,
+		ctx:                 ctx,
+		ctxCancel:           cancel,
 		ipstack:             ipstack,
 		linkEP:              linkEP,
 		tundev:              tundev,
@@ -179,6 +184,14 @@ func (ns *Impl) Start() error {
 	return nil
 }
 
+// Close stops ns and releases its network stack. It does not close
+// the engine or tun device it was created with.
+func (ns *Impl) Close() error {
+	ns.ctxCancel()
+	ns.ipstack.Close()
+	return nil
+}
+
 // DNSMap maps MagicDNS names (both base + FQDN) to their first IP.
 // It should not be mutated once created.
 type DNSMap map[string]netaddr.IP
@@ -375,12 +388,18 @@ func (m DNSMap) Resolve(ctx context.Context, addr string) (netaddr.IPPort, error
 	return netaddr.IPPortFrom(ip, uint16(port16)), nil
 }
 
-func (ns *Impl) DialContextTCP(ctx context.Context, addr string) (*gonet.TCPConn, error) {
+// Resolve resolves addr, an "ip:port" or "host:port", to an IP and
+// port the same way DialContextTCP and DialContextUDP do, preferring
+// MagicDNS names.
+func (ns *Impl) Resolve(ctx context.Context, addr string) (netaddr.IPPort, error) {
 	ns.mu.Lock()
 	dnsMap := ns.dns
 	ns.mu.Unlock()
+	return dnsMap.Resolve(ctx, addr)
+}
 
-	remoteIPPort, err := dnsMap.Resolve(ctx, addr)
+func (ns *Impl) DialContextTCP(ctx context.Context, addr string) (*gonet.TCPConn, error) {
+	remoteIPPort, err := ns.Resolve(ctx, addr)
 	if err != nil {
 		return nil, err
 	}
@@ -400,11 +419,7 @@ func (ns *Impl) DialContextTCP(ctx context.Context, addr string) (*gonet.TCPConn
 }
 
 func (ns *Impl) DialContextUDP(ctx context.Context, addr string) (*gonet.UDPConn, error) {
-	ns.mu.Lock()
-	dnsMap := ns.dns
-	ns.mu.Unlock()
-
-	remoteIPPort, err := dnsMap.Resolve(ctx, addr)
+	remoteIPPort, err := ns.Resolve(ctx, addr)
 	if err != nil {
 		return nil, err
 	}
@@ -423,10 +438,59 @@ func (ns *Impl) DialContextUDP(ctx context.Context, addr string) (*gonet.UDPConn
 	return gonet.DialUDP(ns.ipstack, nil, remoteAddress, ipType)
 }
 
+// ListenPacket returns a UDP conn bound to ipp, which must be one of
+// this node's Tailscale IP addresses. It requires ProcessLocalIPs.
+func (ns *Impl) ListenPacket(ipp netaddr.IPPort) (*gonet.UDPConn, error) {
+	if !ns.ProcessLocalIPs {
+		return nil, errors.New("netstack: ListenPacket requires ProcessLocalIPs")
+	}
+	if !ns.isLocalIP(ipp.IP()) {
+		return nil, fmt.Errorf("netstack: %v is not a local Tailscale IP", ipp.IP())
+	}
+	localAddress := &tcpip.FullAddress{
+		NIC:  nicID,
+		Addr: tcpip.Address(ipp.IP().IPAddr().IP),
+		Port: ipp.Port(),
+	}
+	var ipType tcpip.NetworkProtocolNumber
+	if ipp.IP().Is4() {
+		ipType = ipv4.ProtocolNumber
+	} else {
+		ipType = ipv6.ProtocolNumber
+	}
+	return gonet.DialUDP(ns.ipstack, localAddress, nil, ipType)
+}
+
+// ListenTCP returns a TCP listener bound to ipp, which must be one of
+// this node's Tailscale IP addresses. It requires ProcessLocalIPs.
+func (ns *Impl) ListenTCP(ipp netaddr.IPPort) (*gonet.TCPListener, error) {
+	if !ns.ProcessLocalIPs {
+		return nil, errors.New("netstack: ListenTCP requires ProcessLocalIPs")
+	}
+	if !ns.isLocalIP(ipp.IP()) {
+		return nil, fmt.Errorf("netstack: %v is not a local Tailscale IP", ipp.IP())
+	}
+	localAddress := tcpip.FullAddress{
+		NIC:  nicID,
+		Addr: tcpip.Address(ipp.IP().IPAddr().IP),
+		Port: ipp.Port(),
+	}
+	var ipType tcpip.NetworkProtocolNumber
+	if ipp.IP().Is4() {
+		ipType = ipv4.ProtocolNumber
+	} else {
+		ipType = ipv6.ProtocolNumber
+	}
+	return gonet.ListenTCP(ns.ipstack, localAddress, ipType)
+}
+
 func (ns *Impl) injectOutbound() {
 	for {
-		packetInfo, ok := ns.linkEP.ReadContext(context.Background())
+		packetInfo, ok := ns.linkEP.ReadContext(ns.ctx)
 		if !ok {
+			if ns.ctx.Err() != nil {
+				return
+			}
 			ns.logf("[v2] ReadContext-for-write = ok=false")
 			continue
 		}
@@ -0,0 +1,709 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+	"golang.org/x/sys/unix"
+)
+
+// nftablesTable is the name of the nftables table, in each address
+// family, that holds all of Tailscale's chains. Keeping everything in
+// our own table means our rules never interleave with other tools'
+// rules and can all be removed together.
+//
+// As all chains share the table, custom chain names must be unique
+// across iptables tables. Tailscale's are.
+const nftablesTable = "tailscale"
+
+// Verdict codes from linux/netfilter.h, which x/sys/unix lacks.
+const (
+	nfDrop   = 0
+	nfAccept = 1
+)
+
+// nftBaseChain is an nftables base chain standing in for one of the
+// iptables built-in chains.
+type nftBaseChain struct {
+	name     string
+	typ      string // "filter" or "nat"
+	hook     uint32
+	priority int32
+}
+
+// nftBaseChains are the base chains in nftablesTable, keyed by the
+// iptables "table/chain" they replace. They're created on first use.
+var nftBaseChains = map[string]nftBaseChain{
+	"filter/INPUT":    {"input", "filter", unix.NF_INET_LOCAL_IN, 0},
+	"filter/FORWARD":  {"forward", "filter", unix.NF_INET_FORWARD, 0},
+	"nat/POSTROUTING": {"postrouting", "nat", unix.NF_INET_POST_ROUTING, 100},
+}
+
+// nftablesRunner is a netfilterRunner that manages chains in
+// nftablesTable over netlink instead of running iptables.
+//
+// Each method makes its change in a single nftables transaction, so
+// it's applied atomically. Rules are identified by their iptables
+// arguments, which are stored as the rule's comment, as shown by
+// "nft list table ip tailscale".
+//
+// Only the subset of iptables arguments that the router uses is
+// supported.
+type nftablesRunner struct {
+	family uint8 // unix.NFPROTO_IPV4 or unix.NFPROTO_IPV6
+
+	// dial opens a netfilter netlink connection. It's replaced in
+	// tests.
+	dial func() (*netlink.Conn, error)
+}
+
+func dialNetfilter() (*netlink.Conn, error) {
+	return netlink.Dial(unix.NETLINK_NETFILTER, nil)
+}
+
+// newNFTablesRunners returns nftablesRunners for IPv4 and, if
+// supportsV6, IPv6. It fails if nftables isn't usable.
+func newNFTablesRunners(supportsV6 bool) (nft4, nft6 netfilterRunner, err error) {
+	n4 := &nftablesRunner{family: unix.NFPROTO_IPV4, dial: dialNetfilter}
+	if err := n4.probe(); err != nil {
+		return nil, nil, fmt.Errorf("nftables: %w", err)
+	}
+	if supportsV6 {
+		nft6 = &nftablesRunner{family: unix.NFPROTO_IPV6, dial: dialNetfilter}
+	}
+	return n4, nft6, nil
+}
+
+// probe checks that the kernel speaks nftables, by looking up
+// nftablesTable. It's fine if the table doesn't exist.
+func (n *nftablesRunner) probe() error {
+	c, err := n.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	m, err := nftMsg(n.family, unix.NFT_MSG_GETTABLE, netlink.Request|netlink.Acknowledge, func(ae *netlink.AttributeEncoder) {
+		ae.String(unix.NFTA_TABLE_NAME, nftablesTable)
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := c.Execute(m); err != nil && !errors.Is(err, unix.ENOENT) {
+		return err
+	}
+	return nil
+}
+
+func (n *nftablesRunner) Insert(table, chain string, pos int, args ...string) error {
+	if pos < 1 {
+		return fmt.Errorf("bad position %d", pos)
+	}
+	return n.addRule(table, chain, pos, args)
+}
+
+func (n *nftablesRunner) Append(table, chain string, args ...string) error {
+	return n.addRule(table, chain, 0, args)
+}
+
+func (n *nftablesRunner) Exists(table, chain string, args ...string) (bool, error) {
+	name, _ := n.chainName(table, chain)
+	rules, err := n.rules(name)
+	if err != nil {
+		return false, err
+	}
+	_, ok := findNFTRule(rules, args)
+	return ok, nil
+}
+
+func (n *nftablesRunner) Delete(table, chain string, args ...string) error {
+	name, _ := n.chainName(table, chain)
+	rules, err := n.rules(name)
+	if err != nil {
+		return err
+	}
+	i, ok := findNFTRule(rules, args)
+	if !ok {
+		return fmt.Errorf("no rule %q in %s/%s", strings.Join(args, " "), table, chain)
+	}
+	b := n.batch()
+	b.delRule(name, rules[i].handle)
+	return n.commit(b)
+}
+
+func (n *nftablesRunner) ClearChain(table, chain string) error {
+	name, _ := n.chainName(table, chain)
+	b := n.batch()
+	b.delRule(name, 0)
+	return n.commit(b)
+}
+
+func (n *nftablesRunner) NewChain(table, chain string) error {
+	name, base := n.chainName(table, chain)
+	if base != nil {
+		return fmt.Errorf("%s/%s is a built-in chain", table, chain)
+	}
+	b := n.batch()
+	b.newTable()
+	b.newChain(name, nil, netlink.Create|netlink.Excl)
+	return n.commit(b)
+}
+
+func (n *nftablesRunner) DeleteChain(table, chain string) error {
+	name, _ := n.chainName(table, chain)
+	b := n.batch()
+	b.add(unix.NFT_MSG_DELCHAIN, 0, func(ae *netlink.AttributeEncoder) {
+		ae.String(unix.NFTA_CHAIN_TABLE, nftablesTable)
+		ae.String(unix.NFTA_CHAIN_NAME, name)
+	})
+	return n.commit(b)
+}
+
+// chainName returns the name in nftablesTable of the iptables chain,
+// and its base chain if it's a built-in one.
+func (n *nftablesRunner) chainName(table, chain string) (string, *nftBaseChain) {
+	if bc, ok := nftBaseChains[table+"/"+chain]; ok {
+		return bc.name, &bc
+	}
+	return chain, nil
+}
+
+// addRule adds the rule given by iptables args to the chain, at the
+// 1-based position pos, or at the end if pos is 0. Built-in chains
+// are created as needed in the same transaction.
+func (n *nftablesRunner) addRule(table, chain string, pos int, args []string) error {
+	name, base := n.chainName(table, chain)
+	exprs, err := nftExprs(n.family, args)
+	if err != nil {
+		return err
+	}
+	comment, err := nftComment(strings.Join(args, " "))
+	if err != nil {
+		return err
+	}
+
+	flags := netlink.Create | netlink.Append
+	var position uint64
+	if pos == 1 {
+		flags = netlink.Create // no position and no append is prepend
+	} else if pos > 1 {
+		rules, err := n.rules(name)
+		if err != nil {
+			return err
+		}
+		switch {
+		case pos > len(rules)+1:
+			return fmt.Errorf("bad position %d in %s/%s", pos, table, chain)
+		case pos <= len(rules):
+			flags = netlink.Create // insert before the rule at pos
+			position = rules[pos-1].handle
+		}
+	}
+
+	b := n.batch()
+	if base != nil {
+		b.newTable()
+		b.newChain(name, base, netlink.Create)
+	}
+	b.add(unix.NFT_MSG_NEWRULE, flags, func(ae *netlink.AttributeEncoder) {
+		ae.String(unix.NFTA_RULE_TABLE, nftablesTable)
+		ae.String(unix.NFTA_RULE_CHAIN, name)
+		if position != 0 {
+			ae.Uint64(unix.NFTA_RULE_POSITION, position)
+		}
+		ae.Nested(unix.NFTA_RULE_EXPRESSIONS, func(ae *netlink.AttributeEncoder) error {
+			for _, e := range exprs {
+				ae.Nested(unix.NFTA_LIST_ELEM, func(ae *netlink.AttributeEncoder) error {
+					ae.String(unix.NFTA_EXPR_NAME, e.name)
+					if e.data != nil {
+						ae.Nested(unix.NFTA_EXPR_DATA, func(ae *netlink.AttributeEncoder) error {
+							e.data(ae)
+							return nil
+						})
+					}
+					return nil
+				})
+			}
+			return nil
+		})
+		ae.Bytes(unix.NFTA_RULE_USERDATA, comment)
+	})
+	return n.commit(b)
+}
+
+// nftBatch accumulates messages for a single nftables transaction.
+type nftBatch struct {
+	family uint8
+	msgs   []netlink.Message
+	err    error // first error building a message
+}
+
+func (n *nftablesRunner) batch() *nftBatch {
+	return &nftBatch{family: n.family}
+}
+
+// add adds a message of the given type to b, with attributes encoded
+// by fn.
+func (b *nftBatch) add(typ uint16, flags netlink.HeaderFlags, fn func(ae *netlink.AttributeEncoder)) {
+	if b.err != nil {
+		return
+	}
+	m, err := nftMsg(b.family, typ, flags|netlink.Request|netlink.Acknowledge, fn)
+	if err != nil {
+		b.err = err
+		return
+	}
+	b.msgs = append(b.msgs, m)
+}
+
+// newTable adds a message creating nftablesTable, if needed.
+func (b *nftBatch) newTable() {
+	b.add(unix.NFT_MSG_NEWTABLE, netlink.Create, func(ae *netlink.AttributeEncoder) {
+		ae.String(unix.NFTA_TABLE_NAME, nftablesTable)
+	})
+}
+
+// newChain adds a message creating the named chain, which is a base
+// chain if base is non-nil.
+func (b *nftBatch) newChain(name string, base *nftBaseChain, flags netlink.HeaderFlags) {
+	b.add(unix.NFT_MSG_NEWCHAIN, flags, func(ae *netlink.AttributeEncoder) {
+		ae.String(unix.NFTA_CHAIN_TABLE, nftablesTable)
+		ae.String(unix.NFTA_CHAIN_NAME, name)
+		if base == nil {
+			return
+		}
+		ae.Nested(unix.NFTA_CHAIN_HOOK, func(ae *netlink.AttributeEncoder) error {
+			ae.Uint32(unix.NFTA_HOOK_HOOKNUM, base.hook)
+			ae.Int32(unix.NFTA_HOOK_PRIORITY, base.priority)
+			return nil
+		})
+		ae.Uint32(unix.NFTA_CHAIN_POLICY, nfAccept)
+		ae.String(unix.NFTA_CHAIN_TYPE, base.typ)
+	})
+}
+
+// delRule adds a message deleting the rule with the given handle
+// from the chain, or all its rules if handle is 0.
+func (b *nftBatch) delRule(chain string, handle uint64) {
+	b.add(unix.NFT_MSG_DELRULE, 0, func(ae *netlink.AttributeEncoder) {
+		ae.String(unix.NFTA_RULE_TABLE, nftablesTable)
+		ae.String(unix.NFTA_RULE_CHAIN, chain)
+		if handle != 0 {
+			ae.Uint64(unix.NFTA_RULE_HANDLE, handle)
+		}
+	})
+}
+
+// nftMsg returns an nftables message of the given type for family,
+// with attributes encoded by fn.
+func nftMsg(family uint8, typ uint16, flags netlink.HeaderFlags, fn func(ae *netlink.AttributeEncoder)) (netlink.Message, error) {
+	ae := netlink.NewAttributeEncoder()
+	ae.ByteOrder = binary.BigEndian
+	fn(ae)
+	attrs, err := ae.Encode()
+	if err != nil {
+		return netlink.Message{}, err
+	}
+	return netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType(unix.NFNL_SUBSYS_NFTABLES<<8 | typ),
+			Flags: flags,
+		},
+		Data: append(nfgenmsg(family, 0), attrs...),
+	}, nil
+}
+
+// nfgenmsg returns a struct nfgenmsg.
+func nfgenmsg(family uint8, resID uint16) []byte {
+	b := []byte{family, unix.NFNETLINK_V0, 0, 0}
+	binary.BigEndian.PutUint16(b[2:], resID)
+	return b
+}
+
+// commit sends b to the kernel, which applies it atomically.
+func (n *nftablesRunner) commit(b *nftBatch) error {
+	if b.err != nil {
+		return b.err
+	}
+	batch := func(typ netlink.HeaderType) netlink.Message {
+		return netlink.Message{
+			Header: netlink.Header{Type: typ, Flags: netlink.Request},
+			Data:   nfgenmsg(unix.AF_UNSPEC, unix.NFNL_SUBSYS_NFTABLES),
+		}
+	}
+	c, err := n.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	req := append([]netlink.Message{batch(unix.NFNL_MSG_BATCH_BEGIN)}, b.msgs...)
+	req = append(req, batch(unix.NFNL_MSG_BATCH_END))
+	if _, err := c.SendMessages(req); err != nil {
+		return err
+	}
+	// Every message asked for an ack, or gets an error.
+	for acks := 0; acks < len(b.msgs); {
+		res, err := c.Receive()
+		if err != nil {
+			return err
+		}
+		if len(res) == 0 {
+			return errors.New("nftables: missing ack")
+		}
+		acks += len(res)
+	}
+	return nil
+}
+
+// nftRule is a rule read back from the kernel.
+type nftRule struct {
+	handle  uint64
+	comment string
+}
+
+// rules returns the rules in the named chain of nftablesTable, which
+// is empty if the chain doesn't exist.
+func (n *nftablesRunner) rules(chain string) ([]nftRule, error) {
+	c, err := n.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	m, err := nftMsg(n.family, unix.NFT_MSG_GETRULE, netlink.Request|netlink.Dump, func(ae *netlink.AttributeEncoder) {
+		ae.String(unix.NFTA_RULE_TABLE, nftablesTable)
+		ae.String(unix.NFTA_RULE_CHAIN, chain)
+	})
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.Execute(m)
+	if errors.Is(err, unix.ENOENT) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rules []nftRule
+	for _, m := range res {
+		if len(m.Data) < 4 {
+			continue
+		}
+		ad, err := netlink.NewAttributeDecoder(m.Data[4:])
+		if err != nil {
+			return nil, err
+		}
+		ad.ByteOrder = binary.BigEndian
+		var r nftRule
+		var ruleChain string
+		for ad.Next() {
+			switch ad.Type() {
+			case unix.NFTA_RULE_CHAIN:
+				ruleChain = ad.String()
+			case unix.NFTA_RULE_HANDLE:
+				r.handle = ad.Uint64()
+			case unix.NFTA_RULE_USERDATA:
+				r.comment = parseNFTComment(ad.Bytes())
+			}
+		}
+		if err := ad.Err(); err != nil {
+			return nil, err
+		}
+		// Older kernels ignore the chain when dumping rules.
+		if ruleChain == chain {
+			rules = append(rules, r)
+		}
+	}
+	return rules, nil
+}
+
+// findNFTRule returns the index of the rule made from args in rules.
+func findNFTRule(rules []nftRule, args []string) (int, bool) {
+	want := strings.Join(args, " ")
+	for i, r := range rules {
+		if r.comment == want {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// nftCommentType is NFTNL_UDATA_RULE_COMMENT, the type of the rule
+// userdata TLV that nft displays as the rule's comment.
+const nftCommentType = 0
+
+// nftComment returns rule userdata holding s as the comment.
+func nftComment(s string) ([]byte, error) {
+	if len(s)+1 > 255 || strings.IndexByte(s, 0) >= 0 {
+		return nil, fmt.Errorf("rule %q too long or invalid", s)
+	}
+	b := []byte{nftCommentType, byte(len(s) + 1)}
+	b = append(b, s...)
+	return append(b, 0), nil
+}
+
+// parseNFTComment returns the comment in rule userdata b, if any.
+func parseNFTComment(b []byte) string {
+	for len(b) >= 2 {
+		typ, n := b[0], int(b[1])
+		if len(b) < 2+n {
+			break
+		}
+		if typ == nftCommentType {
+			return string(bytes.TrimSuffix(b[2:2+n], []byte{0}))
+		}
+		b = b[2+n:]
+	}
+	return ""
+}
+
+// nftExpr is an nftables expression in a rule.
+type nftExpr struct {
+	name string
+	data func(ae *netlink.AttributeEncoder) // or nil
+}
+
+// nftExprs translates iptables rule arguments, as used by the router,
+// to nftables expressions for the given family.
+func nftExprs(family uint8, args []string) ([]nftExpr, error) {
+	var exprs []nftExpr
+	neg := false
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		val := func() (string, error) {
+			if i+1 >= len(args) {
+				return "", fmt.Errorf("missing value for %s", arg)
+			}
+			i++
+			return args[i], nil
+		}
+		if arg == "!" {
+			neg = true
+			continue
+		}
+		v, err := val()
+		if err != nil {
+			return nil, err
+		}
+		op := uint32(unix.NFT_CMP_EQ)
+		if neg {
+			op = unix.NFT_CMP_NEQ
+		}
+		switch arg {
+		case "-i", "-o":
+			key := uint32(unix.NFT_META_IIFNAME)
+			if arg == "-o" {
+				key = unix.NFT_META_OIFNAME
+			}
+			if len(v) >= unix.IFNAMSIZ || strings.HasSuffix(v, "+") {
+				return nil, fmt.Errorf("unsupported interface name %q", v)
+			}
+			name := make([]byte, unix.IFNAMSIZ)
+			copy(name, v)
+			exprs = append(exprs, nftMetaLoad(key), nftCmp(op, name))
+		case "-s", "-d":
+			e, err := nftAddrMatch(family, arg == "-d", op, v)
+			if err != nil {
+				return nil, err
+			}
+			exprs = append(exprs, e...)
+		case "-m":
+			if v != "mark" || neg {
+				return nil, fmt.Errorf("unsupported match %s %q", arg, v)
+			}
+		case "--mark":
+			mark, err := strconv.ParseUint(v, 0, 32)
+			if err != nil {
+				return nil, fmt.Errorf("bad mark %q", v)
+			}
+			exprs = append(exprs, nftMetaLoad(unix.NFT_META_MARK), nftCmp(op, nlenc.Uint32Bytes(uint32(mark))))
+		case "-j":
+			if neg {
+				return nil, errors.New("unsupported negated target")
+			}
+			e, err := nftTarget(v, args[i+1:])
+			if err != nil {
+				return nil, err
+			}
+			return append(exprs, e...), nil
+		default:
+			return nil, fmt.Errorf("unsupported argument %q", arg)
+		}
+		neg = false
+	}
+	return nil, errors.New("rule has no target")
+}
+
+// nftTarget returns the expressions for the iptables target and its
+// arguments, which must end the rule.
+func nftTarget(target string, args []string) ([]nftExpr, error) {
+	nargs := 0
+	var exprs []nftExpr
+	switch target {
+	case "ACCEPT":
+		exprs = append(exprs, nftVerdict(nfAccept, ""))
+	case "DROP":
+		exprs = append(exprs, nftVerdict(nfDrop, ""))
+	case "RETURN":
+		exprs = append(exprs, nftVerdict(unix.NFT_RETURN, ""))
+	case "MASQUERADE":
+		exprs = append(exprs, nftExpr{name: "masq"})
+	case "MARK":
+		if len(args) < 2 || args[0] != "--set-mark" {
+			return nil, errors.New("MARK without --set-mark")
+		}
+		nargs = 2
+		mark, err := strconv.ParseUint(args[1], 0, 32)
+		if err != nil {
+			return nil, fmt.Errorf("bad mark %q", args[1])
+		}
+		exprs = append(exprs, nftImmediate(unix.NFT_REG_1, nlenc.Uint32Bytes(uint32(mark))), nftExpr{
+			name: "meta",
+			data: func(ae *netlink.AttributeEncoder) {
+				ae.Uint32(unix.NFTA_META_KEY, unix.NFT_META_MARK)
+				ae.Uint32(unix.NFTA_META_SREG, unix.NFT_REG_1)
+			},
+		})
+	default:
+		if strings.ToUpper(target) == target {
+			return nil, fmt.Errorf("unsupported target %q", target)
+		}
+		exprs = append(exprs, nftVerdict(unix.NFT_JUMP, target))
+	}
+	if len(args) != nargs {
+		return nil, fmt.Errorf("unsupported arguments %q after target", args[nargs:])
+	}
+	return exprs, nil
+}
+
+// nftAddrMatch returns the expressions matching the packet's source,
+// or destination if dst, against the address or CIDR s.
+func nftAddrMatch(family uint8, dst bool, op uint32, s string) ([]nftExpr, error) {
+	if !strings.Contains(s, "/") {
+		if family == unix.NFPROTO_IPV4 {
+			s += "/32"
+		} else {
+			s += "/128"
+		}
+	}
+	ip, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, err
+	}
+	var offset uint32
+	addr := ip.To4()
+	if family == unix.NFPROTO_IPV4 {
+		if addr == nil {
+			return nil, fmt.Errorf("%s is not an IPv4 prefix", s)
+		}
+		offset = 12 // saddr in struct iphdr
+		if dst {
+			offset = 16
+		}
+	} else {
+		if addr != nil {
+			return nil, fmt.Errorf("%s is not an IPv6 prefix", s)
+		}
+		addr = ip.To16()
+		offset = 8 // saddr in struct ipv6hdr
+		if dst {
+			offset = 24
+		}
+	}
+	mask := []byte(ipNet.Mask)
+	exprs := []nftExpr{{
+		name: "payload",
+		data: func(ae *netlink.AttributeEncoder) {
+			ae.Uint32(unix.NFTA_PAYLOAD_DREG, unix.NFT_REG_1)
+			ae.Uint32(unix.NFTA_PAYLOAD_BASE, unix.NFT_PAYLOAD_NETWORK_HEADER)
+			ae.Uint32(unix.NFTA_PAYLOAD_OFFSET, offset)
+			ae.Uint32(unix.NFTA_PAYLOAD_LEN, uint32(len(addr)))
+		},
+	}}
+	if ones, bits := ipNet.Mask.Size(); ones != bits {
+		exprs = append(exprs, nftExpr{
+			name: "bitwise",
+			data: func(ae *netlink.AttributeEncoder) {
+				ae.Uint32(unix.NFTA_BITWISE_SREG, unix.NFT_REG_1)
+				ae.Uint32(unix.NFTA_BITWISE_DREG, unix.NFT_REG_1)
+				ae.Uint32(unix.NFTA_BITWISE_LEN, uint32(len(mask)))
+				nftData(ae, unix.NFTA_BITWISE_MASK, mask)
+				nftData(ae, unix.NFTA_BITWISE_XOR, make([]byte, len(mask)))
+			},
+		})
+	}
+	return append(exprs, nftCmp(op, ipNet.IP)), nil
+}
+
+// nftMetaLoad returns an expression loading the meta key into
+// register 1.
+func nftMetaLoad(key uint32) nftExpr {
+	return nftExpr{
+		name: "meta",
+		data: func(ae *netlink.AttributeEncoder) {
+			ae.Uint32(unix.NFTA_META_DREG, unix.NFT_REG_1)
+			ae.Uint32(unix.NFTA_META_KEY, key)
+		},
+	}
+}
+
+// nftCmp returns an expression comparing register 1 to v.
+func nftCmp(op uint32, v []byte) nftExpr {
+	return nftExpr{
+		name: "cmp",
+		data: func(ae *netlink.AttributeEncoder) {
+			ae.Uint32(unix.NFTA_CMP_SREG, unix.NFT_REG_1)
+			ae.Uint32(unix.NFTA_CMP_OP, op)
+			nftData(ae, unix.NFTA_CMP_DATA, v)
+		},
+	}
+}
+
+// nftImmediate returns an expression loading v into register reg.
+func nftImmediate(reg uint32, v []byte) nftExpr {
+	return nftExpr{
+		name: "immediate",
+		data: func(ae *netlink.AttributeEncoder) {
+			ae.Uint32(unix.NFTA_IMMEDIATE_DREG, reg)
+			nftData(ae, unix.NFTA_IMMEDIATE_DATA, v)
+		},
+	}
+}
+
+// nftVerdict returns an expression ending the rule with the verdict
+// code, jumping to chain for unix.NFT_JUMP.
+func nftVerdict(code int32, chain string) nftExpr {
+	return nftExpr{
+		name: "immediate",
+		data: func(ae *netlink.AttributeEncoder) {
+			ae.Uint32(unix.NFTA_IMMEDIATE_DREG, unix.NFT_REG_VERDICT)
+			ae.Nested(unix.NFTA_IMMEDIATE_DATA, func(ae *netlink.AttributeEncoder) error {
+				ae.Nested(unix.NFTA_DATA_VERDICT, func(ae *netlink.AttributeEncoder) error {
+					ae.Int32(unix.NFTA_VERDICT_CODE, code)
+					if chain != "" {
+						ae.String(unix.NFTA_VERDICT_CHAIN, chain)
+					}
+					return nil
+				})
+				return nil
+			})
+		},
+	}
+}
+
+// nftData encodes v as a struct nft_data value attribute of type typ.
+func nftData(ae *netlink.AttributeEncoder, typ uint16, v []byte) {
+	ae.Nested(typ, func(ae *netlink.AttributeEncoder) error {
+		ae.Bytes(unix.NFTA_DATA_VALUE, v)
+		return nil
+	})
+}
@@ -0,0 +1,454 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+	"github.com/mdlayher/netlink/nltest"
+	"golang.org/x/sys/unix"
+)
+
+// fakeNFTables is a fake kernel nftables implementation for the
+// subset of messages nftablesRunner sends.
+type fakeNFTables struct {
+	t      *testing.T
+	table  bool
+	chains map[string][]fakeNFTRule // by name
+	last   uint64                   // last rule handle
+
+	failRule bool // whether to fail the next new rule
+}
+
+type fakeNFTRule struct {
+	handle  uint64
+	comment string
+	exprs   string // expression names
+}
+
+func newFakeNFTables(t *testing.T) (*fakeNFTables, *nftablesRunner) {
+	f := &fakeNFTables{t: t, chains: map[string][]fakeNFTRule{}}
+	n := &nftablesRunner{
+		family: unix.NFPROTO_IPV4,
+		dial: func() (*netlink.Conn, error) {
+			return nltest.Dial(f.handle), nil
+		},
+	}
+	return f, n
+}
+
+// String returns the rules in each chain, like fakeOS.String.
+func (f *fakeNFTables) String() string {
+	var b strings.Builder
+	for _, chain := range []string{"input", "forward", "postrouting", "ts-input", "ts-forward", "ts-postrouting"} {
+		for _, r := range f.chains[chain] {
+			b.WriteString(chain + " " + r.comment + "\n")
+		}
+	}
+	return strings.TrimSpace(b.String())
+}
+
+func (f *fakeNFTables) handle(req []netlink.Message) ([]netlink.Message, error) {
+	if len(req) == 1 {
+		m := req[0]
+		switch nftMsgType(m) {
+		case unix.NFT_MSG_GETTABLE:
+			if !f.table {
+				return []netlink.Message{nlReply(m, unix.ENOENT)}, nil
+			}
+			return []netlink.Message{nlReply(m, 0)}, nil
+		case unix.NFT_MSG_GETRULE:
+			return f.dumpRules(m), nil
+		}
+		f.t.Fatalf("unexpected message type %#x outside batch", uint16(m.Header.Type))
+	}
+	if len(req) < 2 || req[0].Header.Type != unix.NFNL_MSG_BATCH_BEGIN || req[len(req)-1].Header.Type != unix.NFNL_MSG_BATCH_END {
+		f.t.Fatalf("request isn't a batch: %v", req)
+	}
+
+	// Apply the batch to a copy, and only keep it if it all succeeds.
+	saved := *f
+	f.chains = map[string][]fakeNFTRule{}
+	for k, v := range saved.chains {
+		f.chains[k] = append([]fakeNFTRule(nil), v...)
+	}
+	var res []netlink.Message
+	for _, m := range req[1 : len(req)-1] {
+		if m.Header.Flags&netlink.Acknowledge == 0 {
+			f.t.Errorf("message %#x doesn't ask for an ack", uint16(m.Header.Type))
+		}
+		errno := f.apply(m)
+		res = append(res, nlReply(m, errno))
+		if errno != 0 {
+			f.table, f.chains, f.last = saved.table, saved.chains, saved.last
+			return res, nil
+		}
+	}
+	return res, nil
+}
+
+func (f *fakeNFTables) apply(m netlink.Message) unix.Errno {
+	attrs := nftAttrs(f.t, m)
+	table := nlString(attrs[unix.NFTA_TABLE_NAME]) // same number for chains and rules
+	if table != nftablesTable {
+		f.t.Errorf("message %#x for table %q", uint16(m.Header.Type), table)
+		return unix.EINVAL
+	}
+	switch nftMsgType(m) {
+	case unix.NFT_MSG_NEWTABLE:
+		f.table = true
+		return 0
+	}
+	if !f.table {
+		return unix.ENOENT
+	}
+	switch nftMsgType(m) {
+	case unix.NFT_MSG_NEWCHAIN:
+		name := nlString(attrs[unix.NFTA_CHAIN_NAME])
+		if _, ok := f.chains[name]; ok {
+			if m.Header.Flags&netlink.Excl != 0 {
+				return unix.EEXIST
+			}
+			return 0
+		}
+		f.chains[name] = nil
+	case unix.NFT_MSG_DELCHAIN:
+		name := nlString(attrs[unix.NFTA_CHAIN_NAME])
+		rules, ok := f.chains[name]
+		if !ok {
+			return unix.ENOENT
+		}
+		if len(rules) > 0 {
+			return unix.EBUSY
+		}
+		delete(f.chains, name)
+	case unix.NFT_MSG_NEWRULE:
+		chain := nlString(attrs[unix.NFTA_RULE_CHAIN])
+		rules, ok := f.chains[chain]
+		if !ok {
+			return unix.ENOENT
+		}
+		if f.failRule {
+			f.failRule = false
+			return unix.EINVAL
+		}
+		f.last++
+		r := fakeNFTRule{
+			handle:  f.last,
+			comment: parseNFTComment(attrs[unix.NFTA_RULE_USERDATA]),
+			exprs:   nftExprNames(f.t, attrs[unix.NFTA_RULE_EXPRESSIONS]),
+		}
+		i := len(rules)
+		if m.Header.Flags&netlink.Append == 0 {
+			i = 0
+		}
+		if pos, ok := attrs[unix.NFTA_RULE_POSITION]; ok {
+			i = -1
+			for j, old := range rules {
+				if old.handle == binary.BigEndian.Uint64(pos) {
+					i = j
+				}
+			}
+			if i < 0 {
+				return unix.ENOENT
+			}
+			if m.Header.Flags&netlink.Append != 0 {
+				i++
+			}
+		}
+		rules = append(rules, fakeNFTRule{})
+		copy(rules[i+1:], rules[i:])
+		rules[i] = r
+		f.chains[chain] = rules
+	case unix.NFT_MSG_DELRULE:
+		chain := nlString(attrs[unix.NFTA_RULE_CHAIN])
+		rules, ok := f.chains[chain]
+		if !ok {
+			return unix.ENOENT
+		}
+		h, ok := attrs[unix.NFTA_RULE_HANDLE]
+		if !ok {
+			f.chains[chain] = nil
+			return 0
+		}
+		for i, r := range rules {
+			if r.handle == binary.BigEndian.Uint64(h) {
+				f.chains[chain] = append(rules[:i], rules[i+1:]...)
+				return 0
+			}
+		}
+		return unix.ENOENT
+	default:
+		f.t.Errorf("unexpected message type %#x in batch", uint16(m.Header.Type))
+		return unix.EINVAL
+	}
+	return 0
+}
+
+func (f *fakeNFTables) dumpRules(m netlink.Message) []netlink.Message {
+	chain := nlString(nftAttrs(f.t, m)[unix.NFTA_RULE_CHAIN])
+	var res []netlink.Message
+	for _, r := range f.chains[chain] {
+		ae := netlink.NewAttributeEncoder()
+		ae.ByteOrder = binary.BigEndian
+		ae.String(unix.NFTA_RULE_TABLE, nftablesTable)
+		ae.String(unix.NFTA_RULE_CHAIN, chain)
+		ae.Uint64(unix.NFTA_RULE_HANDLE, r.handle)
+		if r.comment != "" {
+			c, _ := nftComment(r.comment)
+			ae.Bytes(unix.NFTA_RULE_USERDATA, c)
+		}
+		b, err := ae.Encode()
+		if err != nil {
+			f.t.Fatal(err)
+		}
+		res = append(res, netlink.Message{
+			Header: netlink.Header{
+				Type:     netlink.HeaderType(unix.NFNL_SUBSYS_NFTABLES<<8 | unix.NFT_MSG_NEWRULE),
+				Flags:    netlink.Multi,
+				Sequence: m.Header.Sequence,
+				PID:      m.Header.PID,
+			},
+			Data: append(nfgenmsg(unix.NFPROTO_IPV4, 0), b...),
+		})
+	}
+	return append(res, netlink.Message{
+		Header: netlink.Header{
+			Type:     netlink.Done,
+			Flags:    netlink.Multi,
+			Sequence: m.Header.Sequence,
+			PID:      m.Header.PID,
+		},
+	})
+}
+
+func nftMsgType(m netlink.Message) uint16 {
+	return uint16(m.Header.Type) &^ (unix.NFNL_SUBSYS_NFTABLES << 8)
+}
+
+// nlReply returns the ack for req, or an error if errno is non-zero.
+func nlReply(req netlink.Message, errno unix.Errno) netlink.Message {
+	b := make([]byte, 4)
+	nlenc.PutInt32(b, -int32(errno))
+	return netlink.Message{
+		Header: netlink.Header{
+			Type:     netlink.Error,
+			Sequence: req.Header.Sequence,
+			PID:      req.Header.PID,
+		},
+		Data: b,
+	}
+}
+
+func nlString(b []byte) string {
+	return strings.TrimSuffix(string(b), "\x00")
+}
+
+// nftAttrs returns the top-level attributes of the nftables message.
+func nftAttrs(t *testing.T, m netlink.Message) map[uint16][]byte {
+	attrs, err := netlink.UnmarshalAttributes(m.Data[4:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	ret := map[uint16][]byte{}
+	for _, a := range attrs {
+		ret[a.Type&^netlink.Nested] = a.Data
+	}
+	return ret
+}
+
+// nftExprNames returns the names of the expressions in the
+// NFTA_RULE_EXPRESSIONS attribute b.
+func nftExprNames(t *testing.T, b []byte) string {
+	elems, err := netlink.UnmarshalAttributes(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range elems {
+		attrs, err := netlink.UnmarshalAttributes(e.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, a := range attrs {
+			if a.Type == unix.NFTA_EXPR_NAME {
+				names = append(names, nlString(a.Data))
+			}
+		}
+	}
+	return strings.Join(names, " ")
+}
+
+func TestNFTablesRunner(t *testing.T) {
+	f, n := newFakeNFTables(t)
+	check := func(want string) {
+		t.Helper()
+		if diff := cmp.Diff(f.String(), strings.TrimSpace(want)); diff != "" {
+			t.Fatalf("unexpected state (-got+want):\n%s", diff)
+		}
+	}
+
+	if err := n.probe(); err != nil {
+		t.Fatalf("probe: %v", err)
+	}
+	if err := n.ClearChain("filter", "ts-input"); errCode(err) != 1 {
+		t.Fatalf("ClearChain of missing chain = %v; want exit code 1", err)
+	}
+	for _, c := range []string{"filter/ts-input", "filter/ts-forward", "nat/ts-postrouting"} {
+		table, chain := c[:strings.Index(c, "/")], c[strings.Index(c, "/")+1:]
+		if err := n.NewChain(table, chain); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := n.NewChain("filter", "ts-input"); err == nil {
+		t.Fatal("NewChain of existing chain succeeded")
+	}
+
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	must(n.Append("filter", "ts-input", "!", "-i", "tailscale0", "-s", "100.64.0.0/10", "-j", "DROP"))
+	must(n.Insert("filter", "ts-input", 1, "-i", "lo", "-s", "100.101.102.104", "-j", "ACCEPT"))
+	must(n.Insert("filter", "ts-input", 2, "!", "-i", "tailscale0", "-s", "100.115.92.0/23", "-j", "RETURN"))
+	must(n.Append("filter", "ts-forward", "-i", "tailscale0", "-j", "MARK", "--set-mark", "0x40000"))
+	must(n.Append("filter", "ts-forward", "-m", "mark", "--mark", "0x40000", "-j", "ACCEPT"))
+	must(n.Append("nat", "ts-postrouting", "-m", "mark", "--mark", "0x40000", "-j", "MASQUERADE"))
+	must(n.Insert("filter", "INPUT", 1, "-j", "ts-input"))
+	must(n.Insert("nat", "POSTROUTING", 1, "-j", "ts-postrouting"))
+	check(`
+input -j ts-input
+postrouting -j ts-postrouting
+ts-input -i lo -s 100.101.102.104 -j ACCEPT
+ts-input ! -i tailscale0 -s 100.115.92.0/23 -j RETURN
+ts-input ! -i tailscale0 -s 100.64.0.0/10 -j DROP
+ts-forward -i tailscale0 -j MARK --set-mark 0x40000
+ts-forward -m mark --mark 0x40000 -j ACCEPT
+ts-postrouting -m mark --mark 0x40000 -j MASQUERADE
+`)
+	if got, want := f.chains["ts-input"][1].exprs, "meta cmp payload bitwise cmp immediate"; got != want {
+		t.Errorf("expressions = %q; want %q", got, want)
+	}
+	if got, want := f.chains["ts-input"][0].exprs, "meta cmp payload cmp immediate"; got != want {
+		t.Errorf("expressions for a single address = %q; want %q", got, want)
+	}
+	if got, want := f.chains["ts-forward"][0].exprs, "meta cmp immediate meta"; got != want {
+		t.Errorf("expressions for MARK = %q; want %q", got, want)
+	}
+
+	for _, tt := range []struct {
+		chain string
+		args  []string
+		want  bool
+	}{
+		{"INPUT", []string{"-j", "ts-input"}, true},
+		{"FORWARD", []string{"-j", "ts-forward"}, false},
+		{"ts-input", []string{"-i", "lo", "-s", "100.101.102.104", "-j", "ACCEPT"}, true},
+		{"ts-input", []string{"-i", "lo", "-s", "100.101.102.105", "-j", "ACCEPT"}, false},
+	} {
+		got, err := n.Exists("filter", tt.chain, tt.args...)
+		if err != nil || got != tt.want {
+			t.Errorf("Exists(%s, %q) = %v, %v; want %v", tt.chain, tt.args, got, err, tt.want)
+		}
+	}
+
+	must(n.Delete("filter", "ts-input", "-i", "lo", "-s", "100.101.102.104", "-j", "ACCEPT"))
+	if err := n.Delete("filter", "ts-input", "-i", "lo", "-s", "100.101.102.104", "-j", "ACCEPT"); err == nil {
+		t.Error("Delete of missing rule succeeded")
+	}
+	if err := n.DeleteChain("filter", "ts-input"); err == nil {
+		t.Error("DeleteChain of non-empty chain succeeded")
+	}
+	must(n.ClearChain("filter", "ts-input"))
+	must(n.DeleteChain("filter", "ts-input"))
+	must(n.Delete("filter", "INPUT", "-j", "ts-input"))
+	check(`
+postrouting -j ts-postrouting
+ts-forward -i tailscale0 -j MARK --set-mark 0x40000
+ts-forward -m mark --mark 0x40000 -j ACCEPT
+ts-postrouting -m mark --mark 0x40000 -j MASQUERADE
+`)
+
+	if err := n.Insert("filter", "ts-missing", 1, "-j", "ACCEPT"); !errors.Is(err, unix.ENOENT) {
+		t.Errorf("Insert into missing chain = %v; want ENOENT", err)
+	}
+
+	// A failed batch changes nothing: the base chain created along
+	// with the rule is rolled back.
+	f.failRule = true
+	if err := n.Insert("filter", "FORWARD", 1, "-j", "ts-forward"); !errors.Is(err, unix.EINVAL) {
+		t.Errorf("Insert of failing rule = %v; want EINVAL", err)
+	}
+	if _, ok := f.chains["forward"]; ok {
+		t.Error("forward chain created by failed batch")
+	}
+}
+
+func TestNFTExprs(t *testing.T) {
+	tests := []struct {
+		family uint8
+		args   string
+		want   string // expression names, or "error"
+	}{
+		{unix.NFPROTO_IPV4, "-j ACCEPT", "immediate"},
+		{unix.NFPROTO_IPV4, "-o tailscale0 -s 100.64.0.0/10 -j DROP", "meta cmp payload bitwise cmp immediate"},
+		{unix.NFPROTO_IPV4, "-d 10.0.0.0/8 -j RETURN", "payload bitwise cmp immediate"},
+		{unix.NFPROTO_IPV6, "-s fd7a:115c:a1e0::/48 -j ACCEPT", "payload bitwise cmp immediate"},
+		{unix.NFPROTO_IPV6, "-s fd7a:115c:a1e0::1 -j ACCEPT", "payload cmp immediate"},
+		{unix.NFPROTO_IPV4, "-m mark --mark 0x40000 -j MASQUERADE", "meta cmp masq"},
+		{unix.NFPROTO_IPV4, "-m mark --mark 0x40000 -d 200.0.0.0/8 -j MASQUERADE", "meta cmp payload bitwise cmp masq"},
+		{unix.NFPROTO_IPV4, "-j ts-forward", "immediate"},
+		{unix.NFPROTO_IPV6, "-s 100.64.0.0/10 -j DROP", "error"},
+		{unix.NFPROTO_IPV4, "-s fd7a:115c:a1e0::/48 -j DROP", "error"},
+		{unix.NFPROTO_IPV4, "-m comment --comment tailscale -j ACCEPT", "error"},
+		{unix.NFPROTO_IPV4, "-i eth+ -j ACCEPT", "error"},
+		{unix.NFPROTO_IPV4, "-j LOG", "error"},
+		{unix.NFPROTO_IPV4, "-j ACCEPT -i lo", "error"},
+		{unix.NFPROTO_IPV4, "-i lo", "error"},
+		{unix.NFPROTO_IPV4, "-j MARK", "error"},
+	}
+	for _, tt := range tests {
+		exprs, err := nftExprs(tt.family, strings.Fields(tt.args))
+		var got string
+		if err != nil {
+			got = "error"
+		} else {
+			var names []string
+			for _, e := range exprs {
+				names = append(names, e.name)
+			}
+			got = strings.Join(names, " ")
+		}
+		if got != tt.want {
+			t.Errorf("nftExprs(%d, %q) = %q (%v); want %q", tt.family, tt.args, got, err, tt.want)
+		}
+	}
+}
+
+func TestNFTComment(t *testing.T) {
+	const s = "-i lo -s 100.101.102.104 -j ACCEPT"
+	b, err := nftComment(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := parseNFTComment(b); got != s {
+		t.Errorf("round trip = %q; want %q", got, s)
+	}
+	// Other userdata before the comment is skipped.
+	if got := parseNFTComment(append([]byte{1, 2, 'x', 'y'}, b...)); got != s {
+		t.Errorf("with other userdata = %q; want %q", got, s)
+	}
+	if _, err := nftComment(strings.Repeat("x", 255)); err == nil {
+		t.Error("nftComment of long string succeeded")
+	}
+}
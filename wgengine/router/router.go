@@ -67,9 +67,10 @@ type Config struct {
 	LocalRoutes []netaddr.IPPrefix
 
 	// Linux-only things below, ignored on other platforms.
-	SubnetRoutes     []netaddr.IPPrefix     // subnets being advertised to other Tailscale nodes
-	SNATSubnetRoutes bool                   // SNAT traffic to local subnets
-	NetfilterMode    preftype.NetfilterMode // how much to manage netfilter rules
+	SubnetRoutes       []netaddr.IPPrefix     // subnets being advertised to other Tailscale nodes
+	SNATSubnetRoutes   bool                   // SNAT traffic to local subnets
+	NoSNATSubnetRoutes []netaddr.IPPrefix     // SubnetRoutes not to SNAT, even if SNATSubnetRoutes
+	NetfilterMode      preftype.NetfilterMode // how much to manage netfilter rules
 }
 
 // shutdownConfig is a routing configuration that removes all router
@@ -11,6 +11,7 @@ import (
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
@@ -35,6 +36,7 @@ const (
 	netfilterOff      = preftype.NetfilterOff
 	netfilterNoDivert = preftype.NetfilterNoDivert
 	netfilterOn       = preftype.NetfilterOn
+	netfilterNFTables = preftype.NetfilterNFTables
 )
 
 // The following bits are added to packet marks for Tailscale use.
@@ -68,9 +70,9 @@ const (
 	tailscaleBypassMarkNum = 0x80000
 )
 
-// netfilterRunner abstracts helpers to run netfilter commands. It
-// exists purely to swap out go-iptables for a fake implementation in
-// tests.
+// netfilterRunner abstracts helpers to run netfilter commands, in
+// iptables terms. It's implemented by go-iptables, by nftablesRunner,
+// and by a fake implementation in tests.
 type netfilterRunner interface {
 	Insert(table, chain string, pos int, args ...string) error
 	Append(table, chain string, args ...string) error
@@ -82,16 +84,16 @@ type netfilterRunner interface {
 }
 
 type linuxRouter struct {
-	closed           syncs.AtomicBool
-	logf             func(fmt string, args ...interface{})
-	tunname          string
-	linkMon          *monitor.Mon
-	unregLinkMon     func()
-	addrs            map[netaddr.IPPrefix]bool
-	routes           map[netaddr.IPPrefix]bool
-	localRoutes      map[netaddr.IPPrefix]bool
-	snatSubnetRoutes bool
-	netfilterMode    preftype.NetfilterMode
+	closed        syncs.AtomicBool
+	logf          func(fmt string, args ...interface{})
+	tunname       string
+	linkMon       *monitor.Mon
+	unregLinkMon  func()
+	addrs         map[netaddr.IPPrefix]bool
+	routes        map[netaddr.IPPrefix]bool
+	localRoutes   map[netaddr.IPPrefix]bool
+	snatRules     []snatRule // current nat/ts-postrouting rules
+	netfilterMode preftype.NetfilterMode
 
 	// ruleRestorePending is whether a timer has been started to
 	// restore deleted ip rules.
@@ -103,9 +105,17 @@ type linuxRouter struct {
 	v6Available     bool
 	v6NATAvailable  bool
 
-	ipt4 netfilterRunner
-	ipt6 netfilterRunner
-	cmd  commandRunner
+	// nf4 and nf6 are the netfilterRunners in use: ipt4 and ipt6, or
+	// nft4 and nft6 if useNFTables.
+	nf4         netfilterRunner
+	nf6         netfilterRunner
+	ipt4        netfilterRunner // nil if iptables is unavailable
+	ipt6        netfilterRunner
+	nft4        netfilterRunner // nil if nftables is unavailable
+	nft6        netfilterRunner
+	useNFTables bool
+
+	cmd commandRunner
 }
 
 func newUserspaceRouter(logf logger.Logf, tunDev tun.Device, linkMon *monitor.Mon) (Router, error) {
@@ -114,11 +124,6 @@ func newUserspaceRouter(logf logger.Logf, tunDev tun.Device, linkMon *monitor.Mo
 		return nil, err
 	}
 
-	ipt4, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
-	if err != nil {
-		return nil, err
-	}
-
 	v6err := checkIPv6()
 	if v6err != nil {
 		logf("disabling tunneled IPv6 due to system IPv6 config: %v", v6err)
@@ -129,24 +134,46 @@ func newUserspaceRouter(logf logger.Logf, tunDev tun.Device, linkMon *monitor.Mo
 		logf("v6nat = %v", supportsV6NAT)
 	}
 
-	var ipt6 netfilterRunner
-	if supportsV6 {
-		// The iptables package probes for `ip6tables` and errors out
-		// if unavailable. We want that to be a non-fatal error.
-		ipt6, err = iptables.NewWithProtocol(iptables.ProtocolIPv6)
-		if err != nil {
-			return nil, err
+	// Use iptables if it's there. Without it, such as on hosts with
+	// only nftables, fall back to nftables.
+	ipt4, ipt6, iptErr := newIPTablesRunners(supportsV6)
+	nft4, nft6, nftErr := newNFTablesRunners(supportsV6)
+	if iptErr != nil {
+		if nftErr != nil {
+			return nil, iptErr
 		}
+		logf("iptables unavailable, using nftables: %v", iptErr)
 	}
 
 	cmd := osCommandRunner{
 		ambientCapNetAdmin: useAmbientCaps(),
 	}
 
-	return newUserspaceRouterAdvanced(logf, tunname, linkMon, ipt4, ipt6, cmd, supportsV6, supportsV6NAT)
+	return newUserspaceRouterAdvanced(logf, tunname, linkMon, ipt4, ipt6, nft4, nft6, cmd, supportsV6, supportsV6NAT)
+}
+
+// newIPTablesRunners returns go-iptables netfilterRunners for IPv4
+// and, if supportsV6, IPv6.
+func newIPTablesRunners(supportsV6 bool) (ipt4, ipt6 netfilterRunner, err error) {
+	ipt4, err = iptables.NewWithProtocol(iptables.ProtocolIPv4)
+	if err != nil {
+		return nil, nil, err
+	}
+	if supportsV6 {
+		// The iptables package probes for `ip6tables` and errors out
+		// if unavailable.
+		ipt6, err = iptables.NewWithProtocol(iptables.ProtocolIPv6)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return ipt4, ipt6, nil
 }
 
-func newUserspaceRouterAdvanced(logf logger.Logf, tunname string, linkMon *monitor.Mon, netfilter4, netfilter6 netfilterRunner, cmd commandRunner, supportsV6, supportsV6NAT bool) (Router, error) {
+// newUserspaceRouterAdvanced returns a Router using the given
+// netfilterRunners for iptables and nftables. Either pair may be nil
+// if unavailable, but not both.
+func newUserspaceRouterAdvanced(logf logger.Logf, tunname string, linkMon *monitor.Mon, netfilter4, netfilter6, nftables4, nftables6 netfilterRunner, cmd commandRunner, supportsV6, supportsV6NAT bool) (Router, error) {
 	r := &linuxRouter{
 		logf:          logf,
 		tunname:       tunname,
@@ -156,12 +183,20 @@ func newUserspaceRouterAdvanced(logf logger.Logf, tunname string, linkMon *monit
 		v6Available:    supportsV6,
 		v6NATAvailable: supportsV6NAT,
 
+		nf4:  netfilter4,
+		nf6:  netfilter6,
 		ipt4: netfilter4,
 		ipt6: netfilter6,
+		nft4: nftables4,
+		nft6: nftables6,
 		cmd:  cmd,
 
 		ipRuleFixLimiter: rate.NewLimiter(rate.Every(5*time.Second), 10),
 	}
+	if netfilter4 == nil {
+		r.nf4, r.nf6 = nftables4, nftables6
+		r.useNFTables = true
+	}
 	if r.useIPCommand() {
 		r.ipRuleAvailable = (cmd.run("ip", "rule") == nil)
 	} else {
@@ -306,31 +341,54 @@ func (r *linuxRouter) Set(cfg *Config) error {
 	}
 	r.addrs = newAddrs
 
-	switch {
-	case cfg.SNATSubnetRoutes == r.snatSubnetRoutes:
-		// state already correct, nothing to do.
-	case cfg.SNATSubnetRoutes:
-		if err := r.addSNATRule(); err != nil {
-			errs = append(errs, err)
-		}
-	default:
-		if err := r.delSNATRule(); err != nil {
+	snatRules := snatRulesForConfig(cfg)
+	if !snatRulesEqual(r.snatRules, snatRules) {
+		if err := r.setSNATRules(snatRules); err != nil {
 			errs = append(errs, err)
+			// Rebuild the chain on the next Set.
+			snatRules = nil
 		}
 	}
-	r.snatSubnetRoutes = cfg.SNATSubnetRoutes
+	r.snatRules = snatRules
 
 	return multierr.New(errs...)
 }
 
 // setNetfilterMode switches the router to the given netfilter
 // mode. Netfilter state is created or deleted appropriately to
-// reflect the new mode, and r.snatSubnetRoutes is updated to reflect
-// the current state of subnet SNATing.
+// reflect the new mode, and r.snatRules is updated to reflect the
+// current state of subnet SNATing.
 func (r *linuxRouter) setNetfilterMode(mode preftype.NetfilterMode) error {
 	if distro.Get() == distro.Synology {
 		mode = netfilterOff
 	}
+
+	// netfilterNFTables is netfilterOn, using nftables. If switching
+	// between iptables and nftables, remove everything with the old
+	// one first.
+	useNFTables := r.useNFTables
+	switch {
+	case mode == netfilterNFTables:
+		if r.nft4 == nil {
+			return errors.New("nftables is unavailable")
+		}
+		useNFTables = true
+		mode = netfilterOn
+	case mode != netfilterOff:
+		useNFTables = r.ipt4 == nil
+	}
+	if useNFTables != r.useNFTables {
+		if err := r.setNetfilterMode(netfilterOff); err != nil {
+			return err
+		}
+		r.useNFTables = useNFTables
+		if useNFTables {
+			r.nf4, r.nf6 = r.nft4, r.nft6
+		} else {
+			r.nf4, r.nf6 = r.ipt4, r.ipt6
+		}
+	}
+
 	if r.netfilterMode == mode {
 		return nil
 	}
@@ -371,7 +429,7 @@ func (r *linuxRouter) setNetfilterMode(mode preftype.NetfilterMode) error {
 				// this table somewhere else.
 			}
 		}
-		r.snatSubnetRoutes = false
+		r.snatRules = nil
 	case netfilterNoDivert:
 		switch r.netfilterMode {
 		case netfilterOff:
@@ -382,7 +440,7 @@ func (r *linuxRouter) setNetfilterMode(mode preftype.NetfilterMode) error {
 			if err := r.addNetfilterBase(); err != nil {
 				return err
 			}
-			r.snatSubnetRoutes = false
+			r.snatRules = nil
 		case netfilterOn:
 			if err := r.delNetfilterHooks(); err != nil {
 				return err
@@ -410,7 +468,7 @@ func (r *linuxRouter) setNetfilterMode(mode preftype.NetfilterMode) error {
 			if err := r.addNetfilterBase(); err != nil {
 				return err
 			}
-			r.snatSubnetRoutes = false
+			r.snatRules = nil
 		case netfilterNoDivert:
 			reprocess = true
 			if err := r.delNetfilterBase(); err != nil {
@@ -422,7 +480,7 @@ func (r *linuxRouter) setNetfilterMode(mode preftype.NetfilterMode) error {
 			if err := r.addNetfilterBase(); err != nil {
 				return err
 			}
-			r.snatSubnetRoutes = false
+			r.snatRules = nil
 		}
 	default:
 		panic("unhandled netfilter mode")
@@ -502,13 +560,13 @@ func (r *linuxRouter) addLoopbackRule(addr netaddr.IP) error {
 		return nil
 	}
 
-	nf := r.ipt4
+	nf := r.nf4
 	if addr.Is6() {
 		if !r.v6Available {
 			// IPv6 not available, ignore.
 			return nil
 		}
-		nf = r.ipt6
+		nf = r.nf6
 	}
 
 	if err := nf.Insert("filter", "ts-input", 1, "-i", "lo", "-s", addr.String(), "-j", "ACCEPT"); err != nil {
@@ -524,13 +582,13 @@ func (r *linuxRouter) delLoopbackRule(addr netaddr.IP) error {
 		return nil
 	}
 
-	nf := r.ipt4
+	nf := r.nf4
 	if addr.Is6() {
 		if !r.v6Available {
 			// IPv6 not available, ignore.
 			return nil
 		}
-		nf = r.ipt6
+		nf = r.nf6
 	}
 
 	if err := nf.Delete("filter", "ts-input", "-i", "lo", "-s", addr.String(), "-j", "ACCEPT"); err != nil {
@@ -1055,9 +1113,9 @@ func (r *linuxRouter) delIPRulesWithIPCommand() error {
 
 func (r *linuxRouter) netfilterFamilies() []netfilterRunner {
 	if r.v6Available {
-		return []netfilterRunner{r.ipt4, r.ipt6}
+		return []netfilterRunner{r.nf4, r.nf6}
 	}
-	return []netfilterRunner{r.ipt4}
+	return []netfilterRunner{r.nf4}
 }
 
 // addNetfilterChains creates custom Tailscale chains in netfilter.
@@ -1082,11 +1140,11 @@ func (r *linuxRouter) addNetfilterChains() error {
 			return err
 		}
 	}
-	if err := create(r.ipt4, "nat", "ts-postrouting"); err != nil {
+	if err := create(r.nf4, "nat", "ts-postrouting"); err != nil {
 		return err
 	}
 	if r.v6NATAvailable {
-		if err := create(r.ipt6, "nat", "ts-postrouting"); err != nil {
+		if err := create(r.nf6, "nat", "ts-postrouting"); err != nil {
 			return err
 		}
 	}
@@ -1117,11 +1175,11 @@ func (r *linuxRouter) addNetfilterBase4() error {
 	// Note, this will definitely break nodes that end up using the
 	// CGNAT range for other purposes :(.
 	args := []string{"!", "-i", r.tunname, "-s", tsaddr.ChromeOSVMRange().String(), "-j", "RETURN"}
-	if err := r.ipt4.Append("filter", "ts-input", args...); err != nil {
+	if err := r.nf4.Append("filter", "ts-input", args...); err != nil {
 		return fmt.Errorf("adding %v in v4/filter/ts-input: %w", args, err)
 	}
 	args = []string{"!", "-i", r.tunname, "-s", tsaddr.CGNATRange().String(), "-j", "DROP"}
-	if err := r.ipt4.Append("filter", "ts-input", args...); err != nil {
+	if err := r.nf4.Append("filter", "ts-input", args...); err != nil {
 		return fmt.Errorf("adding %v in v4/filter/ts-input: %w", args, err)
 	}
 
@@ -1137,19 +1195,19 @@ func (r *linuxRouter) addNetfilterBase4() error {
 	// filter/FORWARD, and set a packet mark that nat/POSTROUTING can
 	// use to effectively run that same test again.
 	args = []string{"-i", r.tunname, "-j", "MARK", "--set-mark", tailscaleSubnetRouteMark}
-	if err := r.ipt4.Append("filter", "ts-forward", args...); err != nil {
+	if err := r.nf4.Append("filter", "ts-forward", args...); err != nil {
 		return fmt.Errorf("adding %v in v4/filter/ts-forward: %w", args, err)
 	}
 	args = []string{"-m", "mark", "--mark", tailscaleSubnetRouteMark, "-j", "ACCEPT"}
-	if err := r.ipt4.Append("filter", "ts-forward", args...); err != nil {
+	if err := r.nf4.Append("filter", "ts-forward", args...); err != nil {
 		return fmt.Errorf("adding %v in v4/filter/ts-forward: %w", args, err)
 	}
 	args = []string{"-o", r.tunname, "-s", tsaddr.CGNATRange().String(), "-j", "DROP"}
-	if err := r.ipt4.Append("filter", "ts-forward", args...); err != nil {
+	if err := r.nf4.Append("filter", "ts-forward", args...); err != nil {
 		return fmt.Errorf("adding %v in v4/filter/ts-forward: %w", args, err)
 	}
 	args = []string{"-o", r.tunname, "-j", "ACCEPT"}
-	if err := r.ipt4.Append("filter", "ts-forward", args...); err != nil {
+	if err := r.nf4.Append("filter", "ts-forward", args...); err != nil {
 		return fmt.Errorf("adding %v in v4/filter/ts-forward: %w", args, err)
 	}
 
@@ -1163,17 +1221,17 @@ func (r *linuxRouter) addNetfilterBase6() error {
 	// from tailscale0.
 
 	args := []string{"-i", r.tunname, "-j", "MARK", "--set-mark", tailscaleSubnetRouteMark}
-	if err := r.ipt6.Append("filter", "ts-forward", args...); err != nil {
+	if err := r.nf6.Append("filter", "ts-forward", args...); err != nil {
 		return fmt.Errorf("adding %v in v6/filter/ts-forward: %w", args, err)
 	}
 	args = []string{"-m", "mark", "--mark", tailscaleSubnetRouteMark, "-j", "ACCEPT"}
-	if err := r.ipt6.Append("filter", "ts-forward", args...); err != nil {
+	if err := r.nf6.Append("filter", "ts-forward", args...); err != nil {
 		return fmt.Errorf("adding %v in v6/filter/ts-forward: %w", args, err)
 	}
 	// TODO: drop forwarded traffic to tailscale0 from tailscale's ULA
 	// (see corresponding IPv4 CGNAT rule).
 	args = []string{"-o", r.tunname, "-j", "ACCEPT"}
-	if err := r.ipt6.Append("filter", "ts-forward", args...); err != nil {
+	if err := r.nf6.Append("filter", "ts-forward", args...); err != nil {
 		return fmt.Errorf("adding %v in v6/filter/ts-forward: %w", args, err)
 	}
 
@@ -1207,11 +1265,11 @@ func (r *linuxRouter) delNetfilterChains() error {
 			return err
 		}
 	}
-	if err := del(r.ipt4, "nat", "ts-postrouting"); err != nil {
+	if err := del(r.nf4, "nat", "ts-postrouting"); err != nil {
 		return err
 	}
 	if r.v6NATAvailable {
-		if err := del(r.ipt6, "nat", "ts-postrouting"); err != nil {
+		if err := del(r.nf6, "nat", "ts-postrouting"); err != nil {
 			return err
 		}
 	}
@@ -1242,11 +1300,11 @@ func (r *linuxRouter) delNetfilterBase() error {
 			return err
 		}
 	}
-	if err := del(r.ipt4, "nat", "ts-postrouting"); err != nil {
+	if err := del(r.nf4, "nat", "ts-postrouting"); err != nil {
 		return err
 	}
 	if r.v6NATAvailable {
-		if err := del(r.ipt6, "nat", "ts-postrouting"); err != nil {
+		if err := del(r.nf6, "nat", "ts-postrouting"); err != nil {
 			return err
 		}
 	}
@@ -1283,11 +1341,11 @@ func (r *linuxRouter) addNetfilterHooks() error {
 			return err
 		}
 	}
-	if err := divert(r.ipt4, "nat", "POSTROUTING"); err != nil {
+	if err := divert(r.nf4, "nat", "POSTROUTING"); err != nil {
 		return err
 	}
 	if r.v6NATAvailable {
-		if err := divert(r.ipt6, "nat", "POSTROUTING"); err != nil {
+		if err := divert(r.nf6, "nat", "POSTROUTING"); err != nil {
 			return err
 		}
 	}
@@ -1320,50 +1378,126 @@ func (r *linuxRouter) delNetfilterHooks() error {
 			return err
 		}
 	}
-	if err := del(r.ipt4, "nat", "POSTROUTING"); err != nil {
+	if err := del(r.nf4, "nat", "POSTROUTING"); err != nil {
 		return err
 	}
 	if r.v6NATAvailable {
-		if err := del(r.ipt6, "nat", "POSTROUTING"); err != nil {
+		if err := del(r.nf6, "nat", "POSTROUTING"); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-// addSNATRule adds a netfilter rule to SNAT traffic destined for
-// local subnets.
-func (r *linuxRouter) addSNATRule() error {
-	if r.netfilterMode == netfilterOff {
+// snatRule is a rule in nat/ts-postrouting for a subnet route.
+type snatRule struct {
+	dst  netaddr.IPPrefix
+	masq bool // whether to SNAT, or else to RETURN without SNAT
+}
+
+// args returns the netfilter arguments for the rule.
+func (s snatRule) args() []string {
+	var args []string
+	if s.masq {
+		args = append(args, "-m", "mark", "--mark", tailscaleSubnetRouteMark)
+	}
+	if s.dst.Bits() != 0 {
+		args = append(args, "-d", s.dst.String())
+	}
+	if s.masq {
+		return append(args, "-j", "MASQUERADE")
+	}
+	return append(args, "-j", "RETURN")
+}
+
+// snatRulesForConfig returns the nat/ts-postrouting rules to SNAT
+// traffic destined for cfg's subnet routes, except those in
+// cfg.NoSNATSubnetRoutes.
+//
+// A route that isn't SNATed only needs a rule if it's within a route
+// that is. Rules are ordered most specific first, so such a route's
+// RETURN rule comes before the MASQUERADE rule for the wider route.
+func snatRulesForConfig(cfg *Config) []snatRule {
+	if !cfg.SNATSubnetRoutes {
 		return nil
 	}
+	var masq, noSNAT []netaddr.IPPrefix
+	for _, route := range cfg.SubnetRoutes {
+		if containsPrefix(cfg.NoSNATSubnetRoutes, route) {
+			noSNAT = append(noSNAT, route)
+		} else {
+			masq = append(masq, route)
+		}
+	}
+	var rules []snatRule
+	for _, route := range masq {
+		rules = append(rules, snatRule{dst: route, masq: true})
+	}
+	for _, route := range noSNAT {
+		for _, m := range masq {
+			if m.Bits() < route.Bits() && m.Contains(route.IP()) {
+				rules = append(rules, snatRule{dst: route})
+				break
+			}
+		}
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		a, b := rules[i].dst, rules[j].dst
+		if a.Bits() != b.Bits() {
+			return a.Bits() > b.Bits()
+		}
+		return a.IP().Less(b.IP())
+	})
+	return rules
+}
 
-	args := []string{"-m", "mark", "--mark", tailscaleSubnetRouteMark, "-j", "MASQUERADE"}
-	if err := r.ipt4.Append("nat", "ts-postrouting", args...); err != nil {
-		return fmt.Errorf("adding %v in v4/nat/ts-postrouting: %w", args, err)
+func containsPrefix(prefixes []netaddr.IPPrefix, p netaddr.IPPrefix) bool {
+	for _, q := range prefixes {
+		if q == p {
+			return true
+		}
 	}
-	if r.v6NATAvailable {
-		if err := r.ipt6.Append("nat", "ts-postrouting", args...); err != nil {
-			return fmt.Errorf("adding %v in v6/nat/ts-postrouting: %w", args, err)
+	return false
+}
+
+func snatRulesEqual(a, b []snatRule) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
 		}
 	}
-	return nil
+	return true
 }
 
-// delSNATRule removes the netfilter rule to SNAT traffic destined for
-// local subnets. Fails if the rule does not exist.
-func (r *linuxRouter) delSNATRule() error {
+// setSNATRules replaces the rules in nat/ts-postrouting with rules.
+// IPv6 rules are skipped if IPv6 NAT is unavailable.
+func (r *linuxRouter) setSNATRules(rules []snatRule) error {
 	if r.netfilterMode == netfilterOff {
 		return nil
 	}
 
-	args := []string{"-m", "mark", "--mark", tailscaleSubnetRouteMark, "-j", "MASQUERADE"}
-	if err := r.ipt4.Delete("nat", "ts-postrouting", args...); err != nil {
-		return fmt.Errorf("deleting %v in v4/nat/ts-postrouting: %w", args, err)
+	if err := r.nf4.ClearChain("nat", "ts-postrouting"); err != nil {
+		return fmt.Errorf("flushing v4/nat/ts-postrouting: %w", err)
 	}
 	if r.v6NATAvailable {
-		if err := r.ipt6.Delete("nat", "ts-postrouting", args...); err != nil {
-			return fmt.Errorf("deleting %v in v6/nat/ts-postrouting: %w", args, err)
+		if err := r.nf6.ClearChain("nat", "ts-postrouting"); err != nil {
+			return fmt.Errorf("flushing v6/nat/ts-postrouting: %w", err)
+		}
+	}
+	for _, rule := range rules {
+		nf, family := r.nf4, "v4"
+		if rule.dst.IP().Is6() {
+			if !r.v6NATAvailable {
+				continue
+			}
+			nf, family = r.nf6, "v6"
+		}
+		args := rule.args()
+		if err := nf.Append("nat", "ts-postrouting", args...); err != nil {
+			return fmt.Errorf("adding %v in %s/nat/ts-postrouting: %w", args, family, err)
 		}
 	}
 	return nil
@@ -1379,12 +1513,12 @@ func (r *linuxRouter) delLegacyNetfilter() error {
 	}
 
 	del := func(table, chain string, args ...string) error {
-		exists, err := r.ipt4.Exists(table, chain, args...)
+		exists, err := r.nf4.Exists(table, chain, args...)
 		if err != nil {
 			return fmt.Errorf("checking for %v in %s/%s: %w", args, table, chain, err)
 		}
 		if exists {
-			if err := r.ipt4.Delete(table, chain, args...); err != nil {
+			if err := r.nf4.Delete(table, chain, args...); err != nil {
 				return fmt.Errorf("deleting %v in %s/%s: %w", args, table, chain, err)
 			}
 		}
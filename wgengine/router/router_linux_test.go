@@ -109,16 +109,49 @@ v4/filter/ts-input -i lo -s 100.101.102.104 -j ACCEPT
 v4/filter/ts-input ! -i tailscale0 -s 100.115.92.0/23 -j RETURN
 v4/filter/ts-input ! -i tailscale0 -s 100.64.0.0/10 -j DROP
 v4/nat/POSTROUTING -j ts-postrouting
-v4/nat/ts-postrouting -m mark --mark 0x40000 -j MASQUERADE
+v4/nat/ts-postrouting -m mark --mark 0x40000 -d 200.0.0.0/8 -j MASQUERADE
 v6/filter/FORWARD -j ts-forward
 v6/filter/INPUT -j ts-input
 v6/filter/ts-forward -i tailscale0 -j MARK --set-mark 0x40000
 v6/filter/ts-forward -m mark --mark 0x40000 -j ACCEPT
 v6/filter/ts-forward -o tailscale0 -j ACCEPT
 v6/nat/POSTROUTING -j ts-postrouting
-v6/nat/ts-postrouting -m mark --mark 0x40000 -j MASQUERADE
 `,
 		},
+		{
+			name: "addr and routes and subnet routes with nftables",
+			in: &Config{
+				LocalAddrs:       mustCIDRs("100.101.102.104/10"),
+				Routes:           mustCIDRs("100.100.100.100/32", "10.0.0.0/8"),
+				SubnetRoutes:     mustCIDRs("200.0.0.0/8"),
+				SNATSubnetRoutes: true,
+				NetfilterMode:    netfilterNFTables,
+			},
+			want: `
+up
+ip addr add 100.101.102.104/10 dev tailscale0
+ip route add 10.0.0.0/8 dev tailscale0 table 52
+ip route add 100.100.100.100/32 dev tailscale0 table 52` + basic +
+				`nft4/filter/FORWARD -j ts-forward
+nft4/filter/INPUT -j ts-input
+nft4/filter/ts-forward -i tailscale0 -j MARK --set-mark 0x40000
+nft4/filter/ts-forward -m mark --mark 0x40000 -j ACCEPT
+nft4/filter/ts-forward -o tailscale0 -s 100.64.0.0/10 -j DROP
+nft4/filter/ts-forward -o tailscale0 -j ACCEPT
+nft4/filter/ts-input -i lo -s 100.101.102.104 -j ACCEPT
+nft4/filter/ts-input ! -i tailscale0 -s 100.115.92.0/23 -j RETURN
+nft4/filter/ts-input ! -i tailscale0 -s 100.64.0.0/10 -j DROP
+nft4/nat/POSTROUTING -j ts-postrouting
+nft4/nat/ts-postrouting -m mark --mark 0x40000 -d 200.0.0.0/8 -j MASQUERADE
+nft6/filter/FORWARD -j ts-forward
+nft6/filter/INPUT -j ts-input
+nft6/filter/ts-forward -i tailscale0 -j MARK --set-mark 0x40000
+nft6/filter/ts-forward -m mark --mark 0x40000 -j ACCEPT
+nft6/filter/ts-forward -o tailscale0 -j ACCEPT
+nft6/nat/POSTROUTING -j ts-postrouting
+`,
+		},
+
 		{
 			name: "addr and routes with netfilter",
 			in: &Config{
@@ -150,6 +183,78 @@ v6/nat/POSTROUTING -j ts-postrouting
 `,
 		},
 
+		{
+			name: "addr and routes and subnet routes with per-route SNAT",
+			in: &Config{
+				LocalAddrs:         mustCIDRs("100.101.102.104/10"),
+				Routes:             mustCIDRs("100.100.100.100/32", "10.0.0.0/8"),
+				SubnetRoutes:       mustCIDRs("200.0.0.0/8", "200.1.0.0/16", "192.168.0.0/24", "fd00:1::/64"),
+				SNATSubnetRoutes:   true,
+				NoSNATSubnetRoutes: mustCIDRs("200.1.0.0/16", "192.168.0.0/24"),
+				NetfilterMode:      netfilterOn,
+			},
+			want: `
+up
+ip addr add 100.101.102.104/10 dev tailscale0
+ip route add 10.0.0.0/8 dev tailscale0 table 52
+ip route add 100.100.100.100/32 dev tailscale0 table 52` + basic +
+				`v4/filter/FORWARD -j ts-forward
+v4/filter/INPUT -j ts-input
+v4/filter/ts-forward -i tailscale0 -j MARK --set-mark 0x40000
+v4/filter/ts-forward -m mark --mark 0x40000 -j ACCEPT
+v4/filter/ts-forward -o tailscale0 -s 100.64.0.0/10 -j DROP
+v4/filter/ts-forward -o tailscale0 -j ACCEPT
+v4/filter/ts-input -i lo -s 100.101.102.104 -j ACCEPT
+v4/filter/ts-input ! -i tailscale0 -s 100.115.92.0/23 -j RETURN
+v4/filter/ts-input ! -i tailscale0 -s 100.64.0.0/10 -j DROP
+v4/nat/POSTROUTING -j ts-postrouting
+v4/nat/ts-postrouting -d 200.1.0.0/16 -j RETURN
+v4/nat/ts-postrouting -m mark --mark 0x40000 -d 200.0.0.0/8 -j MASQUERADE
+v6/filter/FORWARD -j ts-forward
+v6/filter/INPUT -j ts-input
+v6/filter/ts-forward -i tailscale0 -j MARK --set-mark 0x40000
+v6/filter/ts-forward -m mark --mark 0x40000 -j ACCEPT
+v6/filter/ts-forward -o tailscale0 -j ACCEPT
+v6/nat/POSTROUTING -j ts-postrouting
+v6/nat/ts-postrouting -m mark --mark 0x40000 -d fd00:1::/64 -j MASQUERADE
+`,
+		},
+
+		{
+			name: "addr and routes and exit node routes with netfilter",
+			in: &Config{
+				LocalAddrs:       mustCIDRs("100.101.102.104/10"),
+				Routes:           mustCIDRs("100.100.100.100/32", "10.0.0.0/8"),
+				SubnetRoutes:     mustCIDRs("0.0.0.0/0", "::/0"),
+				SNATSubnetRoutes: true,
+				NetfilterMode:    netfilterOn,
+			},
+			want: `
+up
+ip addr add 100.101.102.104/10 dev tailscale0
+ip route add 10.0.0.0/8 dev tailscale0 table 52
+ip route add 100.100.100.100/32 dev tailscale0 table 52` + basic +
+				`v4/filter/FORWARD -j ts-forward
+v4/filter/INPUT -j ts-input
+v4/filter/ts-forward -i tailscale0 -j MARK --set-mark 0x40000
+v4/filter/ts-forward -m mark --mark 0x40000 -j ACCEPT
+v4/filter/ts-forward -o tailscale0 -s 100.64.0.0/10 -j DROP
+v4/filter/ts-forward -o tailscale0 -j ACCEPT
+v4/filter/ts-input -i lo -s 100.101.102.104 -j ACCEPT
+v4/filter/ts-input ! -i tailscale0 -s 100.115.92.0/23 -j RETURN
+v4/filter/ts-input ! -i tailscale0 -s 100.64.0.0/10 -j DROP
+v4/nat/POSTROUTING -j ts-postrouting
+v4/nat/ts-postrouting -m mark --mark 0x40000 -j MASQUERADE
+v6/filter/FORWARD -j ts-forward
+v6/filter/INPUT -j ts-input
+v6/filter/ts-forward -i tailscale0 -j MARK --set-mark 0x40000
+v6/filter/ts-forward -m mark --mark 0x40000 -j ACCEPT
+v6/filter/ts-forward -o tailscale0 -j ACCEPT
+v6/nat/POSTROUTING -j ts-postrouting
+v6/nat/ts-postrouting -m mark --mark 0x40000 -j MASQUERADE
+`,
+		},
+
 		{
 			name: "addr and routes and subnet routes with netfilter but no SNAT",
 			in: &Config{
@@ -325,7 +430,7 @@ ip route add throw 192.168.0.0/24 table 52` + basic,
 	defer mon.Close()
 
 	fake := NewFakeOS(t)
-	router, err := newUserspaceRouterAdvanced(t.Logf, "tailscale0", mon, fake.netfilter4, fake.netfilter6, fake, true, true)
+	router, err := newUserspaceRouterAdvanced(t.Logf, "tailscale0", mon, fake.netfilter4, fake.netfilter6, fake.nftables4, fake.nftables6, fake, true, true)
 	if err != nil {
 		t.Fatalf("failed to create router: %v", err)
 	}
@@ -480,6 +585,8 @@ type fakeOS struct {
 	rules      []string
 	netfilter4 *fakeNetfilter
 	netfilter6 *fakeNetfilter
+	nftables4  *fakeNetfilter
+	nftables6  *fakeNetfilter
 }
 
 func NewFakeOS(t *testing.T) *fakeOS {
@@ -487,6 +594,8 @@ func NewFakeOS(t *testing.T) *fakeOS {
 		t:          t,
 		netfilter4: newNetfilter(t),
 		netfilter6: newNetfilter(t),
+		nftables4:  newNetfilter(t),
+		nftables6:  newNetfilter(t),
 	}
 }
 
@@ -512,27 +621,22 @@ func (o *fakeOS) String() string {
 		fmt.Fprintf(&b, "ip rule add %s\n", rule)
 	}
 
-	var chains []string
-	for chain := range o.netfilter4.n {
-		chains = append(chains, chain)
-	}
-	sort.Strings(chains)
-	for _, chain := range chains {
-		for _, rule := range o.netfilter4.n[chain] {
-			fmt.Fprintf(&b, "v4/%s %s\n", chain, rule)
+	writeRules := func(prefix string, nf *fakeNetfilter) {
+		var chains []string
+		for chain := range nf.n {
+			chains = append(chains, chain)
 		}
-	}
-
-	chains = nil
-	for chain := range o.netfilter6.n {
-		chains = append(chains, chain)
-	}
-	sort.Strings(chains)
-	for _, chain := range chains {
-		for _, rule := range o.netfilter6.n[chain] {
-			fmt.Fprintf(&b, "v6/%s %s\n", chain, rule)
+		sort.Strings(chains)
+		for _, chain := range chains {
+			for _, rule := range nf.n[chain] {
+				fmt.Fprintf(&b, "%s/%s %s\n", prefix, chain, rule)
+			}
 		}
 	}
+	writeRules("v4", o.netfilter4)
+	writeRules("v6", o.netfilter6)
+	writeRules("nft4", o.nftables4)
+	writeRules("nft6", o.nftables6)
 
 	return b.String()[:len(b.String())-1]
 }
@@ -39,7 +39,8 @@ type osCommandRunner struct {
 }
 
 // errCode extracts and returns the process exit code from err, or
-// zero if err is nil.
+// zero if err is nil. A netlink ENOENT, as from nftablesRunner for a
+// nonexistent chain, is reported as iptables' exit code for that, 1.
 func errCode(err error) int {
 	if err == nil {
 		return 0
@@ -48,6 +49,9 @@ func errCode(err error) int {
 	if ok := errors.As(err, &e); ok {
 		return e.ExitCode()
 	}
+	if errors.Is(err, unix.ENOENT) {
+		return 1
+	}
 	s := err.Error()
 	if strings.HasPrefix(s, "exitcode:") {
 		code, err := strconv.Atoi(s[9:])
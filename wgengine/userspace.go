@@ -95,6 +95,8 @@ type userspaceEngine struct {
 	linkMonOwned      bool       // whether we created linkMon (and thus need to close it)
 	linkMonUnregister func()     // unsubscribes from changes; used regardless of linkMonOwned
 	birdClient        BIRDClient // or nil
+	routeFeed         RouteFeed  // or nil
+	routeFeedPeers    bool       // whether routeFeed gets peers' addresses
 
 	testMaybeReconfigHook func() // for tests; if non-nil, fires if maybeReconfigWireguardLocked called
 
@@ -121,7 +123,10 @@ type userspaceEngine struct {
 	statusBufioReader   *bufio.Reader // reusable for UAPI
 	lastStatusPollTime  mono.Time     // last time we polled the engine status
 
-	lastIsSubnetRouter bool // was the node a primary subnet router in the last run.
+	lastIsSubnetRouter bool         // was the node a primary subnet router in the last run.
+	lastRouteFeedSig   deephash.Sum // of routes last given to routeFeed
+	birdErr            error        // last error configuring BIRD, or nil
+	routeFeedErr       error        // last error from routeFeed, or nil
 
 	mu                  sync.Mutex         // guards following; see lock order comment below
 	netMap              *netmap.NetworkMap // or nil
@@ -153,6 +158,17 @@ type BIRDClient interface {
 	Close() error
 }
 
+// RouteFeed exports routes to a routing daemon, such as BIRD, to
+// announce to other routers.
+type RouteFeed interface {
+	// SetRoutes replaces the exported routes: the subnet routes this
+	// node is the primary subnet router for, and its peers'
+	// Tailscale addresses. Both are empty when this node isn't a
+	// primary subnet router, withdrawing its routes so that another
+	// subnet router's are used.
+	SetRoutes(subnets, peers []netaddr.IPPrefix) error
+}
+
 // Config is the engine configuration.
 type Config struct {
 	// Tun is the device used by the Engine to exchange packets with
@@ -188,6 +204,15 @@ type Config struct {
 	// BIRDClient, if non-nil, will be used to configure BIRD whenever
 	// this node is a primary subnet router.
 	BIRDClient BIRDClient
+
+	// RouteFeed, if non-nil, is given the routes to export whenever
+	// they change. Its routes are withdrawn when the engine closes.
+	RouteFeed RouteFeed
+
+	// RouteFeedPeers is whether RouteFeed is also given the
+	// Tailscale addresses of this node's peers, while it's a
+	// primary subnet router.
+	RouteFeedPeers bool
 }
 
 func NewFakeUserspaceEngine(logf logger.Logf, listenPort uint16) (Engine, error) {
@@ -271,6 +296,8 @@ func NewUserspaceEngine(logf logger.Logf, conf Config) (_ Engine, reterr error)
 		router:         conf.Router,
 		confListenPort: conf.ListenPort,
 		birdClient:     conf.BIRDClient,
+		routeFeed:      conf.RouteFeed,
+		routeFeedPeers: conf.RouteFeedPeers,
 	}
 
 	if e.birdClient != nil {
@@ -279,6 +306,13 @@ func NewUserspaceEngine(logf logger.Logf, conf Config) (_ Engine, reterr error)
 			return nil, err
 		}
 	}
+	if e.routeFeed != nil {
+		// Withdraw any routes left from a previous run.
+		if err := e.routeFeed.SetRoutes(nil, nil); err != nil {
+			return nil, err
+		}
+		deephash.Update(&e.lastRouteFeedSig, []netaddr.IPPrefix(nil), []netaddr.IPPrefix(nil))
+	}
 	e.isLocalAddr.Store(tsaddr.NewContainsIPFunc(nil))
 	e.isDNSIPOverTailscale.Store(tsaddr.NewContainsIPFunc(nil))
 
@@ -788,6 +822,36 @@ func hasOverlap(aips, rips []netaddr.IPPrefix) bool {
 	return false
 }
 
+// routeFeedRoutes returns the routes for a RouteFeed from the
+// configuration being applied: the subnet routes in routerCfg that
+// this node is the primary subnet router for, per primary, other than
+// exit node routes, and if there are any and withPeers is set, the
+// Tailscale addresses of the peers in cfg.
+func routeFeedRoutes(cfg *wgcfg.Config, routerCfg *router.Config, primary []netaddr.IPPrefix, withPeers bool) (subnets, peers []netaddr.IPPrefix) {
+	for _, r := range routerCfg.SubnetRoutes {
+		if r.Bits() == 0 {
+			continue
+		}
+		for _, p := range primary {
+			if p == r {
+				subnets = append(subnets, r)
+				break
+			}
+		}
+	}
+	if len(subnets) == 0 || !withPeers {
+		return subnets, nil
+	}
+	for _, p := range cfg.Peers {
+		for _, a := range p.AllowedIPs {
+			if a.IsSingleIP() && tsaddr.IsTailscaleIP(a.IP()) {
+				peers = append(peers, a)
+			}
+		}
+	}
+	return subnets, peers
+}
+
 func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config, dnsCfg *dns.Config, debug *tailcfg.Debug) error {
 	if routerCfg == nil {
 		panic("routerCfg must not be nil")
@@ -822,9 +886,24 @@ func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config,
 	}
 	isSubnetRouterChanged := isSubnetRouter != e.lastIsSubnetRouter
 
+	var feedSubnets, feedPeers []netaddr.IPPrefix
+	routeFeedChanged := false
+	if e.routeFeed != nil {
+		// Which routes are primary is only known from control's
+		// netmap, which SetNetworkMap updates before Reconfig.
+		var primary []netaddr.IPPrefix
+		e.mu.Lock()
+		if e.netMap != nil && e.netMap.SelfNode != nil {
+			primary = e.netMap.SelfNode.PrimaryRoutes
+		}
+		e.mu.Unlock()
+		feedSubnets, feedPeers = routeFeedRoutes(cfg, routerCfg, primary, e.routeFeedPeers)
+		routeFeedChanged = deephash.Update(&e.lastRouteFeedSig, feedSubnets, feedPeers)
+	}
+
 	engineChanged := deephash.Update(&e.lastEngineSigFull, cfg)
 	routerChanged := deephash.Update(&e.lastRouterSig, routerCfg, dnsCfg)
-	if !engineChanged && !routerChanged && listenPort == e.magicConn.LocalPort() && !isSubnetRouterChanged {
+	if !engineChanged && !routerChanged && listenPort == e.magicConn.LocalPort() && !isSubnetRouterChanged && !routeFeedChanged {
 		return ErrNoChanges
 	}
 
@@ -908,6 +987,25 @@ func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config,
 		} else {
 			e.lastIsSubnetRouter = isSubnetRouter
 		}
+		e.birdErr = err
+	}
+
+	if routeFeedChanged {
+		e.logf("wgengine: Reconfig: feeding %d subnet routes and %d peer routes", len(feedSubnets), len(feedPeers))
+		err := e.routeFeed.SetRoutes(feedSubnets, feedPeers)
+		if err != nil {
+			// Log but don't fail here, and try again next time.
+			e.logf("wgengine: error feeding routes: %v", err)
+			e.lastRouteFeedSig = deephash.Sum{}
+		}
+		e.routeFeedErr = err
+	}
+	if e.birdClient != nil || e.routeFeed != nil {
+		if e.birdErr != nil {
+			health.SetRouteFeedHealth(e.birdErr)
+		} else {
+			health.SetRouteFeedHealth(e.routeFeedErr)
+		}
 	}
 
 	e.logf("[v1] wgengine: Reconfig done")
@@ -1128,6 +1226,9 @@ func (e *userspaceEngine) Close() {
 	e.router.Close()
 	e.wgdev.Close()
 	e.tundev.Close()
+	if e.routeFeed != nil {
+		e.routeFeed.SetRoutes(nil, nil)
+	}
 	if e.birdClient != nil {
 		e.birdClient.DisableProtocol("tailscale")
 		e.birdClient.Close()
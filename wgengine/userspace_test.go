@@ -209,6 +209,69 @@ func TestUserspaceEnginePortReconfig(t *testing.T) {
 	}
 }
 
+func TestRouteFeedRoutes(t *testing.T) {
+	pfx := func(strs ...string) (ret []netaddr.IPPrefix) {
+		for _, s := range strs {
+			ret = append(ret, netaddr.MustParseIPPrefix(s))
+		}
+		return ret
+	}
+	cfg := &wgcfg.Config{
+		Peers: []wgcfg.Peer{
+			// The first peer is a subnet router, whose subnet
+			// isn't one of its Tailscale addresses.
+			{AllowedIPs: pfx("100.64.0.2/32", "fd7a:115c:a1e0::2/128", "192.168.0.0/24")},
+			{AllowedIPs: pfx("100.64.0.3/32")},
+		},
+	}
+	tests := []struct {
+		name        string
+		primary     []netaddr.IPPrefix
+		advertised  []netaddr.IPPrefix
+		withPeers   bool
+		wantSubnets []netaddr.IPPrefix
+		wantPeers   []netaddr.IPPrefix
+	}{
+		{
+			name:       "not_primary",
+			advertised: pfx("10.0.0.0/24"),
+			withPeers:  true,
+		},
+		{
+			name:        "primary",
+			primary:     pfx("10.0.0.0/24", "10.1.0.0/24"),
+			advertised:  pfx("10.0.0.0/24", "0.0.0.0/0", "::/0"),
+			wantSubnets: pfx("10.0.0.0/24"),
+		},
+		{
+			name:        "primary_with_peers",
+			primary:     pfx("10.0.0.0/24", "10.1.0.0/24"),
+			advertised:  pfx("10.0.0.0/24", "0.0.0.0/0", "::/0"),
+			withPeers:   true,
+			wantSubnets: pfx("10.0.0.0/24"),
+			wantPeers:   pfx("100.64.0.2/32", "fd7a:115c:a1e0::2/128", "100.64.0.3/32"),
+		},
+		{
+			name:       "exit_node_only",
+			primary:    pfx("0.0.0.0/0"),
+			advertised: pfx("0.0.0.0/0", "::/0"),
+			withPeers:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			routerCfg := &router.Config{SubnetRoutes: tt.advertised}
+			subnets, peers := routeFeedRoutes(cfg, routerCfg, tt.primary, tt.withPeers)
+			if !reflect.DeepEqual(subnets, tt.wantSubnets) {
+				t.Errorf("subnets = %v; want %v", subnets, tt.wantSubnets)
+			}
+			if !reflect.DeepEqual(peers, tt.wantPeers) {
+				t.Errorf("peers = %v; want %v", peers, tt.wantPeers)
+			}
+		})
+	}
+}
+
 func nkFromHex(hex string) key.NodePublic {
 	if len(hex) != 64 {
 		panic(fmt.Sprintf("%q is len %d; want 64", hex, len(hex)))